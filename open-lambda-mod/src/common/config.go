@@ -32,6 +32,10 @@ type Config struct {
 	// port the scheduler listens to
 	Scheduler_port string `json:"scheduler_port"`
 
+	// secret to sign requests to the scheduler with, if it requires
+	// authentication
+	Scheduler_secret string `json:"scheduler_secret"`
+
 	// log output of the runtime and proxy?
 	Log_output bool `json:"log_output"`
 
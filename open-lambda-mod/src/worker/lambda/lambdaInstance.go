@@ -2,11 +2,17 @@ package lambda
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 	"github.com/open-lambda/open-lambda/ol/worker/sandbox"
@@ -67,6 +73,7 @@ func (linst *LambdaInstance) Task() {
 					}
 
 					r.Header.Set("Content-Type", "application/json")
+					signSchedulerRequest(r, body)
 					client := &http.Client{}
 					resp, err := client.Do(r)
 					if err != nil {
@@ -224,6 +231,7 @@ func (linst *LambdaInstance) Task() {
 					}
 
 					r.Header.Set("Content-Type", "application/json")
+					signSchedulerRequest(r, body)
 					client := &http.Client{}
 					resp, err := client.Do(r)
 					if err != nil {
@@ -296,3 +304,25 @@ func (linst *LambdaInstance) AsyncKill() chan bool {
 	linst.killChan <- done
 	return done
 }
+
+// signSchedulerRequest sets the X-Hiku-Timestamp, X-Hiku-Nonce and
+// X-Hiku-Signature headers the scheduler expects from workers if a secret
+// is configured. The signature is the HMAC-SHA256 of timestamp, nonce,
+// method, request URI and body.
+func signSchedulerRequest(r *http.Request, body []byte) {
+	if common.Conf.Scheduler_secret == "" {
+		return
+	}
+
+	nonceBytes := make([]byte, 16)
+	rand.Read(nonceBytes)
+	nonce := hex.EncodeToString(nonceBytes)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(common.Conf.Scheduler_secret))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + r.Method + "\n" + r.URL.RequestURI() + "\n"))
+	mac.Write(body)
+	r.Header.Set("X-Hiku-Timestamp", timestamp)
+	r.Header.Set("X-Hiku-Nonce", nonce)
+	r.Header.Set("X-Hiku-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
@@ -3,9 +3,10 @@ set -e
 #set -x
 
 usage() {
-  printf 'Usage: %s [-n n_iterations] [-m mode] <n_workers> <n_copies> \n' "$0"
+  printf 'Usage: %s [-n n_iterations] [-m mode] [-g load_generator] <n_workers> <n_copies> \n' "$0"
   printf '      n_iterations: number of iterations to run the experiment (default: 1) \n'
   printf '      mode: local or cloud (default: local) \n'
+  printf '      load_generator: k6 or hiku (default: k6) \n'
   printf '      n_workers: number of workers to set up \n'
   printf '      n_copies: number of copies of each benchmark to deploy \n'
   exit 1
@@ -26,7 +27,8 @@ minutes=0
 # Parse parameters
 n_iterations=1
 mode="local"
-while getopts ":n:m:" opt; do
+load_generator="k6"
+while getopts ":n:m:g:" opt; do
   case ${opt} in
     n )
       n_iterations=$OPTARG
@@ -34,6 +36,9 @@ while getopts ":n:m:" opt; do
     m )
       mode=$OPTARG
       ;;
+    g )
+      load_generator=$OPTARG
+      ;;
     \? )
       usage
       ;;
@@ -45,6 +50,10 @@ if [ $# -lt 2 ] || [ "$mode" != "local" ] && [ "$mode" != "cloud" ]; then
   usage
 fi
 
+if [ "$load_generator" != "k6" ] && [ "$load_generator" != "hiku" ]; then
+  usage
+fi
+
 n_workers=$1
 n_copies=$2
 
@@ -91,9 +100,14 @@ for n in $(seq 1 "$n_iterations"); do
     fi
 
     # Run load test
-    k6 run -e N_COPIES="${n_copies}" -e SEED="${seed}" -e SCHEDULER_DNS="${scheduler_url}" \
-      --out json="results/${balancer}/${timestamp}/load_test.json" \
-      evaluation/load_test.js
+    if [ "$load_generator" == "hiku" ]; then
+      src/bin/hiku loadgen --copies="${n_copies}" --seed="${seed}" --target="http://${scheduler_url}:9020" \
+        --out="results/${balancer}/${timestamp}/load_test.json"
+    else
+      k6 run -e N_COPIES="${n_copies}" -e SEED="${seed}" -e SCHEDULER_DNS="${scheduler_url}" \
+        --out json="results/${balancer}/${timestamp}/load_test.json" \
+        evaluation/load_test.js
+    fi
 
     # Forward logs
     if [ "$mode" == "cloud" ]; then
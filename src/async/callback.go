@@ -0,0 +1,103 @@
+package async
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrCallbackNotAllowed is returned for callback URLs the invocation results
+// may not be sent to.
+var ErrCallbackNotAllowed = errors.New("callback URL is not allowed")
+
+// callbackPolicy keeps callbacks from reaching the scheduler's own network,
+// since any client that submits invocations chooses the callback URL. Only
+// the configured hosts are called back if there are any. Otherwise any host
+// is, as long as it doesn't resolve to a loopback, link-local, private or
+// unspecified address.
+type callbackPolicy struct {
+	hosts map[string]bool
+}
+
+func newCallbackPolicy(hosts []string) callbackPolicy {
+	p := callbackPolicy{}
+	if len(hosts) > 0 {
+		p.hosts = make(map[string]bool, len(hosts))
+		for _, host := range hosts {
+			p.hosts[host] = true
+		}
+	}
+	return p
+}
+
+func (p callbackPolicy) checkURL(callbackURL *url.URL) error {
+	if callbackURL.Scheme != "http" && callbackURL.Scheme != "https" || callbackURL.Host == "" {
+		return fmt.Errorf("%w: %s", ErrCallbackNotAllowed, callbackURL.Redacted())
+	}
+	if p.hosts != nil {
+		if !p.hosts[callbackURL.Hostname()] {
+			return fmt.Errorf("%w: host %s is not configured", ErrCallbackNotAllowed, callbackURL.Hostname())
+		}
+		return nil
+	}
+	if address, err := netip.ParseAddr(callbackURL.Hostname()); err == nil {
+		return p.checkAddress(address)
+	}
+	return nil
+}
+
+func (p callbackPolicy) checkAddress(address netip.Addr) error {
+	if p.hosts != nil {
+		return nil
+	}
+	address = address.Unmap()
+	if address.IsLoopback() || address.IsPrivate() || address.IsUnspecified() ||
+		address.IsLinkLocalUnicast() || address.IsLinkLocalMulticast() || address.IsMulticast() {
+		return fmt.Errorf("%w: address %s is internal", ErrCallbackNotAllowed, address)
+	}
+	return nil
+}
+
+// newCallbackClient returns a client that checks the address of each
+// connection, so host names resolving to internal addresses are refused as
+// well, and the URL of each redirect.
+func newCallbackClient(p callbackPolicy, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return p.checkAddress(addrPort.Addr())
+		},
+	}
+	// Through a proxy, the address of the proxy would be checked instead
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return p.checkURL(req.URL)
+		},
+	}
+}
+
+// CheckCallback returns ErrCallbackNotAllowed if invocation results may not
+// be sent to the URL.
+func (d *Dispatcher) CheckCallback(callbackURL string) error {
+	parsed, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrCallbackNotAllowed, err)
+	}
+	return d.callbacks.checkURL(parsed)
+}
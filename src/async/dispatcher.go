@@ -0,0 +1,419 @@
+package async
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWorkers         = 16
+	defaultQueueSize       = 1024
+	defaultRetention       = time.Hour
+	defaultCallbackTimeout = 10 * time.Second
+	callbackAttempts       = 3
+)
+
+// ErrQueueFull is returned when an invocation is submitted while the queue
+// is full.
+var ErrQueueFull = errors.New("async queue is full")
+
+// Options configures asynchronous invocations.
+type Options struct {
+	// Workers is the number of invocations run at once. Defaults to 16.
+	Workers int
+	// QueueSize is the number of invocations waiting to run before new ones
+	// are rejected. Defaults to 1024.
+	QueueSize int
+	// Retention is how long results are kept after completion. Defaults to
+	// one hour.
+	Retention time.Duration
+	// MaxResults caps the number of kept results, dropping the oldest
+	// first. Zero means no limit.
+	MaxResults int
+	// StoreFile keeps results in this file instead of in memory.
+	StoreFile string
+	// CallbackTimeout of a request to a callback webhook. Defaults to ten
+	// seconds.
+	CallbackTimeout time.Duration
+	// CallbackHosts are the only hosts called back if set. Otherwise
+	// callbacks to loopback, link-local and private addresses are refused.
+	CallbackHosts []string
+	// Durable configures the persistent queue of durable invocations.
+	Durable DurableOptions
+}
+
+// RunFunc runs an invocation and returns the response of the worker.
+type RunFunc func(function string, body []byte, contentType string) Response
+
+// Dispatcher queues asynchronous invocations, runs them in a pool of
+// goroutines and stores their results.
+type Dispatcher struct {
+	options   Options
+	store     Store
+	run       RunFunc
+	queue     chan Invocation
+	durable   *durableQueue
+	callbacks callbackPolicy
+	client    *http.Client
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	once      sync.Once
+}
+
+// Submit queues an invocation and returns it with its ID. The callback URL,
+// if set, receives the invocation as JSON once it completed.
+func (d *Dispatcher) Submit(function string, body []byte, contentType string, callbackURL string) (Invocation, error) {
+	invocation := Invocation{
+		ID:          newID(),
+		Function:    function,
+		State:       Queued,
+		CallbackURL: callbackURL,
+		SubmittedAt: time.Now(),
+		body:        body,
+		contentType: contentType,
+	}
+	if err := d.store.Save(invocation); err != nil {
+		return Invocation{}, err
+	}
+
+	select {
+	case d.queue <- invocation:
+		return invocation, nil
+	default:
+		invocation.State = Failed
+		invocation.Error = ErrQueueFull.Error()
+		now := time.Now()
+		invocation.CompletedAt = &now
+		d.store.Save(invocation)
+		return Invocation{}, ErrQueueFull
+	}
+}
+
+// SubmitDurable persists an invocation in the durable queue before it
+// returns. The invocation is retried until it succeeds, fails with a client
+// error or runs out of attempts, even across restarts of the scheduler.
+func (d *Dispatcher) SubmitDurable(function string, body []byte, contentType string, callbackURL string) (Invocation, error) {
+	if d.durable == nil {
+		return Invocation{}, ErrDurableDisabled
+	}
+
+	invocation := Invocation{
+		ID:          newID(),
+		Function:    function,
+		State:       Queued,
+		CallbackURL: callbackURL,
+		Durable:     true,
+		SubmittedAt: time.Now(),
+	}
+	d.save(invocation)
+
+	m := &message{Invocation: invocation, Body: body, ContentType: contentType, VisibleAt: invocation.SubmittedAt}
+	if err := d.durable.enqueue(m); err != nil {
+		return Invocation{}, err
+	}
+	return invocation, nil
+}
+
+// DurableStats returns the number of pending, in-flight and dead-lettered
+// durable invocations.
+func (d *Dispatcher) DurableStats() (DurableStats, error) {
+	if d.durable == nil {
+		return DurableStats{}, ErrDurableDisabled
+	}
+	return d.durable.stats(time.Now()), nil
+}
+
+// DeadLetters returns the durable invocations that ran out of attempts.
+func (d *Dispatcher) DeadLetters() ([]Invocation, error) {
+	if d.durable == nil {
+		return nil, ErrDurableDisabled
+	}
+	return d.durable.deadLetters()
+}
+
+// Get returns the invocation with the ID and whether it exists.
+func (d *Dispatcher) Get(id string) (Invocation, bool, error) {
+	return d.store.Get(id)
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case invocation := <-d.queue:
+			d.execute(invocation)
+		case <-d.stop:
+			// Run the invocations queued so far, they are only kept in
+			// memory
+			for {
+				select {
+				case invocation := <-d.queue:
+					d.execute(invocation)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// workDurable runs invocations from the durable queue. When none is
+// visible, it sleeps until the next one becomes visible or a new one is
+// queued.
+func (d *Dispatcher) workDurable() {
+	defer d.wg.Done()
+
+	for {
+		// Queued invocations stay in the log for the next start
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		m, dead, nextVisible := d.durable.lease(time.Now())
+		for _, deadMessage := range dead {
+			d.complete(deadMessage.Invocation, Failed)
+		}
+		if m != nil {
+			d.executeDurable(m)
+			continue
+		}
+
+		wait := time.Minute
+		if !nextVisible.IsZero() {
+			wait = time.Until(nextVisible)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-d.durable.wake:
+		case <-timer.C:
+		case <-d.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+func (d *Dispatcher) executeDurable(m *message) {
+	invocation := m.Invocation
+	started := time.Now()
+	invocation.State = Running
+	invocation.StartedAt = &started
+	d.durable.setState(invocation.ID, Running)
+	d.save(invocation)
+
+	response := d.run(invocation.Function, m.Body, m.ContentType)
+	invocation.Response = &response
+
+	// Retry server errors and throttling, the function might succeed on
+	// another worker or later
+	if response.Status == 0 || response.Status >= 500 || response.Status == http.StatusTooManyRequests {
+		lastError := fmt.Sprintf("Attempt %d failed with status %d", invocation.Attempts, response.Status)
+		dead, err := d.durable.retry(invocation.ID, lastError, time.Now())
+		if err != nil {
+			log.Printf("Error requeuing invocation %s: %v", invocation.ID, err)
+		}
+		invocation.Error = lastError
+		if dead {
+			log.Printf("Dead-lettered invocation %s after %d attempts", invocation.ID, invocation.Attempts)
+			d.complete(invocation, Failed)
+			return
+		}
+		d.durable.setState(invocation.ID, Queued)
+		invocation.State = Queued
+		d.save(invocation)
+		return
+	}
+
+	if err := d.durable.ack(invocation.ID); err != nil {
+		log.Printf("Error acknowledging invocation %s: %v", invocation.ID, err)
+	}
+	invocation.Error = ""
+	if response.Status >= 200 && response.Status < 300 {
+		d.complete(invocation, Succeeded)
+	} else {
+		d.complete(invocation, Failed)
+	}
+}
+
+// complete stores the final state of an invocation and calls its webhook.
+func (d *Dispatcher) complete(invocation Invocation, state State) {
+	completed := time.Now()
+	invocation.State = state
+	invocation.CompletedAt = &completed
+	d.save(invocation)
+
+	if invocation.CallbackURL != "" {
+		d.notify(invocation)
+	}
+}
+
+func (d *Dispatcher) execute(invocation Invocation) {
+	started := time.Now()
+	invocation.State = Running
+	invocation.StartedAt = &started
+	d.save(invocation)
+
+	response := d.run(invocation.Function, invocation.body, invocation.contentType)
+	invocation.Response = &response
+	invocation.body = nil
+	if response.Status >= 200 && response.Status < 300 {
+		d.complete(invocation, Succeeded)
+	} else {
+		d.complete(invocation, Failed)
+	}
+}
+
+func (d *Dispatcher) save(invocation Invocation) {
+	if err := d.store.Save(invocation); err != nil {
+		log.Printf("Error storing invocation %s: %v", invocation.ID, err)
+	}
+}
+
+// notify posts the completed invocation to its callback URL, retrying with
+// a growing backoff if the webhook fails.
+func (d *Dispatcher) notify(invocation Invocation) {
+	// Durable invocations may have been submitted with another policy
+	if err := d.CheckCallback(invocation.CallbackURL); err != nil {
+		log.Printf("Not calling back for invocation %s: %v", invocation.ID, err)
+		return
+	}
+
+	body, err := json.Marshal(invocation)
+	if err != nil {
+		log.Printf("Error encoding invocation %s: %v", invocation.ID, err)
+		return
+	}
+
+	backoff := 100 * time.Millisecond
+	for attempt := 1; attempt <= callbackAttempts; attempt++ {
+		err = d.post(invocation.CallbackURL, body)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, ErrCallbackNotAllowed) {
+			break
+		}
+		if attempt < callbackAttempts {
+			time.Sleep(backoff)
+			backoff *= 4
+		}
+	}
+	log.Printf("Error calling back %s for invocation %s: %v", invocation.CallbackURL, invocation.ID, err)
+}
+
+func (d *Dispatcher) post(callbackURL string, body []byte) error {
+	resp, err := d.client.Post(callbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// prune deletes expired results periodically.
+func (d *Dispatcher) prune() {
+	defer d.wg.Done()
+
+	interval := d.options.Retention / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pruned, err := d.store.Prune(time.Now().Add(-d.options.Retention), d.options.MaxResults)
+			if err != nil {
+				log.Printf("Error pruning async results: %v", err)
+			} else if pruned > 0 {
+				log.Printf("Pruned %d async results", pruned)
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Close stops the workers once they ran the invocations queued in memory
+// and finished their current durable attempt, and closes the store.
+// Durable invocations still queued run after a restart, and none is left
+// leased, so they don't wait for the visibility timeout.
+func (d *Dispatcher) Close() {
+	d.once.Do(func() {
+		close(d.stop)
+		d.wg.Wait()
+		d.store.Close()
+		if d.durable != nil {
+			d.durable.close()
+		}
+	})
+}
+
+// NewDispatcher starts the workers that run invocations with run. With a
+// durable queue file, the queue is restored from it.
+func NewDispatcher(store Store, options Options, run RunFunc) (*Dispatcher, error) {
+	if options.Workers <= 0 {
+		options.Workers = defaultWorkers
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultQueueSize
+	}
+	if options.Retention <= 0 {
+		options.Retention = defaultRetention
+	}
+	if options.CallbackTimeout <= 0 {
+		options.CallbackTimeout = defaultCallbackTimeout
+	}
+
+	d := &Dispatcher{
+		options: options,
+		store:   store,
+		run:     run,
+		queue:   make(chan Invocation, options.QueueSize),
+		stop:    make(chan struct{}),
+	}
+	d.callbacks = newCallbackPolicy(options.CallbackHosts)
+	d.client = newCallbackClient(d.callbacks, options.CallbackTimeout)
+
+	if options.Durable.File != "" {
+		durable, err := openDurableQueue(options.Durable)
+		if err != nil {
+			return nil, err
+		}
+		d.durable = durable
+
+		// The store may have marked them failed when it was loaded
+		for _, invocation := range durable.queued() {
+			invocation.State = Queued
+			invocation.Error = ""
+			d.save(invocation)
+		}
+
+		d.wg.Add(options.Workers)
+		for i := 0; i < options.Workers; i++ {
+			go d.workDurable()
+		}
+	}
+
+	d.wg.Add(options.Workers + 1)
+	for i := 0; i < options.Workers; i++ {
+		go d.work()
+	}
+	go d.prune()
+	return d, nil
+}
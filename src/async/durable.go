@@ -0,0 +1,417 @@
+package async
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxAttempts       = 5
+	defaultVisibilityTimeout = 5 * time.Minute
+	defaultRetryBackoff      = time.Second
+	compactionThreshold      = 1024
+)
+
+// ErrDurableDisabled is returned for durable invocations if no queue file is
+// configured.
+var ErrDurableDisabled = errors.New("durable invocations are not enabled")
+
+// DurableOptions configures the persistent queue of durable invocations.
+type DurableOptions struct {
+	// File is the write-ahead log of the queue. Durable invocations are
+	// disabled without one.
+	File string
+	// DeadLetterFile receives invocations that failed MaxAttempts times.
+	// Defaults to File with the suffix ".dead".
+	DeadLetterFile string
+	// MaxAttempts before an invocation is dead-lettered. Defaults to 5.
+	MaxAttempts int
+	// VisibilityTimeout is how long an attempt may take before the
+	// invocation is handed out again. Defaults to five minutes.
+	VisibilityTimeout time.Duration
+	// RetryBackoff is the delay before the first retry, doubled for every
+	// further one. Defaults to one second.
+	RetryBackoff time.Duration
+}
+
+// message is a durable invocation as kept in the log.
+type message struct {
+	Invocation  Invocation `json:"invocation"`
+	Body        []byte     `json:"body"`
+	ContentType string     `json:"content_type,omitempty"`
+	VisibleAt   time.Time  `json:"visible_at"`
+}
+
+// walRecord is a line of the log. Enqueue records carry the whole message,
+// the other operations refer to it by ID.
+type walRecord struct {
+	Op        string    `json:"op"`
+	Message   *message  `json:"message,omitempty"`
+	ID        string    `json:"id,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	VisibleAt time.Time `json:"visible_at,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+const (
+	opEnqueue = "enqueue"
+	opLease   = "lease"
+	opRetry   = "retry"
+	opAck     = "ack"
+	opDead    = "dead"
+)
+
+// DurableStats counts the invocations in the durable queue.
+type DurableStats struct {
+	Pending      int `json:"pending"`
+	InFlight     int `json:"in_flight"`
+	DeadLettered int `json:"dead_lettered"`
+}
+
+// durableQueue is a queue persisted in a write-ahead log. Every change is
+// synced to disk before it takes effect, so queued invocations survive a
+// crash. An invocation is handed out with a lease and stays in the queue
+// until it is acknowledged, so it is delivered at least once.
+type durableQueue struct {
+	options  DurableOptions
+	messages map[string]*message
+	file     *os.File
+	records  int
+	dead     int
+	wake     chan struct{}
+	mutex    sync.Mutex
+}
+
+func (q *durableQueue) write(record walRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := q.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	q.records++
+	return q.file.Sync()
+}
+
+func (q *durableQueue) enqueue(m *message) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err := q.write(walRecord{Op: opEnqueue, Message: m}); err != nil {
+		return err
+	}
+	q.messages[m.Invocation.ID] = m
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// lease hands out the oldest visible invocation and hides it for the
+// visibility timeout. Invocations whose last lease timed out on the final
+// attempt are dead-lettered instead and returned as the second value. If
+// nothing is visible, it returns when the next invocation becomes visible.
+func (q *durableQueue) lease(now time.Time) (*message, []*message, time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var dead []*message
+	var candidates []*message
+	var nextVisible time.Time
+	for _, m := range q.messages {
+		if m.VisibleAt.After(now) {
+			if nextVisible.IsZero() || m.VisibleAt.Before(nextVisible) {
+				nextVisible = m.VisibleAt
+			}
+			continue
+		}
+		if m.Invocation.Attempts >= q.options.MaxAttempts {
+			dead = append(dead, m)
+			continue
+		}
+		candidates = append(candidates, m)
+	}
+
+	for _, m := range dead {
+		q.deadLetter(m, "Attempt timed out")
+	}
+	if len(candidates) == 0 {
+		return nil, dead, nextVisible
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Invocation.SubmittedAt.Before(candidates[j].Invocation.SubmittedAt)
+	})
+	m := candidates[0]
+	attempts := m.Invocation.Attempts + 1
+	visibleAt := now.Add(q.options.VisibilityTimeout)
+	if err := q.write(walRecord{Op: opLease, ID: m.Invocation.ID, Attempts: attempts, VisibleAt: visibleAt}); err != nil {
+		return nil, dead, now.Add(q.options.RetryBackoff)
+	}
+	m.Invocation.Attempts = attempts
+	m.VisibleAt = visibleAt
+
+	leased := *m
+	return &leased, dead, time.Time{}
+}
+
+// ack removes a completed invocation from the queue.
+func (q *durableQueue) ack(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.messages[id]; !ok {
+		// Completed by another attempt after a visibility timeout
+		return nil
+	}
+	if err := q.write(walRecord{Op: opAck, ID: id}); err != nil {
+		return err
+	}
+	delete(q.messages, id)
+	return q.compactIfNeeded()
+}
+
+// retry makes a failed invocation visible again after the backoff, or
+// dead-letters it after the last attempt. It reports whether the
+// invocation was dead-lettered.
+func (q *durableQueue) retry(id string, lastError string, now time.Time) (bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	m, ok := q.messages[id]
+	if !ok {
+		return false, nil
+	}
+	m.Invocation.Error = lastError
+	if m.Invocation.Attempts >= q.options.MaxAttempts {
+		return true, q.deadLetter(m, lastError)
+	}
+
+	backoff := q.options.RetryBackoff << uint(m.Invocation.Attempts-1)
+	if backoff <= 0 || backoff > q.options.VisibilityTimeout {
+		backoff = q.options.VisibilityTimeout
+	}
+	visibleAt := now.Add(backoff)
+	if err := q.write(walRecord{Op: opRetry, ID: id, VisibleAt: visibleAt, Error: lastError}); err != nil {
+		return false, err
+	}
+	m.VisibleAt = visibleAt
+	return false, nil
+}
+
+// deadLetter moves an invocation to the dead-letter file.
+func (q *durableQueue) deadLetter(m *message, lastError string) error {
+	m.Invocation.Error = lastError
+	file, err := os.OpenFile(q.options.DeadLetterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	encodeErr := json.NewEncoder(file).Encode(m)
+	syncErr := file.Sync()
+	file.Close()
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if syncErr != nil {
+		return syncErr
+	}
+
+	if err := q.write(walRecord{Op: opDead, ID: m.Invocation.ID, Error: lastError}); err != nil {
+		return err
+	}
+	delete(q.messages, m.Invocation.ID)
+	q.dead++
+	return q.compactIfNeeded()
+}
+
+// compactIfNeeded rewrites the log with the queued invocations only, once
+// most of its records refer to completed ones.
+func (q *durableQueue) compactIfNeeded() error {
+	if q.records < compactionThreshold || q.records < 2*len(q.messages) {
+		return nil
+	}
+
+	path := q.options.File
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, m := range q.messages {
+		if err := encoder.Encode(walRecord{Op: opEnqueue, Message: m}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	q.file.Close()
+	q.file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	q.records = len(q.messages)
+	return err
+}
+
+func (q *durableQueue) stats(now time.Time) DurableStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := DurableStats{DeadLettered: q.dead}
+	for _, m := range q.messages {
+		if m.Invocation.State == Running && m.VisibleAt.After(now) {
+			stats.InFlight++
+		} else {
+			stats.Pending++
+		}
+	}
+	return stats
+}
+
+// setState keeps the state of a queued invocation, so it is reported
+// correctly after a restart.
+func (q *durableQueue) setState(id string, state State) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if m, ok := q.messages[id]; ok {
+		m.Invocation.State = state
+	}
+}
+
+func (q *durableQueue) queued() []Invocation {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	invocations := make([]Invocation, 0, len(q.messages))
+	for _, m := range q.messages {
+		invocations = append(invocations, m.Invocation)
+	}
+	return invocations
+}
+
+func (q *durableQueue) deadLetters() ([]Invocation, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	file, err := os.Open(q.options.DeadLetterFile)
+	if os.IsNotExist(err) {
+		return []Invocation{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	invocations := make([]Invocation, 0)
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var m message
+		if err := decoder.Decode(&m); err != nil {
+			return invocations, err
+		}
+		invocations = append(invocations, m.Invocation)
+	}
+	return invocations, nil
+}
+
+func (q *durableQueue) close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.file.Close()
+}
+
+// openDurableQueue replays the log to restore the queue.
+func openDurableQueue(options DurableOptions) (*durableQueue, error) {
+	if options.DeadLetterFile == "" {
+		options.DeadLetterFile = options.File + ".dead"
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = defaultMaxAttempts
+	}
+	if options.VisibilityTimeout <= 0 {
+		options.VisibilityTimeout = defaultVisibilityTimeout
+	}
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = defaultRetryBackoff
+	}
+
+	q := &durableQueue{
+		options:  options,
+		messages: make(map[string]*message),
+		wake:     make(chan struct{}, 1),
+	}
+
+	if file, err := os.Open(options.File); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			var record walRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				// A torn last line after a crash, the change never took effect
+				continue
+			}
+			q.replay(record)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(options.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	q.file = file
+	return q, nil
+}
+
+func (q *durableQueue) replay(record walRecord) {
+	q.records++
+	if record.Op == opEnqueue {
+		if record.Message != nil {
+			q.messages[record.Message.Invocation.ID] = record.Message
+		}
+		return
+	}
+
+	m, ok := q.messages[record.ID]
+	if !ok {
+		return
+	}
+	switch record.Op {
+	case opLease:
+		m.Invocation.Attempts = record.Attempts
+		m.VisibleAt = record.VisibleAt
+	case opRetry:
+		m.VisibleAt = record.VisibleAt
+		m.Invocation.Error = record.Error
+	case opAck:
+		delete(q.messages, record.ID)
+	case opDead:
+		delete(q.messages, record.ID)
+		q.dead++
+	}
+}
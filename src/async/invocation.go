@@ -0,0 +1,55 @@
+package async
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// State of an asynchronous invocation.
+type State string
+
+const (
+	Queued    State = "queued"
+	Running   State = "running"
+	Succeeded State = "succeeded"
+	Failed    State = "failed"
+)
+
+// Done reports whether the invocation has a final result.
+func (s State) Done() bool {
+	return s == Succeeded || s == Failed
+}
+
+// Response is the response of the worker to an asynchronous invocation.
+type Response struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body"`
+}
+
+// Invocation is an asynchronous invocation and, once it completed, its
+// result.
+type Invocation struct {
+	ID          string     `json:"id"`
+	Function    string     `json:"function"`
+	State       State      `json:"state"`
+	CallbackURL string     `json:"callback_url,omitempty"`
+	Durable     bool       `json:"durable,omitempty"`
+	Attempts    int        `json:"attempts,omitempty"`
+	SubmittedAt time.Time  `json:"submitted_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Response    *Response  `json:"response,omitempty"`
+	Error       string     `json:"error,omitempty"`
+
+	// Request body and content type, kept until the invocation ran
+	body        []byte
+	contentType string
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
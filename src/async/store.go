@@ -0,0 +1,210 @@
+package async
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store keeps asynchronous invocations and their results.
+type Store interface {
+	Save(invocation Invocation) error
+	// Get returns the invocation with the ID and whether it exists.
+	Get(id string) (Invocation, bool, error)
+	// Prune deletes completed invocations that completed before the given
+	// time, and the oldest ones beyond maxCompleted if it is positive.
+	Prune(before time.Time, maxCompleted int) (int, error)
+	Close() error
+}
+
+// MemoryStore keeps invocations in memory. They are lost on restart.
+type MemoryStore struct {
+	invocations map[string]Invocation
+	mutex       sync.Mutex
+}
+
+func (m *MemoryStore) Save(invocation Invocation) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.invocations[invocation.ID] = invocation
+	return nil
+}
+
+func (m *MemoryStore) Get(id string) (Invocation, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	invocation, ok := m.invocations[id]
+	return invocation, ok, nil
+}
+
+func (m *MemoryStore) Prune(before time.Time, maxCompleted int) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.prune(before, maxCompleted)), nil
+}
+
+// prune deletes expired invocations and returns their IDs.
+func (m *MemoryStore) prune(before time.Time, maxCompleted int) []string {
+	var completed []Invocation
+	var deleted []string
+	for id, invocation := range m.invocations {
+		if !invocation.State.Done() {
+			continue
+		}
+		if invocation.CompletedAt.Before(before) {
+			delete(m.invocations, id)
+			deleted = append(deleted, id)
+		} else {
+			completed = append(completed, invocation)
+		}
+	}
+
+	if maxCompleted > 0 && len(completed) > maxCompleted {
+		sort.Slice(completed, func(i, j int) bool {
+			return completed[i].CompletedAt.Before(*completed[j].CompletedAt)
+		})
+		for _, invocation := range completed[:len(completed)-maxCompleted] {
+			delete(m.invocations, invocation.ID)
+			deleted = append(deleted, invocation.ID)
+		}
+	}
+	return deleted
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{invocations: make(map[string]Invocation)}
+}
+
+// FileStore keeps invocations in memory and appends every change to a JSON
+// lines file, so results survive a restart. Later lines for the same ID
+// replace earlier ones, and the file is compacted when invocations are
+// pruned.
+type FileStore struct {
+	MemoryStore
+	path    string
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func (f *FileStore) Save(invocation Invocation) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.invocations[invocation.ID] = invocation
+	return f.encoder.Encode(invocation)
+}
+
+func (f *FileStore) Prune(before time.Time, maxCompleted int) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	deleted := f.prune(before, maxCompleted)
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+	return len(deleted), f.compact()
+}
+
+// compact rewrites the file with the current invocations only.
+func (f *FileStore) compact() error {
+	tmpPath := f.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, invocation := range f.invocations {
+		if err := encoder.Encode(invocation); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		return err
+	}
+	f.file.Close()
+	return f.open()
+}
+
+func (f *FileStore) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.encoder = json.NewEncoder(file)
+	return nil
+}
+
+func (f *FileStore) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.file.Close()
+}
+
+// NewFileStore opens the store file, or creates it, and loads the
+// invocations in it.
+func NewFileStore(path string) (*FileStore, error) {
+	f := &FileStore{
+		MemoryStore: MemoryStore{invocations: make(map[string]Invocation)},
+		path:        path,
+	}
+
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			var invocation Invocation
+			if err := json.Unmarshal(scanner.Bytes(), &invocation); err != nil {
+				// A torn last line after a crash
+				continue
+			}
+			f.invocations[invocation.ID] = invocation
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+		// The queue is kept in memory, so unfinished invocations are lost
+		now := time.Now()
+		for id, invocation := range f.invocations {
+			if !invocation.State.Done() {
+				invocation.State = Failed
+				invocation.Error = "Scheduler restarted before the invocation completed"
+				invocation.CompletedAt = &now
+				f.invocations[id] = invocation
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a line of the audit log.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Principal  string    `json:"principal,omitempty"`
+	Role       Role      `json:"role,omitempty"`
+	AuthMethod string    `json:"auth_method,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Status     int       `json:"status"`
+}
+
+type auditLog struct {
+	file    *os.File
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+func (l *auditLog) record(r *http.Request, principal Principal, status int) {
+	entry := AuditEntry{
+		Time:       time.Now(),
+		Principal:  principal.Name,
+		Role:       principal.Role,
+		AuthMethod: principal.Method,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Status:     status,
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.encoder.Encode(entry)
+}
+
+func (l *auditLog) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
@@ -0,0 +1,181 @@
+// Package auth authenticates requests to the scheduler by bearer token,
+// HMAC signature or TLS client certificate and authorizes them by role.
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Role of a principal. Admins may do everything, workers may call back the
+// scheduler and invokers may run functions.
+type Role string
+
+const (
+	Admin   Role = "admin"
+	Worker  Role = "worker"
+	Invoker Role = "invoker"
+)
+
+// Allows reports whether the role grants access to endpoints of the
+// required role.
+func (r Role) Allows(required Role) bool {
+	return r == Admin || r == required
+}
+
+func (r Role) valid() bool {
+	return r == Admin || r == Worker || r == Invoker
+}
+
+var (
+	// ErrUnauthenticated is returned for requests without valid credentials.
+	ErrUnauthenticated = errors.New("missing or invalid credentials")
+	// ErrForbidden is returned for principals without the required role.
+	ErrForbidden = errors.New("insufficient role")
+)
+
+// Principal is the authenticated client of a request.
+type Principal struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+	// Method is how the principal authenticated: "token", "signature",
+	// "certificate" or "none"
+	Method string `json:"method"`
+}
+
+// Token is a static bearer token.
+type Token struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  Role   `json:"role"`
+}
+
+// Options configures the accepted credentials. Without any, requests are
+// not authenticated and every client is an anonymous admin.
+type Options struct {
+	Tokens []Token
+	// WorkerSecret is the key of HMAC-signed requests from workers
+	WorkerSecret string
+	// MaxSkew is how far the timestamp of a signed request may be off.
+	// Defaults to five minutes.
+	MaxSkew time.Duration
+	// ClientCertificates maps the common name or a DNS name of a verified
+	// TLS client certificate to its role.
+	ClientCertificates map[string]Role
+	// AuditLog is the JSON lines file that records admin actions. Empty
+	// means no audit log.
+	AuditLog string
+}
+
+// Authenticator checks the credentials of requests.
+type Authenticator struct {
+	options Options
+	audit   *auditLog
+	replays *replayCache
+}
+
+// Enabled reports whether any credentials are configured.
+func (a *Authenticator) Enabled() bool {
+	return len(a.options.Tokens) > 0 || a.options.WorkerSecret != "" || len(a.options.ClientCertificates) > 0
+}
+
+// Authenticate returns the principal of the request. A bearer token takes
+// precedence over a signature, and a signature over a client certificate.
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if !a.Enabled() {
+		return Principal{Name: "anonymous", Role: Admin, Method: "none"}, nil
+	}
+
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		presented := []byte(strings.TrimPrefix(header, "Bearer "))
+		for _, token := range a.options.Tokens {
+			if subtle.ConstantTimeCompare(presented, []byte(token.Token)) == 1 {
+				return Principal{Name: token.Name, Role: token.Role, Method: "token"}, nil
+			}
+		}
+		return Principal{}, ErrUnauthenticated
+	}
+
+	if r.Header.Get(SignatureHeader) != "" {
+		if a.options.WorkerSecret == "" {
+			return Principal{}, ErrUnauthenticated
+		}
+		now := time.Now()
+		if err := Verify(r, a.options.WorkerSecret, a.options.MaxSkew, now); err != nil {
+			return Principal{}, ErrUnauthenticated
+		}
+		if !a.replays.accept(r, a.options.MaxSkew, now) {
+			return Principal{}, ErrUnauthenticated
+		}
+		return Principal{Name: "worker", Role: Worker, Method: "signature"}, nil
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		certificate := r.TLS.VerifiedChains[0][0]
+		names := append([]string{certificate.Subject.CommonName}, certificate.DNSNames...)
+		for _, name := range names {
+			if role, ok := a.options.ClientCertificates[name]; ok && name != "" {
+				return Principal{Name: name, Role: role, Method: "certificate"}, nil
+			}
+		}
+	}
+	return Principal{}, ErrUnauthenticated
+}
+
+// Authorize authenticates the request and checks that the principal has
+// the required role.
+func (a *Authenticator) Authorize(r *http.Request, required Role) (Principal, error) {
+	principal, err := a.Authenticate(r)
+	if err != nil {
+		return principal, err
+	}
+	if !principal.Role.Allows(required) {
+		return principal, ErrForbidden
+	}
+	return principal, nil
+}
+
+// Audit records a request to an admin endpoint and its outcome.
+func (a *Authenticator) Audit(r *http.Request, principal Principal, status int) {
+	if a.audit != nil {
+		a.audit.record(r, principal, status)
+	}
+}
+
+func (a *Authenticator) Close() error {
+	if a.audit != nil {
+		return a.audit.close()
+	}
+	return nil
+}
+
+// NewAuthenticator fails for tokens without a known role or if the audit
+// log can't be opened.
+func NewAuthenticator(options Options) (*Authenticator, error) {
+	if options.MaxSkew <= 0 {
+		options.MaxSkew = defaultMaxSkew
+	}
+	for _, token := range options.Tokens {
+		if token.Token == "" || !token.Role.valid() {
+			return nil, errors.New("token " + token.Name + " needs a value and a role of admin, worker or invoker")
+		}
+	}
+	for name, role := range options.ClientCertificates {
+		if !role.valid() {
+			return nil, errors.New("client certificate " + name + " needs a role of admin, worker or invoker")
+		}
+	}
+
+	a := &Authenticator{options: options, replays: newReplayCache()}
+	if options.AuditLog != "" {
+		audit, err := openAuditLog(options.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+		a.audit = audit
+	}
+	return a, nil
+}
@@ -0,0 +1,402 @@
+// Package autoscale recommends how many workers the scheduler needs, from
+// the load it sees, and runs hooks that resize the pool when the
+// recommendation crosses the current size. Workers are removed by draining
+// them first, so that no invocation is cut off.
+package autoscale
+
+import (
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval        = 15 * time.Second
+	defaultTargetInFlight  = 4
+	defaultMinWorkers      = 1
+	defaultScaleUpCooldown = time.Minute
+	defaultScaleDownDelay  = 5 * time.Minute
+	defaultDrainTimeout    = 2 * time.Minute
+)
+
+// Options configures the recommendation and the hooks.
+type Options struct {
+	// Interval is how often the recommendation is computed. Defaults to 15
+	// seconds.
+	Interval time.Duration
+	// TargetInFlight is the number of invocations in flight or queued that a
+	// worker should take on average. Defaults to 4.
+	TargetInFlight float64
+	// MaxColdStartRatio adds a worker if the share of cold starts among the
+	// invocations of an interval exceeds it. Zero disables it.
+	MaxColdStartRatio float64
+	// MinWorkers defaults to one, MaxWorkers of zero is unbounded.
+	MinWorkers int
+	MaxWorkers int
+	// ScaleUpCooldown is how long after scaling up the same target is not
+	// requested again, while new workers are provisioned. Higher targets are
+	// requested right away. Defaults to a minute.
+	ScaleUpCooldown time.Duration
+	// ScaleDownDelay is how long the recommendation must stay below the
+	// current size before workers are drained. Defaults to five minutes.
+	ScaleDownDelay time.Duration
+	// DrainTimeout is how long draining workers may take to finish their
+	// invocations. Defaults to two minutes.
+	DrainTimeout time.Duration
+	Hooks        []Hook
+}
+
+func (o Options) withDefaults() Options {
+	if o.Interval <= 0 {
+		o.Interval = defaultInterval
+	}
+	if o.TargetInFlight <= 0 {
+		o.TargetInFlight = defaultTargetInFlight
+	}
+	if o.MinWorkers <= 0 {
+		o.MinWorkers = defaultMinWorkers
+	}
+	if o.ScaleUpCooldown <= 0 {
+		o.ScaleUpCooldown = defaultScaleUpCooldown
+	}
+	if o.ScaleDownDelay <= 0 {
+		o.ScaleDownDelay = defaultScaleDownDelay
+	}
+	if o.DrainTimeout <= 0 {
+		o.DrainTimeout = defaultDrainTimeout
+	}
+	for i := range o.Hooks {
+		if o.Hooks[i].Timeout <= 0 {
+			o.Hooks[i].Timeout = defaultHookTimeout
+		}
+	}
+	return o
+}
+
+// Source provides the state of the scheduler the recommendation is
+// computed from, and removes workers from its balancer to drain them.
+type Source interface {
+	Workers() []url.URL
+	// Queued returns the number of invocations waiting for admission.
+	Queued() int
+	// ColdStarts returns the total number of cold starts and invocations
+	// placed by the balancer.
+	ColdStarts() (coldStarts uint64, invocations uint64)
+	Drain(workerURL url.URL)
+}
+
+// Signals are the inputs of a recommendation.
+type Signals struct {
+	InFlight int `json:"in_flight"`
+	// PeakInFlight is the most invocations in flight at once during the
+	// interval
+	PeakInFlight   int            `json:"peak_in_flight"`
+	Queued         int            `json:"queued"`
+	WorkerInFlight map[string]int `json:"worker_in_flight"`
+	// Cold starts and invocations during the interval
+	ColdStarts     uint64  `json:"cold_starts"`
+	Invocations    uint64  `json:"invocations"`
+	ColdStartRatio float64 `json:"cold_start_ratio"`
+}
+
+// Recommendation is the number of workers the scheduler needs.
+type Recommendation struct {
+	Time           time.Time `json:"time"`
+	CurrentWorkers int       `json:"current_workers"`
+	DesiredWorkers int       `json:"desired_workers"`
+	Reason         string    `json:"reason"`
+	Signals        Signals   `json:"signals"`
+	// Draining holds the workers that are being drained or were drained
+	// and wait to be removed from the pool
+	Draining []string `json:"draining,omitempty"`
+}
+
+type drain struct {
+	since time.Time
+	done  bool
+}
+
+// Autoscaler computes recommendations on an interval and runs the hooks.
+type Autoscaler struct {
+	options Options
+	source  Source
+
+	inFlight     map[url.URL]int
+	total        int
+	peak         int
+	coldStarts   uint64
+	invocations  uint64
+	below        time.Time
+	lastUp       time.Time
+	lastUpTarget int
+	draining     map[url.URL]*drain
+	// pendingDown is the scale-down waiting for its workers to drain
+	pendingDown    *Event
+	recommendation Recommendation
+
+	now      func() time.Time
+	mutex    sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Started records an invocation sent to the worker.
+func (a *Autoscaler) Started(workerURL url.URL) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.inFlight[workerURL]++
+	a.total++
+	if a.total > a.peak {
+		a.peak = a.total
+	}
+}
+
+// Finished records that an invocation on the worker is done.
+func (a *Autoscaler) Finished(workerURL url.URL) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.inFlight[workerURL]--; a.inFlight[workerURL] <= 0 {
+		delete(a.inFlight, workerURL)
+	}
+	a.total--
+}
+
+// Evaluate computes a recommendation and runs the hooks if it crossed the
+// current size or a drain finished.
+func (a *Autoscaler) Evaluate() Recommendation {
+	workers := a.source.Workers()
+	queued := a.source.Queued()
+	coldStarts, invocations := a.source.ColdStarts()
+
+	a.mutex.Lock()
+	now := a.now()
+	signals := Signals{
+		InFlight:       a.total,
+		PeakInFlight:   a.peak,
+		Queued:         queued,
+		WorkerInFlight: make(map[string]int),
+	}
+	for workerURL, inFlight := range a.inFlight {
+		signals.WorkerInFlight[workerURL.String()] = inFlight
+	}
+	if coldStarts >= a.coldStarts && invocations >= a.invocations {
+		signals.ColdStarts = coldStarts - a.coldStarts
+		signals.Invocations = invocations - a.invocations
+	}
+	if signals.Invocations > 0 {
+		signals.ColdStartRatio = float64(signals.ColdStarts) / float64(signals.Invocations)
+	}
+	a.coldStarts, a.invocations = coldStarts, invocations
+	a.peak = a.total
+
+	current := len(workers)
+	desired := int(math.Ceil(float64(signals.PeakInFlight+signals.Queued) / a.options.TargetInFlight))
+	reason := "load"
+	if a.options.MaxColdStartRatio > 0 && signals.ColdStartRatio > a.options.MaxColdStartRatio && desired <= current {
+		desired = current + 1
+		reason = "cold starts"
+	}
+	if desired < a.options.MinWorkers {
+		desired, reason = a.options.MinWorkers, "min workers"
+	}
+	if a.options.MaxWorkers > 0 && desired > a.options.MaxWorkers {
+		desired, reason = a.options.MaxWorkers, "max workers"
+	}
+
+	events := a.decide(now, current, desired, workers)
+	a.recommendation = Recommendation{
+		Time:           now,
+		CurrentWorkers: current,
+		DesiredWorkers: desired,
+		Reason:         reason,
+		Signals:        signals,
+		Draining:       a.drainingWorkers(),
+	}
+	recommendation := a.recommendation
+	a.mutex.Unlock()
+
+	for _, event := range events {
+		a.runHooks(event)
+	}
+	return recommendation
+}
+
+func (a *Autoscaler) decide(now time.Time, current int, desired int, workers []url.URL) []Event {
+	var events []Event
+
+	switch {
+	case desired > current:
+		a.below = time.Time{}
+		if a.lastUp.IsZero() || desired > a.lastUpTarget || now.Sub(a.lastUp) >= a.options.ScaleUpCooldown {
+			a.lastUp, a.lastUpTarget = now, desired
+			events = append(events, Event{Direction: ScaleUp, CurrentWorkers: current, TargetWorkers: desired, Time: now})
+		}
+	case desired < current:
+		if a.below.IsZero() {
+			a.below = now
+		}
+		// Without hooks, nothing would remove drained workers from the pool
+		// or add them back, so only the recommendation is published
+		if len(a.options.Hooks) > 0 && a.pendingDown == nil && now.Sub(a.below) >= a.options.ScaleDownDelay {
+			a.below = time.Time{}
+			a.pendingDown = a.startDrain(now, current, desired, workers)
+		}
+	default:
+		a.below = time.Time{}
+	}
+
+	if a.pendingDown != nil && a.drained(now, a.pendingDown.Workers) {
+		event := *a.pendingDown
+		event.Time = now
+		a.pendingDown = nil
+		events = append(events, event)
+	}
+	return events
+}
+
+// startDrain removes the workers with the fewest invocations in flight from
+// the balancer, so that they only finish the invocations they have.
+func (a *Autoscaler) startDrain(now time.Time, current int, desired int, workers []url.URL) *Event {
+	candidates := make([]url.URL, len(workers))
+	copy(candidates, workers)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if a.inFlight[candidates[i]] != a.inFlight[candidates[j]] {
+			return a.inFlight[candidates[i]] < a.inFlight[candidates[j]]
+		}
+		return candidates[i].String() < candidates[j].String()
+	})
+
+	event := &Event{Direction: ScaleDown, CurrentWorkers: current, TargetWorkers: desired}
+	for _, workerURL := range candidates[:current-desired] {
+		log.Printf("Draining worker %s to scale down to %d workers", workerURL.String(), desired)
+		a.draining[workerURL] = &drain{since: now}
+		a.source.Drain(workerURL)
+		event.Workers = append(event.Workers, workerURL.String())
+	}
+	return event
+}
+
+func (a *Autoscaler) drained(now time.Time, workers []string) bool {
+	for _, worker := range workers {
+		workerURL, _ := url.Parse(worker)
+		d, ok := a.draining[*workerURL]
+		if !ok || d.done {
+			continue
+		}
+		if a.inFlight[*workerURL] > 0 && now.Sub(d.since) < a.options.DrainTimeout {
+			return false
+		}
+	}
+	for _, worker := range workers {
+		workerURL, _ := url.Parse(worker)
+		if d, ok := a.draining[*workerURL]; ok {
+			d.done = true
+		}
+	}
+	return true
+}
+
+func (a *Autoscaler) drainingWorkers() []string {
+	workers := make([]string, 0, len(a.draining))
+	for workerURL := range a.draining {
+		workers = append(workers, workerURL.String())
+	}
+	sort.Strings(workers)
+	return workers
+}
+
+// Draining reports whether the worker is being drained or was drained, in
+// which case it must not be added back to the balancer.
+func (a *Autoscaler) Draining(workerURL url.URL) bool {
+	if a == nil {
+		return false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	_, ok := a.draining[workerURL]
+	return ok
+}
+
+// DrainingWorkers returns the workers being drained or drained.
+func (a *Autoscaler) DrainingWorkers() []url.URL {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	workers := make([]url.URL, 0, len(a.draining))
+	for workerURL := range a.draining {
+		workers = append(workers, workerURL)
+	}
+	return workers
+}
+
+// Undrain forgets that the worker was drained, e.g. once it left the pool
+// or was added again by hand.
+func (a *Autoscaler) Undrain(workerURL url.URL) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.draining, workerURL)
+}
+
+// Recommendation returns the last recommendation.
+func (a *Autoscaler) Recommendation() Recommendation {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.recommendation
+}
+
+// Run evaluates on the interval until the autoscaler is stopped.
+func (a *Autoscaler) Run() {
+	ticker := time.NewTicker(a.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.Evaluate()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+func (a *Autoscaler) Stop() {
+	a.stopOnce.Do(func() { close(a.stop) })
+}
+
+func (a *Autoscaler) SetClock(now func() time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.now = now
+}
+
+func NewAutoscaler(options Options, source Source) *Autoscaler {
+	return &Autoscaler{
+		options:  options.withDefaults(),
+		source:   source,
+		inFlight: make(map[url.URL]int),
+		draining: make(map[url.URL]*drain),
+		now:      time.Now,
+		stop:     make(chan struct{}),
+	}
+}
@@ -0,0 +1,91 @@
+package autoscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+const (
+	ScaleUp   = "up"
+	ScaleDown = "down"
+)
+
+// Hook is a command or webhook run with the target number of workers. A
+// command gets the event as JSON on stdin and in HIKU_SCALE_* environment
+// variables, a webhook gets it as JSON in a POST request.
+type Hook struct {
+	Command []string
+	URL     string
+	// Timeout defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+// Event asks to resize the pool of workers. On scale-down, Workers holds
+// the drained workers that can be removed.
+type Event struct {
+	Direction      string    `json:"direction"`
+	CurrentWorkers int       `json:"current_workers"`
+	TargetWorkers  int       `json:"target_workers"`
+	Workers        []string  `json:"workers,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+func (a *Autoscaler) runHooks(event Event) {
+	log.Printf("Scaling %s from %d to %d workers", event.Direction, event.CurrentWorkers, event.TargetWorkers)
+	for _, hook := range a.options.Hooks {
+		if err := hook.run(event); err != nil {
+			log.Printf("Scaling hook failed: %v", err)
+		}
+	}
+}
+
+func (h Hook) run(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	if len(h.Command) > 0 {
+		cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(),
+			"HIKU_SCALE_DIRECTION="+event.Direction,
+			"HIKU_SCALE_CURRENT_WORKERS="+strconv.Itoa(event.CurrentWorkers),
+			"HIKU_SCALE_TARGET_WORKERS="+strconv.Itoa(event.TargetWorkers),
+			"HIKU_SCALE_WORKERS="+strings.Join(event.Workers, ","),
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w: %s", h.Command[0], err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	if h.URL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook %s responded with %s", h.URL, resp.Status)
+		}
+	}
+	return nil
+}
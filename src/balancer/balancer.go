@@ -3,6 +3,7 @@ package balancer
 import (
 	"net/http"
 	"net/url"
+	"time"
 
 	"hiku/httputil"
 	"hiku/lambda"
@@ -10,9 +11,27 @@ import (
 
 type Balancer interface {
 	SelectWorker(r *http.Request, l *lambda.Lambda) (url.URL, *httputil.HttpError)
-	ReleaseWorker(workerUrl url.URL, l *lambda.Lambda)
+	ReleaseWorker(workerUrl url.URL, l *lambda.Lambda, outcome Outcome)
 	AddWorker(workerUrl url.URL)
 	RemoveWorker(workerUrl url.URL)
 	GetAllWorkers() []url.URL
 	DestroySandbox(workerUrl url.URL, l *lambda.Lambda)
 }
+
+// Outcome describes how a worker served a request, as observed by the
+// scheduler around the proxied request.
+type Outcome struct {
+	Latency time.Duration
+	Status  int
+}
+
+// Failed reports whether the worker failed to serve the request.
+func (o Outcome) Failed() bool {
+	return o.Status >= http.StatusInternalServerError
+}
+
+// Clocked is implemented by balancers that depend on the current time, so
+// that they can be run on the virtual clock of a simulation.
+type Clocked interface {
+	SetClock(now func() time.Time)
+}
@@ -0,0 +1,67 @@
+package balancer
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/lafikl/consistent"
+)
+
+// maxColdStartRings bounds the rings kept for distinct candidate sets,
+// which vary with placement and memory filters.
+const maxColdStartRings = 64
+
+// coldStartRing places cold starts by consistent hashing with bounded loads
+// on the function, instead of on the least loaded worker. Repeated cold
+// starts of a function go to the same few workers, which makes later warm
+// hits more likely, and bursts spread over the neighbours on the ring once
+// a worker exceeds its bound.
+type coldStartRing struct {
+	rings map[string]*consistent.Consistent
+}
+
+// selectWorker returns the worker of the function among the non-empty
+// candidates, bounded by the loads of the balancer.
+func (c *coldStartRing) selectWorker(candidates []url.URL, functionType string, load func(url.URL) uint) url.URL {
+	ring := c.ringOf(candidates)
+	for _, workerURL := range candidates {
+		ring.UpdateLoad(workerURL.String(), int64(load(workerURL)))
+	}
+
+	host, err := ring.GetLeast(functionType)
+	if err == nil {
+		for _, workerURL := range candidates {
+			if workerURL.String() == host {
+				return workerURL
+			}
+		}
+	}
+	return candidates[0]
+}
+
+func (c *coldStartRing) ringOf(candidates []url.URL) *consistent.Consistent {
+	hosts := make([]string, len(candidates))
+	for i, workerURL := range candidates {
+		hosts[i] = workerURL.String()
+	}
+	sort.Strings(hosts)
+	key := strings.Join(hosts, ",")
+
+	ring, ok := c.rings[key]
+	if !ok {
+		if len(c.rings) >= maxColdStartRings {
+			c.rings = make(map[string]*consistent.Consistent)
+		}
+		ring = consistent.New()
+		for _, host := range hosts {
+			ring.Add(host)
+		}
+		c.rings[key] = ring
+	}
+	return ring
+}
+
+func newColdStartRing() *coldStartRing {
+	return &coldStartRing{rings: make(map[string]*consistent.Consistent)}
+}
@@ -4,6 +4,9 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
 
 	"hiku/httputil"
 	"hiku/lambda"
@@ -11,42 +14,128 @@ import (
 	"github.com/lafikl/consistent"
 )
 
+// maxSubRings bounds the rings kept for distinct candidate sets, which vary
+// with placement and, through zone preferences, with load. A new ring takes
+// its loads from the main ring, so the rings can be dropped at any time.
+const maxSubRings = 64
+
 type ConsistentHashingBounded struct {
 	hashRing  *consistent.Consistent
 	workerMap map[string]url.URL
+
+	// Functions with placement constraints or zone preferences are hashed
+	// onto a ring of the workers they may run on, which shares the loads of
+	// the main ring
+	placement *Placement
+	subRings  map[string]*consistent.Consistent
+	mutex     sync.Mutex
+}
+
+// ringOf returns the ring of the candidates, creating it with the current
+// loads if necessary.
+func (b *ConsistentHashingBounded) ringOf(candidates []url.URL) *consistent.Consistent {
+	if len(candidates) == len(b.workerMap) {
+		return b.hashRing
+	}
+
+	hosts := make([]string, len(candidates))
+	for i, workerUrl := range candidates {
+		hosts[i] = workerUrl.String()
+	}
+	sort.Strings(hosts)
+	key := strings.Join(hosts, ",")
+
+	ring, ok := b.subRings[key]
+	if !ok {
+		if len(b.subRings) >= maxSubRings {
+			b.subRings = make(map[string]*consistent.Consistent)
+		}
+		ring = consistent.New()
+		loads := b.hashRing.GetLoads()
+		for _, host := range hosts {
+			ring.Add(host)
+			ring.UpdateLoad(host, loads[host])
+		}
+		b.subRings[key] = ring
+	}
+	return ring
 }
 
 func (b *ConsistentHashingBounded) SelectWorker(r *http.Request, l *lambda.Lambda) (url.URL, *httputil.HttpError) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
 	if len(b.workerMap) == 0 {
 		return url.URL{}, httputil.New500Error("Can't select worker, Workers empty")
 	}
 
-	host, err := b.hashRing.GetLeast(r.URL.String())
+	candidates, filterErr := b.placement.Filter(b.allWorkers(), l)
+	if filterErr != nil {
+		return url.URL{}, filterErr
+	}
+	loads := b.hashRing.GetLoads()
+	candidates = b.placement.Localize(candidates, func(workerUrl url.URL) uint { return uint(loads[workerUrl.String()]) })
+
+	host, err := b.ringOf(candidates).GetLeast(l.ID())
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	b.hashRing.Inc(host)
+	b.inc(host)
 	return b.workerMap[host], nil
 }
 
-func (b *ConsistentHashingBounded) ReleaseWorker(workerUrl url.URL, l *lambda.Lambda) {
-	b.hashRing.Done(workerUrl.String())
+// inc and done keep the load of a host equal on all rings. Rings without
+// the host ignore it.
+func (b *ConsistentHashingBounded) inc(host string) {
+	b.hashRing.Inc(host)
+	for _, ring := range b.subRings {
+		ring.Inc(host)
+	}
+}
+
+func (b *ConsistentHashingBounded) done(host string) {
+	b.hashRing.Done(host)
+	for _, ring := range b.subRings {
+		ring.Done(host)
+	}
+}
+
+func (b *ConsistentHashingBounded) ReleaseWorker(workerUrl url.URL, l *lambda.Lambda, outcome Outcome) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.done(workerUrl.String())
 }
 
 func (b *ConsistentHashingBounded) AddWorker(workerUrl url.URL) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
 	host := workerUrl.String()
 	b.hashRing.Add(host)
 	b.workerMap[host] = workerUrl
+	b.subRings = make(map[string]*consistent.Consistent)
 }
 
 func (b *ConsistentHashingBounded) RemoveWorker(workerUrl url.URL) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
 	host := workerUrl.String()
 	b.hashRing.Remove(host)
 	delete(b.workerMap, host)
+	b.subRings = make(map[string]*consistent.Consistent)
 }
 
 func (b *ConsistentHashingBounded) GetAllWorkers() []url.URL {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.allWorkers()
+}
+
+func (b *ConsistentHashingBounded) allWorkers() []url.URL {
 	totalUrls := len(b.workerMap)
 	urlSlice := make([]url.URL, totalUrls)
 	i := 0
@@ -60,6 +149,13 @@ func (b *ConsistentHashingBounded) GetAllWorkers() []url.URL {
 func (b *ConsistentHashingBounded) DestroySandbox(workerUrl url.URL, l *lambda.Lambda) {
 }
 
+func (b *ConsistentHashingBounded) SetPlacement(placement *Placement) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.placement = placement
+}
+
 func NewConsistentHashingBounded(workerUrls []url.URL) Balancer {
 	workerMap := make(map[string]url.URL)
 	hashRing := consistent.New()
@@ -68,7 +164,11 @@ func NewConsistentHashingBounded(workerUrls []url.URL) Balancer {
 		hashRing.Add(workerUrl.String())
 	}
 
-	return &ConsistentHashingBounded{hashRing, workerMap}
+	return &ConsistentHashingBounded{
+		hashRing:  hashRing,
+		workerMap: workerMap,
+		subRings:  make(map[string]*consistent.Consistent),
+	}
 }
 
 func NewConsistentHashingBoundedFromJSONSlice(jsonSlice []string) Balancer {
@@ -0,0 +1,153 @@
+package balancer
+
+import (
+	"container/heap"
+	"log"
+	"time"
+
+	"hiku/lambda"
+)
+
+const defaultSweepInterval = 10 * time.Second
+
+// IdleQueueStats counts how idle-queue entries of a function were resolved.
+// An entry is expected to be warm while it sits in the queue. It turns out to
+// be warm when it is popped (Hits), and cold when the worker reports that the
+// sandbox was destroyed before we used it (Evicted). Entries dropped because
+// their TTL passed are counted as Expired.
+type IdleQueueStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Expired uint64 `json:"expired"`
+	Evicted uint64 `json:"evicted"`
+
+	evictedIdleTime time.Duration
+}
+
+// WarmRatio is the share of expected-warm entries that were actually warm
+// when they were resolved. A low ratio means the TTL is longer than the
+// keep-alive of the workers.
+func (s IdleQueueStats) WarmRatio() float64 {
+	expectedWarm := s.Hits + s.Evicted
+	if expectedWarm == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(expectedWarm)
+}
+
+// MeanEvictedIdleTime is the average time evicted entries spent in the idle
+// queue, i.e. the keep-alive the workers actually granted.
+func (s IdleQueueStats) MeanEvictedIdleTime() time.Duration {
+	if s.Evicted == 0 {
+		return 0
+	}
+	return s.evictedIdleTime / time.Duration(s.Evicted)
+}
+
+// IdleQueueStatsProvider is implemented by balancers that keep idle queues.
+type IdleQueueStatsProvider interface {
+	IdleQueueStats() map[string]IdleQueueStats
+}
+
+func (o PullBasedOptions) hasIdleTTL() bool {
+	if o.IdleTTL > 0 {
+		return true
+	}
+	for _, ttl := range o.FunctionIdleTTLs {
+		if ttl > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// idleTTL of a function by its ID. TTLs are configured by name and apply to
+// the functions of that name in all namespaces.
+func (o PullBasedOptions) idleTTL(functionType string) time.Duration {
+	if ttl, ok := o.FunctionIdleTTLs[lambda.ParseID(functionType).Name]; ok {
+		return ttl
+	}
+	return o.IdleTTL
+}
+
+func (b *PullBased) isExpired(functionType string, item *Item, now time.Time) bool {
+	ttl := b.options.idleTTL(functionType)
+	return ttl > 0 && now.Sub(item.idleSince) > ttl
+}
+
+func (b *PullBased) getIdleStats(functionType string) *IdleQueueStats {
+	stats, ok := b.idleStats[functionType]
+	if !ok {
+		stats = &IdleQueueStats{}
+		b.idleStats[functionType] = stats
+	}
+	return stats
+}
+
+func (b *PullBased) IdleQueueStats() map[string]IdleQueueStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	result := make(map[string]IdleQueueStats, len(b.idleStats))
+	for functionType, stats := range b.idleStats {
+		result[functionType] = *stats
+	}
+	return result
+}
+
+// ExpireIdleEntries removes all idle-queue entries whose TTL has passed and
+// returns how many were removed.
+func (b *PullBased) ExpireIdleEntries() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.now()
+	total := 0
+	for functionType, idleQueue := range b.idleQueues {
+		kept := idleQueue.queue[:0]
+		for _, item := range idleQueue.queue {
+			if b.isExpired(functionType, item, now) {
+				b.getIdleStats(functionType).Expired++
+				b.releaseMemory(item)
+				total++
+				continue
+			}
+			item.index = len(kept)
+			kept = append(kept, item)
+		}
+		for i := len(kept); i < len(idleQueue.queue); i++ {
+			idleQueue.queue[i] = nil
+		}
+		idleQueue.queue = kept
+		heap.Init(&idleQueue.queue)
+	}
+	return total
+}
+
+func (b *PullBased) sweepIdleQueues() {
+	interval := b.options.SweepInterval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if expired := b.ExpireIdleEntries(); expired > 0 {
+				log.Printf("Expired %d idle queue entries", expired)
+			}
+		case <-b.stopSweep:
+			return
+		}
+	}
+}
+
+// Close stops the background sweep of the idle queues.
+func (b *PullBased) Close() {
+	b.stopOnce.Do(func() {
+		close(b.stopSweep)
+	})
+}
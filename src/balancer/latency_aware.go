@@ -0,0 +1,277 @@
+package balancer
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"hiku/httputil"
+	"hiku/lambda"
+)
+
+const (
+	defaultLatencyDecay        = 10 * time.Second
+	defaultLatencyErrorPenalty = time.Second
+	defaultLatencyDefaultRTT   = 100 * time.Millisecond
+)
+
+// LatencyOptions configures the latency-aware balancer.
+type LatencyOptions struct {
+	// Decay is the time constant of the moving average. Older samples lose
+	// weight the longer ago they were taken. Defaults to 10 seconds.
+	Decay time.Duration
+	// PerFunction keeps an average per worker and function, falling back to
+	// the worker average for functions without samples on a worker.
+	PerFunction bool
+	// ErrorPenalty is the latency assumed for requests that failed with a
+	// server error. Defaults to one second.
+	ErrorPenalty time.Duration
+	// DefaultRTT is the latency assumed for workers without samples while
+	// no worker has any. Otherwise they are assumed to be as fast as the
+	// average sampled worker. Defaults to 100 milliseconds.
+	DefaultRTT time.Duration
+}
+
+type ewma struct {
+	value      float64
+	lastUpdate time.Time
+}
+
+// observe adds a sample peak-EWMA style: latency spikes are taken as they
+// are, improvements are averaged in with a weight decaying over time.
+func (e *ewma) observe(sample float64, now time.Time, decay time.Duration) {
+	if e.lastUpdate.IsZero() || sample > e.value {
+		e.value = sample
+	} else {
+		elapsed := now.Sub(e.lastUpdate)
+		weight := math.Exp(-float64(elapsed) / float64(decay))
+		e.value = e.value*weight + sample*(1-weight)
+	}
+	e.lastUpdate = now
+}
+
+type functionWorker struct {
+	functionType string
+	workerURL    url.URL
+}
+
+// LatencyAware selects the worker with the lowest expected completion time,
+// which is the moving average of its response time multiplied by the number
+// of requests it would be serving. It picks up degraded workers that still
+// accept connections.
+type LatencyAware struct {
+	workerUrls  []url.URL
+	options     LatencyOptions
+	inFlight    map[url.URL]uint
+	workerRTT   map[url.URL]*ewma
+	functionRTT map[functionWorker]*ewma
+	now         func() time.Time
+	mutex       *sync.Mutex
+	placement   *Placement
+}
+
+// unsampledLatency is the latency assumed for workers without samples: the
+// mean of the sampled workers, or the default RTT if there are none. Taking
+// zero instead would send every request to a new worker until its first
+// response comes back.
+func (b *LatencyAware) unsampledLatency() float64 {
+	var sum float64
+	sampled := 0
+	for _, workerURL := range b.workerUrls {
+		if rtt, ok := b.workerRTT[workerURL]; ok {
+			sum += rtt.value
+			sampled++
+		}
+	}
+	if sampled == 0 {
+		return float64(b.options.DefaultRTT)
+	}
+	return sum / float64(sampled)
+}
+
+func (b *LatencyAware) expectedLatency(workerURL url.URL, l *lambda.Lambda, unsampled float64) float64 {
+	if b.options.PerFunction {
+		if rtt, ok := b.functionRTT[functionWorker{l.ID(), workerURL}]; ok {
+			return rtt.value
+		}
+	}
+	if rtt, ok := b.workerRTT[workerURL]; ok {
+		return rtt.value
+	}
+	return unsampled
+}
+
+func (b *LatencyAware) cost(workerURL url.URL, l *lambda.Lambda, unsampled float64) float64 {
+	return b.expectedLatency(workerURL, l, unsampled) * float64(b.inFlight[workerURL]+1)
+}
+
+func (b *LatencyAware) SelectWorker(r *http.Request, l *lambda.Lambda) (url.URL, *httputil.HttpError) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.workerUrls) == 0 {
+		return url.URL{}, httputil.New500Error("Can't select worker, Workers empty")
+	}
+	workerUrls, err := b.placement.Filter(b.workerUrls, l)
+	if err != nil {
+		return url.URL{}, err
+	}
+	workerUrls = b.placement.Localize(workerUrls, func(workerURL url.URL) uint { return b.inFlight[workerURL] })
+
+	// Workers without samples are assumed to be average, so they get tried
+	// without drawing all requests until they respond. Equal costs are
+	// decided by the number of requests in flight.
+	unsampled := b.unsampledLatency()
+	bestCost := math.Inf(1)
+	var bestInFlight uint
+	var tiedWorkers []url.URL
+	for _, workerURL := range workerUrls {
+		workerCost := b.cost(workerURL, l, unsampled)
+		workerInFlight := b.inFlight[workerURL]
+		if workerCost < bestCost || (workerCost == bestCost && workerInFlight < bestInFlight) {
+			bestCost = workerCost
+			bestInFlight = workerInFlight
+			tiedWorkers = []url.URL{workerURL}
+		} else if workerCost == bestCost && workerInFlight == bestInFlight {
+			tiedWorkers = append(tiedWorkers, workerURL)
+		}
+	}
+
+	selectedURL := tiedWorkers[rand.Intn(len(tiedWorkers))]
+	b.inFlight[selectedURL]++
+	return selectedURL, nil
+}
+
+func (b *LatencyAware) ReleaseWorker(workerURL url.URL, l *lambda.Lambda, outcome Outcome) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.inFlight[workerURL] > 0 {
+		b.inFlight[workerURL]--
+	}
+
+	latency := outcome.Latency
+	if outcome.Failed() && latency < b.options.ErrorPenalty {
+		latency = b.options.ErrorPenalty
+	}
+	if latency <= 0 || FindUrlInSlice(b.workerUrls, workerURL) == -1 {
+		return
+	}
+
+	now := b.now()
+	sample := float64(latency)
+	b.getEWMA(b.workerRTT, workerURL).observe(sample, now, b.options.Decay)
+	if b.options.PerFunction {
+		key := functionWorker{l.ID(), workerURL}
+		rtt, ok := b.functionRTT[key]
+		if !ok {
+			rtt = &ewma{}
+			b.functionRTT[key] = rtt
+		}
+		rtt.observe(sample, now, b.options.Decay)
+	}
+}
+
+func (b *LatencyAware) getEWMA(averages map[url.URL]*ewma, workerURL url.URL) *ewma {
+	rtt, ok := averages[workerURL]
+	if !ok {
+		rtt = &ewma{}
+		averages[workerURL] = rtt
+	}
+	return rtt
+}
+
+// ExpectedLatencies returns the current moving average of the response time
+// of each worker.
+func (b *LatencyAware) ExpectedLatencies() map[string]time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	latencies := make(map[string]time.Duration)
+	for _, workerURL := range b.workerUrls {
+		if rtt, ok := b.workerRTT[workerURL]; ok {
+			latencies[workerURL.String()] = time.Duration(rtt.value)
+		}
+	}
+	return latencies
+}
+
+func (b *LatencyAware) AddWorker(workerURL url.URL) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.workerUrls = append(b.workerUrls, workerURL)
+}
+
+func (b *LatencyAware) RemoveWorker(targetURL url.URL) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	index := FindUrlInSlice(b.workerUrls, targetURL)
+	if index == -1 {
+		return
+	}
+	b.workerUrls = append(b.workerUrls[:index], b.workerUrls[index+1:]...)
+	delete(b.inFlight, targetURL)
+	delete(b.workerRTT, targetURL)
+	for key := range b.functionRTT {
+		if key.workerURL == targetURL {
+			delete(b.functionRTT, key)
+		}
+	}
+}
+
+func (b *LatencyAware) GetAllWorkers() []url.URL {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	workerUrls := make([]url.URL, len(b.workerUrls))
+	copy(workerUrls, b.workerUrls)
+	return workerUrls
+}
+
+func (b *LatencyAware) DestroySandbox(workerURL url.URL, l *lambda.Lambda) {
+}
+
+func (b *LatencyAware) SetPlacement(placement *Placement) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.placement = placement
+}
+
+func (b *LatencyAware) SetClock(now func() time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.now = now
+}
+
+func NewLatencyAware(workerUrls []url.URL, options LatencyOptions) Balancer {
+	if options.Decay <= 0 {
+		options.Decay = defaultLatencyDecay
+	}
+	if options.ErrorPenalty <= 0 {
+		options.ErrorPenalty = defaultLatencyErrorPenalty
+	}
+	if options.DefaultRTT <= 0 {
+		options.DefaultRTT = defaultLatencyDefaultRTT
+	}
+
+	return &LatencyAware{
+		workerUrls:  workerUrls,
+		options:     options,
+		inFlight:    make(map[url.URL]uint),
+		workerRTT:   make(map[url.URL]*ewma),
+		functionRTT: make(map[functionWorker]*ewma),
+		now:         time.Now,
+		mutex:       &sync.Mutex{},
+	}
+}
+
+func NewLatencyAwareFromJSONSlice(jsonSlice []string) Balancer {
+	return NewLatencyAware(CreateWorkerURLSlice(jsonSlice), LatencyOptions{})
+}
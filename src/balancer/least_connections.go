@@ -14,6 +14,7 @@ type LeastConnections struct {
 	workerUrls    []url.URL
 	connectionMap map[url.URL]uint
 	mutex         *sync.Mutex
+	placement     *Placement
 }
 
 func (b *LeastConnections) getWorkerLoad(workerUrl url.URL) uint {
@@ -39,12 +40,17 @@ func (b *LeastConnections) SelectWorker(r *http.Request, l *lambda.Lambda) (url.
 	if len(workerUrls) == 0 {
 		return url.URL{}, httputil.New500Error("Can't select worker, Workers empty")
 	}
+	workerUrls, err := b.placement.Filter(workerUrls, l)
+	if err != nil {
+		return url.URL{}, err
+	}
+	workerUrls = b.placement.Localize(workerUrls, b.getWorkerLoad)
 
 	leastConnectionsUrl := workerUrls[0]
 	leastConnections := b.getWorkerLoad(leastConnectionsUrl)
 	tiedWorkers := []url.URL{leastConnectionsUrl}
 
-	for _, workerUrl := range b.workerUrls[1:] {
+	for _, workerUrl := range workerUrls[1:] {
 		tempConnections := b.getWorkerLoad(workerUrl)
 		if tempConnections < leastConnections {
 			leastConnectionsUrl = workerUrl
@@ -65,7 +71,7 @@ func (b *LeastConnections) SelectWorker(r *http.Request, l *lambda.Lambda) (url.
 	return leastConnectionsUrl, nil
 }
 
-func (b *LeastConnections) ReleaseWorker(workerURL url.URL, l *lambda.Lambda) {
+func (b *LeastConnections) ReleaseWorker(workerURL url.URL, l *lambda.Lambda, outcome Outcome) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
@@ -91,8 +97,15 @@ func (b *LeastConnections) RemoveWorker(targetURL url.URL) {
 	b.workerUrls = append(source[:targetIndex], source[targetIndex+1:]...)
 }
 
+func (b *LeastConnections) SetPlacement(placement *Placement) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.placement = placement
+}
+
 func NewLeastConnections(workerUrls []url.URL) Balancer {
-	leastConnections := &LeastConnections{workerUrls, make(map[url.URL]uint), &sync.Mutex{}}
+	leastConnections := &LeastConnections{workerUrls, make(map[url.URL]uint), &sync.Mutex{}, nil}
 
 	for _, workerURL := range workerUrls {
 		leastConnections.connectionMap[workerURL] = 0
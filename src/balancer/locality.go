@@ -0,0 +1,121 @@
+package balancer
+
+import (
+	"net/url"
+	"sync"
+)
+
+const defaultZoneLabel = "zone"
+
+// LocalityOptions configures zone-aware routing. Workers are assigned to
+// zones by a label, so they have to be labeled with their zone.
+type LocalityOptions struct {
+	// Zone of the scheduler. Empty disables zone-aware routing.
+	Zone string
+	// ZoneLabel is the worker label holding the zone. Defaults to "zone".
+	ZoneLabel string
+	// SpilloverLoad is the number of in-flight requests at which a
+	// same-zone worker is considered busy, so that requests spill over to
+	// other zones. Zero means requests only spill over if there is no
+	// same-zone worker or warm sandbox.
+	SpilloverLoad uint
+}
+
+// ZoneStats counts the requests routed to workers in the scheduler's zone
+// and to other zones.
+type ZoneStats struct {
+	Zone      string            `json:"zone"`
+	SameZone  uint64            `json:"same_zone"`
+	CrossZone uint64            `json:"cross_zone"`
+	ByZone    map[string]uint64 `json:"by_zone"`
+}
+
+type zoneCounter struct {
+	stats ZoneStats
+	mutex sync.Mutex
+}
+
+func (p *Placement) zoneOf(workerURL url.URL) string {
+	return p.labels[workerURL][p.locality.ZoneLabel]
+}
+
+func (p *Placement) zoned() bool {
+	return p != nil && p.locality.Zone != ""
+}
+
+// Local reports whether the worker is in the scheduler's zone, which all
+// workers are without zone-aware routing.
+func (p *Placement) Local(workerURL url.URL) bool {
+	if !p.zoned() {
+		return true
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.zoneOf(workerURL) == p.locality.Zone
+}
+
+// Busy reports whether a same-zone worker with this load should be passed
+// over for a less loaded worker in another zone.
+func (p *Placement) Busy(load uint) bool {
+	return p.zoned() && p.locality.SpilloverLoad > 0 && load >= p.locality.SpilloverLoad
+}
+
+// Localize narrows the candidates down to the ones in the scheduler's zone,
+// unless there are none or all of them are busy.
+func (p *Placement) Localize(candidates []url.URL, load func(url.URL) uint) []url.URL {
+	if !p.zoned() {
+		return candidates
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	local := make([]url.URL, 0, len(candidates))
+	busy := true
+	for _, workerURL := range candidates {
+		if p.zoneOf(workerURL) == p.locality.Zone {
+			local = append(local, workerURL)
+			busy = busy && p.Busy(load(workerURL))
+		}
+	}
+	if len(local) == 0 || busy {
+		return candidates
+	}
+	return local
+}
+
+// RecordRoute counts a request routed to the worker.
+func (p *Placement) RecordRoute(workerURL url.URL) {
+	if !p.zoned() {
+		return
+	}
+
+	p.mutex.RLock()
+	zone := p.zoneOf(workerURL)
+	p.mutex.RUnlock()
+
+	p.routes.mutex.Lock()
+	defer p.routes.mutex.Unlock()
+
+	if zone == p.locality.Zone {
+		p.routes.stats.SameZone++
+	} else {
+		p.routes.stats.CrossZone++
+	}
+	p.routes.stats.ByZone[zone]++
+}
+
+// ZoneStats returns the requests routed per zone.
+func (p *Placement) ZoneStats() ZoneStats {
+	p.routes.mutex.Lock()
+	defer p.routes.mutex.Unlock()
+
+	stats := p.routes.stats
+	stats.ByZone = make(map[string]uint64, len(p.routes.stats.ByZone))
+	for zone, count := range p.routes.stats.ByZone {
+		stats.ByZone[zone] = count
+	}
+	return stats
+}
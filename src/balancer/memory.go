@@ -0,0 +1,169 @@
+package balancer
+
+import (
+	"log"
+	"net/url"
+)
+
+const defaultFunctionMemoryMB = 512
+
+// MemoryOptions configures memory-aware placement. Budgets correspond to the
+// Mem_pool_mb of the OpenLambda workers, footprints to the memory limit of
+// the function sandboxes.
+type MemoryOptions struct {
+	// WorkerBudgetMB is the memory available for sandboxes on each worker.
+	WorkerBudgetMB uint64
+	// WorkerBudgetsMB overrides WorkerBudgetMB for single workers, keyed by
+	// worker URL.
+	WorkerBudgetsMB map[string]uint64
+	// DefaultFunctionMB is the footprint of functions without a profile.
+	// Defaults to 512, the sandbox memory limit of OpenLambda.
+	DefaultFunctionMB uint64
+	// FunctionMB holds the footprint of single functions by function ID.
+	FunctionMB map[string]uint64
+}
+
+// MemoryAware is implemented by balancers that account for the memory
+// committed to warm and running sandboxes on each worker.
+type MemoryAware interface {
+	SetFunctionMemory(functionType string, memoryMB uint64)
+	MemoryUsage() map[string]WorkerMemory
+}
+
+// WorkerMemory is the estimated memory committed on a worker.
+type WorkerMemory struct {
+	CommittedMB uint64 `json:"committed_mb"`
+	BudgetMB    uint64 `json:"budget_mb"`
+}
+
+type memoryTracker struct {
+	options    MemoryOptions
+	functionMB map[string]uint64
+	committed  map[url.URL]uint64
+}
+
+func (m *memoryTracker) footprint(functionType string) uint64 {
+	if memoryMB, ok := m.functionMB[functionType]; ok {
+		return memoryMB
+	}
+	return m.options.DefaultFunctionMB
+}
+
+func (m *memoryTracker) budget(workerURL url.URL) uint64 {
+	if budget, ok := m.options.WorkerBudgetsMB[workerURL.String()]; ok {
+		return budget
+	}
+	return m.options.WorkerBudgetMB
+}
+
+func (m *memoryTracker) fits(workerURL url.URL, memoryMB uint64) bool {
+	budget := m.budget(workerURL)
+	return budget == 0 || m.committed[workerURL]+memoryMB <= budget
+}
+
+// filterWorkers returns the workers that can fit another sandbox of the
+// function. If none can, the workers with the least committed memory are
+// returned, as that is where the worker has to evict the fewest sandboxes.
+func (m *memoryTracker) filterWorkers(workerUrls []url.URL, functionType string) []url.URL {
+	memoryMB := m.footprint(functionType)
+
+	fitting := make([]url.URL, 0, len(workerUrls))
+	for _, workerURL := range workerUrls {
+		if m.fits(workerURL, memoryMB) {
+			fitting = append(fitting, workerURL)
+		}
+	}
+	if len(fitting) > 0 {
+		return fitting
+	}
+
+	log.Printf("No worker has %d MB left for %s, placing on the least committed worker", memoryMB, functionType)
+	leastCommitted := []url.URL{workerUrls[0]}
+	for _, workerURL := range workerUrls[1:] {
+		committed := m.committed[workerURL]
+		if committed < m.committed[leastCommitted[0]] {
+			leastCommitted = []url.URL{workerURL}
+		} else if committed == m.committed[leastCommitted[0]] {
+			leastCommitted = append(leastCommitted, workerURL)
+		}
+	}
+	return leastCommitted
+}
+
+func (m *memoryTracker) commit(workerURL url.URL, memoryMB uint64) {
+	m.committed[workerURL] += memoryMB
+}
+
+func (m *memoryTracker) release(workerURL url.URL, memoryMB uint64) {
+	committed, ok := m.committed[workerURL]
+	if !ok {
+		return
+	}
+	if committed < memoryMB {
+		m.committed[workerURL] = 0
+		return
+	}
+	m.committed[workerURL] -= memoryMB
+}
+
+func (m *memoryTracker) removeWorker(workerURL url.URL) {
+	delete(m.committed, workerURL)
+}
+
+func newMemoryTracker(options MemoryOptions) *memoryTracker {
+	if options.DefaultFunctionMB == 0 {
+		options.DefaultFunctionMB = defaultFunctionMemoryMB
+	}
+
+	functionMB := make(map[string]uint64, len(options.FunctionMB))
+	for functionType, memoryMB := range options.FunctionMB {
+		functionMB[functionType] = memoryMB
+	}
+
+	return &memoryTracker{
+		options:    options,
+		functionMB: functionMB,
+		committed:  make(map[url.URL]uint64),
+	}
+}
+
+// releaseMemory frees the memory of a sandbox whose idle-queue entry was
+// removed because the sandbox is gone.
+func (b *PullBased) releaseMemory(item *Item) {
+	if b.memory != nil {
+		b.memory.release(item.url, item.memoryMB)
+	}
+}
+
+// SetFunctionMemory updates the memory footprint of a function, e.g. as
+// measured and reported by the workers.
+func (b *PullBased) SetFunctionMemory(functionType string, memoryMB uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.memory != nil {
+		b.memory.functionMB[functionType] = memoryMB
+	}
+}
+
+func (b *PullBased) MemoryUsage() map[string]WorkerMemory {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	usage := make(map[string]WorkerMemory)
+	if b.memory == nil {
+		return usage
+	}
+	for _, workerURL := range b.workerUrls {
+		usage[workerURL.String()] = WorkerMemory{
+			CommittedMB: b.memory.committed[workerURL],
+			BudgetMB:    b.memory.budget(workerURL),
+		}
+	}
+	return usage
+}
+
+func NewMemoryAware(workerUrls []url.URL, options PullBasedOptions, memory MemoryOptions) Balancer {
+	options.Memory = &memory
+	return NewPullBasedWithOptions(workerUrls, options)
+}
@@ -0,0 +1,168 @@
+package balancer
+
+import (
+	"net/url"
+	"sort"
+)
+
+const defaultPackageLoadSlack = 2
+
+// PackageOptions configures package-affinity placement. Cold starts are much
+// cheaper on workers that already have a function's packages installed by
+// the OpenLambda package puller.
+type PackageOptions struct {
+	// FunctionPackages holds the pip packages each function imports, by
+	// function ID.
+	FunctionPackages map[string][]string
+	// WorkerPackages holds packages known to be installed on workers, keyed
+	// by worker URL.
+	WorkerPackages map[string][]string
+	// LoadSlack is how many more in-flight requests than the least loaded
+	// worker a worker may have to still be preferred for its packages.
+	// Defaults to 2.
+	LoadSlack uint
+}
+
+// PackageAware is implemented by balancers that place cold starts by the
+// packages installed on the workers.
+type PackageAware interface {
+	SetFunctionPackages(functionType string, packages []string)
+	SetWorkerPackages(workerURL url.URL, packages []string)
+	WorkerPackages() map[string][]string
+}
+
+type packageTracker struct {
+	loadSlack        uint
+	functionPackages map[string][]string
+	workerPackages   map[url.URL]map[string]bool
+}
+
+func (p *packageTracker) overlap(workerURL url.URL, functionType string) int {
+	installed := p.workerPackages[workerURL]
+	total := 0
+	for _, pkg := range p.functionPackages[functionType] {
+		if installed[pkg] {
+			total++
+		}
+	}
+	return total
+}
+
+// preferWorkers narrows the candidates down to the workers with the greatest
+// package overlap among those not much busier than the least loaded one.
+func (p *packageTracker) preferWorkers(candidates []url.URL, functionType string, load func(url.URL) uint) []url.URL {
+	if len(p.functionPackages[functionType]) == 0 {
+		return candidates
+	}
+
+	minLoad := load(candidates[0])
+	for _, workerURL := range candidates[1:] {
+		if workerLoad := load(workerURL); workerLoad < minLoad {
+			minLoad = workerLoad
+		}
+	}
+
+	bestOverlap := -1
+	var preferred []url.URL
+	for _, workerURL := range candidates {
+		if load(workerURL) > minLoad+p.loadSlack {
+			continue
+		}
+		workerOverlap := p.overlap(workerURL, functionType)
+		if workerOverlap > bestOverlap {
+			bestOverlap = workerOverlap
+			preferred = []url.URL{workerURL}
+		} else if workerOverlap == bestOverlap {
+			preferred = append(preferred, workerURL)
+		}
+	}
+	return preferred
+}
+
+// installed records that a worker pulled the packages of a function for a
+// cold start.
+func (p *packageTracker) installed(workerURL url.URL, functionType string) {
+	p.addWorkerPackages(workerURL, p.functionPackages[functionType])
+}
+
+func (p *packageTracker) addWorkerPackages(workerURL url.URL, packages []string) {
+	installed, ok := p.workerPackages[workerURL]
+	if !ok {
+		installed = make(map[string]bool)
+		p.workerPackages[workerURL] = installed
+	}
+	for _, pkg := range packages {
+		installed[pkg] = true
+	}
+}
+
+func newPackageTracker(options PackageOptions) *packageTracker {
+	loadSlack := options.LoadSlack
+	if loadSlack == 0 {
+		loadSlack = defaultPackageLoadSlack
+	}
+
+	tracker := &packageTracker{
+		loadSlack:        loadSlack,
+		functionPackages: make(map[string][]string),
+		workerPackages:   make(map[url.URL]map[string]bool),
+	}
+	for functionType, packages := range options.FunctionPackages {
+		tracker.functionPackages[functionType] = packages
+	}
+	for _, workerURL := range CreateWorkerURLSlice(mapKeys(options.WorkerPackages)) {
+		tracker.addWorkerPackages(workerURL, options.WorkerPackages[workerURL.String()])
+	}
+	return tracker
+}
+
+func mapKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (b *PullBased) SetFunctionPackages(functionType string, packages []string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.packages != nil {
+		b.packages.functionPackages[functionType] = packages
+	}
+}
+
+// SetWorkerPackages records packages a worker reported as installed.
+func (b *PullBased) SetWorkerPackages(workerURL url.URL, packages []string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.packages != nil {
+		b.packages.addWorkerPackages(workerURL, packages)
+	}
+}
+
+func (b *PullBased) WorkerPackages() map[string][]string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	result := make(map[string][]string)
+	if b.packages == nil {
+		return result
+	}
+	for workerURL, installed := range b.packages.workerPackages {
+		packages := make([]string, 0, len(installed))
+		for pkg := range installed {
+			packages = append(packages, pkg)
+		}
+		sort.Strings(packages)
+		result[workerURL.String()] = packages
+	}
+	return result
+}
+
+func NewPackageAffinity(workerUrls []url.URL, options PullBasedOptions, packages PackageOptions) Balancer {
+	options.Packages = &packages
+	return NewPullBasedWithOptions(workerUrls, options)
+}
@@ -0,0 +1,234 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"hiku/httputil"
+	"hiku/lambda"
+)
+
+// Constraint matches workers by one of their labels, e.g. pool=batch or
+// gpu!=true. Workers without the label have an empty value.
+type Constraint struct {
+	Key    string
+	Value  string
+	Negate bool
+}
+
+// ParseConstraint parses constraints of the form key=value or key!=value.
+func ParseConstraint(expression string) (Constraint, error) {
+	if key, value, ok := strings.Cut(expression, "!="); ok {
+		return Constraint{Key: strings.TrimSpace(key), Value: strings.TrimSpace(value), Negate: true}, validConstraint(expression, key)
+	}
+	if key, value, ok := strings.Cut(expression, "="); ok {
+		return Constraint{Key: strings.TrimSpace(key), Value: strings.TrimSpace(value)}, validConstraint(expression, key)
+	}
+	return Constraint{}, fmt.Errorf("constraint %q is not of the form key=value or key!=value", expression)
+}
+
+func validConstraint(expression string, key string) error {
+	if strings.TrimSpace(key) == "" {
+		return fmt.Errorf("constraint %q has no label", expression)
+	}
+	return nil
+}
+
+// UnmarshalText parses constraints in JSON configs and requests.
+func (c *Constraint) UnmarshalText(text []byte) error {
+	constraint, err := ParseConstraint(string(text))
+	if err != nil {
+		return err
+	}
+	*c = constraint
+	return nil
+}
+
+func (c Constraint) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c Constraint) String() string {
+	if c.Negate {
+		return c.Key + "!=" + c.Value
+	}
+	return c.Key + "=" + c.Value
+}
+
+func (c Constraint) matches(labels map[string]string) bool {
+	return (labels[c.Key] == c.Value) != c.Negate
+}
+
+// FunctionPlacement holds where a function may and should run. All
+// constraints must match a worker, preferences only narrow the workers
+// down if any of them matches all preferences.
+type FunctionPlacement struct {
+	Constraints []Constraint `json:"constraints,omitempty"`
+	Preferences []Constraint `json:"preferences,omitempty"`
+}
+
+// PlacementOptions configures the labels of workers and the placement of
+// functions.
+type PlacementOptions struct {
+	// WorkerLabels holds the labels of workers, keyed by worker URL.
+	WorkerLabels map[string]map[string]string
+	// Functions holds the placement of single functions by function ID,
+	// i.e. <namespace>__<name> for functions of tenants.
+	Functions map[string]FunctionPlacement
+	Locality  LocalityOptions
+}
+
+// Constrained is implemented by balancers that filter their workers
+// through a placement before selecting one.
+type Constrained interface {
+	SetPlacement(placement *Placement)
+}
+
+// Placement is the constraint layer shared by all balancers. It narrows the
+// candidate workers of a function down to the ones its constraints and
+// preferences allow. A nil Placement allows every worker.
+type Placement struct {
+	labels    map[url.URL]map[string]string
+	functions map[string]FunctionPlacement
+	locality  LocalityOptions
+	routes    zoneCounter
+	mutex     sync.RWMutex
+}
+
+func allMatch(constraints []Constraint, labels map[string]string) bool {
+	for _, constraint := range constraints {
+		if !constraint.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Allows reports whether the constraints of the function allow the worker.
+func (p *Placement) Allows(workerURL url.URL, l *lambda.Lambda) bool {
+	if p == nil {
+		return true
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return allMatch(p.functions[l.ID()].Constraints, p.labels[workerURL])
+}
+
+// Filter returns the candidates that satisfy the constraints of the
+// function, narrowed down to the preferred ones if there are any. It fails
+// with 503 if no candidate satisfies the constraints.
+func (p *Placement) Filter(candidates []url.URL, l *lambda.Lambda) ([]url.URL, *httputil.HttpError) {
+	if p == nil || len(candidates) == 0 {
+		return candidates, nil
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	function, ok := p.functions[l.ID()]
+	if !ok {
+		return candidates, nil
+	}
+
+	allowed := make([]url.URL, 0, len(candidates))
+	for _, workerURL := range candidates {
+		if allMatch(function.Constraints, p.labels[workerURL]) {
+			allowed = append(allowed, workerURL)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, &httputil.HttpError{
+			Code: http.StatusServiceUnavailable,
+			Msg:  fmt.Sprintf("No worker satisfies the constraints of %s", l.ID()),
+		}
+	}
+
+	preferred := make([]url.URL, 0, len(allowed))
+	for _, workerURL := range allowed {
+		if allMatch(function.Preferences, p.labels[workerURL]) {
+			preferred = append(preferred, workerURL)
+		}
+	}
+	if len(preferred) > 0 {
+		return preferred, nil
+	}
+	return allowed, nil
+}
+
+// SetWorkerLabels replaces the labels of a worker.
+func (p *Placement) SetWorkerLabels(workerURL url.URL, labels map[string]string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.labels[workerURL] = labels
+}
+
+// WorkerLabels returns the labels of each worker, keyed by worker URL.
+func (p *Placement) WorkerLabels() map[string]map[string]string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	result := make(map[string]map[string]string, len(p.labels))
+	for workerURL, labels := range p.labels {
+		result[workerURL.String()] = labels
+	}
+	return result
+}
+
+// SetFunctionPlacement replaces the placement of a function. A placement
+// without constraints and preferences removes it.
+func (p *Placement) SetFunctionPlacement(functionType string, placement FunctionPlacement) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(placement.Constraints) == 0 && len(placement.Preferences) == 0 {
+		delete(p.functions, functionType)
+		return
+	}
+	p.functions[functionType] = placement
+}
+
+// FunctionPlacements returns the placement of each function.
+func (p *Placement) FunctionPlacements() map[string]FunctionPlacement {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	result := make(map[string]FunctionPlacement, len(p.functions))
+	for functionType, placement := range p.functions {
+		result[functionType] = placement
+	}
+	return result
+}
+
+func NewPlacement(options PlacementOptions) *Placement {
+	if options.Locality.ZoneLabel == "" {
+		options.Locality.ZoneLabel = defaultZoneLabel
+	}
+
+	p := &Placement{
+		labels:    make(map[url.URL]map[string]string),
+		functions: make(map[string]FunctionPlacement),
+		locality:  options.Locality,
+	}
+	p.routes.stats = ZoneStats{Zone: options.Locality.Zone, ByZone: make(map[string]uint64)}
+	for _, workerURL := range CreateWorkerURLSlice(labelKeys(options.WorkerLabels)) {
+		p.labels[workerURL] = options.WorkerLabels[workerURL.String()]
+	}
+	for functionType, placement := range options.Functions {
+		p.SetFunctionPlacement(functionType, placement)
+	}
+	return p
+}
+
+func labelKeys(m map[string]map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
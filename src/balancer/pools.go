@@ -0,0 +1,214 @@
+package balancer
+
+import (
+	"net/http"
+	"net/url"
+
+	"hiku/httputil"
+	"hiku/lambda"
+)
+
+// Pools gives namespaces dedicated workers. The functions of a namespace
+// with a pool run on a balancer of its own, all others on the shared
+// balancer, so neither sandboxes nor load accounting are shared.
+type Pools struct {
+	shared  Balancer
+	pools   map[string]Balancer
+	members map[url.URL]Balancer
+}
+
+func (p *Pools) balancerOf(l *lambda.Lambda) Balancer {
+	if pool, ok := p.pools[l.Namespace]; ok {
+		return pool
+	}
+	return p.shared
+}
+
+func (p *Pools) balancerOfWorker(workerUrl url.URL) Balancer {
+	if pool, ok := p.members[workerUrl]; ok {
+		return pool
+	}
+	return p.shared
+}
+
+func (p *Pools) SelectWorker(r *http.Request, l *lambda.Lambda) (url.URL, *httputil.HttpError) {
+	return p.balancerOf(l).SelectWorker(r, l)
+}
+
+func (p *Pools) ReleaseWorker(workerUrl url.URL, l *lambda.Lambda, outcome Outcome) {
+	p.balancerOf(l).ReleaseWorker(workerUrl, l, outcome)
+}
+
+// AddWorker adds a worker to the pool it was configured in, or else to the
+// shared balancer.
+func (p *Pools) AddWorker(workerUrl url.URL) {
+	p.balancerOfWorker(workerUrl).AddWorker(workerUrl)
+}
+
+func (p *Pools) RemoveWorker(workerUrl url.URL) {
+	p.balancerOfWorker(workerUrl).RemoveWorker(workerUrl)
+}
+
+func (p *Pools) GetAllWorkers() []url.URL {
+	workers := p.shared.GetAllWorkers()
+	for _, pool := range p.pools {
+		workers = append(workers, pool.GetAllWorkers()...)
+	}
+	return workers
+}
+
+func (p *Pools) DestroySandbox(workerUrl url.URL, l *lambda.Lambda) {
+	p.balancerOf(l).DestroySandbox(workerUrl, l)
+}
+
+// SetPlacement shares the placement with the shared balancer and the pools.
+func (p *Pools) SetPlacement(placement *Placement) {
+	for _, b := range append([]Balancer{p.shared}, p.poolBalancers()...) {
+		if constrained, ok := b.(Constrained); ok {
+			constrained.SetPlacement(placement)
+		}
+	}
+}
+
+// IdleQueueStats merges the statistics of the balancers that keep idle
+// queues. Function IDs are namespaced, so they don't collide.
+func (p *Pools) IdleQueueStats() map[string]IdleQueueStats {
+	result := make(map[string]IdleQueueStats)
+	for _, b := range append([]Balancer{p.shared}, p.poolBalancers()...) {
+		if provider, ok := b.(IdleQueueStatsProvider); ok {
+			for functionType, stats := range provider.IdleQueueStats() {
+				result[functionType] = stats
+			}
+		}
+	}
+	return result
+}
+
+// SetFunctionMemory sets the footprint in the balancer the function runs
+// on.
+func (p *Pools) SetFunctionMemory(functionType string, memoryMB uint64) {
+	if memoryAware, ok := p.balancerOf(lambda.ParseID(functionType)).(MemoryAware); ok {
+		memoryAware.SetFunctionMemory(functionType, memoryMB)
+	}
+}
+
+// MemoryUsage merges the memory committed on the workers of all balancers.
+func (p *Pools) MemoryUsage() map[string]WorkerMemory {
+	result := make(map[string]WorkerMemory)
+	for _, b := range append([]Balancer{p.shared}, p.poolBalancers()...) {
+		if memoryAware, ok := b.(MemoryAware); ok {
+			for workerURL, memory := range memoryAware.MemoryUsage() {
+				result[workerURL] = memory
+			}
+		}
+	}
+	return result
+}
+
+// SetFunctionPackages sets the packages in the balancer the function runs
+// on.
+func (p *Pools) SetFunctionPackages(functionType string, packages []string) {
+	if packageAware, ok := p.balancerOf(lambda.ParseID(functionType)).(PackageAware); ok {
+		packageAware.SetFunctionPackages(functionType, packages)
+	}
+}
+
+// SetWorkerPackages sets the packages in the balancer the worker belongs
+// to.
+func (p *Pools) SetWorkerPackages(workerURL url.URL, packages []string) {
+	if packageAware, ok := p.balancerOfWorker(workerURL).(PackageAware); ok {
+		packageAware.SetWorkerPackages(workerURL, packages)
+	}
+}
+
+// WorkerPackages merges the packages known on the workers of all balancers.
+func (p *Pools) WorkerPackages() map[string][]string {
+	result := make(map[string][]string)
+	for _, b := range append([]Balancer{p.shared}, p.poolBalancers()...) {
+		if packageAware, ok := b.(PackageAware); ok {
+			for workerURL, packages := range packageAware.WorkerPackages() {
+				result[workerURL] = packages
+			}
+		}
+	}
+	return result
+}
+
+// Snapshot merges the snapshots of all balancers. Function IDs and workers
+// belong to a single balancer, so they don't collide.
+func (p *Pools) Snapshot() Snapshot {
+	snapshot := newSnapshot(nil)
+	for _, b := range append([]Balancer{p.shared}, p.poolBalancers()...) {
+		snapshotter, ok := b.(Snapshotter)
+		if !ok {
+			continue
+		}
+		part := snapshotter.Snapshot()
+		snapshot.Workers = append(snapshot.Workers, part.Workers...)
+		snapshot.Functions = mergeInto(snapshot.Functions, part.Functions)
+		snapshot.WorkerPackages = mergeInto(snapshot.WorkerPackages, part.WorkerPackages)
+		snapshot.WorkerLatencies = mergeInto(snapshot.WorkerLatencies, part.WorkerLatencies)
+	}
+	return snapshot
+}
+
+// Restore passes each balancer the functions that run on it. The state of
+// workers is restored by the balancer that has them.
+func (p *Pools) Restore(snapshot Snapshot) {
+	parts := make(map[Balancer]Snapshot)
+	for _, b := range append([]Balancer{p.shared}, p.poolBalancers()...) {
+		part := snapshot
+		part.Functions = make(map[string]FunctionSnapshot)
+		parts[b] = part
+	}
+	for functionType, function := range snapshot.Functions {
+		parts[p.balancerOf(lambda.ParseID(functionType))].Functions[functionType] = function
+	}
+	for b, part := range parts {
+		if snapshotter, ok := b.(Snapshotter); ok {
+			snapshotter.Restore(part)
+		}
+	}
+}
+
+func mergeInto[V any](into map[string]V, from map[string]V) map[string]V {
+	if len(from) == 0 {
+		return into
+	}
+	if into == nil {
+		into = make(map[string]V, len(from))
+	}
+	for key, value := range from {
+		into[key] = value
+	}
+	return into
+}
+
+// Close stops the background work of the shared balancer and the pools.
+func (p *Pools) Close() {
+	for _, b := range append([]Balancer{p.shared}, p.poolBalancers()...) {
+		if closer, ok := b.(interface{ Close() }); ok {
+			closer.Close()
+		}
+	}
+}
+
+func (p *Pools) poolBalancers() []Balancer {
+	balancers := make([]Balancer, 0, len(p.pools))
+	for _, pool := range p.pools {
+		balancers = append(balancers, pool)
+	}
+	return balancers
+}
+
+// NewPools creates the balancer from the shared one and the dedicated pools
+// by namespace, with the workers they were created with.
+func NewPools(shared Balancer, pools map[string]Balancer) *Pools {
+	members := make(map[url.URL]Balancer)
+	for _, pool := range pools {
+		for _, workerUrl := range pool.GetAllWorkers() {
+			members[workerUrl] = pool
+		}
+	}
+	return &Pools{shared: shared, pools: pools, members: members}
+}
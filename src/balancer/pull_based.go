@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	"hiku/httputil"
 	"hiku/lambda"
@@ -19,9 +20,11 @@ type IdleQueue struct {
 type PriorityQueue []*Item
 
 type Item struct {
-	url   url.URL
-	load  uint
-	index int
+	url       url.URL
+	load      uint
+	index     int
+	idleSince time.Time
+	memoryMB  uint64
 }
 
 func (pq *PriorityQueue) Len() int { return len(*pq) }
@@ -58,11 +61,41 @@ func (pq *PriorityQueue) Update(item *Item, newLoad uint) {
 	heap.Fix(pq, item.index)
 }
 
+// PullBasedOptions tunes the optional behavior of the pull-based balancer.
+// The zero value disables all of it.
+type PullBasedOptions struct {
+	// IdleTTL is how long an idle-queue entry is assumed to be warm. It should
+	// match the keep-alive policy of the workers. Zero means entries never expire.
+	IdleTTL time.Duration
+	// FunctionIdleTTLs overrides IdleTTL for single functions.
+	FunctionIdleTTLs map[string]time.Duration
+	// SweepInterval is how often expired entries are removed in the
+	// background. Defaults to 10 seconds if any TTL is set.
+	SweepInterval time.Duration
+	// Memory enables memory-aware cold placement if set.
+	Memory *MemoryOptions
+	// Packages enables package-affinity cold placement if set.
+	Packages *PackageOptions
+	// ColdStartHashing places cold starts by consistent hashing with
+	// bounded loads on the function instead of on the least loaded worker.
+	ColdStartHashing bool
+}
+
 type PullBased struct {
 	workerUrls []url.URL
 	idleQueues map[string]*IdleQueue
 	loadMap    map[url.URL]uint
 	mutex      *sync.Mutex
+
+	options   PullBasedOptions
+	memory    *memoryTracker
+	packages  *packageTracker
+	hashing   *coldStartRing
+	placement *Placement
+	idleStats map[string]*IdleQueueStats
+	now       func() time.Time
+	stopSweep chan struct{}
+	stopOnce  sync.Once
 }
 
 func (b *PullBased) getWorkerLoad(workerUrl url.URL) uint {
@@ -102,31 +135,112 @@ func (b *PullBased) SelectWorker(r *http.Request, l *lambda.Lambda) (url.URL, *h
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	queue := b.getIdleQueue(l.Name)
+	queue := b.getIdleQueue(l.ID())
+	stats := b.getIdleStats(l.ID())
+	now := b.now()
+
+	// The least loaded sandbox in another zone, and the ones passed over
+	// for it that go back into the queue
+	var remote *Item
+	var skipped []*Item
+	hit := func(item *Item) (url.URL, *httputil.HttpError) {
+		for _, skippedItem := range skipped {
+			heap.Push(queue, skippedItem)
+		}
+		stats.Hits++
+		b.incrementWorkerLoad(item.url)
+		return item.url, nil
+	}
+
 	for queue.Len() > 0 {
 		item := heap.Pop(queue).(*Item)
 		workerURL := item.url
 
-		if FindUrlInSlice(b.workerUrls, workerURL) != -1 {
-			b.incrementWorkerLoad(workerURL)
-			return workerURL, nil
+		// Lazy expiry, the sandbox has most likely been evicted by now
+		if b.isExpired(l.ID(), item, now) {
+			stats.Expired++
+			b.releaseMemory(item)
+			continue
 		}
+
+		// Sandboxes on workers the function may no longer run on are dropped
+		if FindUrlInSlice(b.workerUrls, workerURL) == -1 || !b.placement.Allows(workerURL, l) {
+			b.releaseMemory(item)
+			continue
+		}
+
+		if !b.placement.Local(workerURL) {
+			if remote == nil {
+				remote = item
+			} else {
+				skipped = append(skipped, item)
+			}
+			continue
+		}
+
+		// A busy same-zone sandbox spills over to a less loaded one in
+		// another zone, which the queue returned first
+		if remote != nil && b.placement.Busy(item.load) {
+			skipped = append(skipped, item)
+			break
+		}
+		if remote != nil {
+			skipped = append(skipped, remote)
+		}
+		return hit(item)
+	}
+
+	if remote != nil {
+		return hit(remote)
 	}
 
-	return b.selectLeastLoadedWorker()
+	stats.Misses++
+	return b.selectLeastLoadedWorker(l)
 }
 
-func (b *PullBased) selectLeastLoadedWorker() (url.URL, *httputil.HttpError) {
+func (b *PullBased) selectLeastLoadedWorker(l *lambda.Lambda) (url.URL, *httputil.HttpError) {
 	workerUrls := b.workerUrls
 	if len(workerUrls) == 0 {
 		return url.URL{}, httputil.New500Error("Can't select worker, Workers empty")
 	}
+	workerUrls, err := b.placement.Filter(workerUrls, l)
+	if err != nil {
+		return url.URL{}, err
+	}
+	workerUrls = b.placement.Localize(workerUrls, b.getWorkerLoad)
+
+	if b.memory != nil {
+		workerUrls = b.memory.filterWorkers(workerUrls, l.ID())
+	}
+	if b.packages != nil {
+		workerUrls = b.packages.preferWorkers(workerUrls, l.ID(), b.getWorkerLoad)
+	}
+
+	var selectedUrl url.URL
+	if b.hashing != nil {
+		selectedUrl = b.hashing.selectWorker(workerUrls, l.ID(), b.getWorkerLoad)
+	} else {
+		selectedUrl = b.leastLoadedWorker(workerUrls)
+	}
+	if b.memory != nil {
+		b.memory.commit(selectedUrl, b.memory.footprint(l.ID()))
+	}
+	if b.packages != nil {
+		b.packages.installed(selectedUrl, l.ID())
+	}
 
-	leastConnectionsUrl := workerUrls[0]
+	b.incrementWorkerLoad(selectedUrl)
+	return selectedUrl, nil
+}
+
+// leastLoadedWorker returns the worker with the lowest load among the
+// non-empty candidates, breaking ties randomly.
+func (b *PullBased) leastLoadedWorker(candidates []url.URL) url.URL {
+	leastConnectionsUrl := candidates[0]
 	leastConnections := b.getWorkerLoad(leastConnectionsUrl)
 	tiedWorkers := []url.URL{leastConnectionsUrl}
 
-	for _, workerUrl := range b.workerUrls[1:] {
+	for _, workerUrl := range candidates[1:] {
 		tempConnections := b.getWorkerLoad(workerUrl)
 		if tempConnections < leastConnections {
 			leastConnectionsUrl = workerUrl
@@ -143,20 +257,23 @@ func (b *PullBased) selectLeastLoadedWorker() (url.URL, *httputil.HttpError) {
 		leastConnectionsUrl = tiedWorkers[randomIndex]
 	}
 
-	b.incrementWorkerLoad(leastConnectionsUrl)
-	return leastConnectionsUrl, nil
+	return leastConnectionsUrl
 }
 
-func (b *PullBased) ReleaseWorker(workerURL url.URL, l *lambda.Lambda) {
+func (b *PullBased) ReleaseWorker(workerURL url.URL, l *lambda.Lambda, outcome Outcome) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
 	b.decrementWorkerLoad(workerURL)
 
-	idleQueue := b.getIdleQueue(l.Name)
+	idleQueue := b.getIdleQueue(l.ID())
 	item := &Item{
-		url:  workerURL,
-		load: b.getWorkerLoad(workerURL),
+		url:       workerURL,
+		load:      b.getWorkerLoad(workerURL),
+		idleSince: b.now(),
+	}
+	if b.memory != nil {
+		item.memoryMB = b.memory.footprint(l.ID())
 	}
 	heap.Push(idleQueue, item)
 }
@@ -165,10 +282,16 @@ func (b *PullBased) DestroySandbox(workerUrl url.URL, l *lambda.Lambda) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	idleQueue := b.getIdleQueue(l.Name)
+	idleQueue := b.getIdleQueue(l.ID())
 	for i, item := range *idleQueue {
 		if item.url.Host == workerUrl.Host {
 			heap.Remove(idleQueue, i)
+
+			// The worker evicted a sandbox we still expected to be warm
+			stats := b.getIdleStats(l.ID())
+			stats.Evicted++
+			stats.evictedIdleTime += b.now().Sub(item.idleSince)
+			b.releaseMemory(item)
 			break
 		}
 	}
@@ -211,20 +334,62 @@ func (b *PullBased) RemoveWorker(targetURL url.URL) {
 	index := FindUrlInSlice(b.workerUrls, targetURL)
 	b.workerUrls = append(b.workerUrls[:index], b.workerUrls[index+1:]...)
 	delete(b.loadMap, targetURL)
+	if b.memory != nil {
+		b.memory.removeWorker(targetURL)
+	}
+	if b.packages != nil {
+		delete(b.packages.workerPackages, targetURL)
+	}
+}
+
+func (b *PullBased) SetPlacement(placement *Placement) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.placement = placement
+}
+
+func (b *PullBased) SetClock(now func() time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.now = now
 }
 
 func NewPullBased(workerUrls []url.URL) Balancer {
+	return NewPullBasedWithOptions(workerUrls, PullBasedOptions{})
+}
+
+func NewPullBasedWithOptions(workerUrls []url.URL, options PullBasedOptions) Balancer {
 	pullBased := &PullBased{
 		workerUrls: workerUrls,
 		idleQueues: make(map[string]*IdleQueue),
 		loadMap:    make(map[url.URL]uint),
 		mutex:      &sync.Mutex{},
+		options:    options,
+		idleStats:  make(map[string]*IdleQueueStats),
+		now:        time.Now,
+		stopSweep:  make(chan struct{}),
 	}
 
 	for _, workerURL := range workerUrls {
 		pullBased.loadMap[workerURL] = 0
 	}
 
+	if options.Memory != nil {
+		pullBased.memory = newMemoryTracker(*options.Memory)
+	}
+	if options.Packages != nil {
+		pullBased.packages = newPackageTracker(*options.Packages)
+	}
+	if options.ColdStartHashing {
+		pullBased.hashing = newColdStartRing()
+	}
+
+	if options.hasIdleTTL() {
+		go pullBased.sweepIdleQueues()
+	}
+
 	return pullBased
 }
 
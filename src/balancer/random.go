@@ -13,6 +13,7 @@ import (
 type Random struct {
 	workerUrls []url.URL
 	rng        *rand.Rand
+	placement  *Placement
 }
 
 func (b *Random) SelectWorker(r *http.Request, l *lambda.Lambda) (url.URL, *httputil.HttpError) {
@@ -22,6 +23,13 @@ func (b *Random) SelectWorker(r *http.Request, l *lambda.Lambda) (url.URL, *http
 		return url.URL{}, httputil.New500Error("Can't select worker, Workers empty")
 	}
 
+	workerUrls, err := b.placement.Filter(workerUrls, l)
+	if err != nil {
+		return url.URL{}, err
+	}
+	workerUrls = b.placement.Localize(workerUrls, func(url.URL) uint { return 0 })
+	totalWorkers = len(workerUrls)
+
 	randomIndex := rand.Intn(totalWorkers)
 	return workerUrls[randomIndex], nil
 }
@@ -30,7 +38,7 @@ func (b *Random) AddWorker(workerURL url.URL) {
 	b.workerUrls = append(b.workerUrls, workerURL)
 }
 
-func (b *Random) ReleaseWorker(workerURL url.URL, l *lambda.Lambda) {
+func (b *Random) ReleaseWorker(workerURL url.URL, l *lambda.Lambda, outcome Outcome) {
 }
 
 func (b *Random) RemoveWorker(targetURL url.URL) {
@@ -49,6 +57,10 @@ func (b *Random) GetAllWorkers() []url.URL {
 	return dest
 }
 
+func (b *Random) SetPlacement(placement *Placement) {
+	b.placement = placement
+}
+
 func (b *Random) DestroySandbox(workerURL url.URL, l *lambda.Lambda) {
 
 }
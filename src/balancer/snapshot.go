@@ -0,0 +1,195 @@
+package balancer
+
+import (
+	"container/heap"
+	"net/url"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format written by this
+// scheduler. Newer versions only add fields, so snapshots of any version
+// can be restored as far as their fields are known.
+const SnapshotVersion = 1
+
+// Snapshot is the learned state of a balancer, kept across restarts so that
+// a restarted scheduler doesn't start cold.
+type Snapshot struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Workers []string  `json:"workers"`
+	// Functions holds the idle queues and statistics by function ID
+	Functions       map[string]FunctionSnapshot `json:"functions,omitempty"`
+	WorkerPackages  map[string][]string         `json:"worker_packages,omitempty"`
+	WorkerLatencies map[string]time.Duration    `json:"worker_latencies,omitempty"`
+}
+
+// FunctionSnapshot holds the idle-queue entries and statistics of a
+// function.
+type FunctionSnapshot struct {
+	IdleQueueStats
+	EvictedIdleTime time.Duration `json:"evicted_idle_time,omitempty"`
+	Idle            []IdleEntry   `json:"idle,omitempty"`
+}
+
+// IdleEntry is a sandbox expected to be warm on a worker.
+type IdleEntry struct {
+	Worker    string    `json:"worker"`
+	IdleSince time.Time `json:"idle_since"`
+	MemoryMB  uint64    `json:"memory_mb,omitempty"`
+}
+
+// Snapshotter is implemented by balancers whose state can be restored from
+// a snapshot. Restore only restores the state of workers the balancer
+// already has, so a worker removed before the restart, or one added to the
+// snapshot file, doesn't come back.
+type Snapshotter interface {
+	Snapshot() Snapshot
+	Restore(snapshot Snapshot)
+}
+
+func newSnapshot(workerUrls []url.URL) Snapshot {
+	workers := make([]string, len(workerUrls))
+	for i, workerURL := range workerUrls {
+		workers[i] = workerURL.String()
+	}
+	return Snapshot{Version: SnapshotVersion, Time: time.Now(), Workers: workers}
+}
+
+func (b *Random) Snapshot() Snapshot {
+	return newSnapshot(b.GetAllWorkers())
+}
+
+// Restore has nothing to restore, the random balancer only has workers.
+func (b *Random) Restore(snapshot Snapshot) {}
+
+func (b *LeastConnections) Snapshot() Snapshot {
+	return newSnapshot(b.GetAllWorkers())
+}
+
+// Restore has nothing to restore, connections are counted anew.
+func (b *LeastConnections) Restore(snapshot Snapshot) {}
+
+func (b *ConsistentHashingBounded) Snapshot() Snapshot {
+	return newSnapshot(b.GetAllWorkers())
+}
+
+// Restore has nothing to restore, the ring follows from the workers.
+func (b *ConsistentHashingBounded) Restore(snapshot Snapshot) {}
+
+// Snapshot of the latency-aware balancer keeps the moving average of each
+// worker. Averages per function are learned again.
+func (b *LatencyAware) Snapshot() Snapshot {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	snapshot := newSnapshot(b.workerUrls)
+	snapshot.WorkerLatencies = make(map[string]time.Duration)
+	for _, workerURL := range b.workerUrls {
+		if rtt, ok := b.workerRTT[workerURL]; ok {
+			snapshot.WorkerLatencies[workerURL.String()] = time.Duration(rtt.value)
+		}
+	}
+	return snapshot
+}
+
+func (b *LatencyAware) Restore(snapshot Snapshot) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, workerURL := range CreateWorkerURLSlice(mapKeysOf(snapshot.WorkerLatencies)) {
+		if _, ok := b.workerRTT[workerURL]; !ok && FindUrlInSlice(b.workerUrls, workerURL) != -1 {
+			b.workerRTT[workerURL] = &ewma{
+				value:      float64(snapshot.WorkerLatencies[workerURL.String()]),
+				lastUpdate: snapshot.Time,
+			}
+		}
+	}
+}
+
+func mapKeysOf[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Snapshot of the pull-based balancer keeps the idle queues, their
+// statistics and the packages known to be installed on the workers.
+func (b *PullBased) Snapshot() Snapshot {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	snapshot := newSnapshot(b.workerUrls)
+	snapshot.Functions = make(map[string]FunctionSnapshot)
+	for functionType, stats := range b.idleStats {
+		snapshot.Functions[functionType] = FunctionSnapshot{
+			IdleQueueStats:  *stats,
+			EvictedIdleTime: stats.evictedIdleTime,
+		}
+	}
+	for functionType, idleQueue := range b.idleQueues {
+		function := snapshot.Functions[functionType]
+		for _, item := range idleQueue.queue {
+			function.Idle = append(function.Idle, IdleEntry{
+				Worker:    item.url.String(),
+				IdleSince: item.idleSince,
+				MemoryMB:  item.memoryMB,
+			})
+		}
+		if len(function.Idle) > 0 || function.IdleQueueStats != (IdleQueueStats{}) {
+			snapshot.Functions[functionType] = function
+		}
+	}
+	if b.packages != nil {
+		snapshot.WorkerPackages = make(map[string][]string)
+		for workerURL, installed := range b.packages.workerPackages {
+			snapshot.WorkerPackages[workerURL.String()] = mapKeysOf(installed)
+		}
+	}
+	return snapshot
+}
+
+// Restore adds the idle-queue entries of the snapshot on workers the
+// balancer has. Entries whose TTL passed while the scheduler was down are
+// expired as usual.
+func (b *PullBased) Restore(snapshot Snapshot) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for functionType, function := range snapshot.Functions {
+		stats := b.getIdleStats(functionType)
+		stats.Hits += function.Hits
+		stats.Misses += function.Misses
+		stats.Expired += function.Expired
+		stats.Evicted += function.Evicted
+		stats.evictedIdleTime += function.EvictedIdleTime
+
+		queue := b.getIdleQueue(functionType)
+		for _, entry := range function.Idle {
+			workerURL, err := url.Parse(entry.Worker)
+			if err != nil || FindUrlInSlice(b.workerUrls, *workerURL) == -1 {
+				continue
+			}
+			item := &Item{
+				url:       *workerURL,
+				load:      b.getWorkerLoad(*workerURL),
+				idleSince: entry.IdleSince,
+				memoryMB:  entry.MemoryMB,
+			}
+			if b.memory != nil {
+				b.memory.commit(item.url, item.memoryMB)
+			}
+			heap.Push(queue, item)
+		}
+	}
+
+	if b.packages != nil {
+		for _, workerURL := range CreateWorkerURLSlice(mapKeysOf(snapshot.WorkerPackages)) {
+			if FindUrlInSlice(b.workerUrls, workerURL) == -1 {
+				continue
+			}
+			b.packages.addWorkerPackages(workerURL, snapshot.WorkerPackages[workerURL.String()])
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Package cluster partitions functions across scheduler replicas by
+// consistent hashing on the function name. Each function is owned by one
+// replica, which keeps its idle queues, so any replica can accept an
+// invocation and forward it to the owner.
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lafikl/consistent"
+)
+
+// ForwardedHeader marks requests forwarded by another replica, which are
+// served where they arrive instead of being forwarded again.
+const ForwardedHeader = "X-Hiku-Forwarded-By"
+
+// ForwardedSignatureHeader holds the hex-encoded HMAC-SHA256 of forwarded
+// requests if the replicas share a secret.
+const ForwardedSignatureHeader = "X-Hiku-Forwarded-Signature"
+
+const (
+	defaultRetryInterval = 10 * time.Second
+	defaultTimeout       = 5 * time.Minute
+	// connectTimeout is short so that replicas that are down are skipped
+	// soon
+	connectTimeout = 5 * time.Second
+)
+
+// Options configures the replicas.
+type Options struct {
+	// Self is the URL the other replicas reach this replica at.
+	Self string
+	// Replicas holds the URLs of all replicas, including this one.
+	Replicas []string
+	// RetryInterval is how long a replica that could not be reached serves
+	// none of its functions. Defaults to ten seconds.
+	RetryInterval time.Duration
+	// Timeout bounds forwarded requests, including the invocation by the
+	// owner. Defaults to five minutes.
+	Timeout time.Duration
+	// TLS configures connections to replicas with https URLs.
+	TLS *tls.Config
+	// Secret signs forwarded requests. Without it, requests are only taken
+	// as forwarded if they come from the address of a replica.
+	Secret string
+}
+
+// ReplicaStatus tells whether a replica is reachable.
+type ReplicaStatus struct {
+	URL  string `json:"url"`
+	Up   bool   `json:"up"`
+	Self bool   `json:"self,omitempty"`
+}
+
+// Ring assigns functions to replicas and forwards invocations to them.
+type Ring struct {
+	self          url.URL
+	replicas      map[string]url.URL
+	hashRing      *consistent.Consistent
+	retryInterval time.Duration
+	secret        string
+	down          map[string]time.Time
+	client        *http.Client
+	now           func() time.Time
+	mutex         sync.Mutex
+}
+
+// Owner returns the replica owning the function. Functions of replicas
+// that are down are owned by this replica until they are retried.
+func (r *Ring) Owner(function string) (url.URL, bool) {
+	host, err := r.hashRing.Get(function)
+	if err != nil || host == r.self.String() {
+		return r.self, true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if until, ok := r.down[host]; ok {
+		if r.now().Before(until) {
+			return r.self, true
+		}
+		delete(r.down, host)
+	}
+	return r.replicas[host], false
+}
+
+func (r *Ring) markDown(owner url.URL) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.down[owner.String()] = r.now().Add(r.retryInterval)
+}
+
+// Forward sends the request with the body to the owner and copies the
+// response to w. It fails without writing to w if the owner is not
+// reachable, which is then skipped for the retry interval.
+func (r *Ring) Forward(owner url.URL, w http.ResponseWriter, req *http.Request, body []byte) error {
+	resp, err := r.send(owner, req, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	copyResponse(w, resp)
+	return nil
+}
+
+// Find sends the request to the other replicas in turn and copies the
+// first response other than 404 Not Found to w. It reports whether a
+// replica answered, e.g. to look up an invocation queued by its owner.
+func (r *Ring) Find(w http.ResponseWriter, req *http.Request) bool {
+	for host, replica := range r.replicas {
+		if host == r.self.String() {
+			continue
+		}
+		resp, err := r.send(replica, req, nil)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			continue
+		}
+		copyResponse(w, resp)
+		resp.Body.Close()
+		return true
+	}
+	return false
+}
+
+func (r *Ring) send(replica url.URL, req *http.Request, body []byte) (*http.Response, error) {
+	target := replica.ResolveReference(&url.URL{Path: req.URL.Path, RawQuery: req.URL.RawQuery})
+	forwarded, err := http.NewRequestWithContext(req.Context(), req.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	forwarded.Header = req.Header.Clone()
+	forwarded.Header.Set(ForwardedHeader, r.self.String())
+	forwarded.Header.Del(ForwardedSignatureHeader)
+	if r.secret != "" {
+		forwarded.Header.Set(ForwardedSignatureHeader, r.signature(r.self.String(), forwarded))
+	}
+
+	resp, err := r.client.Do(forwarded)
+	if err != nil {
+		log.Printf("Replica %s is unreachable, serving its functions locally: %v", replica.String(), err)
+		r.markDown(replica)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Forwarded reports whether the request was forwarded by another replica
+// and removes the headers marking it. Clients can't skip the owner of a
+// function by setting the headers themselves, since the header must name
+// another replica and carry its signature, or come from its address.
+func (r *Ring) Forwarded(req *http.Request) bool {
+	host := req.Header.Get(ForwardedHeader)
+	presented := req.Header.Get(ForwardedSignatureHeader)
+	req.Header.Del(ForwardedHeader)
+	req.Header.Del(ForwardedSignatureHeader)
+
+	replica, ok := r.replicas[host]
+	if host == "" || !ok || host == r.self.String() {
+		return false
+	}
+	if r.secret != "" {
+		return hmac.Equal([]byte(presented), []byte(r.signature(host, req)))
+	}
+	return fromAddressOf(req, replica)
+}
+
+// signature is the HMAC of the forwarding replica, the method and the
+// request URI, separated by newlines.
+func (r *Ring) signature(replica string, req *http.Request) string {
+	mac := hmac.New(sha256.New, []byte(r.secret))
+	mac.Write([]byte(replica + "\n" + req.Method + "\n" + req.URL.RequestURI()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func fromAddressOf(req *http.Request, replica url.URL) bool {
+	remoteHost, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remote := net.ParseIP(remoteHost)
+	addresses, err := net.DefaultResolver.LookupIPAddr(req.Context(), replica.Hostname())
+	if err != nil {
+		return false
+	}
+	for _, address := range addresses {
+		if address.IP.Equal(remote) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Status returns the replicas and whether they are up.
+func (r *Ring) Status() []ReplicaStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	status := make([]ReplicaStatus, 0, len(r.replicas))
+	for host := range r.replicas {
+		until, down := r.down[host]
+		status = append(status, ReplicaStatus{
+			URL:  host,
+			Up:   !down || !now.Before(until),
+			Self: host == r.self.String(),
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].URL < status[j].URL })
+	return status
+}
+
+// NewRing fails if a URL is malformed or this replica is not one of the
+// replicas.
+func NewRing(options Options) (*Ring, error) {
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = defaultRetryInterval
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultTimeout
+	}
+	self, err := url.Parse(options.Self)
+	if err != nil || self.Host == "" {
+		return nil, fmt.Errorf("malformed URL of this replica: %q", options.Self)
+	}
+
+	r := &Ring{
+		self:          *self,
+		replicas:      make(map[string]url.URL),
+		hashRing:      consistent.New(),
+		retryInterval: options.RetryInterval,
+		secret:        options.Secret,
+		down:          make(map[string]time.Time),
+		client:        newClient(options),
+		now:           time.Now,
+	}
+	for _, replica := range options.Replicas {
+		replicaURL, err := url.Parse(replica)
+		if err != nil || replicaURL.Host == "" {
+			return nil, fmt.Errorf("malformed replica URL: %q", replica)
+		}
+		r.replicas[replicaURL.String()] = *replicaURL
+		r.hashRing.Add(replicaURL.String())
+	}
+	if _, ok := r.replicas[self.String()]; !ok {
+		return nil, fmt.Errorf("replica %s is not one of the replicas", options.Self)
+	}
+	return r, nil
+}
+
+func newClient(options Options) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout}).DialContext
+	if options.TLS != nil {
+		transport.TLSClientConfig = options.TLS
+	}
+	return &http.Client{Transport: transport, Timeout: options.Timeout}
+}
@@ -0,0 +1,323 @@
+// Package concurrency limits the number of invocations of each function
+// running at once, with reserved concurrency like in AWS Lambda.
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrThrottled is returned when a function is at its limit and requests
+	// are throttled instead of queued.
+	ErrThrottled = errors.New("function is at its concurrency limit")
+	// ErrQueueFull is returned when a request would have to wait while the
+	// queue is full.
+	ErrQueueFull = errors.New("concurrency queue is full")
+)
+
+// Mode decides what happens to requests over the limit.
+type Mode string
+
+const (
+	// Queue makes requests wait until a slot frees up
+	Queue Mode = "queue"
+	// Throttle rejects requests at once
+	Throttle Mode = "throttle"
+)
+
+// FunctionLimit sets the concurrency of a function. Reserved slots are
+// taken from the total limit and can only be used by the function, further
+// invocations share the unreserved slots with all other functions. Max caps
+// the invocations of the function. Zero means no reservation or no cap.
+type FunctionLimit struct {
+	Max      int `json:"max,omitempty"`
+	Reserved int `json:"reserved,omitempty"`
+}
+
+// Options configures the limits.
+type Options struct {
+	// Limit is the total number of invocations running at once. Zero means
+	// no limit, which leaves only the caps of the functions.
+	Limit int
+	// Functions maps function names to their limits.
+	Functions map[string]FunctionLimit
+	// Mode defaults to Queue.
+	Mode Mode
+	// MaxQueued is the number of waiting requests before new ones are
+	// rejected. Zero means no limit.
+	MaxQueued int
+	// QueueTimeout is how long a request waits before it is rejected. Zero
+	// means until the client gives up.
+	QueueTimeout time.Duration
+}
+
+// FunctionStats is the concurrency of a function.
+type FunctionStats struct {
+	FunctionLimit
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+}
+
+// Stats is a snapshot of the limiter.
+type Stats struct {
+	Limit              int                      `json:"limit"`
+	Unreserved         int                      `json:"unreserved"`
+	UnreservedInFlight int                      `json:"unreserved_in_flight"`
+	Functions          map[string]FunctionStats `json:"functions"`
+}
+
+type waiter struct {
+	function string
+	admitted chan bool
+}
+
+// Limiter admits invocations while their function is below its limits.
+// Waiting requests are admitted in arrival order as far as their function
+// has a free slot.
+type Limiter struct {
+	options            Options
+	reserved           int
+	inFlight           map[string]int
+	reservedInFlight   map[string]int
+	unreservedInFlight int
+	waiters            []*waiter
+	mutex              sync.Mutex
+}
+
+// tryAcquire takes a slot for the function if one is free and reports
+// whether it is a reserved slot.
+func (cl *Limiter) tryAcquire(function string) (bool, bool) {
+	limit := cl.options.Functions[function]
+	inFlight := cl.inFlight[function]
+	if limit.Max > 0 && inFlight >= limit.Max {
+		return false, false
+	}
+
+	if cl.reservedInFlight[function] < limit.Reserved {
+		cl.inFlight[function]++
+		cl.reservedInFlight[function]++
+		return true, true
+	}
+	if cl.options.Limit > 0 && cl.unreservedInFlight >= cl.options.Limit-cl.reserved {
+		return false, false
+	}
+	cl.inFlight[function]++
+	cl.unreservedInFlight++
+	return true, false
+}
+
+func (cl *Limiter) releaser(function string, reserved bool) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cl.mutex.Lock()
+			defer cl.mutex.Unlock()
+
+			cl.inFlight[function]--
+			if cl.inFlight[function] <= 0 {
+				delete(cl.inFlight, function)
+			}
+			if reserved {
+				cl.reservedInFlight[function]--
+				if cl.reservedInFlight[function] <= 0 {
+					delete(cl.reservedInFlight, function)
+				}
+			} else {
+				cl.unreservedInFlight--
+			}
+			cl.dispatch()
+		})
+	}
+}
+
+// Acquire waits until the function has a free slot and returns the
+// function that frees it again. It fails at once in throttle mode or if the
+// queue is full, and if the context ends while waiting.
+func (cl *Limiter) Acquire(ctx context.Context, function string) (func(), error) {
+	cl.mutex.Lock()
+	if cl.queued(function) == 0 {
+		if ok, reserved := cl.tryAcquire(function); ok {
+			cl.mutex.Unlock()
+			return cl.releaser(function, reserved), nil
+		}
+	}
+	if cl.options.Mode == Throttle {
+		cl.mutex.Unlock()
+		return nil, ErrThrottled
+	}
+	if cl.options.MaxQueued > 0 && len(cl.waiters) >= cl.options.MaxQueued {
+		cl.mutex.Unlock()
+		return nil, ErrQueueFull
+	}
+
+	w := &waiter{function: function, admitted: make(chan bool, 1)}
+	cl.waiters = append(cl.waiters, w)
+	cl.mutex.Unlock()
+
+	select {
+	case reserved := <-w.admitted:
+		return cl.releaser(function, reserved), nil
+	case <-ctx.Done():
+		cl.mutex.Lock()
+		select {
+		case reserved := <-w.admitted:
+			// Admitted in the meantime, give the slot to the next one
+			cl.mutex.Unlock()
+			cl.releaser(function, reserved)()
+		default:
+			cl.remove(w)
+			cl.mutex.Unlock()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (cl *Limiter) queued(function string) int {
+	queued := 0
+	for _, w := range cl.waiters {
+		if w.function == function {
+			queued++
+		}
+	}
+	return queued
+}
+
+func (cl *Limiter) remove(w *waiter) {
+	for i, candidate := range cl.waiters {
+		if candidate == w {
+			cl.waiters = append(cl.waiters[:i], cl.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatch admits waiting requests in arrival order while their functions
+// have free slots. A function whose oldest request can't be admitted is
+// skipped, so its later requests don't overtake it.
+func (cl *Limiter) dispatch() {
+	blocked := make(map[string]bool)
+	remaining := cl.waiters[:0]
+	for _, w := range cl.waiters {
+		if !blocked[w.function] {
+			if ok, reserved := cl.tryAcquire(w.function); ok {
+				w.admitted <- reserved
+				continue
+			}
+			blocked[w.function] = true
+		}
+		remaining = append(remaining, w)
+	}
+	for i := len(remaining); i < len(cl.waiters); i++ {
+		cl.waiters[i] = nil
+	}
+	cl.waiters = remaining
+}
+
+func (cl *Limiter) validate(limit int, functions map[string]FunctionLimit) (int, error) {
+	reserved := 0
+	for function, functionLimit := range functions {
+		if functionLimit.Max < 0 || functionLimit.Reserved < 0 {
+			return 0, fmt.Errorf("limits of %s must not be negative", function)
+		}
+		if functionLimit.Max > 0 && functionLimit.Reserved > functionLimit.Max {
+			return 0, fmt.Errorf("reserved concurrency of %s exceeds its maximum", function)
+		}
+		reserved += functionLimit.Reserved
+	}
+	if limit > 0 && reserved > limit {
+		return 0, fmt.Errorf("reserved concurrency of %d exceeds the limit of %d", reserved, limit)
+	}
+	return reserved, nil
+}
+
+// SetFunctionLimit changes the limits of a function. It fails if the
+// reservations would exceed the total limit. Invocations in flight keep
+// their slots.
+func (cl *Limiter) SetFunctionLimit(function string, limit FunctionLimit) error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	functions := make(map[string]FunctionLimit, len(cl.options.Functions)+1)
+	for name, functionLimit := range cl.options.Functions {
+		functions[name] = functionLimit
+	}
+	if limit == (FunctionLimit{}) {
+		delete(functions, function)
+	} else {
+		functions[function] = limit
+	}
+
+	reserved, err := cl.validate(cl.options.Limit, functions)
+	if err != nil {
+		return err
+	}
+	cl.options.Functions = functions
+	cl.reserved = reserved
+	cl.dispatch()
+	return nil
+}
+
+func (cl *Limiter) Stats() Stats {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	stats := Stats{
+		Limit:              cl.options.Limit,
+		UnreservedInFlight: cl.unreservedInFlight,
+		Functions:          make(map[string]FunctionStats),
+	}
+	if cl.options.Limit > 0 {
+		stats.Unreserved = cl.options.Limit - cl.reserved
+	}
+	for function, limit := range cl.options.Functions {
+		stats.Functions[function] = FunctionStats{FunctionLimit: limit}
+	}
+	for function, inFlight := range cl.inFlight {
+		functionStats := stats.Functions[function]
+		functionStats.FunctionLimit = cl.options.Functions[function]
+		functionStats.InFlight = inFlight
+		stats.Functions[function] = functionStats
+	}
+	for _, w := range cl.waiters {
+		functionStats := stats.Functions[w.function]
+		functionStats.FunctionLimit = cl.options.Functions[w.function]
+		functionStats.Queued++
+		stats.Functions[w.function] = functionStats
+	}
+	return stats
+}
+
+func (cl *Limiter) Options() Options {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.options
+}
+
+// NewLimiter fails if the reservations exceed the total limit.
+func NewLimiter(options Options) (*Limiter, error) {
+	if options.Mode == "" {
+		options.Mode = Queue
+	}
+	if options.Mode != Queue && options.Mode != Throttle {
+		return nil, fmt.Errorf("unknown concurrency mode %q", options.Mode)
+	}
+	if options.Functions == nil {
+		options.Functions = make(map[string]FunctionLimit)
+	}
+
+	cl := &Limiter{
+		options:          options,
+		inFlight:         make(map[string]int),
+		reservedInFlight: make(map[string]int),
+	}
+	reserved, err := cl.validate(options.Limit, options.Functions)
+	if err != nil {
+		return nil, err
+	}
+	cl.reserved = reserved
+	return cl, nil
+}
@@ -1,8 +1,21 @@
 package config
 
 import (
+	"hiku/async"
+	"hiku/auth"
+	"hiku/autoscale"
 	"hiku/balancer"
+	"hiku/cluster"
+	"hiku/concurrency"
+	"hiku/discovery"
+	"hiku/fairqueue"
+	"hiku/predictor"
 	"hiku/proxy"
+	"hiku/ratelimit"
+	"hiku/snapshot"
+	"hiku/tenancy"
+	"hiku/tlsutil"
+	"hiku/trace"
 	"net/url"
 )
 
@@ -12,6 +25,62 @@ type Config struct {
 	Port         int
 	Balancer     balancer.Balancer
 	ReverseProxy proxy.ReverseProxy
+
+	// Predictor enables predictive pre-warming if set
+	Predictor *predictor.Options
+	// PrewarmPayloads are the request bodies of warm-up invocations by
+	// function ID, or by name for all namespaces. Functions without a
+	// payload are invoked with "{}".
+	PrewarmPayloads map[string][]byte
+	// MaxPrewarmPerWorker caps the warm-up invocations of a pre-warming
+	// request at this many per worker. Defaults to four.
+	MaxPrewarmPerWorker int
+
+	// Capture records invocations to a trace file if set
+	Capture *trace.CaptureOptions
+
+	// Async configures the worker pool and result store of asynchronous
+	// invocations
+	Async async.Options
+
+	// FairQueue limits the requests in flight and admits waiting ones by
+	// priority class and weight if set
+	FairQueue *fairqueue.Options
+
+	// RateLimit holds the initial token bucket limits of functions and
+	// tenants, which can be changed at runtime
+	RateLimit ratelimit.Options
+
+	// Concurrency limits the invocations running at once per function and
+	// in total
+	Concurrency concurrency.Options
+
+	// Auth sets the credentials accepted by the endpoints and the audit log
+	// of admin actions. Without credentials, requests are not authenticated.
+	Auth auth.Options
+
+	// TLS serves the endpoints over TLS if set
+	TLS *tlsutil.ServerOptions
+
+	// Tenancy maps API keys to tenants and their namespaces
+	Tenancy tenancy.Options
+
+	// Placement constrains the workers functions run on by worker labels
+	Placement *balancer.Placement
+
+	// Cluster partitions functions across scheduler replicas if set
+	Cluster *cluster.Options
+
+	// Snapshot persists the learned state of the balancer across restarts
+	// if set
+	Snapshot *snapshot.Options
+
+	// Discovery adds and removes workers by external sources if set
+	Discovery *discovery.Options
+
+	// Autoscale recommends the number of workers and runs hooks to resize
+	// the pool if set
+	Autoscale *autoscale.Options
 }
 
 func CreateDefaultConfig() Config {
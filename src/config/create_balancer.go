@@ -1,20 +1,121 @@
 package config
 
 import (
+	"fmt"
+	"time"
+
 	"hiku/balancer"
 )
 
+// BalancerNames lists the balancers that can be configured by name.
+var BalancerNames = []string{
+	"hashing-bounded",
+	"memory-aware",
+	"package-affinity",
+	"latency-aware",
+	"least-connections",
+	"pull-based",
+	"random",
+}
+
 func createBalancerFromConfig(c JSONConfig) balancer.Balancer {
+	b, err := CreateBalancer(c)
+	if err != nil {
+		panic(err.Error())
+	}
+	if c.Tenancy == nil {
+		return b
+	}
+
+	// Tenants with dedicated workers get a balancer of the same kind
+	pools := make(map[string]balancer.Balancer)
+	for name, tenant := range c.Tenancy.Tenants {
+		if len(tenant.Workers) == 0 {
+			continue
+		}
+		poolConfig := c
+		poolConfig.Workers = tenant.Workers
+		pool, err := CreateBalancer(poolConfig)
+		if err != nil {
+			panic(err.Error())
+		}
+		pools[tenant.namespace(name)] = pool
+	}
+	if len(pools) == 0 {
+		return b
+	}
+	return balancer.NewPools(b, pools)
+}
+
+// CreateBalancer creates the balancer named in the config for its workers.
+func CreateBalancer(c JSONConfig) (balancer.Balancer, error) {
 	switch c.Balancer {
 	case "hashing-bounded":
-		return balancer.NewConsistentHashingBoundedFromJSONSlice(c.Workers)
+		return balancer.NewConsistentHashingBoundedFromJSONSlice(c.Workers), nil
+	case "memory-aware":
+		return balancer.NewMemoryAware(balancer.CreateWorkerURLSlice(c.Workers), createPullBasedOptions(c), createMemoryOptions(c)), nil
+	case "package-affinity":
+		return balancer.NewPackageAffinity(balancer.CreateWorkerURLSlice(c.Workers), createPullBasedOptions(c), createPackageOptions(c)), nil
+	case "latency-aware":
+		return balancer.NewLatencyAware(balancer.CreateWorkerURLSlice(c.Workers), balancer.LatencyOptions{
+			Decay:        c.LatencyDecay.Std(),
+			PerFunction:  c.LatencyPerFunction,
+			ErrorPenalty: c.LatencyErrorPenalty.Std(),
+			DefaultRTT:   c.LatencyDefaultRTT.Std(),
+		}), nil
 	case "least-connections":
-		return balancer.NewLeastConnectionsFromJSONSlice(c.Workers)
+		return balancer.NewLeastConnectionsFromJSONSlice(c.Workers), nil
 	case "pull-based":
-		return balancer.NewPullBasedFromJSONSlice(c.Workers)
+		return balancer.NewPullBasedWithOptions(balancer.CreateWorkerURLSlice(c.Workers), createPullBasedOptions(c)), nil
 	case "random":
-		return balancer.NewRandomFromJSONSlice(c.Workers)
+		return balancer.NewRandomFromJSONSlice(c.Workers), nil
 	}
 
-	panic("Unknown balancer: " + c.Balancer)
+	return nil, fmt.Errorf("Unknown balancer: %s", c.Balancer)
+}
+
+func createPullBasedOptions(c JSONConfig) balancer.PullBasedOptions {
+	functionIdleTTLs := make(map[string]time.Duration)
+	for name, function := range c.Functions {
+		if function.IdleTTL > 0 {
+			functionIdleTTLs[name] = function.IdleTTL.Std()
+		}
+	}
+
+	return balancer.PullBasedOptions{
+		IdleTTL:          c.IdleTTL.Std(),
+		FunctionIdleTTLs: functionIdleTTLs,
+		SweepInterval:    c.IdleSweepInterval.Std(),
+		ColdStartHashing: c.ColdStartHashing,
+	}
+}
+
+func createMemoryOptions(c JSONConfig) balancer.MemoryOptions {
+	functionMB := make(map[string]uint64)
+	for name, function := range c.Functions {
+		if function.MemoryMB > 0 {
+			functionMB[name] = function.MemoryMB
+		}
+	}
+
+	return balancer.MemoryOptions{
+		WorkerBudgetMB:    c.WorkerMemoryMB,
+		DefaultFunctionMB: c.DefaultFunctionMemoryMB,
+		FunctionMB:        functionMB,
+	}
+}
+
+func createPackageOptions(c JSONConfig) balancer.PackageOptions {
+	functionPackages := make(map[string][]string)
+	for name, function := range c.Functions {
+		if len(function.Packages) > 0 {
+			functionPackages[name] = function.Packages
+		}
+	}
+
+	return balancer.PackageOptions{
+		FunctionPackages: functionPackages,
+		WorkerPackages:   c.WorkerPackages,
+		LoadSlack:        c.PackageLoadSlack,
+	}
 }
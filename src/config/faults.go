@@ -0,0 +1,75 @@
+package config
+
+import (
+	"time"
+
+	"hiku/proxy"
+)
+
+// FaultInjectionConfig wraps the reverse proxy with fault injection. Faults
+// can then also be changed at runtime via /admin/faults.
+type FaultInjectionConfig struct {
+	Enabled bool          `json:"enabled"`
+	Faults  []FaultConfig `json:"faults"`
+}
+
+// FaultConfig is the JSON form of proxy.Fault, used in the config file and
+// by the admin endpoint.
+type FaultConfig struct {
+	ID          string     `json:"id,omitempty"`
+	Function    string     `json:"function,omitempty"`
+	Worker      string     `json:"worker,omitempty"`
+	Percentage  float64    `json:"percentage,omitempty"`
+	Delay       Duration   `json:"delay,omitempty"`
+	AbortStatus int        `json:"abort_status,omitempty"`
+	Drop        bool       `json:"drop,omitempty"`
+	Blackout    bool       `json:"blackout,omitempty"`
+	Duration    Duration   `json:"duration,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+func (f FaultConfig) ToFault() proxy.Fault {
+	return proxy.Fault{
+		ID:          f.ID,
+		Function:    f.Function,
+		Worker:      f.Worker,
+		Percentage:  f.Percentage,
+		Delay:       f.Delay.Std(),
+		AbortStatus: f.AbortStatus,
+		Drop:        f.Drop,
+		Blackout:    f.Blackout,
+		Duration:    f.Duration.Std(),
+	}
+}
+
+func NewFaultConfig(fault proxy.Fault) FaultConfig {
+	f := FaultConfig{
+		ID:          fault.ID,
+		Function:    fault.Function,
+		Worker:      fault.Worker,
+		Percentage:  fault.Percentage,
+		Delay:       Duration(fault.Delay),
+		AbortStatus: fault.AbortStatus,
+		Drop:        fault.Drop,
+		Blackout:    fault.Blackout,
+		Duration:    Duration(fault.Duration),
+	}
+	if !fault.Expires.IsZero() {
+		expires := fault.Expires
+		f.Expires = &expires
+	}
+	return f
+}
+
+func (c JSONConfig) reverseProxy() proxy.ReverseProxy {
+	reverseProxy := proxy.NewHTTPSReverseProxy(c.workerTLSOptions())
+	if c.FaultInjection == nil || !c.FaultInjection.Enabled {
+		return reverseProxy
+	}
+
+	faults := make([]proxy.Fault, len(c.FaultInjection.Faults))
+	for i, fault := range c.FaultInjection.Faults {
+		faults[i] = fault.ToFault()
+	}
+	return proxy.NewFaultInjector(reverseProxy, faults)
+}
@@ -6,7 +6,20 @@ import (
 	"log"
 	"os"
 
-	"hiku/proxy"
+	"hiku/async"
+	"hiku/auth"
+	"hiku/autoscale"
+	"hiku/balancer"
+	"hiku/cluster"
+	"hiku/concurrency"
+	"hiku/discovery"
+	"hiku/fairqueue"
+	"hiku/predictor"
+	"hiku/ratelimit"
+	"hiku/snapshot"
+	"hiku/tenancy"
+	"hiku/tlsutil"
+	"hiku/trace"
 )
 
 // JSONConfig holds the data configured via a JSON file. This shall be used
@@ -17,6 +30,299 @@ type JSONConfig struct {
 	Port     int      `json:"port"`
 	Balancer string   `json:"balancer"`
 	Workers  []string `json:"workers"`
+
+	// IdleTTL should match the keep-alive of paused sandboxes on the workers
+	IdleTTL           Duration                  `json:"idle_ttl"`
+	IdleSweepInterval Duration                  `json:"idle_sweep_interval"`
+	Functions         map[string]FunctionConfig `json:"functions"`
+
+	// Place cold starts of pull-based balancers by consistent hashing with
+	// bounded loads on the function
+	ColdStartHashing bool `json:"cold_start_hashing"`
+
+	// Memory budget of each worker (Mem_pool_mb) for the memory-aware balancer
+	WorkerMemoryMB          uint64 `json:"worker_memory_mb"`
+	DefaultFunctionMemoryMB uint64 `json:"default_function_memory_mb"`
+
+	// Packages installed on the workers for the package-affinity balancer
+	WorkerPackages   map[string][]string `json:"worker_packages"`
+	PackageLoadSlack uint                `json:"package_load_slack"`
+
+	// Labels of the workers, e.g. zone or pool, for placement constraints
+	WorkerLabels map[string]map[string]string `json:"worker_labels"`
+
+	// Zone of the scheduler, to prefer workers whose zone label matches
+	Zone              string `json:"zone"`
+	ZoneLabel         string `json:"zone_label"`
+	ZoneSpilloverLoad uint   `json:"zone_spillover_load"`
+
+	// Moving average of response times for the latency-aware balancer
+	LatencyDecay        Duration `json:"latency_decay"`
+	LatencyPerFunction  bool     `json:"latency_per_function"`
+	LatencyErrorPenalty Duration `json:"latency_error_penalty"`
+	LatencyDefaultRTT   Duration `json:"latency_default_rtt"`
+
+	Prewarm *PrewarmConfig `json:"prewarm"`
+
+	Capture *CaptureConfig `json:"capture"`
+
+	FaultInjection *FaultInjectionConfig `json:"fault_injection"`
+
+	Async *AsyncConfig `json:"async"`
+
+	FairQueuing *FairQueuingConfig `json:"fair_queuing"`
+
+	RateLimits *RateLimitConfig `json:"rate_limits"`
+
+	Concurrency *ConcurrencyConfig `json:"concurrency"`
+
+	Auth *AuthConfig `json:"auth"`
+
+	TLS       *TLSConfig       `json:"tls"`
+	WorkerTLS *WorkerTLSConfig `json:"worker_tls"`
+
+	Tenancy *TenancyConfig `json:"tenancy"`
+
+	Cluster *ClusterConfig `json:"cluster"`
+
+	Snapshot *SnapshotConfig `json:"snapshot"`
+
+	Discovery *DiscoveryConfig `json:"discovery"`
+
+	Autoscaling *AutoscalingConfig `json:"autoscaling"`
+}
+
+// AutoscalingConfig configures the recommended number of workers and the
+// hooks that resize the pool.
+type AutoscalingConfig struct {
+	Interval          Duration     `json:"interval"`
+	TargetInFlight    float64      `json:"target_in_flight"`
+	MaxColdStartRatio float64      `json:"max_cold_start_ratio"`
+	MinWorkers        int          `json:"min_workers"`
+	MaxWorkers        int          `json:"max_workers"`
+	ScaleUpCooldown   Duration     `json:"scale_up_cooldown"`
+	ScaleDownDelay    Duration     `json:"scale_down_delay"`
+	DrainTimeout      Duration     `json:"drain_timeout"`
+	Hooks             []HookConfig `json:"hooks"`
+}
+
+// HookConfig is a command or webhook run when the pool should be resized.
+type HookConfig struct {
+	Command []string `json:"command"`
+	URL     string   `json:"url"`
+	Timeout Duration `json:"timeout"`
+}
+
+// DiscoveryConfig adds and removes workers by DNS records, inventory files
+// and commands, in addition to the static workers.
+type DiscoveryConfig struct {
+	Interval Duration                 `json:"interval"`
+	DNS      []DNSDiscoveryConfig     `json:"dns"`
+	Files    []FileDiscoveryConfig    `json:"files"`
+	Commands []CommandDiscoveryConfig `json:"commands"`
+}
+
+type DNSDiscoveryConfig struct {
+	Name string `json:"name"`
+	// Record is "a" (default) or "srv"
+	Record string `json:"record"`
+	Port   int    `json:"port"`
+	Scheme string `json:"scheme"`
+}
+
+type FileDiscoveryConfig struct {
+	Path string `json:"path"`
+}
+
+type CommandDiscoveryConfig struct {
+	Command []string `json:"command"`
+	Timeout Duration `json:"timeout"`
+}
+
+// SnapshotConfig persists the learned state of the balancer to a file,
+// which is restored on start.
+type SnapshotConfig struct {
+	File           string   `json:"file"`
+	Interval       Duration `json:"interval"`
+	MaxAge         Duration `json:"max_age"`
+	RestoreWorkers bool     `json:"restore_workers"`
+}
+
+// ClusterConfig lists the scheduler replicas that partition the functions
+// among them.
+type ClusterConfig struct {
+	Self          string   `json:"self"`
+	Replicas      []string `json:"replicas"`
+	RetryInterval Duration `json:"retry_interval"`
+	Timeout       Duration `json:"timeout"`
+	Secret        string   `json:"secret"`
+	// TLS configures connections to replicas with https URLs. Unset
+	// settings are taken from the worker TLS.
+	TLS *WorkerTLSClientConfig `json:"tls"`
+}
+
+// TenancyConfig maps API keys to tenants. Each tenant runs the functions of
+// its namespace, with optional quotas and a dedicated pool of workers.
+type TenancyConfig struct {
+	APIKeyHeader  string                  `json:"api_key_header"`
+	RequireAPIKey bool                    `json:"require_api_key"`
+	Tenants       map[string]TenantConfig `json:"tenants"`
+}
+
+// TenantConfig holds the settings of a tenant, keyed by its name in
+// TenancyConfig.Tenants. The namespace defaults to the name.
+type TenantConfig struct {
+	Namespace   string           `json:"namespace"`
+	APIKeys     []string         `json:"api_keys"`
+	MaxInFlight int              `json:"max_in_flight"`
+	RateLimit   *ratelimit.Limit `json:"rate_limit"`
+	// Workers dedicated to the tenant, which run no other functions
+	Workers []string `json:"workers"`
+}
+
+func (t TenantConfig) namespace(name string) string {
+	if t.Namespace == "" {
+		return name
+	}
+	return t.Namespace
+}
+
+// TLSConfig serves the scheduler over TLS. Certificate and key are reloaded
+// when their files change. With a client CA file, client certificates are
+// verified, and required if RequireClientCert is set.
+type TLSConfig struct {
+	CertFile          string   `json:"cert_file"`
+	KeyFile           string   `json:"key_file"`
+	ClientCAFile      string   `json:"client_ca_file"`
+	RequireClientCert bool     `json:"require_client_cert"`
+	ReloadInterval    Duration `json:"reload_interval"`
+}
+
+// WorkerTLSClientConfig configures connections to workers with https URLs.
+type WorkerTLSClientConfig struct {
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// WorkerTLSConfig holds the global settings of connections to workers and
+// those of single workers, keyed by host. RequireTLS refuses workers with
+// http URLs.
+type WorkerTLSConfig struct {
+	WorkerTLSClientConfig
+	RequireTLS     bool                             `json:"require_tls"`
+	ReloadInterval Duration                         `json:"reload_interval"`
+	Workers        map[string]WorkerTLSClientConfig `json:"workers"`
+}
+
+// AuthConfig sets the credentials of admins, workers and invokers. Clients
+// authenticate with a bearer token, workers may also sign their callbacks
+// with the worker secret, and TLS client certificates are mapped to roles
+// by common name or DNS name.
+type AuthConfig struct {
+	Tokens             []auth.Token         `json:"tokens"`
+	WorkerSecret       string               `json:"worker_secret"`
+	MaxSkew            Duration             `json:"max_skew"`
+	ClientCertificates map[string]auth.Role `json:"client_certificates"`
+	AuditLog           string               `json:"audit_log"`
+}
+
+// ConcurrencyConfig sets the total number of invocations running at once.
+// Functions can reserve part of it and be capped in JSONConfig.Functions.
+// Requests over the limit wait if OnLimit is "queue" or are rejected if it
+// is "throttle".
+type ConcurrencyConfig struct {
+	Limit        int      `json:"limit"`
+	OnLimit      string   `json:"on_limit"`
+	MaxQueued    int      `json:"max_queued"`
+	QueueTimeout Duration `json:"queue_timeout"`
+}
+
+// RateLimitConfig sets token bucket limits per tenant, identified by the key
+// header, and default limits for functions and tenants without their own.
+// Limits of single functions are set in JSONConfig.Functions.
+type RateLimitConfig struct {
+	KeyHeader       string                     `json:"key_header"`
+	DefaultFunction ratelimit.Limit            `json:"default_function"`
+	DefaultTenant   ratelimit.Limit            `json:"default_tenant"`
+	Tenants         map[string]ratelimit.Limit `json:"tenants"`
+}
+
+// FairQueuingConfig limits the requests sent to workers at once. Waiting
+// requests are admitted by the priority of their class, and by weight across
+// tenants and functions within a class.
+type FairQueuingConfig struct {
+	MaxInFlight   int                `json:"max_in_flight"`
+	MaxQueued     int                `json:"max_queued"`
+	QueueTimeout  Duration           `json:"queue_timeout"`
+	Classes       map[string]int     `json:"classes"`
+	DefaultClass  string             `json:"default_class"`
+	TenantWeights map[string]float64 `json:"tenant_weights"`
+}
+
+// AsyncConfig tunes asynchronous invocations. Results are kept in memory
+// unless a store file is set.
+type AsyncConfig struct {
+	Workers         int      `json:"workers"`
+	QueueSize       int      `json:"queue_size"`
+	Retention       Duration `json:"retention"`
+	MaxResults      int      `json:"max_results"`
+	StoreFile       string   `json:"store_file"`
+	CallbackTimeout Duration `json:"callback_timeout"`
+	CallbackHosts   []string `json:"callback_hosts"`
+
+	// Durable queue for invocations with the X-Hiku-Durable header
+	DurableFile       string   `json:"durable_file"`
+	DeadLetterFile    string   `json:"dead_letter_file"`
+	MaxAttempts       int      `json:"max_attempts"`
+	VisibilityTimeout Duration `json:"visibility_timeout"`
+	RetryBackoff      Duration `json:"retry_backoff"`
+}
+
+// CaptureConfig enables recording of invocations to a JSON lines trace file
+// that can be replayed or simulated. Body is one of "none", "hash" or "full".
+type CaptureConfig struct {
+	File         string `json:"file"`
+	Body         string `json:"body"`
+	MaxBodyBytes int    `json:"max_body_bytes"`
+}
+
+// PrewarmConfig enables pre-warming shortly before a function's next
+// invocation, predicted from a histogram of its inter-arrival times.
+type PrewarmConfig struct {
+	Enabled         bool     `json:"enabled"`
+	BinWidth        Duration `json:"bin_width"`
+	Bins            int      `json:"bins"`
+	Percentile      float64  `json:"percentile"`
+	Lead            Duration `json:"lead"`
+	MinSamples      uint64   `json:"min_samples"`
+	MinInterArrival Duration `json:"min_inter_arrival"`
+	// MaxPerWorker caps /admin/prewarm requests, even without Enabled
+	MaxPerWorker int `json:"max_per_worker"`
+}
+
+// FunctionConfig holds settings for a single lambda function, keyed by its
+// name in JSONConfig.Functions.
+type FunctionConfig struct {
+	IdleTTL        Duration        `json:"idle_ttl"`
+	PrewarmPayload json.RawMessage `json:"prewarm_payload"`
+	MemoryMB       uint64          `json:"memory_mb"`
+	Packages       []string        `json:"packages"`
+	// Priority class and fair-queuing weight of the function
+	Priority string  `json:"priority"`
+	Weight   float64 `json:"weight"`
+	// RateLimit of the function, overriding the default function limit
+	RateLimit *ratelimit.Limit `json:"rate_limit"`
+	// Concurrency cap of the function and the part of the total limit
+	// reserved for it
+	MaxConcurrency      int `json:"max_concurrency"`
+	ReservedConcurrency int `json:"reserved_concurrency"`
+	// Constraints on the labels of the workers the function runs on, and
+	// labels of workers it prefers, e.g. "pool=batch" or "gpu!=true"
+	Constraints []balancer.Constraint `json:"constraints"`
+	Preferences []balancer.Constraint `json:"preferences"`
 }
 
 func (c JSONConfig) ToConfig() Config {
@@ -24,8 +330,303 @@ func (c JSONConfig) ToConfig() Config {
 		Host:         c.Host,
 		Port:         c.Port,
 		Balancer:     createBalancerFromConfig(c),
-		ReverseProxy: proxy.NewHTTPReverseProxy(),
+		ReverseProxy: c.reverseProxy(),
+
+		Predictor:       c.predictorOptions(),
+		PrewarmPayloads: c.prewarmPayloads(),
+		Capture:         c.captureOptions(),
+		Async:           c.asyncOptions(),
+		FairQueue:       c.fairQueueOptions(),
+		RateLimit:       c.rateLimitOptions(),
+		Concurrency:     c.concurrencyOptions(),
+		Auth:            c.authOptions(),
+		TLS:             c.tlsOptions(),
+		Tenancy:         c.tenancyOptions(),
+		Placement:       c.placement(),
+		Cluster:         c.clusterOptions(),
+		Snapshot:        c.snapshotOptions(),
+		Discovery:       c.discoveryOptions(),
+		Autoscale:       c.autoscaleOptions(),
+
+		MaxPrewarmPerWorker: c.maxPrewarmPerWorker(),
+	}
+}
+
+func (c JSONConfig) autoscaleOptions() *autoscale.Options {
+	if c.Autoscaling == nil {
+		return nil
+	}
+	options := &autoscale.Options{
+		Interval:          c.Autoscaling.Interval.Std(),
+		TargetInFlight:    c.Autoscaling.TargetInFlight,
+		MaxColdStartRatio: c.Autoscaling.MaxColdStartRatio,
+		MinWorkers:        c.Autoscaling.MinWorkers,
+		MaxWorkers:        c.Autoscaling.MaxWorkers,
+		ScaleUpCooldown:   c.Autoscaling.ScaleUpCooldown.Std(),
+		ScaleDownDelay:    c.Autoscaling.ScaleDownDelay.Std(),
+		DrainTimeout:      c.Autoscaling.DrainTimeout.Std(),
+	}
+	for _, hook := range c.Autoscaling.Hooks {
+		options.Hooks = append(options.Hooks, autoscale.Hook{
+			Command: hook.Command,
+			URL:     hook.URL,
+			Timeout: hook.Timeout.Std(),
+		})
+	}
+	return options
+}
+
+func (c JSONConfig) discoveryOptions() *discovery.Options {
+	if c.Discovery == nil {
+		return nil
+	}
+	options := &discovery.Options{Interval: c.Discovery.Interval.Std()}
+	for _, dns := range c.Discovery.DNS {
+		options.DNS = append(options.DNS, discovery.DNSOptions{
+			Name:   dns.Name,
+			Record: dns.Record,
+			Port:   dns.Port,
+			Scheme: dns.Scheme,
+		})
+	}
+	for _, file := range c.Discovery.Files {
+		options.Files = append(options.Files, discovery.FileOptions{Path: file.Path})
+	}
+	for _, command := range c.Discovery.Commands {
+		options.Commands = append(options.Commands, discovery.CommandOptions{
+			Command: command.Command,
+			Timeout: command.Timeout.Std(),
+		})
+	}
+	return options
+}
+
+func (c JSONConfig) snapshotOptions() *snapshot.Options {
+	if c.Snapshot == nil || c.Snapshot.File == "" {
+		return nil
+	}
+	return &snapshot.Options{
+		File:           c.Snapshot.File,
+		Interval:       c.Snapshot.Interval.Std(),
+		MaxAge:         c.Snapshot.MaxAge.Std(),
+		RestoreWorkers: c.Snapshot.RestoreWorkers,
+	}
+}
+
+func (c JSONConfig) clusterOptions() *cluster.Options {
+	if c.Cluster == nil || len(c.Cluster.Replicas) == 0 {
+		return nil
+	}
+	return &cluster.Options{
+		Self:          c.Cluster.Self,
+		Replicas:      c.Cluster.Replicas,
+		RetryInterval: c.Cluster.RetryInterval.Std(),
+		Timeout:       c.Cluster.Timeout.Std(),
+		TLS:           c.clusterTLS(),
+		Secret:        c.Cluster.Secret,
+	}
+}
+
+func (c JSONConfig) placement() *balancer.Placement {
+	options := balancer.PlacementOptions{
+		WorkerLabels: c.WorkerLabels,
+		Functions:    make(map[string]balancer.FunctionPlacement),
+		Locality: balancer.LocalityOptions{
+			Zone:          c.Zone,
+			ZoneLabel:     c.ZoneLabel,
+			SpilloverLoad: c.ZoneSpilloverLoad,
+		},
+	}
+	for name, function := range c.Functions {
+		if len(function.Constraints) > 0 || len(function.Preferences) > 0 {
+			options.Functions[name] = balancer.FunctionPlacement{
+				Constraints: function.Constraints,
+				Preferences: function.Preferences,
+			}
+		}
+	}
+	return balancer.NewPlacement(options)
+}
+
+func (c JSONConfig) tenancyOptions() tenancy.Options {
+	if c.Tenancy == nil {
+		return tenancy.Options{}
+	}
+
+	options := tenancy.Options{
+		APIKeyHeader:  c.Tenancy.APIKeyHeader,
+		RequireAPIKey: c.Tenancy.RequireAPIKey,
+	}
+	for name, tenant := range c.Tenancy.Tenants {
+		options.Tenants = append(options.Tenants, tenancy.Tenant{
+			Name:        name,
+			Namespace:   tenant.namespace(name),
+			APIKeys:     tenant.APIKeys,
+			MaxInFlight: tenant.MaxInFlight,
+		})
+	}
+	return options
+}
+
+func (c JSONConfig) tlsOptions() *tlsutil.ServerOptions {
+	if c.TLS == nil || c.TLS.CertFile == "" {
+		return nil
+	}
+	return &tlsutil.ServerOptions{
+		CertFile:          c.TLS.CertFile,
+		KeyFile:           c.TLS.KeyFile,
+		ClientCAFile:      c.TLS.ClientCAFile,
+		RequireClientCert: c.TLS.RequireClientCert,
+		ReloadInterval:    c.TLS.ReloadInterval.Std(),
+	}
+}
+
+func (c JSONConfig) authOptions() auth.Options {
+	if c.Auth == nil {
+		return auth.Options{}
+	}
+	return auth.Options{
+		Tokens:             c.Auth.Tokens,
+		WorkerSecret:       c.Auth.WorkerSecret,
+		MaxSkew:            c.Auth.MaxSkew.Std(),
+		ClientCertificates: c.Auth.ClientCertificates,
+		AuditLog:           c.Auth.AuditLog,
+	}
+}
+
+func (c JSONConfig) concurrencyOptions() concurrency.Options {
+	options := concurrency.Options{Functions: make(map[string]concurrency.FunctionLimit)}
+	if c.Concurrency != nil {
+		options.Limit = c.Concurrency.Limit
+		options.Mode = concurrency.Mode(c.Concurrency.OnLimit)
+		options.MaxQueued = c.Concurrency.MaxQueued
+		options.QueueTimeout = c.Concurrency.QueueTimeout.Std()
+	}
+	for name, function := range c.Functions {
+		if function.MaxConcurrency > 0 || function.ReservedConcurrency > 0 {
+			options.Functions[name] = concurrency.FunctionLimit{
+				Max:      function.MaxConcurrency,
+				Reserved: function.ReservedConcurrency,
+			}
+		}
+	}
+	return options
+}
+
+func (c JSONConfig) rateLimitOptions() ratelimit.Options {
+	options := ratelimit.Options{Functions: make(map[string]ratelimit.Limit)}
+	if c.RateLimits != nil {
+		options.KeyHeader = c.RateLimits.KeyHeader
+		options.DefaultFunction = c.RateLimits.DefaultFunction
+		options.DefaultTenant = c.RateLimits.DefaultTenant
+		options.Tenants = c.RateLimits.Tenants
+	}
+	if c.Tenancy != nil {
+		if options.Tenants == nil {
+			options.Tenants = make(map[string]ratelimit.Limit)
+		}
+		for name, tenant := range c.Tenancy.Tenants {
+			if tenant.RateLimit != nil {
+				options.Tenants[name] = *tenant.RateLimit
+			}
+		}
+	}
+	for name, function := range c.Functions {
+		if function.RateLimit != nil {
+			options.Functions[name] = *function.RateLimit
+		}
+	}
+	return options
+}
+
+func (c JSONConfig) fairQueueOptions() *fairqueue.Options {
+	if c.FairQueuing == nil || c.FairQueuing.MaxInFlight <= 0 {
+		return nil
+	}
+
+	options := &fairqueue.Options{
+		MaxInFlight:     c.FairQueuing.MaxInFlight,
+		MaxQueued:       c.FairQueuing.MaxQueued,
+		QueueTimeout:    c.FairQueuing.QueueTimeout.Std(),
+		Classes:         c.FairQueuing.Classes,
+		DefaultClass:    c.FairQueuing.DefaultClass,
+		TenantWeights:   c.FairQueuing.TenantWeights,
+		FunctionClasses: make(map[string]string),
+		FunctionWeights: make(map[string]float64),
+	}
+	for name, function := range c.Functions {
+		if function.Priority != "" {
+			options.FunctionClasses[name] = function.Priority
+		}
+		if function.Weight > 0 {
+			options.FunctionWeights[name] = function.Weight
+		}
+	}
+	return options
+}
+
+func (c JSONConfig) asyncOptions() async.Options {
+	if c.Async == nil {
+		return async.Options{}
+	}
+	return async.Options{
+		Workers:         c.Async.Workers,
+		QueueSize:       c.Async.QueueSize,
+		Retention:       c.Async.Retention.Std(),
+		MaxResults:      c.Async.MaxResults,
+		StoreFile:       c.Async.StoreFile,
+		CallbackTimeout: c.Async.CallbackTimeout.Std(),
+		CallbackHosts:   c.Async.CallbackHosts,
+		Durable: async.DurableOptions{
+			File:              c.Async.DurableFile,
+			DeadLetterFile:    c.Async.DeadLetterFile,
+			MaxAttempts:       c.Async.MaxAttempts,
+			VisibilityTimeout: c.Async.VisibilityTimeout.Std(),
+			RetryBackoff:      c.Async.RetryBackoff.Std(),
+		},
+	}
+}
+
+func (c JSONConfig) captureOptions() *trace.CaptureOptions {
+	if c.Capture == nil || c.Capture.File == "" {
+		return nil
+	}
+	return &trace.CaptureOptions{
+		File:         c.Capture.File,
+		Body:         trace.BodyMode(c.Capture.Body),
+		MaxBodyBytes: c.Capture.MaxBodyBytes,
+	}
+}
+
+func (c JSONConfig) maxPrewarmPerWorker() int {
+	if c.Prewarm == nil {
+		return 0
+	}
+	return c.Prewarm.MaxPerWorker
+}
+
+func (c JSONConfig) predictorOptions() *predictor.Options {
+	if c.Prewarm == nil || !c.Prewarm.Enabled {
+		return nil
+	}
+	return &predictor.Options{
+		BinWidth:        c.Prewarm.BinWidth.Std(),
+		Bins:            c.Prewarm.Bins,
+		Percentile:      c.Prewarm.Percentile,
+		Lead:            c.Prewarm.Lead.Std(),
+		MinSamples:      c.Prewarm.MinSamples,
+		MinInterArrival: c.Prewarm.MinInterArrival.Std(),
+	}
+}
+
+func (c JSONConfig) prewarmPayloads() map[string][]byte {
+	payloads := make(map[string][]byte)
+	for name, function := range c.Functions {
+		if len(function.PrewarmPayload) > 0 {
+			payloads[name] = function.PrewarmPayload
+		}
 	}
+	return payloads
 }
 
 func LoadConfigFromFile(configFilepath string) JSONConfig {
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"crypto/tls"
+	"log"
+
+	"hiku/proxy"
+	"hiku/tlsutil"
+)
+
+func (c WorkerTLSClientConfig) clientConfig(reloadInterval Duration) *tls.Config {
+	config, err := tlsutil.NewClientConfig(tlsutil.ClientOptions{
+		CAFile:             c.CAFile,
+		CertFile:           c.CertFile,
+		KeyFile:            c.KeyFile,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ReloadInterval:     reloadInterval.Std(),
+	})
+	if err != nil {
+		log.Fatalf("Cannot load worker TLS configuration (%s)", err)
+	}
+	return config
+}
+
+// inherit fills the unset files and server name from the global settings.
+func (c WorkerTLSClientConfig) inherit(global WorkerTLSClientConfig) WorkerTLSClientConfig {
+	if c.CAFile == "" {
+		c.CAFile = global.CAFile
+	}
+	if c.CertFile == "" && c.KeyFile == "" {
+		c.CertFile = global.CertFile
+		c.KeyFile = global.KeyFile
+	}
+	if c.ServerName == "" {
+		c.ServerName = global.ServerName
+	}
+	return c
+}
+
+func (c JSONConfig) workerTLSOptions() proxy.TLSOptions {
+	if c.WorkerTLS == nil {
+		return proxy.TLSOptions{}
+	}
+
+	options := proxy.TLSOptions{
+		Default:    c.WorkerTLS.clientConfig(c.WorkerTLS.ReloadInterval),
+		Workers:    make(map[string]*tls.Config),
+		RequireTLS: c.WorkerTLS.RequireTLS,
+	}
+	for host, worker := range c.WorkerTLS.Workers {
+		options.Workers[host] = worker.inherit(c.WorkerTLS.WorkerTLSClientConfig).clientConfig(c.WorkerTLS.ReloadInterval)
+	}
+	return options
+}
+
+// clusterTLS returns the TLS configuration of connections to scheduler
+// replicas, which inherits the unset settings from the worker TLS.
+func (c JSONConfig) clusterTLS() *tls.Config {
+	var replicas, global WorkerTLSClientConfig
+	var reloadInterval Duration
+	if c.Cluster.TLS != nil {
+		replicas = *c.Cluster.TLS
+	}
+	if c.WorkerTLS != nil {
+		global = c.WorkerTLS.WorkerTLSClientConfig
+		reloadInterval = c.WorkerTLS.ReloadInterval
+	}
+	if replicas == (WorkerTLSClientConfig{}) && global == (WorkerTLSClientConfig{}) {
+		return nil
+	}
+	return replicas.inherit(global).clientConfig(reloadInterval)
+}
@@ -0,0 +1,73 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultCommandTimeout = 10 * time.Second
+
+// CommandOptions configures a command that prints the workers.
+type CommandOptions struct {
+	// Command is the program and its arguments, run without a shell.
+	Command []string
+	// Timeout is how long the command may run. Defaults to ten seconds.
+	Timeout time.Duration
+}
+
+// Command discovers workers from the output of a command, either one
+// worker per line or an inventory in JSON like the file provider accepts.
+type Command struct {
+	options CommandOptions
+}
+
+func (c *Command) Discover(ctx context.Context) ([]url.URL, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.options.Timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.options.Command[0], c.options.Command[1:]...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	output = bytes.TrimSpace(output)
+	if len(output) > 0 && (output[0] == '[' || output[0] == '{') {
+		workers, err := parseInventory(output)
+		if err != nil {
+			return nil, err
+		}
+		return parseWorkers(workers)
+	}
+
+	var workers []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			workers = append(workers, line)
+		}
+	}
+	return parseWorkers(workers)
+}
+
+func (c *Command) String() string {
+	return "command " + strings.Join(c.options.Command, " ")
+}
+
+func NewCommand(options CommandOptions) (*Command, error) {
+	if len(options.Command) == 0 {
+		return nil, fmt.Errorf("command discovery needs a command")
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultCommandTimeout
+	}
+	return &Command{options: options}, nil
+}
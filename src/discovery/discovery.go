@@ -0,0 +1,253 @@
+// Package discovery keeps the workers of a balancer in sync with external
+// sources, such as DNS records of a headless service, an inventory file or
+// the output of a command, instead of adding and removing them by hand.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultInterval = 30 * time.Second
+
+// Provider discovers the URLs of workers.
+type Provider interface {
+	// Discover returns the workers that should currently be members.
+	Discover(ctx context.Context) ([]url.URL, error)
+	// String describes the provider in logs and the status.
+	String() string
+}
+
+// Membership is the part of a balancer whose workers are reconciled.
+type Membership interface {
+	AddWorker(workerURL url.URL)
+	RemoveWorker(workerURL url.URL)
+	GetAllWorkers() []url.URL
+}
+
+// Options configures the providers and how often they are queried.
+type Options struct {
+	// Interval is how often the providers are queried. Defaults to 30
+	// seconds.
+	Interval time.Duration
+	DNS      []DNSOptions
+	Files    []FileOptions
+	Commands []CommandOptions
+}
+
+// Providers creates the providers of the options.
+func (o Options) Providers() ([]Provider, error) {
+	var providers []Provider
+	for _, options := range o.DNS {
+		provider, err := NewDNS(options, nil)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+	for _, options := range o.Files {
+		provider, err := NewFile(options)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+	for _, options := range o.Commands {
+		provider, err := NewCommand(options)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+// ProviderStatus holds the outcome of the last query of a provider.
+type ProviderStatus struct {
+	Provider string    `json:"provider"`
+	Workers  []string  `json:"workers"`
+	Error    string    `json:"error,omitempty"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Watcher queries the providers on an interval and reconciles the
+// membership with the union of the workers they discovered. Workers that
+// were members before they were discovered, e.g. configured ones, are never
+// removed. A provider that fails keeps the workers it discovered last, so
+// that a DNS or file hiccup doesn't empty the pool.
+type Watcher struct {
+	members   Membership
+	providers []Provider
+	interval  time.Duration
+	status    []ProviderStatus
+	// managed holds the workers added by discovery, which it may remove
+	managed  map[url.URL]bool
+	mutex    sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Reconcile queries the providers once and adds and removes workers by the
+// difference to the discovered ones.
+func (w *Watcher) Reconcile(ctx context.Context) {
+	// Providers are queried without holding the lock, since commands and
+	// lookups may take a while
+	workers := make([][]url.URL, len(w.providers))
+	errs := make([]error, len(w.providers))
+	for i, provider := range w.providers {
+		workers[i], errs[i] = provider.Discover(ctx)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for i, provider := range w.providers {
+		status := &w.status[i]
+		status.Updated = time.Now()
+		if errs[i] != nil {
+			log.Printf("Worker discovery from %s failed, keeping its last workers: %v", provider, errs[i])
+			status.Error = errs[i].Error()
+			continue
+		}
+		status.Error = ""
+		status.Workers = urlStrings(workers[i])
+	}
+
+	desired := make(map[url.URL]bool)
+	for _, status := range w.status {
+		for _, worker := range status.Workers {
+			workerURL, _ := url.Parse(worker)
+			desired[*workerURL] = true
+		}
+	}
+
+	current := make(map[url.URL]bool)
+	for _, workerURL := range w.members.GetAllWorkers() {
+		current[workerURL] = true
+	}
+
+	for _, workerURL := range sortedURLs(desired) {
+		if !current[workerURL] {
+			log.Printf("Discovered worker %s", workerURL.String())
+			w.members.AddWorker(workerURL)
+			w.managed[workerURL] = true
+		}
+	}
+	for _, workerURL := range sortedURLs(w.managed) {
+		if desired[workerURL] {
+			continue
+		}
+		delete(w.managed, workerURL)
+		if current[workerURL] {
+			log.Printf("Worker %s is no longer discovered, removing it", workerURL.String())
+			w.members.RemoveWorker(workerURL)
+		}
+	}
+}
+
+// Manage lets discovery remove the workers once they are no longer
+// discovered, as if it had added them.
+func (w *Watcher) Manage(workerUrls []url.URL) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, workerURL := range workerUrls {
+		w.managed[workerURL] = true
+	}
+}
+
+// Run reconciles on the interval until the watcher is stopped.
+func (w *Watcher) Run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.Reconcile(context.Background())
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// Status returns the outcome of the last query of each provider.
+func (w *Watcher) Status() []ProviderStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	status := make([]ProviderStatus, len(w.status))
+	copy(status, w.status)
+	return status
+}
+
+func NewWatcher(members Membership, interval time.Duration, providers ...Provider) *Watcher {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	w := &Watcher{
+		members:   members,
+		providers: providers,
+		interval:  interval,
+		status:    make([]ProviderStatus, len(providers)),
+		managed:   make(map[url.URL]bool),
+		stop:      make(chan struct{}),
+	}
+	for i, provider := range providers {
+		w.status[i].Provider = provider.String()
+	}
+	return w
+}
+
+// parseWorker parses a discovered worker, which may omit the scheme.
+func parseWorker(worker string, scheme string) (url.URL, error) {
+	worker = strings.TrimSpace(worker)
+	if !strings.Contains(worker, "://") {
+		worker = scheme + "://" + worker
+	}
+	workerURL, err := url.Parse(worker)
+	if err != nil || workerURL.Host == "" {
+		return url.URL{}, fmt.Errorf("malformed worker URL: %q", worker)
+	}
+	return *workerURL, nil
+}
+
+func parseWorkers(workers []string) ([]url.URL, error) {
+	workerUrls := make([]url.URL, 0, len(workers))
+	for _, worker := range workers {
+		workerURL, err := parseWorker(worker, "http")
+		if err != nil {
+			return nil, err
+		}
+		workerUrls = append(workerUrls, workerURL)
+	}
+	return workerUrls, nil
+}
+
+func urlStrings(workerUrls []url.URL) []string {
+	workers := make([]string, len(workerUrls))
+	for i, workerURL := range workerUrls {
+		workers[i] = workerURL.String()
+	}
+	sort.Strings(workers)
+	return workers
+}
+
+func sortedURLs(set map[url.URL]bool) []url.URL {
+	workerUrls := make([]url.URL, 0, len(set))
+	for workerURL := range set {
+		workerUrls = append(workerUrls, workerURL)
+	}
+	sort.Slice(workerUrls, func(i, j int) bool { return workerUrls[i].String() < workerUrls[j].String() })
+	return workerUrls
+}
@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DNSOptions configures the lookup of workers behind a DNS name, e.g. a
+// headless service.
+type DNSOptions struct {
+	Name string
+	// Record is "srv" to use the targets and ports of SRV records, or "a" to
+	// use the addresses of A and AAAA records with Port. Defaults to "a".
+	Record string
+	Port   int
+	// Scheme of the worker URLs. Defaults to http.
+	Scheme string
+}
+
+// DNS discovers workers from A/AAAA or SRV records.
+type DNS struct {
+	options  DNSOptions
+	resolver *net.Resolver
+}
+
+func (d *DNS) Discover(ctx context.Context) ([]url.URL, error) {
+	var hosts []string
+	if d.options.Record == "srv" {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", d.options.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			target := strings.TrimSuffix(record.Target, ".")
+			hosts = append(hosts, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+		}
+	} else {
+		addresses, err := d.resolver.LookupIPAddr(ctx, d.options.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			hosts = append(hosts, net.JoinHostPort(address.IP.String(), strconv.Itoa(d.options.Port)))
+		}
+	}
+
+	workerUrls := make([]url.URL, len(hosts))
+	for i, host := range hosts {
+		workerUrls[i] = url.URL{Scheme: d.options.Scheme, Host: host}
+	}
+	return workerUrls, nil
+}
+
+func (d *DNS) String() string {
+	return fmt.Sprintf("dns %s %s", d.options.Record, d.options.Name)
+}
+
+// NewDNS uses the resolver of the system if resolver is nil.
+func NewDNS(options DNSOptions, resolver *net.Resolver) (*DNS, error) {
+	if options.Name == "" {
+		return nil, fmt.Errorf("DNS discovery needs a name")
+	}
+	options.Record = strings.ToLower(options.Record)
+	if options.Record == "" {
+		options.Record = "a"
+	}
+	if options.Record != "a" && options.Record != "srv" {
+		return nil, fmt.Errorf("unknown DNS record %q of %s, expected a or srv", options.Record, options.Name)
+	}
+	if options.Record == "a" && options.Port <= 0 {
+		return nil, fmt.Errorf("DNS discovery of A records of %s needs a port", options.Name)
+	}
+	if options.Scheme == "" {
+		options.Scheme = "http"
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &DNS{options: options, resolver: resolver}, nil
+}
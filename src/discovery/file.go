@@ -0,0 +1,178 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileOptions configures an inventory file of workers.
+type FileOptions struct {
+	Path string
+}
+
+// File discovers workers from a JSON or YAML inventory file, which is read
+// again whenever it changes. See parseInventory for the accepted layouts.
+type File struct {
+	path    string
+	yaml    bool
+	modTime time.Time
+	size    int64
+	workers []url.URL
+	mutex   sync.Mutex
+}
+
+func (f *File) Discover(ctx context.Context) ([]url.URL, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.workers != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.workers, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var workers []string
+	if f.yaml {
+		workers, err = parseYAMLInventory(data)
+	} else {
+		workers, err = parseInventory(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	workerUrls, err := parseWorkers(workers)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	f.modTime, f.size, f.workers = info.ModTime(), info.Size(), workerUrls
+	return workerUrls, nil
+}
+
+func (f *File) String() string {
+	return "file " + f.path
+}
+
+func NewFile(options FileOptions) (*File, error) {
+	if options.Path == "" {
+		return nil, fmt.Errorf("file discovery needs a path")
+	}
+	extension := strings.ToLower(filepath.Ext(options.Path))
+	return &File{path: options.Path, yaml: extension == ".yaml" || extension == ".yml"}, nil
+}
+
+// parseInventory accepts a JSON array of workers, an object with a
+// "workers" array, or the output of `terraform output -json`, where the
+// array is the value of the "workers" output.
+func parseInventory(data []byte) ([]string, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var workers []string
+		if err := json.Unmarshal(data, &workers); err != nil {
+			return nil, fmt.Errorf("malformed inventory: %w", err)
+		}
+		return workers, nil
+	}
+
+	var inventory struct {
+		Workers json.RawMessage `json:"workers"`
+	}
+	if err := json.Unmarshal(data, &inventory); err != nil {
+		return nil, fmt.Errorf("malformed inventory: %w", err)
+	}
+	if inventory.Workers == nil {
+		return nil, fmt.Errorf("inventory has no workers")
+	}
+
+	var workers []string
+	if err := json.Unmarshal(inventory.Workers, &workers); err == nil {
+		return workers, nil
+	}
+	var output struct {
+		Value []string `json:"value"`
+	}
+	if err := json.Unmarshal(inventory.Workers, &output); err != nil {
+		return nil, fmt.Errorf("malformed workers: %w", err)
+	}
+	return output.Value, nil
+}
+
+// parseYAMLInventory accepts the YAML equivalents of parseInventory: a
+// sequence of workers, either at the top level or under a "workers" key,
+// possibly nested under "value". Only plain block and flow sequences of
+// scalars are supported.
+func parseYAMLInventory(data []byte) ([]string, error) {
+	var workers []string
+	// Indentation of the workers key, or -1 outside of it
+	workersIndent := -1
+	hasWorkersKey := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if workersIndent >= 0 && indent <= workersIndent {
+			workersIndent = -1
+		}
+
+		if item, ok := strings.CutPrefix(trimmed, "-"); ok {
+			if workersIndent >= 0 || (!hasWorkersKey && indent == 0) {
+				workers = append(workers, yamlScalar(item))
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed YAML line %q", trimmed)
+		}
+		if strings.TrimSpace(key) != "workers" || workersIndent >= 0 {
+			continue
+		}
+		hasWorkersKey = true
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			for _, item := range strings.Split(strings.Trim(value, "[]"), ",") {
+				if item = yamlScalar(item); item != "" {
+					workers = append(workers, item)
+				}
+			}
+			continue
+		}
+		if value != "" {
+			return nil, fmt.Errorf("workers is not a sequence: %q", value)
+		}
+		workersIndent = indent
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return workers, nil
+}
+
+func yamlScalar(value string) string {
+	return strings.Trim(strings.TrimSpace(value), `"'`)
+}
@@ -0,0 +1,288 @@
+// Package fairqueue admits requests to the workers in a fair order once
+// more requests arrive than the cluster should run at once.
+package fairqueue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when a request would have to wait while the
+	// queue is full.
+	ErrQueueFull = errors.New("fair queue is full")
+)
+
+// Options configures the fair queue.
+type Options struct {
+	// MaxInFlight is the number of requests admitted at once. Further
+	// requests wait in the queue.
+	MaxInFlight int
+	// MaxQueued is the number of waiting requests before new ones are
+	// rejected. Zero means no limit.
+	MaxQueued int
+	// Classes maps priority class names to their priority. Waiting requests
+	// of a higher priority are always admitted first, classes of the same
+	// priority in order of their names. Unknown classes have priority zero.
+	Classes map[string]int
+	// DefaultClass applies to requests without a known class.
+	DefaultClass string
+	// QueueTimeout is how long a request waits before it is rejected. Zero
+	// means until the client gives up.
+	QueueTimeout time.Duration
+
+	// FunctionClasses and FunctionWeights apply to requests without tenant.
+	FunctionClasses map[string]string
+	FunctionWeights map[string]float64
+	// TenantWeights apply to requests with tenant. All requests of a tenant
+	// share a flow.
+	TenantWeights map[string]float64
+}
+
+// Classify returns the class, flow and weight of a request. A class
+// requested by the client is used if it is known and of no higher priority
+// than the class of the function or the default class, so clients can lower
+// the priority of their requests but not raise it.
+func (o Options) Classify(function string, tenant string, requestedClass string) (string, string, float64) {
+	class := o.DefaultClass
+	if functionClass, ok := o.FunctionClasses[function]; ok {
+		class = functionClass
+	}
+	if priority, ok := o.Classes[requestedClass]; ok && priority <= o.Classes[class] {
+		class = requestedClass
+	}
+
+	if tenant != "" {
+		return class, "tenant:" + tenant, o.TenantWeights[tenant]
+	}
+	return class, "function:" + function, o.FunctionWeights[function]
+}
+
+// ClassStats counts the waiting requests of a priority class.
+type ClassStats struct {
+	Priority int            `json:"priority"`
+	Queued   int            `json:"queued"`
+	Flows    map[string]int `json:"flows"`
+}
+
+// Stats is a snapshot of the queue.
+type Stats struct {
+	InFlight int                   `json:"in_flight"`
+	Queued   int                   `json:"queued"`
+	Classes  map[string]ClassStats `json:"classes"`
+}
+
+type waiter struct {
+	admitted chan struct{}
+	flow     *flow
+}
+
+// flow is the queue of a tenant or function within a priority level.
+type flow struct {
+	key     string
+	weight  float64
+	waiters []*waiter
+	deficit float64
+}
+
+// level holds the flows of a priority with waiting requests, served by
+// deficit round robin: the flow at the head gets its weight as credit per
+// round and is served while it has credit for another request.
+type level struct {
+	class    string
+	priority int
+	flows    map[string]*flow
+	active   []*flow
+	credited bool
+}
+
+func (l *level) next() *waiter {
+	for len(l.active) > 0 {
+		f := l.active[0]
+		if !l.credited {
+			f.deficit += f.weight
+			l.credited = true
+		}
+		if f.deficit >= 1 {
+			f.deficit--
+			w := f.waiters[0]
+			f.waiters = f.waiters[1:]
+			if len(f.waiters) == 0 {
+				l.deactivate(f)
+			}
+			return w
+		}
+		l.active = append(l.active[1:], f)
+		l.credited = false
+	}
+	return nil
+}
+
+func (l *level) deactivate(f *flow) {
+	for i, candidate := range l.active {
+		if candidate == f {
+			l.active = append(l.active[:i], l.active[i+1:]...)
+			if i == 0 {
+				l.credited = false
+			}
+			break
+		}
+	}
+	f.deficit = 0
+	delete(l.flows, f.key)
+}
+
+// Queue admits up to MaxInFlight requests at once. Waiting requests are
+// admitted by strict priority of their class, and by weighted deficit round
+// robin across flows of the same class, so one busy flow can't starve the
+// others.
+type Queue struct {
+	options  Options
+	levels   []*level
+	classes  map[string]*level
+	inFlight int
+	queued   int
+	mutex    sync.Mutex
+}
+
+func (q *Queue) getLevel(class string) *level {
+	if l, ok := q.classes[class]; ok {
+		return l
+	}
+
+	l := &level{class: class, priority: q.options.Classes[class], flows: make(map[string]*flow)}
+	q.levels = append(q.levels, l)
+	sort.Slice(q.levels, func(i, j int) bool {
+		if q.levels[i].priority == q.levels[j].priority {
+			return q.levels[i].class < q.levels[j].class
+		}
+		return q.levels[i].priority > q.levels[j].priority
+	})
+	q.classes[class] = l
+	return l
+}
+
+// Acquire waits until the request is admitted and returns the function that
+// releases its slot. The flow is the tenant or function the request belongs
+// to, and its weight the share of admissions it gets relative to the other
+// flows of its class. It fails if the queue is full or the context ends
+// while waiting.
+func (q *Queue) Acquire(ctx context.Context, class string, flowKey string, weight float64) (func(), error) {
+	q.mutex.Lock()
+	if q.inFlight < q.options.MaxInFlight && q.queued == 0 {
+		q.inFlight++
+		q.mutex.Unlock()
+		return q.release, nil
+	}
+	if q.options.MaxQueued > 0 && q.queued >= q.options.MaxQueued {
+		q.mutex.Unlock()
+		return nil, ErrQueueFull
+	}
+
+	if weight <= 0 {
+		weight = 1
+	}
+	l := q.getLevel(class)
+	f, ok := l.flows[flowKey]
+	if !ok {
+		f = &flow{key: flowKey}
+		l.flows[flowKey] = f
+		l.active = append(l.active, f)
+	}
+	f.weight = weight
+	w := &waiter{admitted: make(chan struct{}), flow: f}
+	f.waiters = append(f.waiters, w)
+	q.queued++
+	q.mutex.Unlock()
+
+	select {
+	case <-w.admitted:
+		return q.release, nil
+	case <-ctx.Done():
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+
+		select {
+		case <-w.admitted:
+			// Admitted in the meantime, give the slot to the next one
+			q.inFlight--
+			q.dispatch()
+		default:
+			q.remove(l, w)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (q *Queue) remove(l *level, w *waiter) {
+	f := w.flow
+	for i, candidate := range f.waiters {
+		if candidate == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			q.queued--
+			break
+		}
+	}
+	if len(f.waiters) == 0 {
+		l.deactivate(f)
+	}
+}
+
+func (q *Queue) release() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.inFlight--
+	q.dispatch()
+}
+
+// dispatch admits waiting requests while there are free slots.
+func (q *Queue) dispatch() {
+	for q.inFlight < q.options.MaxInFlight && q.queued > 0 {
+		var w *waiter
+		for _, l := range q.levels {
+			if w = l.next(); w != nil {
+				break
+			}
+		}
+		if w == nil {
+			return
+		}
+		q.queued--
+		q.inFlight++
+		close(w.admitted)
+	}
+}
+
+func (q *Queue) Options() Options {
+	return q.options
+}
+
+func (q *Queue) Stats() Stats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := Stats{InFlight: q.inFlight, Queued: q.queued, Classes: make(map[string]ClassStats)}
+	for class, l := range q.classes {
+		classStats := ClassStats{Priority: l.priority, Flows: make(map[string]int)}
+		for key, f := range l.flows {
+			classStats.Flows[key] = len(f.waiters)
+			classStats.Queued += len(f.waiters)
+		}
+		stats.Classes[class] = classStats
+	}
+	return stats
+}
+
+func NewQueue(options Options) *Queue {
+	if options.MaxInFlight <= 0 {
+		options.MaxInFlight = 1
+	}
+	return &Queue{
+		options: options,
+		classes: make(map[string]*level),
+	}
+}
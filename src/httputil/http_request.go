@@ -35,3 +35,22 @@ func Get2ndPathSegment(r *http.Request, firstSegment string) string {
 
 	return components[1]
 }
+
+// GetPathSegmentAfter returns the single path segment that follows the given
+// leading segments, e.g. "foo" for /admin/prewarm/foo with leading segments
+// "admin" and "prewarm".
+func GetPathSegmentAfter(r *http.Request, leading ...string) string {
+	components := GetUrlComponents(r)
+
+	if len(components) != len(leading)+1 {
+		return ""
+	}
+
+	for i, segment := range leading {
+		if components[i] != segment {
+			return ""
+		}
+	}
+
+	return components[len(leading)]
+}
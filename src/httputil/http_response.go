@@ -1,6 +1,7 @@
 package httputil
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 )
@@ -37,6 +38,31 @@ func (arw *AppendResponseWriter) WriteHeader(status int) {
 	arw.Status = status
 }
 
+// BufferResponseWriter keeps the whole response in memory, e.g. for
+// invocations whose client is not waiting on the connection.
+type BufferResponseWriter struct {
+	headers http.Header
+	Body    []byte
+	Status  int
+}
+
+func NewBufferResponseWriter() *BufferResponseWriter {
+	return &BufferResponseWriter{headers: make(http.Header), Status: http.StatusOK}
+}
+
+func (brw *BufferResponseWriter) Header() http.Header {
+	return brw.headers
+}
+
+func (brw *BufferResponseWriter) Write(body []byte) (int, error) {
+	brw.Body = append(brw.Body, body...)
+	return len(body), nil
+}
+
+func (brw *BufferResponseWriter) WriteHeader(status int) {
+	brw.Status = status
+}
+
 type ObserverResponseWriter struct {
 	Body   []byte
 	Status int
@@ -61,6 +87,32 @@ func (orw *ObserverResponseWriter) WriteHeader(status int) {
 	orw.rw.WriteHeader(status)
 }
 
+// Unwrap gives http.ResponseController access to the wrapped writer.
+func (orw *ObserverResponseWriter) Unwrap() http.ResponseWriter {
+	return orw.rw
+}
+
+// StatusResponseWriter records the status code written to the wrapped
+// ResponseWriter without buffering the body.
+type StatusResponseWriter struct {
+	http.ResponseWriter
+	Status int
+}
+
+func NewStatusResponseWriter(rw http.ResponseWriter) *StatusResponseWriter {
+	return &StatusResponseWriter{ResponseWriter: rw, Status: http.StatusOK}
+}
+
+func (srw *StatusResponseWriter) WriteHeader(status int) {
+	srw.Status = status
+	srw.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap gives http.ResponseController access to the wrapped writer.
+func (srw *StatusResponseWriter) Unwrap() http.ResponseWriter {
+	return srw.ResponseWriter
+}
+
 func New500Error(msg string) *HttpError {
 	return &HttpError{Code: http.StatusInternalServerError, Msg: msg}
 }
@@ -73,3 +125,10 @@ func RespondWithError(w http.ResponseWriter, err *HttpError) {
 	log.Printf("Could not handle request: %s\n", err.Msg)
 	http.Error(w, err.Msg, err.Code)
 }
+
+func RespondWithJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Could not encode response: %v\n", err)
+	}
+}
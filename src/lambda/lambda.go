@@ -1,6 +1,33 @@
 package lambda
 
+import "strings"
+
+// NamespaceSeparator joins the namespace and name of a function in its ID.
+// Function names must not contain it.
+const NamespaceSeparator = "__"
+
 // Lambda is a struct with info about the lambda function to run.
 type Lambda struct {
 	Name string
+	// Namespace of the tenant the function belongs to. Empty for functions
+	// without tenant.
+	Namespace string
+}
+
+// ID identifies the function across tenants. It is the name of the function
+// on the workers, and balancers key their state on it, so functions of the
+// same name in different namespaces don't share sandboxes.
+func (l *Lambda) ID() string {
+	if l.Namespace == "" {
+		return l.Name
+	}
+	return l.Namespace + NamespaceSeparator + l.Name
+}
+
+// ParseID returns the function with the ID.
+func ParseID(id string) *Lambda {
+	if namespace, name, ok := strings.Cut(id, NamespaceSeparator); ok {
+		return &Lambda{Name: name, Namespace: namespace}
+	}
+	return &Lambda{Name: id}
 }
@@ -0,0 +1,188 @@
+package loadgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"hiku/trace"
+)
+
+// Benchmarks are the FunctionBench benchmarks deployed by the setup scripts,
+// as copies named <benchmark>-<copy>.
+var Benchmarks = []string{
+	"chameleon",
+	"dd",
+	"float_operation",
+	"gzip_compression",
+	"json_dumps_loads",
+	"linpack",
+	"matmul",
+	"pyaes",
+}
+
+var payloads = map[string]string{
+	"chameleon":        `{"num_of_rows": 250, "num_of_cols": 250, "metadata": ""}`,
+	"dd":               `{"bs": "1024", "count": "100000"}`,
+	"float_operation":  `{"n": 100000, "metadata": ""}`,
+	"gzip_compression": `{"file_size": 5}`,
+	"json_dumps_loads": `{"link": "https://api.nobelprize.org/2.1/nobelPrizes"}`,
+	"linpack":          `{"n": 100, "metadata": ""}`,
+	"matmul":           `{"n": 100, "metadata": ""}`,
+	"pyaes":            `{"length_of_message": 100, "num_of_iterations": 100, "metadata": ""}`,
+}
+
+// Payload returns the request body for a benchmark copy such as "matmul-3".
+func Payload(function string) []byte {
+	benchmark := strings.SplitN(function, "-", 2)[0]
+	if payload, ok := payloads[benchmark]; ok {
+		return []byte(payload)
+	}
+	return []byte("{}")
+}
+
+// Workload samples functions of the Azure Functions trace and maps them onto
+// the deployed benchmark copies, as evaluation/load_test.js does.
+type Workload struct {
+	Functions     []string
+	probabilities []float64
+	rng           *rand.Rand
+}
+
+// NewWorkload reads the invocation probabilities of Azure functions and
+// samples as many of them as there are benchmark copies. The same seed
+// yields the same workload, so balancers can be compared fairly.
+func NewWorkload(probabilitiesFile string, copies int, seed int64) (*Workload, error) {
+	content, err := os.ReadFile(probabilitiesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var probabilities map[string]struct {
+		Probability float64 `json:"probability"`
+	}
+	if err := json.Unmarshal(content, &probabilities); err != nil {
+		return nil, err
+	}
+
+	total := len(Benchmarks) * copies
+	if copies < 1 || len(probabilities) < total {
+		return nil, fmt.Errorf("cannot sample %d functions from %d", total, len(probabilities))
+	}
+
+	hashes := make([]string, 0, len(probabilities))
+	for hash := range probabilities {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(hashes), func(i, j int) {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	})
+
+	w := &Workload{
+		Functions:     make([]string, total),
+		probabilities: make([]float64, total),
+		rng:           rng,
+	}
+	var sum float64
+	for i, hash := range hashes[:total] {
+		w.Functions[i] = Benchmarks[i%len(Benchmarks)] + "-" + strconv.Itoa(i/len(Benchmarks))
+		w.probabilities[i] = probabilities[hash].Probability
+		sum += w.probabilities[i]
+	}
+	for i := range w.probabilities {
+		w.probabilities[i] /= sum
+	}
+	return w, nil
+}
+
+func (w *Workload) choose() string {
+	value := w.rng.Float64()
+	var accumulated float64
+	for i, probability := range w.probabilities {
+		accumulated += probability
+		if value <= accumulated {
+			return w.Functions[i]
+		}
+	}
+	return w.Functions[len(w.Functions)-1]
+}
+
+// Stage is a phase of open-loop load with a constant arrival rate.
+type Stage struct {
+	Rate     float64
+	Duration time.Duration
+}
+
+// ParseStages parses stages like "20:100s,50:100s", i.e. the arrival rate in
+// requests per second and the duration of each stage.
+func ParseStages(value string) ([]Stage, error) {
+	var stages []Stage
+	for _, part := range strings.Split(value, ",") {
+		fields := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid stage %q, expecting <rate>:<duration>", part)
+		}
+		rate, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate in stage %q", part)
+		}
+		duration, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration in stage %q", part)
+		}
+		stages = append(stages, Stage{Rate: rate, Duration: duration})
+	}
+	return stages, nil
+}
+
+// Poisson generates invocations with exponentially distributed inter-arrival
+// times at the rate of each stage.
+func (w *Workload) Poisson(stages []Stage) []trace.Invocation {
+	var invocations []trace.Invocation
+	var stageStart time.Duration
+	for _, stage := range stages {
+		offset := stageStart
+		for {
+			offset += time.Duration(w.rng.ExpFloat64() / stage.Rate * float64(time.Second))
+			if offset >= stageStart+stage.Duration {
+				break
+			}
+			function := w.choose()
+			invocations = append(invocations, trace.Invocation{
+				Offset:   offset,
+				Function: function,
+				Body:     Payload(function),
+			})
+		}
+		stageStart += stage.Duration
+	}
+	return invocations
+}
+
+// FromTrace keeps the arrival times of a trace and maps each function of the
+// trace onto a benchmark copy, in order of first appearance.
+func (w *Workload) FromTrace(invocations []trace.Invocation) []trace.Invocation {
+	mapping := make(map[string]string)
+	mapped := make([]trace.Invocation, len(invocations))
+	for i, invocation := range invocations {
+		function, ok := mapping[invocation.Function]
+		if !ok {
+			function = w.Functions[len(mapping)%len(w.Functions)]
+			mapping[invocation.Function] = function
+		}
+		mapped[i] = trace.Invocation{
+			Offset:   invocation.Offset,
+			Function: function,
+			Body:     Payload(function),
+		}
+	}
+	return mapped
+}
@@ -0,0 +1,57 @@
+package loadgen
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"hiku/replay"
+)
+
+type point struct {
+	Type   string    `json:"type"`
+	Metric string    `json:"metric"`
+	Data   pointData `json:"data"`
+}
+
+type pointData struct {
+	Time  string            `json:"time"`
+	Value float64           `json:"value"`
+	Tags  map[string]string `json:"tags"`
+}
+
+// WriteK6Results writes the results in the JSON output format of k6, so runs
+// of the load generator are plotted by evaluation/plot.py like k6 runs.
+// Requests that got no response are written with status "0", like k6 does.
+func WriteK6Results(w io.Writer, target string, results []replay.Result) error {
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(map[string]interface{}{
+		"type":   "Metric",
+		"metric": "http_req_duration",
+		"data":   map[string]string{"type": "trend", "contains": "time"},
+	}); err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		err := encoder.Encode(point{
+			Type:   "Point",
+			Metric: "http_req_duration",
+			Data: pointData{
+				Time:  result.Start.Format(time.RFC3339Nano),
+				Value: result.LatencyMs,
+				Tags: map[string]string{
+					"method":   "POST",
+					"name":     target + "/run/" + result.Function,
+					"status":   strconv.Itoa(result.Status),
+					"function": result.Function,
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"hiku/config"
+	"hiku/loadgen"
+	"hiku/replay"
 	"hiku/server"
+	"hiku/simulator"
+	"hiku/testing/fakeworker"
+	"hiku/trace"
 
 	"github.com/urfave/cli"
 )
@@ -24,19 +33,241 @@ func createCliApp() *cli.App {
 	}
 	app.Commands = []cli.Command{
 		cli.Command{Name: "start", Usage: "Start Hiku",
-			UsageText:   "hiku start [-c|--config=FILEPATH]",
+			UsageText:   "hiku start [-c|--config=FILEPATH] [--zone=ZONE]",
 			Description: "The scheduler starts with settings from config json file.",
-			Flags:       []cli.Flag{configFlag},
+			Flags: []cli.Flag{configFlag,
+				cli.StringFlag{Name: "zone", Usage: "Zone of the scheduler, overriding the config", EnvVar: "HIKU_ZONE"},
+			},
 			Action: func(c *cli.Context) error {
 				cfgFilePath := c.String("config")
 				cfg := config.LoadConfigFromFile(cfgFilePath)
+				if zone := c.String("zone"); zone != "" {
+					cfg.Zone = zone
+				}
 				return server.Start(cfg.ToConfig())
 			},
 		},
+		cli.Command{Name: "simulate", Usage: "Replay a trace against balancers with simulated workers",
+			UsageText: "hiku simulate --trace=FILEPATH [-c|--config=FILEPATH] [--balancer=NAME[,NAME...]] [OPTIONS]",
+			Description: "Replays an Azure Functions CSV or JSON lines trace against each balancer in a " +
+				"discrete-event simulation and reports warm-start ratio, latency percentiles and load imbalance. " +
+				"Balancer settings are taken from the config file, if given.",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Usage: "Config json file with balancer settings"},
+				cli.StringFlag{Name: "trace, t", Usage: "Trace file, Azure Functions CSV (.csv) or JSON lines"},
+				cli.StringFlag{Name: "balancer, b", Usage: "Comma separated balancers, or \"all\" (default: from config)"},
+				cli.IntFlag{Name: "workers, w", Usage: "Number of simulated workers", Value: 4},
+				cli.DurationFlag{Name: "cold-start", Usage: "Cold-start cost of a sandbox", Value: 500 * time.Millisecond},
+				cli.DurationFlag{Name: "exec", Usage: "Warm execution time if the trace has none", Value: 100 * time.Millisecond},
+				cli.DurationFlag{Name: "keep-alive", Usage: "Idle time until a worker evicts a sandbox (0 = never)", Value: 10 * time.Minute},
+				cli.IntFlag{Name: "concurrency", Usage: "Concurrent invocations per worker (0 = unlimited)"},
+				cli.Int64Flag{Name: "seed", Usage: "Seed for spreading Azure trace invocations within a minute", Value: 1},
+				cli.BoolFlag{Name: "json", Usage: "Print reports as JSON"},
+			},
+			Action: simulate,
+		},
+		cli.Command{Name: "replay", Usage: "Re-send a captured trace against a scheduler",
+			UsageText: "hiku replay --trace=FILEPATH --target=URL [--speed=FACTOR] [--out=FILEPATH]",
+			Description: "Sends the invocations of a trace to the /run/ endpoint of a scheduler at their original " +
+				"arrival times, optionally scaled, and reports status codes and latency percentiles.",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "trace, t", Usage: "Trace file, Azure Functions CSV (.csv) or JSON lines"},
+				cli.StringFlag{Name: "target", Usage: "Scheduler URL", Value: "http://localhost:9020"},
+				cli.Float64Flag{Name: "speed", Usage: "Arrival rate factor, e.g. 2 for twice as fast", Value: 1},
+				cli.DurationFlag{Name: "timeout", Usage: "Timeout per request (0 = none)"},
+				cli.StringFlag{Name: "payload", Usage: "Body for invocations captured without one", Value: "{}"},
+				cli.StringFlag{Name: "out, o", Usage: "Write per-request results as JSON lines to this file"},
+				cli.Int64Flag{Name: "seed", Usage: "Seed for spreading Azure trace invocations within a minute", Value: 1},
+			},
+			Action: replayTrace,
+		},
+		cli.Command{Name: "loadgen", Usage: "Generate the evaluation workload against a scheduler",
+			UsageText: "hiku loadgen --target=URL [--copies=N] [--seed=SEED] [--stages=RATES | --trace=FILEPATH] [--out=FILEPATH]",
+			Description: "Samples functions by their invocation probability in the Azure Functions trace, maps them " +
+				"onto the deployed benchmark copies and invokes them open-loop, with Poisson arrivals at the rates " +
+				"of the stages or at the arrival times of a trace. Results are written in the JSON format of k6.",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "target", Usage: "Scheduler URL", Value: "http://localhost:9020"},
+				cli.StringFlag{Name: "probabilities", Usage: "Invocation probabilities of Azure functions",
+					Value: "evaluation/azure_function_probabilities.json"},
+				cli.IntFlag{Name: "copies", Usage: "Number of deployed copies of each benchmark", Value: 1},
+				cli.Int64Flag{Name: "seed", Usage: "Seed for sampling functions and arrivals", Value: 1},
+				cli.StringFlag{Name: "stages", Usage: "Comma separated <requests per second>:<duration> stages",
+					Value: "20:100s,50:100s,100:100s"},
+				cli.StringFlag{Name: "trace, t", Usage: "Take arrival times from a trace instead of the stages"},
+				cli.DurationFlag{Name: "timeout", Usage: "Timeout per request (0 = none)"},
+				cli.StringFlag{Name: "out, o", Usage: "Write per-request results in the k6 JSON format to this file"},
+			},
+			Action: generateLoad,
+		},
+		cli.Command{Name: "fakeworker", Usage: "Run a fake OpenLambda worker for testing",
+			UsageText: "hiku fakeworker [--addr=HOST:PORT] [--scheduler=URL] [--functions=FILEPATH]",
+			Description: "Serves /run/<name>, /status and /pid like an OpenLambda worker without running any code. " +
+				"Invocations take the configured cold-start and warm latency, idle sandboxes are evicted after the " +
+				"keep-alive or when memory runs out, and evictions are reported to the scheduler.",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "addr", Usage: "Address to listen on", Value: "localhost:5000"},
+				cli.StringFlag{Name: "scheduler", Usage: "Scheduler URL for /destroySandbox callbacks (empty = none)"},
+				cli.StringFlag{Name: "secret", Usage: "Worker secret to sign callbacks with", EnvVar: "HIKU_WORKER_SECRET"},
+				cli.DurationFlag{Name: "cold-start", Usage: "Cold-start latency of a sandbox", Value: 500 * time.Millisecond},
+				cli.DurationFlag{Name: "warm", Usage: "Execution time in a warm sandbox", Value: 100 * time.Millisecond},
+				cli.DurationFlag{Name: "keep-alive", Usage: "Idle time until a sandbox is evicted (0 = never)", Value: 10 * time.Minute},
+				cli.Uint64Flag{Name: "memory-mb", Usage: "Memory available for sandboxes (0 = unlimited)"},
+				cli.Uint64Flag{Name: "function-memory-mb", Usage: "Memory of a sandbox", Value: 128},
+				cli.Float64Flag{Name: "failure-rate", Usage: "Fraction of invocations that fail"},
+				cli.StringFlag{Name: "functions", Usage: "JSON file with per-function settings"},
+				cli.Int64Flag{Name: "seed", Usage: "Seed for failure injection", Value: 1},
+			},
+			Action: runFakeWorker,
+		},
 	}
 	return app
 }
 
+func replayTrace(c *cli.Context) error {
+	if c.String("trace") == "" {
+		return cli.NewExitError("A trace file is required (--trace)", 1)
+	}
+	invocations, err := trace.ReadFile(c.String("trace"), c.Int64("seed"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Cannot read trace (%s)", err), 1)
+	}
+
+	results := replay.Run(invocations, replay.Options{
+		Target:  c.String("target"),
+		Speed:   c.Float64("speed"),
+		Timeout: c.Duration("timeout"),
+		Payload: []byte(c.String("payload")),
+	})
+
+	if out := c.String("out"); out != "" {
+		file, createErr := os.Create(out)
+		if createErr != nil {
+			return cli.NewExitError(fmt.Sprintf("Cannot create results file (%s)", createErr), 1)
+		}
+		defer file.Close()
+		if writeErr := replay.WriteResults(file, results); writeErr != nil {
+			return cli.NewExitError(fmt.Sprintf("Cannot write results (%s)", writeErr), 1)
+		}
+	}
+
+	replay.WriteSummary(os.Stdout, results)
+	return nil
+}
+
+func generateLoad(c *cli.Context) error {
+	workload, err := loadgen.NewWorkload(c.String("probabilities"), c.Int("copies"), c.Int64("seed"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Cannot create workload (%s)", err), 1)
+	}
+
+	var invocations []trace.Invocation
+	if c.String("trace") != "" {
+		recorded, readErr := trace.ReadFile(c.String("trace"), c.Int64("seed"))
+		if readErr != nil {
+			return cli.NewExitError(fmt.Sprintf("Cannot read trace (%s)", readErr), 1)
+		}
+		invocations = workload.FromTrace(recorded)
+	} else {
+		stages, parseErr := loadgen.ParseStages(c.String("stages"))
+		if parseErr != nil {
+			return cli.NewExitError(parseErr.Error(), 1)
+		}
+		invocations = workload.Poisson(stages)
+	}
+
+	results := replay.Run(invocations, replay.Options{
+		Target:  c.String("target"),
+		Timeout: c.Duration("timeout"),
+	})
+
+	if out := c.String("out"); out != "" {
+		file, createErr := os.Create(out)
+		if createErr != nil {
+			return cli.NewExitError(fmt.Sprintf("Cannot create results file (%s)", createErr), 1)
+		}
+		defer file.Close()
+		if writeErr := loadgen.WriteK6Results(file, c.String("target"), results); writeErr != nil {
+			return cli.NewExitError(fmt.Sprintf("Cannot write results (%s)", writeErr), 1)
+		}
+	}
+
+	replay.WriteSummary(os.Stdout, results)
+	return nil
+}
+
+func runFakeWorker(c *cli.Context) error {
+	options := fakeworker.Options{
+		Default: fakeworker.FunctionConfig{
+			ColdStart:   c.Duration("cold-start"),
+			Warm:        c.Duration("warm"),
+			MemoryMB:    c.Uint64("function-memory-mb"),
+			FailureRate: c.Float64("failure-rate"),
+		},
+		KeepAlive:       c.Duration("keep-alive"),
+		MemoryMB:        c.Uint64("memory-mb"),
+		SchedulerURL:    c.String("scheduler"),
+		SchedulerSecret: c.String("secret"),
+		Seed:            c.Int64("seed"),
+	}
+
+	if path := c.String("functions"); path != "" {
+		functions, err := fakeworker.LoadFunctions(path, options.Default)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Cannot read functions (%s)", err), 1)
+		}
+		options.Functions = functions
+	}
+
+	return fakeworker.NewWorker(options).ListenAndServe(c.String("addr"))
+}
+
+func simulate(c *cli.Context) error {
+	cfg := config.JSONConfig{Balancer: "pull-based"}
+	if cfgFilePath := c.String("config"); cfgFilePath != "" {
+		cfg = config.LoadConfigFromFile(cfgFilePath)
+	}
+
+	balancerNames := []string{cfg.Balancer}
+	if names := c.String("balancer"); names == "all" {
+		balancerNames = config.BalancerNames
+	} else if names != "" {
+		balancerNames = strings.Split(names, ",")
+	}
+
+	if c.String("trace") == "" {
+		return cli.NewExitError("A trace file is required (--trace)", 1)
+	}
+	invocations, err := trace.ReadFile(c.String("trace"), c.Int64("seed"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Cannot read trace (%s)", err), 1)
+	}
+
+	reports, err := simulator.Compare(cfg, balancerNames, invocations, simulator.Options{
+		Workers:     c.Int("workers"),
+		ColdStart:   c.Duration("cold-start"),
+		Exec:        c.Duration("exec"),
+		KeepAlive:   c.Duration("keep-alive"),
+		Concurrency: c.Int("concurrency"),
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if c.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reports)
+	}
+	for i, report := range reports {
+		if i > 0 {
+			fmt.Println()
+		}
+		report.WriteText(os.Stdout)
+	}
+	return nil
+}
+
 func main() {
 	app := createCliApp()
 	app.Run(os.Args)
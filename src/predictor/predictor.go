@@ -0,0 +1,181 @@
+package predictor
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Options configures the inter-arrival time predictor. Zero values are
+// replaced by the defaults below.
+type Options struct {
+	// BinWidth is the resolution of the inter-arrival time histograms.
+	BinWidth time.Duration
+	// Bins is the number of histogram bins. Inter-arrival times longer than
+	// BinWidth * Bins are counted as out of bounds.
+	Bins int
+	// Percentile is the head percentile of the histogram used as the
+	// predicted time until the next invocation.
+	Percentile float64
+	// Lead is how long before the predicted invocation the function is
+	// pre-warmed.
+	Lead time.Duration
+	// MinSamples is the number of inter-arrival times needed before
+	// predictions are made for a function.
+	MinSamples uint64
+	// MinInterArrival skips functions whose predicted inter-arrival time is
+	// shorter, as their sandboxes are kept alive by the workers anyway.
+	MinInterArrival time.Duration
+	// MaxOutOfBounds is the share of out-of-bounds samples above which the
+	// histogram is deemed not representative and no prediction is made.
+	MaxOutOfBounds float64
+}
+
+const (
+	defaultBinWidth       = time.Second
+	defaultBins           = 600
+	defaultPercentile     = 5
+	defaultLead           = time.Second
+	defaultMinSamples     = 10
+	defaultMaxOutOfBounds = 0.5
+)
+
+func (o Options) withDefaults() Options {
+	if o.BinWidth <= 0 {
+		o.BinWidth = defaultBinWidth
+	}
+	if o.Bins <= 0 {
+		o.Bins = defaultBins
+	}
+	if o.Percentile <= 0 {
+		o.Percentile = defaultPercentile
+	}
+	if o.Lead <= 0 {
+		o.Lead = defaultLead
+	}
+	if o.MinSamples == 0 {
+		o.MinSamples = defaultMinSamples
+	}
+	if o.MaxOutOfBounds <= 0 {
+		o.MaxOutOfBounds = defaultMaxOutOfBounds
+	}
+	return o
+}
+
+type histogram struct {
+	bins        []uint64
+	total       uint64
+	outOfBounds uint64
+	lastArrival time.Time
+	timer       *time.Timer
+}
+
+// Predictor learns a histogram of inter-arrival times per function, similar
+// to the hybrid histogram policy of Shahrad et al. (ATC '20), and pre-warms a
+// function shortly before its next invocation is expected.
+type Predictor struct {
+	options    Options
+	histograms map[string]*histogram
+	prewarm    func(functionType string)
+	stopped    bool
+	mutex      sync.Mutex
+}
+
+// Observe records an invocation of a function at the given time and
+// schedules the next pre-warm if the function's history allows a prediction.
+func (p *Predictor) Observe(functionType string, arrival time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	h, ok := p.histograms[functionType]
+	if !ok {
+		h = &histogram{bins: make([]uint64, p.options.Bins)}
+		p.histograms[functionType] = h
+	}
+
+	if !h.lastArrival.IsZero() {
+		bin := int(arrival.Sub(h.lastArrival) / p.options.BinWidth)
+		if bin < len(h.bins) {
+			h.bins[bin]++
+		} else {
+			h.outOfBounds++
+		}
+		h.total++
+	}
+	h.lastArrival = arrival
+
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+
+	if p.stopped {
+		return
+	}
+	predicted, ok := p.predict(h)
+	if !ok || predicted < p.options.MinInterArrival {
+		return
+	}
+
+	delay := predicted - p.options.Lead
+	if delay <= 0 {
+		return
+	}
+	h.timer = time.AfterFunc(delay, func() {
+		log.Printf("Pre-warming %s, next invocation predicted in %s", functionType, p.options.Lead)
+		p.prewarm(functionType)
+	})
+}
+
+// Predict returns the predicted time between two invocations of a function.
+func (p *Predictor) Predict(functionType string) (time.Duration, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	h, ok := p.histograms[functionType]
+	if !ok {
+		return 0, false
+	}
+	return p.predict(h)
+}
+
+func (p *Predictor) predict(h *histogram) (time.Duration, bool) {
+	if h.total < p.options.MinSamples {
+		return 0, false
+	}
+	if float64(h.outOfBounds)/float64(h.total) > p.options.MaxOutOfBounds {
+		return 0, false
+	}
+
+	threshold := float64(h.total) * p.options.Percentile / 100
+	var cumulative uint64
+	for bin, count := range h.bins {
+		cumulative += count
+		if count > 0 && float64(cumulative) >= threshold {
+			return time.Duration(bin) * p.options.BinWidth, true
+		}
+	}
+	return 0, false
+}
+
+// Stop cancels all scheduled pre-warms and schedules no further ones.
+func (p *Predictor) Stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.stopped = true
+	for _, h := range p.histograms {
+		if h.timer != nil {
+			h.timer.Stop()
+			h.timer = nil
+		}
+	}
+}
+
+func NewPredictor(options Options, prewarm func(functionType string)) *Predictor {
+	return &Predictor{
+		options:    options.withDefaults(),
+		histograms: make(map[string]*histogram),
+		prewarm:    prewarm,
+	}
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault describes a failure injected into requests proxied to workers. A
+// fault applies to the requests matching all of its targets.
+type Fault struct {
+	ID string
+	// Function targets invocations of a single function. Requests that are
+	// no invocations, e.g. status checks, only match faults without one.
+	Function string
+	// Worker targets a single worker by host, e.g. "10.0.0.1:5000".
+	Worker string
+	// Percentage of matching requests the fault is injected into. Zero
+	// means all of them.
+	Percentage float64
+
+	// Delay is added before the request is proxied.
+	Delay time.Duration
+	// AbortStatus answers the request with this status code instead of
+	// proxying it.
+	AbortStatus int
+	// Drop closes the client connection without a response.
+	Drop bool
+	// Blackout makes the worker unreachable, the request fails with 502
+	// like a refused connection.
+	Blackout bool
+
+	// Duration after which the fault is removed. Zero keeps it until it is
+	// removed explicitly.
+	Duration time.Duration
+	// Expires is set from Duration when the fault is added.
+	Expires time.Time
+}
+
+func (f *Fault) matches(function string, workerURL url.URL) bool {
+	if f.Function != "" && f.Function != function {
+		return false
+	}
+	if f.Worker != "" && f.Worker != workerURL.Host && f.Worker != workerURL.String() {
+		return false
+	}
+	return true
+}
+
+// FaultInjector wraps a ReverseProxy and injects faults into the proxied
+// requests. It is meant for staging, to validate retries, health checking
+// and client behavior without killing real workers.
+type FaultInjector struct {
+	proxy  ReverseProxy
+	faults []Fault
+	nextID int
+	rng    *rand.Rand
+	now    func() time.Time
+	mutex  sync.Mutex
+}
+
+// Faults returns the active faults.
+func (f *FaultInjector) Faults() []Fault {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.removeExpired()
+	faults := make([]Fault, len(f.faults))
+	copy(faults, f.faults)
+	return faults
+}
+
+// AddFault activates a fault and returns it with its ID and expiry set.
+func (f *FaultInjector) AddFault(fault Fault) Fault {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if fault.ID == "" {
+		// Skip IDs that were given to faults explicitly
+		for fault.ID == "" || f.indexOf(fault.ID) != -1 {
+			f.nextID++
+			fault.ID = strconv.Itoa(f.nextID)
+		}
+	}
+	if fault.Duration > 0 {
+		fault.Expires = f.now().Add(fault.Duration)
+	}
+
+	// Replace a fault with the same ID
+	if i := f.indexOf(fault.ID); i != -1 {
+		f.faults[i] = fault
+		return fault
+	}
+	f.faults = append(f.faults, fault)
+	return fault
+}
+
+func (f *FaultInjector) indexOf(id string) int {
+	for i := range f.faults {
+		if f.faults[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// RemoveFault deactivates a fault and reports whether it was active.
+func (f *FaultInjector) RemoveFault(id string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i := range f.faults {
+		if f.faults[i].ID == id {
+			f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ClearFaults deactivates all faults.
+func (f *FaultInjector) ClearFaults() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.faults = nil
+}
+
+func (f *FaultInjector) removeExpired() {
+	now := f.now()
+	active := f.faults[:0]
+	for _, fault := range f.faults {
+		if fault.Expires.IsZero() || now.Before(fault.Expires) {
+			active = append(active, fault)
+		}
+	}
+	f.faults = active
+}
+
+// pick returns the total delay and the first fault that ends the request,
+// if any, for a request to the worker.
+func (f *FaultInjector) pick(function string, workerURL url.URL) (time.Duration, *Fault) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.removeExpired()
+	var delay time.Duration
+	for i := range f.faults {
+		fault := &f.faults[i]
+		if !fault.matches(function, workerURL) {
+			continue
+		}
+		if fault.Percentage > 0 && f.rng.Float64()*100 >= fault.Percentage {
+			continue
+		}
+
+		delay += fault.Delay
+		if fault.Blackout || fault.Drop || fault.AbortStatus != 0 {
+			terminal := *fault
+			return delay, &terminal
+		}
+	}
+	return delay, nil
+}
+
+func (f *FaultInjector) ProxyRequest(workerURL url.URL, w http.ResponseWriter, r *http.Request) {
+	function := ""
+	if components := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(components) == 2 && components[0] == "run" {
+		function = components[1]
+	}
+
+	delay, fault := f.pick(function, workerURL)
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch {
+	case fault == nil:
+		f.proxy.ProxyRequest(workerURL, w, r)
+	case fault.Blackout:
+		log.Printf("Injected fault %s: blackout of %s [%s]", fault.ID, workerURL.Host, r.URL.Path)
+		http.Error(w, "worker unreachable (injected fault)", http.StatusBadGateway)
+	case fault.Drop:
+		log.Printf("Injected fault %s: dropped connection [%s]", fault.ID, r.URL.Path)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			// The connection can't be taken over, e.g. with HTTP/2 or for
+			// warm-up invocations, so fail like a reset worker connection
+			http.Error(w, "connection dropped (injected fault)", http.StatusBadGateway)
+			return
+		}
+		conn.Close()
+	default:
+		log.Printf("Injected fault %s: abort with %d [%s]", fault.ID, fault.AbortStatus, r.URL.Path)
+		http.Error(w, "injected fault", fault.AbortStatus)
+	}
+}
+
+func NewFaultInjector(proxy ReverseProxy, faults []Fault) *FaultInjector {
+	f := &FaultInjector{
+		proxy: proxy,
+		rng:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:   time.Now,
+	}
+	for _, fault := range faults {
+		f.AddFault(fault)
+	}
+	return f
+}
@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -18,9 +20,44 @@ type ReverseProxy interface {
 	ProxyRequest(workerURL url.URL, w http.ResponseWriter, r *http.Request)
 }
 
+// TLSOptions configures the connections to workers with https URLs.
+type TLSOptions struct {
+	// Default applies to workers without their own configuration. Nil
+	// means the default TLS settings.
+	Default *tls.Config
+	// Workers maps worker hosts, e.g. "10.0.0.1:5000", to their
+	// configuration, e.g. with a CA bundle of their own.
+	Workers map[string]*tls.Config
+	// RequireTLS refuses to proxy requests to workers with http URLs.
+	RequireTLS bool
+}
+
 type HTTPReverseProxy struct {
-	proxyMap map[url.URL]*httputil.ReverseProxy
-	mutex    sync.Mutex
+	proxyMap   map[url.URL]*httputil.ReverseProxy
+	tlsOptions TLSOptions
+	transports map[*tls.Config]http.RoundTripper
+	mutex      sync.Mutex
+}
+
+// transport returns the shared transport of a TLS configuration, so
+// connections are reused across proxies of workers with the same one.
+func (p *HTTPReverseProxy) transport(workerURL url.URL) http.RoundTripper {
+	config, ok := p.tlsOptions.Workers[workerURL.Host]
+	if !ok {
+		config = p.tlsOptions.Default
+	}
+	if config == nil {
+		return http.DefaultTransport
+	}
+
+	transport, ok := p.transports[config]
+	if !ok {
+		defaultTransport := http.DefaultTransport.(*http.Transport).Clone()
+		defaultTransport.TLSClientConfig = config
+		transport = defaultTransport
+		p.transports[config] = transport
+	}
+	return transport
 }
 
 func (p *HTTPReverseProxy) getReverseProxyForWorker(workerURL url.URL) *httputil.ReverseProxy {
@@ -30,6 +67,7 @@ func (p *HTTPReverseProxy) getReverseProxyForWorker(workerURL url.URL) *httputil
 	proxy := p.proxyMap[workerURL]
 	if proxy == nil {
 		proxy = httputil.NewSingleHostReverseProxy(&workerURL)
+		proxy.Transport = p.transport(workerURL)
 		p.proxyMap[workerURL] = proxy
 	}
 
@@ -37,13 +75,27 @@ func (p *HTTPReverseProxy) getReverseProxyForWorker(workerURL url.URL) *httputil
 }
 
 func (p *HTTPReverseProxy) ProxyRequest(workerURL url.URL, w http.ResponseWriter, r *http.Request) {
+	if p.tlsOptions.RequireTLS && workerURL.Scheme != "https" {
+		log.Printf("Refusing to proxy to %s without TLS", workerURL.String())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
 	proxy := p.getReverseProxyForWorker(workerURL)
 	proxy.ServeHTTP(w, r)
 }
 
 func NewHTTPReverseProxy() ReverseProxy {
+	return NewHTTPSReverseProxy(TLSOptions{})
+}
+
+// NewHTTPSReverseProxy creates a proxy that connects to https workers with
+// the given TLS configurations.
+func NewHTTPSReverseProxy(tlsOptions TLSOptions) ReverseProxy {
 	return &HTTPReverseProxy{
-		proxyMap: make(map[url.URL]*httputil.ReverseProxy),
-		mutex:    sync.Mutex{},
+		proxyMap:   make(map[url.URL]*httputil.ReverseProxy),
+		tlsOptions: tlsOptions,
+		transports: make(map[*tls.Config]http.RoundTripper),
+		mutex:      sync.Mutex{},
 	}
 }
@@ -0,0 +1,268 @@
+// Package ratelimit limits the request rate of functions and tenants with
+// token buckets.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit allows Rate requests per second on average and bursts of up to
+// Burst requests.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// pruneInterval is how often buckets that refilled completely are dropped.
+// A full bucket is the same as a new one.
+const pruneInterval = time.Minute
+
+// Options configures the limits. Functions and tenants without a limit of
+// their own get the default limit, if it has a positive rate, or none.
+type Options struct {
+	// KeyHeader is the request header with the tenant or API key. Defaults
+	// to X-Hiku-Tenant.
+	KeyHeader string `json:"key_header,omitempty"`
+
+	Functions       map[string]Limit `json:"functions"`
+	Tenants         map[string]Limit `json:"tenants"`
+	DefaultFunction Limit            `json:"default_function"`
+	DefaultTenant   Limit            `json:"default_tenant"`
+}
+
+// Decision is the result of a rate limit check. Limit, Remaining and Reset
+// describe the bucket that is closest to running out.
+type Decision struct {
+	Allowed bool
+	// Limited is false if neither the function nor the tenant has a limit
+	Limited   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the request would be allowed
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	limit   Limit
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens accrued since the last update.
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.limit.burst(), b.tokens+elapsed*b.limit.Rate)
+	}
+	b.updated = now
+}
+
+func (b *bucket) untilTokens(tokens float64) time.Duration {
+	missing := tokens - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(missing / b.limit.Rate * float64(time.Second)))
+}
+
+// Limiter keeps a token bucket per function and per tenant. A request takes
+// a token from both buckets, so it is only allowed if both have one left.
+type Limiter struct {
+	options   Options
+	functions map[string]*bucket
+	tenants   map[string]*bucket
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+func (rl *Limiter) limitOf(limits map[string]Limit, defaultLimit Limit, key string) (Limit, bool) {
+	if limit, ok := limits[key]; ok {
+		return limit, limit.Rate > 0
+	}
+	return defaultLimit, defaultLimit.Rate > 0
+}
+
+func (rl *Limiter) getBucket(buckets map[string]*bucket, limit Limit, key string, now time.Time) *bucket {
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{limit: limit, tokens: limit.burst(), updated: now}
+		buckets[key] = b
+		return b
+	}
+	if b.limit != limit {
+		b.refill(now)
+		b.limit = limit
+		b.tokens = math.Min(b.tokens, limit.burst())
+	}
+	return b
+}
+
+// prune drops the buckets that refilled completely, so that buckets of
+// functions and tenants that are no longer seen don't pile up.
+func (rl *Limiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < pruneInterval {
+		return
+	}
+	rl.lastPrune = now
+	for _, buckets := range []map[string]*bucket{rl.functions, rl.tenants} {
+		for key, b := range buckets {
+			b.refill(now)
+			if b.tokens >= b.limit.burst() {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// Allow takes a token for a request to the function by the tenant, which
+// may be empty, and reports whether the request may proceed.
+func (rl *Limiter) Allow(function string, tenant string) Decision {
+	return rl.AllowAt(function, tenant, time.Now())
+}
+
+// AllowAt is Allow at the given time.
+func (rl *Limiter) AllowAt(function string, tenant string, now time.Time) Decision {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.prune(now)
+	var buckets []*bucket
+	if limit, ok := rl.limitOf(rl.options.Functions, rl.options.DefaultFunction, function); ok {
+		buckets = append(buckets, rl.getBucket(rl.functions, limit, function, now))
+	}
+	if tenant != "" {
+		if limit, ok := rl.limitOf(rl.options.Tenants, rl.options.DefaultTenant, tenant); ok {
+			buckets = append(buckets, rl.getBucket(rl.tenants, limit, tenant, now))
+		}
+	}
+	if len(buckets) == 0 {
+		return Decision{Allowed: true}
+	}
+
+	decision := Decision{Allowed: true, Limited: true}
+	for _, b := range buckets {
+		b.refill(now)
+		if b.tokens < 1 {
+			decision.Allowed = false
+			if wait := b.untilTokens(1); wait > decision.RetryAfter {
+				decision.RetryAfter = wait
+			}
+		}
+	}
+	if decision.Allowed {
+		for _, b := range buckets {
+			b.tokens--
+		}
+	}
+
+	var closest *bucket
+	for _, b := range buckets {
+		if closest == nil || b.tokens < closest.tokens {
+			closest = b
+		}
+	}
+	decision.Limit = int(closest.limit.burst())
+	decision.Remaining = int(math.Max(0, math.Floor(closest.tokens)))
+	decision.Reset = closest.untilTokens(closest.limit.burst())
+	return decision
+}
+
+// SetFunctionLimit changes the limit of a function. A limit with a rate of
+// zero exempts the function from the default limit.
+func (rl *Limiter) SetFunctionLimit(function string, limit Limit) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.options.Functions[function] = limit
+}
+
+// RemoveFunctionLimit makes the default limit apply to the function again.
+func (rl *Limiter) RemoveFunctionLimit(function string) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	_, ok := rl.options.Functions[function]
+	delete(rl.options.Functions, function)
+	delete(rl.functions, function)
+	return ok
+}
+
+// HasTenantLimit reports whether the tenant has a limit of its own.
+func (rl *Limiter) HasTenantLimit(tenant string) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	_, ok := rl.options.Tenants[tenant]
+	return ok
+}
+
+// SetTenantLimit changes the limit of a tenant. A limit with a rate of zero
+// exempts the tenant from the default limit.
+func (rl *Limiter) SetTenantLimit(tenant string, limit Limit) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.options.Tenants[tenant] = limit
+}
+
+// RemoveTenantLimit makes the default limit apply to the tenant again.
+func (rl *Limiter) RemoveTenantLimit(tenant string) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	_, ok := rl.options.Tenants[tenant]
+	delete(rl.options.Tenants, tenant)
+	delete(rl.tenants, tenant)
+	return ok
+}
+
+// Buckets returns the number of buckets kept.
+func (rl *Limiter) Buckets() int {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return len(rl.functions) + len(rl.tenants)
+}
+
+// Options returns a copy of the current limits.
+func (rl *Limiter) Options() Options {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	options := rl.options
+	options.Functions = make(map[string]Limit, len(rl.options.Functions))
+	for function, limit := range rl.options.Functions {
+		options.Functions[function] = limit
+	}
+	options.Tenants = make(map[string]Limit, len(rl.options.Tenants))
+	for tenant, limit := range rl.options.Tenants {
+		options.Tenants[tenant] = limit
+	}
+	return options
+}
+
+func NewLimiter(options Options) *Limiter {
+	functions := make(map[string]Limit, len(options.Functions))
+	for function, limit := range options.Functions {
+		functions[function] = limit
+	}
+	tenants := make(map[string]Limit, len(options.Tenants))
+	for tenant, limit := range options.Tenants {
+		tenants[tenant] = limit
+	}
+	options.Functions = functions
+	options.Tenants = tenants
+
+	return &Limiter{
+		options:   options,
+		functions: make(map[string]*bucket),
+		tenants:   make(map[string]*bucket),
+	}
+}
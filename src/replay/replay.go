@@ -0,0 +1,154 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"hiku/stats"
+	"hiku/trace"
+)
+
+// Options configures how a trace is sent to a scheduler.
+type Options struct {
+	// Target is the base URL of the scheduler, e.g. http://localhost:9020.
+	Target string
+	// Speed scales the arrival rate of the trace, e.g. 2 replays it twice as
+	// fast. Defaults to the original rate.
+	Speed float64
+	// Timeout of a single request. Zero means no timeout.
+	Timeout time.Duration
+	// Payload is sent for invocations whose trace record has no body or
+	// only a truncated one.
+	Payload []byte
+}
+
+// Result is the outcome of a single replayed invocation.
+type Result struct {
+	Function    string    `json:"function"`
+	Start       time.Time `json:"start"`
+	ScheduledMs float64   `json:"scheduled_ms"`
+	LatencyMs   float64   `json:"latency_ms"`
+	Status      int       `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	// BodyTruncated is set if the payload was sent because the captured
+	// body was truncated
+	BodyTruncated bool `json:"body_truncated,omitempty"`
+}
+
+// Run sends the invocations open-loop: every invocation is sent at its offset
+// in the trace, regardless of how long earlier ones take to respond.
+func Run(invocations []trace.Invocation, options Options) []Result {
+	speed := options.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	payload := options.Payload
+	if payload == nil {
+		payload = []byte("{}")
+	}
+	target := strings.TrimSuffix(options.Target, "/")
+
+	client := &http.Client{
+		Timeout: options.Timeout,
+		Transport: &http.Transport{
+			MaxIdleConns:        1024,
+			MaxIdleConnsPerHost: 1024,
+		},
+	}
+
+	results := make([]Result, len(invocations))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, invocation := range invocations {
+		scheduled := time.Duration(float64(invocation.Offset) / speed)
+		time.Sleep(time.Until(start.Add(scheduled)))
+
+		// A truncated body would be sent as if it were the request
+		body := invocation.Body
+		if body == nil || invocation.Truncated {
+			body = payload
+		}
+
+		wg.Add(1)
+		go func(result *Result, invocation trace.Invocation, body []byte) {
+			defer wg.Done()
+			*result = send(client, target, invocation.Function, body)
+			result.ScheduledMs = float64(scheduled) / float64(time.Millisecond)
+			result.BodyTruncated = invocation.Truncated
+		}(&results[i], invocation, body)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func send(client *http.Client, target string, function string, body []byte) Result {
+	result := Result{Function: function, Start: time.Now()}
+
+	resp, err := client.Post(target+"/run/"+function, "application/json", bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		result.LatencyMs = float64(time.Since(result.Start)) / float64(time.Millisecond)
+		return result
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	result.LatencyMs = float64(time.Since(result.Start)) / float64(time.Millisecond)
+	return result
+}
+
+// WriteResults writes one JSON line per result.
+func WriteResults(w io.Writer, results []Result) error {
+	encoder := json.NewEncoder(w)
+	for _, result := range results {
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSummary prints the status codes and latency percentiles of a run.
+func WriteSummary(w io.Writer, results []Result) {
+	statuses := make(map[int]int)
+	errors := 0
+	truncated := 0
+	latencies := make([]time.Duration, 0, len(results))
+	for _, result := range results {
+		if result.Error != "" {
+			errors++
+		} else {
+			statuses[result.Status]++
+		}
+		if result.BodyTruncated {
+			truncated++
+		}
+		latencies = append(latencies, time.Duration(result.LatencyMs*float64(time.Millisecond)))
+	}
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	fmt.Fprintf(w, "Requests:     %d (%d errors)\n", len(results), errors)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d: %d\n", code, statuses[code])
+	}
+	if truncated > 0 {
+		fmt.Fprintf(w, "Truncated:    %d captured bodies, replaced by the payload\n", truncated)
+	}
+	latency := stats.SummarizeLatencies(latencies)
+	fmt.Fprintf(w, "Latency (ms): mean %.1f, p50 %.1f, p90 %.1f, p99 %.1f, p99.9 %.1f, max %.1f\n",
+		latency.Mean, latency.P50, latency.P90, latency.P99, latency.P999, latency.Max)
+}
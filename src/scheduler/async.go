@@ -0,0 +1,150 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"hiku/async"
+	"hiku/httputil"
+	"hiku/lambda"
+)
+
+// CallbackHeader holds the URL that receives the result of an asynchronous
+// invocation once it completed.
+const CallbackHeader = "X-Hiku-Callback"
+
+// DurableHeader marks invocations that are persisted in the durable queue
+// and retried until they complete, even across restarts.
+const DurableHeader = "X-Hiku-Durable"
+
+func isDurable(r *http.Request) bool {
+	value := strings.ToLower(r.Header.Get(DurableHeader))
+	return value != "" && value != "false" && value != "0"
+}
+
+// RunAsync is an HTTP request handler that expects requests of form
+// /async/<lambdaName>. It queues the invocation and responds with 202 and
+// the invocation at once. The invocation later runs like one sent to Run.
+// With several replicas, it is queued by the replica owning the function.
+func (s *Scheduler) RunAsync(w http.ResponseWriter, r *http.Request) {
+	l, err := s.getLambdaInfoFromRequest(r)
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	if s.forward(w, r, l) {
+		return
+	}
+	if tenantErr := s.resolveTenant(r, l); tenantErr != nil {
+		httputil.RespondWithError(w, tenantErr)
+		return
+	}
+	if limitErr := s.limitRate(w, r, l); limitErr != nil {
+		httputil.RespondWithError(w, limitErr)
+		s.tenants.Throttled(l)
+		return
+	}
+	s.submit(w, r, l, isDurable(r))
+}
+
+func (s *Scheduler) submit(w http.ResponseWriter, r *http.Request, l *lambda.Lambda, durable bool) {
+	callbackURL := r.Header.Get(CallbackHeader)
+	if callbackURL != "" {
+		if callbackErr := s.async.CheckCallback(callbackURL); callbackErr != nil {
+			httputil.RespondWithError(w, httputil.New400Error(callbackErr.Error()))
+			return
+		}
+	}
+
+	body, readErr := io.ReadAll(r.Body)
+	if readErr != nil {
+		httputil.RespondWithError(w, httputil.New400Error("Could not read request body"))
+		return
+	}
+
+	var invocation async.Invocation
+	var submitErr error
+	if durable {
+		invocation, submitErr = s.async.SubmitDurable(l.ID(), body, r.Header.Get("Content-Type"), callbackURL)
+	} else {
+		invocation, submitErr = s.async.Submit(l.ID(), body, r.Header.Get("Content-Type"), callbackURL)
+	}
+	if submitErr == async.ErrDurableDisabled {
+		httputil.RespondWithError(w, httputil.New400Error("Durable invocations are not enabled"))
+		return
+	}
+	if submitErr == async.ErrQueueFull {
+		httputil.RespondWithError(w, &httputil.HttpError{Code: http.StatusServiceUnavailable, Msg: submitErr.Error()})
+		return
+	}
+	if submitErr != nil {
+		httputil.RespondWithError(w, httputil.New500Error("Could not queue invocation: "+submitErr.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/invocations/"+invocation.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(invocation)
+}
+
+func (s *Scheduler) DurableStats() (async.DurableStats, *httputil.HttpError) {
+	stats, err := s.async.DurableStats()
+	if err != nil {
+		return stats, httputil.New400Error("Durable invocations are not enabled")
+	}
+	return stats, nil
+}
+
+func (s *Scheduler) DeadLetters() ([]async.Invocation, *httputil.HttpError) {
+	deadLetters, err := s.async.DeadLetters()
+	if err == async.ErrDurableDisabled {
+		return nil, httputil.New400Error("Durable invocations are not enabled")
+	}
+	if err != nil {
+		return nil, httputil.New500Error("Could not read dead letters: " + err.Error())
+	}
+	return deadLetters, nil
+}
+
+func (s *Scheduler) GetInvocation(id string) (async.Invocation, *httputil.HttpError) {
+	invocation, ok, err := s.async.Get(id)
+	if err != nil {
+		return async.Invocation{}, httputil.New500Error("Could not read invocation: " + err.Error())
+	}
+	if !ok {
+		return async.Invocation{}, &httputil.HttpError{Code: http.StatusNotFound, Msg: "No invocation with ID " + id}
+	}
+	return invocation, nil
+}
+
+// runAsync sends a queued invocation through the balancer and proxy and
+// keeps the response. It was rate limited when it was submitted. Functions
+// of tenants are queued by their namespaced ID.
+func (s *Scheduler) runAsync(function string, body []byte, contentType string) async.Response {
+	r, reqErr := http.NewRequest("POST", "/run/"+function, bytes.NewReader(body))
+	if reqErr != nil {
+		return async.Response{Status: http.StatusInternalServerError, Body: reqErr.Error()}
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	w := httputil.NewBufferResponseWriter()
+	s.serve(w, r, lambda.ParseID(function))
+	return async.Response{
+		Status:      w.Status,
+		ContentType: w.Header().Get("Content-Type"),
+		Body:        string(w.Body),
+	}
+}
+
+func newAsyncStore(options async.Options) (async.Store, error) {
+	if options.StoreFile == "" {
+		return async.NewMemoryStore(), nil
+	}
+	return async.NewFileStore(options.StoreFile)
+}
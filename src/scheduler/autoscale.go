@@ -0,0 +1,84 @@
+package scheduler
+
+import (
+	"net/url"
+
+	"hiku/autoscale"
+	"hiku/balancer"
+	"hiku/httputil"
+)
+
+// autoscaleSource provides the load of the scheduler to the autoscaler.
+type autoscaleSource struct {
+	s *Scheduler
+}
+
+func (a autoscaleSource) Workers() []url.URL {
+	return a.s.balancer.GetAllWorkers()
+}
+
+// Queued counts the invocations waiting in the fair queue and for
+// concurrency.
+func (a autoscaleSource) Queued() int {
+	queued := 0
+	if a.s.fairQueue != nil {
+		queued += a.s.fairQueue.Stats().Queued
+	}
+	for _, function := range a.s.concurrency.Stats().Functions {
+		queued += function.Queued
+	}
+	return queued
+}
+
+// ColdStarts counts the idle-queue misses of balancers that keep idle
+// queues. Other balancers report none.
+func (a autoscaleSource) ColdStarts() (uint64, uint64) {
+	provider, ok := a.s.balancer.(balancer.IdleQueueStatsProvider)
+	if !ok {
+		return 0, 0
+	}
+	var coldStarts, invocations uint64
+	for _, stats := range provider.IdleQueueStats() {
+		coldStarts += stats.Misses
+		invocations += stats.Hits + stats.Misses
+	}
+	return coldStarts, invocations
+}
+
+func (a autoscaleSource) Drain(workerURL url.URL) {
+	if balancer.FindUrlInSlice(a.s.balancer.GetAllWorkers(), workerURL) != -1 {
+		a.s.balancer.RemoveWorker(workerURL)
+	}
+}
+
+// discoveredMembers keeps worker discovery from adding drained workers
+// back. They look like members to it until they are no longer discovered.
+type discoveredMembers struct {
+	s *Scheduler
+}
+
+func (m discoveredMembers) AddWorker(workerURL url.URL) {
+	if !m.s.autoscaler.Draining(workerURL) {
+		m.s.balancer.AddWorker(workerURL)
+	}
+}
+
+func (m discoveredMembers) RemoveWorker(workerURL url.URL) {
+	if m.s.autoscaler.Draining(workerURL) {
+		m.s.autoscaler.Undrain(workerURL)
+		return
+	}
+	m.s.balancer.RemoveWorker(workerURL)
+}
+
+func (m discoveredMembers) GetAllWorkers() []url.URL {
+	return append(m.s.balancer.GetAllWorkers(), m.s.autoscaler.DrainingWorkers()...)
+}
+
+// Autoscaling returns the last recommended number of workers.
+func (s *Scheduler) Autoscaling() (autoscale.Recommendation, *httputil.HttpError) {
+	if s.autoscaler == nil {
+		return autoscale.Recommendation{}, httputil.New400Error("Autoscaling is not enabled")
+	}
+	return s.autoscaler.Recommendation(), nil
+}
@@ -0,0 +1,53 @@
+package scheduler
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"hiku/balancer"
+	"hiku/lambda"
+	"hiku/trace"
+)
+
+// bufferBody reads the request body for capturing and replaces it, so that
+// it can still be proxied to the worker.
+func (s *Scheduler) bufferBody(r *http.Request) []byte {
+	if r.Body == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading body for capture: %v", err)
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+// capture records an invocation to the trace file if capture is enabled.
+func (s *Scheduler) capture(l *lambda.Lambda, arrival time.Time, workerURL url.URL, outcome balancer.Outcome, body []byte) {
+	if s.recorder == nil {
+		return
+	}
+
+	record := trace.Record{
+		Time:      arrival,
+		Function:  l.Name,
+		Tenant:    s.tenants.TenantOf(l.Namespace),
+		Status:    outcome.Status,
+		LatencyMs: float64(outcome.Latency) / float64(time.Millisecond),
+	}
+	if workerURL.Host != "" {
+		record.Worker = workerURL.String()
+	}
+	s.recorder.SetBody(&record, body)
+
+	if err := s.recorder.Record(record); err != nil {
+		log.Printf("Error capturing invocation: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package scheduler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"hiku/cluster"
+	"hiku/httputil"
+	"hiku/lambda"
+)
+
+// forward sends a request to the replica that owns its function and
+// reports whether it was answered. Requests for functions of this replica,
+// requests another replica forwarded, and requests whose owner is
+// unreachable are left to be served here.
+func (s *Scheduler) forward(w http.ResponseWriter, r *http.Request, l *lambda.Lambda) bool {
+	if s.cluster == nil {
+		return false
+	}
+	if s.cluster.Forwarded(r) {
+		return false
+	}
+	owner, local := s.cluster.Owner(l.Name)
+	if local {
+		return false
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, _ = io.ReadAll(r.Body)
+		r.Body.Close()
+	}
+	if err := s.cluster.Forward(owner, w, r, body); err == nil {
+		return true
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return false
+}
+
+// Forward passes a request for a function to the replica owning it like
+// Run does, for endpoints served outside the scheduler such as pre-warming.
+func (s *Scheduler) Forward(w http.ResponseWriter, r *http.Request, l *lambda.Lambda) bool {
+	return s.forward(w, r, l)
+}
+
+// FindInvocation asks the other replicas for an invocation that is not
+// known here, since asynchronous invocations are queued by the owner of
+// their function. It reports whether a replica answered.
+func (s *Scheduler) FindInvocation(w http.ResponseWriter, r *http.Request) bool {
+	if s.cluster == nil || s.cluster.Forwarded(r) {
+		return false
+	}
+	return s.cluster.Find(w, r)
+}
+
+func (s *Scheduler) ClusterStatus() ([]cluster.ReplicaStatus, *httputil.HttpError) {
+	if s.cluster == nil {
+		return nil, httputil.New400Error("Scheduler replicas are not configured")
+	}
+	return s.cluster.Status(), nil
+}
@@ -0,0 +1,43 @@
+package scheduler
+
+import (
+	"context"
+	"net/http"
+
+	"hiku/concurrency"
+	"hiku/httputil"
+	"hiku/lambda"
+)
+
+// acquireConcurrency waits for a free slot of the function and returns the
+// function that frees it again. Requests over the limit are throttled with
+// 429, like in AWS Lambda.
+func (s *Scheduler) acquireConcurrency(r *http.Request, l *lambda.Lambda) (func(), *httputil.HttpError) {
+	ctx := r.Context()
+	if timeout := s.concurrency.Options().QueueTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	release, err := s.concurrency.Acquire(ctx, l.ID())
+	switch err {
+	case nil:
+		return release, nil
+	case concurrency.ErrThrottled, concurrency.ErrQueueFull:
+		return nil, &httputil.HttpError{Code: http.StatusTooManyRequests, Msg: "Concurrency limit of " + l.ID() + " reached"}
+	default:
+		return nil, &httputil.HttpError{Code: http.StatusTooManyRequests, Msg: "Timed out waiting for concurrency of " + l.ID()}
+	}
+}
+
+func (s *Scheduler) ConcurrencyStats() concurrency.Stats {
+	return s.concurrency.Stats()
+}
+
+func (s *Scheduler) SetConcurrency(l *lambda.Lambda, limit concurrency.FunctionLimit) *httputil.HttpError {
+	if err := s.concurrency.SetFunctionLimit(l.ID(), limit); err != nil {
+		return httputil.New400Error("Invalid concurrency: " + err.Error())
+	}
+	return nil
+}
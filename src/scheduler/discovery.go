@@ -0,0 +1,14 @@
+package scheduler
+
+import (
+	"hiku/discovery"
+	"hiku/httputil"
+)
+
+// DiscoveryStatus returns the workers each discovery provider found last.
+func (s *Scheduler) DiscoveryStatus() ([]discovery.ProviderStatus, *httputil.HttpError) {
+	if s.discovery == nil {
+		return nil, httputil.New400Error("Worker discovery is not enabled")
+	}
+	return s.discovery.Status(), nil
+}
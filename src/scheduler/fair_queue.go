@@ -0,0 +1,53 @@
+package scheduler
+
+import (
+	"context"
+	"net/http"
+
+	"hiku/fairqueue"
+	"hiku/httputil"
+	"hiku/lambda"
+)
+
+const (
+	// PriorityHeader selects the priority class of a request
+	PriorityHeader = "X-Hiku-Priority"
+	// TenantHeader groups the requests of a tenant into one flow
+	TenantHeader = "X-Hiku-Tenant"
+)
+
+// admit waits in the fair queue until the request may be sent to a worker
+// and returns the function that frees its slot again.
+func (s *Scheduler) admit(r *http.Request, l *lambda.Lambda) (func(), *httputil.HttpError) {
+	options := s.fairQueue.Options()
+	// Without tenancy, the tenant header is whatever the client sent
+	tenant := ""
+	if s.tenants.Enabled() {
+		tenant = r.Header.Get(TenantHeader)
+	}
+	class, flow, weight := options.Classify(l.ID(), tenant, r.Header.Get(PriorityHeader))
+
+	ctx := r.Context()
+	if options.QueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.QueueTimeout)
+		defer cancel()
+	}
+
+	release, err := s.fairQueue.Acquire(ctx, class, flow, weight)
+	switch err {
+	case nil:
+		return release, nil
+	case fairqueue.ErrQueueFull:
+		return nil, &httputil.HttpError{Code: http.StatusServiceUnavailable, Msg: "Queue is full"}
+	default:
+		return nil, &httputil.HttpError{Code: http.StatusServiceUnavailable, Msg: "Timed out waiting in queue"}
+	}
+}
+
+func (s *Scheduler) QueueStats() (fairqueue.Stats, *httputil.HttpError) {
+	if s.fairQueue == nil {
+		return fairqueue.Stats{}, httputil.New400Error("Fair queuing is not enabled")
+	}
+	return s.fairQueue.Stats(), nil
+}
@@ -0,0 +1,86 @@
+package scheduler
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"sync"
+
+	"hiku/balancer"
+	"hiku/httputil"
+	"hiku/lambda"
+)
+
+var defaultPrewarmPayload = []byte("{}")
+
+const defaultMaxPrewarmPerWorker = 4
+
+// PrewarmResult reports the outcome of a single warm-up invocation.
+type PrewarmResult struct {
+	Worker string `json:"worker"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// MaxPrewarm returns the number of warm-up invocations a pre-warming request
+// may ask for, which grows with the workers.
+func (s *Scheduler) MaxPrewarm() int {
+	workers := len(s.balancer.GetAllWorkers())
+	if workers < 1 {
+		workers = 1
+	}
+	return workers * s.maxPrewarmPerWorker
+}
+
+// Prewarm picks count workers through the balancer and sends a warm-up
+// invocation to each of them, so that sandboxes are ready before a burst of
+// traffic arrives. Releasing the workers afterwards records the warm
+// sandboxes in the idle queues of balancers that keep them.
+func (s *Scheduler) Prewarm(l *lambda.Lambda, count int, payload []byte) []PrewarmResult {
+	if payload == nil {
+		payload = s.prewarmPayloads[l.ID()]
+	}
+	if payload == nil {
+		payload = s.prewarmPayloads[l.Name]
+	}
+	if payload == nil {
+		payload = defaultPrewarmPayload
+	}
+
+	// Hold all workers at once, otherwise the balancer hands out the
+	// sandbox we have just warmed up
+	results := make([]PrewarmResult, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		r, reqErr := http.NewRequest("POST", "/run/"+l.ID(), bytes.NewReader(payload))
+		if reqErr != nil {
+			results[i] = PrewarmResult{Error: reqErr.Error()}
+			continue
+		}
+		r.Header.Set("Content-Type", "application/json")
+
+		workerURL, err := s.balancer.SelectWorker(r, l)
+		if err != nil {
+			results[i] = PrewarmResult{Error: err.Msg}
+			continue
+		}
+		results[i].Worker = workerURL.String()
+
+		wg.Add(1)
+		go func(result *PrewarmResult) {
+			defer wg.Done()
+
+			w := httputil.NewAppendResponseWriter()
+			s.proxy.ProxyRequest(workerURL, w, r)
+			// The latency includes the cold start, which would make the
+			// worker look slow to latency-aware balancing
+			s.balancer.ReleaseWorker(workerURL, l, balancer.Outcome{Status: w.Status})
+
+			result.Status = w.Status
+			log.Printf("Pre-warmed %s on %s with status %d", l.Name, workerURL.String(), w.Status)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results
+}
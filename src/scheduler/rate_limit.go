@@ -0,0 +1,52 @@
+package scheduler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hiku/httputil"
+	"hiku/lambda"
+	"hiku/ratelimit"
+)
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// limitRate takes a token for the request from the buckets of its function
+// and tenant and sets the X-RateLimit headers. Rejected requests get 429
+// and a Retry-After header.
+//
+// Only tenants resolved from an API key, or with a limit of their own, get
+// a bucket. Otherwise each new value of the header a client sends would
+// create one.
+func (s *Scheduler) limitRate(w http.ResponseWriter, r *http.Request, l *lambda.Lambda) *httputil.HttpError {
+	tenant := r.Header.Get(s.rateLimitHeader)
+	if !s.tenants.Enabled() && !s.rateLimiter.HasTenantLimit(tenant) {
+		tenant = ""
+	}
+	decision := s.rateLimiter.Allow(l.ID(), tenant)
+	if !decision.Limited {
+		return nil
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+	if decision.Allowed {
+		return nil
+	}
+
+	retryAfter := ceilSeconds(decision.RetryAfter)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	return &httputil.HttpError{Code: http.StatusTooManyRequests, Msg: "Rate limit exceeded"}
+}
+
+func (s *Scheduler) RateLimiter() *ratelimit.Limiter {
+	return s.rateLimiter
+}
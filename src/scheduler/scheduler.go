@@ -1,31 +1,62 @@
 package scheduler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"hiku/async"
+	"hiku/autoscale"
 	"hiku/balancer"
+	"hiku/cluster"
+	"hiku/concurrency"
 	"hiku/config"
+	"hiku/discovery"
+	"hiku/fairqueue"
 	"hiku/httputil"
 	"hiku/lambda"
+	"hiku/predictor"
 	"hiku/proxy"
+	"hiku/ratelimit"
+	"hiku/tenancy"
+	"hiku/trace"
 )
 
 // Scheduler is an object that can schedule lambda function workloads to a pool of workers.
 type Scheduler struct {
-	balancer balancer.Balancer
-	proxy    proxy.ReverseProxy
+	balancer        balancer.Balancer
+	proxy           proxy.ReverseProxy
+	predictor       *predictor.Predictor
+	prewarmPayloads map[string][]byte
+	recorder        *trace.Recorder
+	async           *async.Dispatcher
+	fairQueue       *fairqueue.Queue
+	rateLimiter     *ratelimit.Limiter
+	rateLimitHeader string
+	concurrency     *concurrency.Limiter
+	tenants         *tenancy.Registry
+	placement       *balancer.Placement
+	cluster         *cluster.Ring
+	snapshots       *snapshots
+	discovery       *discovery.Watcher
+	autoscaler      *autoscale.Autoscaler
+
+	// maxPrewarmPerWorker caps pre-warming requests
+	maxPrewarmPerWorker int
 }
 
 // Run is an HTTP request handler that expects requests of form
 // /run/<lambdaName>. It extracts the lambda name from the request path
 // and then chooses a worker to run the lambda workload using the configured
 // load balancer. The lambda response is forwarded to the client "as-is"
-// without any modifications.
+// without any modifications. With several replicas, the request is passed
+// on to the replica owning the function.
 func (s *Scheduler) Run(w http.ResponseWriter, r *http.Request) {
 	l, err := s.getLambdaInfoFromRequest(r)
 
@@ -33,31 +64,129 @@ func (s *Scheduler) Run(w http.ResponseWriter, r *http.Request) {
 		httputil.RespondWithError(w, err)
 		return
 	}
+	if s.forward(w, r, l) {
+		return
+	}
+	if tenantErr := s.resolveTenant(r, l); tenantErr != nil {
+		httputil.RespondWithError(w, tenantErr)
+		return
+	}
+
+	if limitErr := s.limitRate(w, r, l); limitErr != nil {
+		httputil.RespondWithError(w, limitErr)
+		s.tenants.Throttled(l)
+		s.capture(l, time.Now(), url.URL{}, balancer.Outcome{Status: limitErr.Code}, nil)
+		return
+	}
+
+	if isDurable(r) {
+		s.submit(w, r, l, true)
+		return
+	}
+	s.serve(w, r, l)
+}
+
+// serve sends a request that passed the rate limits to a worker once its
+// function has a free concurrency slot and the fair queue admits it.
+func (s *Scheduler) serve(w http.ResponseWriter, r *http.Request, l *lambda.Lambda) {
+	var body []byte
+	if s.recorder != nil && s.recorder.CapturesBody() {
+		body = s.bufferBody(r)
+	}
 
 	// Select worker and serve http
 	startTime := time.Now()
+	if s.predictor != nil {
+		s.predictor.Observe(l.ID(), startTime)
+	}
+	releaseTenant, tenantErr := s.acquireTenant(l)
+	if tenantErr != nil {
+		httputil.RespondWithError(w, tenantErr)
+		s.capture(l, startTime, url.URL{}, balancer.Outcome{Status: tenantErr.Code}, body)
+		return
+	}
+	statusWriter := httputil.NewStatusResponseWriter(w)
+	defer func() { releaseTenant(statusWriter.Status) }()
+
+	releaseConcurrency, concurrencyErr := s.acquireConcurrency(r, l)
+	if concurrencyErr != nil {
+		httputil.RespondWithError(statusWriter, concurrencyErr)
+		s.capture(l, startTime, url.URL{}, balancer.Outcome{Status: concurrencyErr.Code}, body)
+		return
+	}
+	defer releaseConcurrency()
+	if s.fairQueue != nil {
+		release, queueErr := s.admit(r, l)
+		if queueErr != nil {
+			httputil.RespondWithError(statusWriter, queueErr)
+			s.capture(l, startTime, url.URL{}, balancer.Outcome{Status: queueErr.Code}, body)
+			return
+		}
+		defer release()
+	}
 	selectedWorkerURL, err := s.balancer.SelectWorker(r, l)
 	log.Printf("Selected worker: %s in %d ns [%s]", selectedWorkerURL.String(), time.Since(startTime).Nanoseconds(), r.URL.Path)
 	if err != nil {
-		httputil.RespondWithError(w, err)
+		httputil.RespondWithError(statusWriter, err)
+		s.capture(l, startTime, url.URL{}, balancer.Outcome{Status: err.Code}, body)
 		return
 	}
+	s.placement.RecordRoute(selectedWorkerURL)
+	s.autoscaler.Started(selectedWorkerURL)
 
-	s.proxy.ProxyRequest(selectedWorkerURL, w, r)
-	s.balancer.ReleaseWorker(selectedWorkerURL, l)
+	proxyStartTime := time.Now()
+	s.proxy.ProxyRequest(selectedWorkerURL, statusWriter, r)
+	outcome := balancer.Outcome{Latency: time.Since(proxyStartTime), Status: statusWriter.Status}
+	s.balancer.ReleaseWorker(selectedWorkerURL, l, outcome)
+	s.autoscaler.Finished(selectedWorkerURL)
+	s.capture(l, startTime, selectedWorkerURL, outcome, body)
 }
 
 func (s *Scheduler) AddWorkers(urls []url.URL) {
 	for _, workerURL := range urls {
+		s.autoscaler.Undrain(workerURL)
 		s.balancer.AddWorker(workerURL)
 	}
 }
 func (s *Scheduler) RemoveWorkers(urls []url.URL) {
 	for _, workerURL := range urls {
+		// Drained workers have already left the balancer
+		if s.autoscaler.Draining(workerURL) {
+			s.autoscaler.Undrain(workerURL)
+			continue
+		}
 		s.balancer.RemoveWorker(workerURL)
 	}
 }
 
+// Close stops the background work of the scheduler and its balancer, runs
+// the queued asynchronous invocations, writes a final snapshot if snapshots
+// are enabled and flushes the captured traffic.
+func (s *Scheduler) Close() error {
+	if s.discovery != nil {
+		s.discovery.Stop()
+	}
+	if s.autoscaler != nil {
+		s.autoscaler.Stop()
+	}
+	if s.predictor != nil {
+		s.predictor.Stop()
+	}
+	s.async.Close()
+
+	var errs []error
+	if s.snapshots != nil {
+		errs = append(errs, s.snapshots.close())
+	}
+	if closer, ok := s.balancer.(interface{ Close() }); ok {
+		closer.Close()
+	}
+	if s.recorder != nil {
+		errs = append(errs, s.recorder.Close())
+	}
+	return errors.Join(errs...)
+}
+
 func (s *Scheduler) DestroySandbox(r *http.Request) {
 	l, err := s.getLambdaInfoFromRequest(r)
 
@@ -65,6 +194,10 @@ func (s *Scheduler) DestroySandbox(r *http.Request) {
 		log.Printf("Error destroying sandbox: %v", err)
 		return
 	}
+	// The idle queues of the function are kept by its owner
+	if s.forward(httputil.NewBufferResponseWriter(), r, l) {
+		return
+	}
 
 	var workerUrl *url.URL
 	decodingError := json.NewDecoder(r.Body).Decode(&workerUrl)
@@ -82,10 +215,90 @@ func (s *Scheduler) StatusCheckAllWorkers(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// IdleQueueStatsReport is the per-function view of the idle-queue statistics
+// used to tune the idle TTL against the keep-alive of the workers.
+type IdleQueueStatsReport struct {
+	balancer.IdleQueueStats
+	WarmRatio                  float64 `json:"warm_ratio"`
+	MeanEvictedIdleTimeSeconds float64 `json:"mean_evicted_idle_time_seconds"`
+}
+
+func (s *Scheduler) IdleQueueStats() (map[string]IdleQueueStatsReport, *httputil.HttpError) {
+	provider, ok := s.balancer.(balancer.IdleQueueStatsProvider)
+	if !ok {
+		return nil, httputil.New400Error("Balancer does not keep idle queues")
+	}
+
+	report := make(map[string]IdleQueueStatsReport)
+	for functionType, stats := range provider.IdleQueueStats() {
+		report[functionType] = IdleQueueStatsReport{
+			IdleQueueStats:             stats,
+			WarmRatio:                  stats.WarmRatio(),
+			MeanEvictedIdleTimeSeconds: stats.MeanEvictedIdleTime().Seconds(),
+		}
+	}
+	return report, nil
+}
+
+func (s *Scheduler) MemoryUsage() (map[string]balancer.WorkerMemory, *httputil.HttpError) {
+	memoryAware, ok := s.balancer.(balancer.MemoryAware)
+	if !ok {
+		return nil, httputil.New400Error("Balancer is not memory-aware")
+	}
+	return memoryAware.MemoryUsage(), nil
+}
+
+func (s *Scheduler) SetFunctionMemory(l *lambda.Lambda, memoryMB uint64) *httputil.HttpError {
+	memoryAware, ok := s.balancer.(balancer.MemoryAware)
+	if !ok {
+		return httputil.New400Error("Balancer is not memory-aware")
+	}
+	memoryAware.SetFunctionMemory(l.ID(), memoryMB)
+	return nil
+}
+
+func (s *Scheduler) WorkerPackages() (map[string][]string, *httputil.HttpError) {
+	packageAware, ok := s.balancer.(balancer.PackageAware)
+	if !ok {
+		return nil, httputil.New400Error("Balancer is not package-aware")
+	}
+	return packageAware.WorkerPackages(), nil
+}
+
+func (s *Scheduler) SetWorkerPackages(workerURL url.URL, packages []string) *httputil.HttpError {
+	packageAware, ok := s.balancer.(balancer.PackageAware)
+	if !ok {
+		return httputil.New400Error("Balancer is not package-aware")
+	}
+	packageAware.SetWorkerPackages(workerURL, packages)
+	return nil
+}
+
+func (s *Scheduler) Placement() (*balancer.Placement, *httputil.HttpError) {
+	if s.placement == nil {
+		return nil, httputil.New400Error("Placement constraints are not enabled")
+	}
+	return s.placement, nil
+}
+
+func (s *Scheduler) FaultInjector() (*proxy.FaultInjector, *httputil.HttpError) {
+	injector, ok := s.proxy.(*proxy.FaultInjector)
+	if !ok {
+		return nil, httputil.New400Error("Fault injection is not enabled")
+	}
+	return injector, nil
+}
+
 func (s *Scheduler) getLambdaInfoFromRequest(r *http.Request) (*lambda.Lambda, *httputil.HttpError) {
 	lambdaName := httputil.Get2ndPathSegment(r, "run")
 	if lambdaName == "" {
-		lambdaName = httputil.Get2ndPathSegment(r, "destroySandbox")
+		lambdaName = httputil.Get2ndPathSegment(r, "async")
+	}
+	if lambdaName == "" {
+		// Workers call back with the namespaced ID of the function
+		if id := httputil.Get2ndPathSegment(r, "destroySandbox"); id != "" {
+			return lambda.ParseID(id), nil
+		}
 	}
 
 	if lambdaName == "" {
@@ -93,14 +306,136 @@ func (s *Scheduler) getLambdaInfoFromRequest(r *http.Request) (*lambda.Lambda, *
 			Msg:  fmt.Sprintf("Could not find lambda name in path %s", r.URL.Path),
 			Code: http.StatusBadRequest}
 	}
+	if strings.Contains(lambdaName, lambda.NamespaceSeparator) {
+		return nil, httputil.New400Error("Lambda names must not contain " + lambda.NamespaceSeparator)
+	}
 
 	return &lambda.Lambda{Name: lambdaName}, nil
 }
 
 func NewScheduler(c config.Config) *Scheduler {
-	return &Scheduler{
-		c.Balancer,
-		c.ReverseProxy,
+	s := &Scheduler{
+		balancer:        c.Balancer,
+		proxy:           c.ReverseProxy,
+		prewarmPayloads: c.PrewarmPayloads,
+		placement:       c.Placement,
+	}
+	s.maxPrewarmPerWorker = c.MaxPrewarmPerWorker
+	if s.maxPrewarmPerWorker <= 0 {
+		s.maxPrewarmPerWorker = defaultMaxPrewarmPerWorker
+	}
+
+	if c.Placement != nil {
+		constrained, ok := c.Balancer.(balancer.Constrained)
+		if !ok {
+			log.Fatalf("Balancer does not support placement constraints")
+		}
+		constrained.SetPlacement(c.Placement)
+	}
+
+	if c.Capture != nil {
+		recorder, recErr := trace.NewRecorder(*c.Capture)
+		if recErr != nil {
+			log.Fatalf("Cannot open capture file (%s)", recErr)
+		}
+		s.recorder = recorder
+	}
+
+	if c.Cluster != nil {
+		ring, ringErr := cluster.NewRing(*c.Cluster)
+		if ringErr != nil {
+			log.Fatalf("Invalid scheduler replicas (%s)", ringErr)
+		}
+		s.cluster = ring
+	}
+
+	tenants, tenantsErr := tenancy.NewRegistry(c.Tenancy)
+	if tenantsErr != nil {
+		log.Fatalf("Invalid tenants (%s)", tenantsErr)
+	}
+	s.tenants = tenants
+
+	s.rateLimiter = ratelimit.NewLimiter(c.RateLimit)
+	s.rateLimitHeader = c.RateLimit.KeyHeader
+	if s.rateLimitHeader == "" || s.tenants.Enabled() {
+		// Tenants are identified by their API key instead
+		s.rateLimitHeader = TenantHeader
+	}
+
+	limiter, limiterErr := concurrency.NewLimiter(c.Concurrency)
+	if limiterErr != nil {
+		log.Fatalf("Invalid concurrency limits (%s)", limiterErr)
+	}
+	s.concurrency = limiter
+
+	if c.FairQueue != nil {
+		s.fairQueue = fairqueue.NewQueue(*c.FairQueue)
+	}
+
+	if c.Predictor != nil {
+		s.predictor = predictor.NewPredictor(*c.Predictor, func(functionType string) {
+			s.Prewarm(lambda.ParseID(functionType), 1, nil)
+		})
+	}
+
+	if c.Autoscale != nil {
+		s.autoscaler = autoscale.NewAutoscaler(*c.Autoscale, autoscaleSource{s})
+	}
+
+	configured := c.Balancer.GetAllWorkers()
+	if c.Discovery != nil {
+		providers, discoveryErr := c.Discovery.Providers()
+		if discoveryErr != nil {
+			log.Fatalf("Invalid worker discovery (%s)", discoveryErr)
+		}
+		s.discovery = discovery.NewWatcher(discoveredMembers{s}, c.Discovery.Interval, providers...)
+		if c.Snapshot != nil {
+			// The state of discovered workers is restored as well
+			s.discovery.Reconcile(context.Background())
+		}
+	}
+
+	if c.Snapshot != nil {
+		s.snapshots = newSnapshots(*c.Snapshot, c.Balancer)
+		if s.snapshots != nil {
+			s.snapshots.restore()
+		}
+	}
+
+	if s.discovery != nil {
+		// Workers restored from a snapshot that are neither configured nor
+		// discovered go once discovery doesn't find them
+		var restored []url.URL
+		for _, workerURL := range c.Balancer.GetAllWorkers() {
+			if balancer.FindUrlInSlice(configured, workerURL) == -1 {
+				restored = append(restored, workerURL)
+			}
+		}
+		s.discovery.Manage(restored)
+	}
+
+	// The background work starts once every field is set, since it uses
+	// them without synchronization. The dispatcher starts its workers right
+	// away, e.g. for invocations recovered from the durable queue.
+	store, storeErr := newAsyncStore(c.Async)
+	if storeErr != nil {
+		log.Fatalf("Cannot open async store (%s)", storeErr)
+	}
+	dispatcher, dispatcherErr := async.NewDispatcher(store, c.Async, s.runAsync)
+	if dispatcherErr != nil {
+		log.Fatalf("Cannot open durable queue (%s)", dispatcherErr)
+	}
+	s.async = dispatcher
+
+	if s.autoscaler != nil {
+		go s.autoscaler.Run()
+	}
+	if s.discovery != nil {
+		go s.discovery.Run()
+	}
+	if s.snapshots != nil && c.Snapshot.Interval > 0 {
+		go s.snapshots.run()
 	}
 
+	return s
 }
@@ -0,0 +1,102 @@
+package scheduler
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+
+	"hiku/balancer"
+	"hiku/snapshot"
+)
+
+// snapshots writes the learned state of the balancer to a file in the
+// background and on shutdown.
+type snapshots struct {
+	options     snapshot.Options
+	balancer    balancer.Balancer
+	snapshotter balancer.Snapshotter
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+func newSnapshots(options snapshot.Options, b balancer.Balancer) *snapshots {
+	snapshotter, ok := b.(balancer.Snapshotter)
+	if !ok {
+		log.Printf("Balancer does not support snapshots, its state is not persisted")
+		return nil
+	}
+	return &snapshots{
+		options:     options,
+		balancer:    b,
+		snapshotter: snapshotter,
+		stop:        make(chan struct{}),
+	}
+}
+
+// restore loads the snapshot file into the balancer. A missing file is
+// not an error, e.g. on the first start. The workers of the snapshot are
+// only added if the options ask for it, otherwise just the state of the
+// current workers is restored.
+func (s *snapshots) restore() {
+	restored, err := snapshot.Read(s.options.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No snapshot at %s, starting without learned state", s.options.File)
+		return
+	}
+	if err != nil {
+		log.Printf("Cannot read snapshot %s (%s), starting without learned state", s.options.File, err)
+		return
+	}
+	if restored.Version > balancer.SnapshotVersion {
+		log.Printf("Snapshot %s has the newer version %d, restoring the known parts", s.options.File, restored.Version)
+	}
+
+	snapshot.Trim(&restored, s.options.MaxAge, time.Now())
+	if s.options.RestoreWorkers {
+		current := s.balancer.GetAllWorkers()
+		for _, workerURL := range balancer.CreateWorkerURLSlice(restored.Workers) {
+			if balancer.FindUrlInSlice(current, workerURL) == -1 {
+				s.balancer.AddWorker(workerURL)
+			}
+		}
+	}
+	s.snapshotter.Restore(restored)
+	log.Printf("Restored snapshot of %s with %d workers and %d functions", restored.Time.Format(time.RFC3339), len(restored.Workers), len(restored.Functions))
+}
+
+func (s *snapshots) save() error {
+	return snapshot.Write(s.options.File, s.snapshotter.Snapshot())
+}
+
+func (s *snapshots) run() {
+	ticker := time.NewTicker(s.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				log.Printf("Cannot write snapshot (%s)", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close stops the background writes and writes a final snapshot.
+func (s *snapshots) close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	return s.save()
+}
+
+// SaveSnapshot writes the learned state of the balancer to the snapshot
+// file.
+func (s *Scheduler) SaveSnapshot() error {
+	if s.snapshots == nil {
+		return errors.New("snapshots are not enabled")
+	}
+	return s.snapshots.save()
+}
@@ -0,0 +1,49 @@
+package scheduler
+
+import (
+	"net/http"
+
+	"hiku/httputil"
+	"hiku/lambda"
+	"hiku/tenancy"
+)
+
+// resolveTenant moves a request into the namespace of the tenant its API
+// key belongs to. The tenant header is replaced with the resolved tenant,
+// so rate limits and fair queuing can't be claimed for another tenant, and
+// the API key is not passed on to workers.
+func (s *Scheduler) resolveTenant(r *http.Request, l *lambda.Lambda) *httputil.HttpError {
+	if !s.tenants.Enabled() {
+		return nil
+	}
+
+	header := s.tenants.APIKeyHeader()
+	tenant, err := s.tenants.Resolve(r.Header.Get(header))
+	if err != nil {
+		return &httputil.HttpError{Code: http.StatusUnauthorized, Msg: "Invalid tenant: " + err.Error()}
+	}
+	r.Header.Del(header)
+	r.Header.Del(TenantHeader)
+	if tenant == nil {
+		return nil
+	}
+
+	r.Header.Set(TenantHeader, tenant.Name)
+	l.Namespace = tenant.Namespace
+	r.URL.Path = "/run/" + l.ID()
+	return nil
+}
+
+// acquireTenant counts the invocation against the quota of its tenant and
+// returns the function that records its status once it completed.
+func (s *Scheduler) acquireTenant(l *lambda.Lambda) (func(status int), *httputil.HttpError) {
+	release, err := s.tenants.Acquire(l)
+	if err == tenancy.ErrQuotaExceeded {
+		return nil, &httputil.HttpError{Code: http.StatusTooManyRequests, Msg: "Tenant quota exceeded"}
+	}
+	return release, nil
+}
+
+func (s *Scheduler) TenantUsage() map[string]tenancy.Usage {
+	return s.tenants.Usage()
+}
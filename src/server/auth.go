@@ -0,0 +1,78 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"hiku/auth"
+	"hiku/httputil"
+)
+
+// route describes who may call an endpoint and how. Requests to audited
+// routes are written to the audit log, including rejected ones.
+type route struct {
+	role    auth.Role
+	methods []string
+	audited bool
+	// writeRole is required instead of role for methods other than GET if
+	// set
+	writeRole auth.Role
+}
+
+func (rt route) requiredRole(method string) auth.Role {
+	if rt.writeRole != "" && method != http.MethodGet {
+		return rt.writeRole
+	}
+	return rt.role
+}
+
+func (rt route) allowsMethod(method string) bool {
+	if len(rt.methods) == 0 {
+		return true
+	}
+	for _, allowed := range rt.methods {
+		if method == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// protect wraps a handler with the method and role checks of its route.
+func (h *handlers) protect(rt route, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !rt.allowsMethod(r.Method) {
+			if rt.audited {
+				h.authenticator.Audit(r, auth.Principal{}, http.StatusMethodNotAllowed)
+			}
+			w.Header().Set("Allow", strings.Join(rt.methods, ", "))
+			httputil.RespondWithError(w, &httputil.HttpError{Code: http.StatusMethodNotAllowed, Msg: "Method not allowed"})
+			return
+		}
+
+		principal, err := h.authenticator.Authorize(r, rt.requiredRole(r.Method))
+		if err != nil {
+			code := http.StatusUnauthorized
+			if err == auth.ErrForbidden {
+				code = http.StatusForbidden
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			log.Printf("Rejected %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			if rt.audited {
+				h.authenticator.Audit(r, principal, code)
+			}
+			httputil.RespondWithError(w, &httputil.HttpError{Code: code, Msg: http.StatusText(code)})
+			return
+		}
+
+		if !rt.audited {
+			handler(w, r)
+			return
+		}
+		statusWriter := httputil.NewStatusResponseWriter(w)
+		handler(statusWriter, r)
+		h.authenticator.Audit(r, principal, statusWriter.Status)
+	}
+}
@@ -1,18 +1,40 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"hiku/auth"
+	"hiku/balancer"
+	"hiku/concurrency"
 	"hiku/config"
 	"hiku/httputil"
+	"hiku/lambda"
+	"hiku/ratelimit"
 	"hiku/scheduler"
+	"hiku/tlsutil"
 )
 
-var myScheduler *scheduler.Scheduler
-var myConfig config.Config
+// shutdownTimeout is how long requests in flight may take on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// handlers serve the endpoints of one scheduler, so that several schedulers
+// can be served in the same process.
+type handlers struct {
+	scheduler     *scheduler.Scheduler
+	authenticator *auth.Authenticator
+}
 
 func parseWorkerURLs(querySlice []string) ([]url.URL, *httputil.HttpError) {
 	totalWorkers := len(querySlice)
@@ -34,11 +56,11 @@ func parseWorkerURLs(querySlice []string) ([]url.URL, *httputil.HttpError) {
 // Run expects POST requests like this:
 //
 // curl -X POST <host>:<port>/run/<lambda-name> -d '{"param0": "value0"}'
-func runHandler(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) runHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Receive request to %s\n", r.URL.Path)
 
 	observer := httputil.NewObserverResponseWriter(w)
-	myScheduler.Run(observer, r)
+	h.scheduler.Run(observer, r)
 
 	log.Printf("Response Status: %d [%s]", observer.Status, r.URL.Path)
 	if observer.Status == 500 || observer.Status == 502 {
@@ -47,12 +69,451 @@ func runHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
+// Async expects POST requests like this:
+//
+// curl -X POST <host>:<port>/async/<lambda-name> -H 'X-Hiku-Callback: <url>' -d '{"param0": "value0"}'
+//
+// The callback header is optional.
+func (h *handlers) asyncHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Receive async request to %s\n", r.URL.Path)
+	h.scheduler.RunAsync(w, r)
+}
+
+func (h *handlers) invocationHandler(w http.ResponseWriter, r *http.Request) {
+	id := httputil.Get2ndPathSegment(r, "invocations")
+	if id == "" {
+		httputil.RespondWithError(w, httputil.New400Error("Could not find invocation ID in path "+r.URL.Path))
+		return
+	}
+
+	invocation, err := h.scheduler.GetInvocation(id)
+	if err != nil && err.Code == http.StatusNotFound && h.scheduler.FindInvocation(w, r) {
+		return
+	}
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	httputil.RespondWithJSON(w, invocation)
+}
+
+func (h *handlers) durableStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.scheduler.DurableStats()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	httputil.RespondWithJSON(w, stats)
+}
+
+func (h *handlers) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	deadLetters, err := h.scheduler.DeadLetters()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	httputil.RespondWithJSON(w, deadLetters)
+}
+
+func (h *handlers) queueStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.scheduler.QueueStats()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	httputil.RespondWithJSON(w, stats)
+}
+
+// Tenants returns the usage of each tenant:
+//
+// curl <host>:<port>/admin/tenants
+func (h *handlers) tenantsHandler(w http.ResponseWriter, r *http.Request) {
+	httputil.RespondWithJSON(w, h.scheduler.TenantUsage())
+}
+
+func (h *handlers) statusHandler(w http.ResponseWriter, r *http.Request) {
 	appendResponseWriter := httputil.NewAppendResponseWriter()
-	myScheduler.StatusCheckAllWorkers(appendResponseWriter, r)
+	h.scheduler.StatusCheckAllWorkers(appendResponseWriter, r)
+
+	if appendResponseWriter.Status != 0 {
+		w.WriteHeader(appendResponseWriter.Status)
+	}
+	w.Write(appendResponseWriter.Body)
+}
+
+func (h *handlers) idleQueueStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.scheduler.IdleQueueStats()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	httputil.RespondWithJSON(w, stats)
 }
 
-func addWorkerHandler(w http.ResponseWriter, r *http.Request) {
+// Prewarm expects POST requests like this:
+//
+// curl -X POST <host>:<port>/admin/prewarm/<lambda-name>?count=N -d '{"param0": "value0"}'
+//
+// The body is optional and used as payload of the warm-up invocations.
+// With several replicas, the function is pre-warmed by its owner.
+func (h *handlers) prewarmHandler(w http.ResponseWriter, r *http.Request) {
+	lambdaName := httputil.GetPathSegmentAfter(r, "admin", "prewarm")
+	if lambdaName == "" {
+		httputil.RespondWithError(w, httputil.New400Error("Could not find lambda name in path "+r.URL.Path))
+		return
+	}
+	l := lambda.ParseID(lambdaName)
+	if h.scheduler.Forward(w, r, l) {
+		return
+	}
+
+	count := 1
+	if countParam := r.URL.Query().Get("count"); countParam != "" {
+		parsed, parseErr := strconv.Atoi(countParam)
+		if parseErr != nil || parsed < 1 {
+			httputil.RespondWithError(w, httputil.New400Error("Count must be a positive integer: "+countParam))
+			return
+		}
+		if max := h.scheduler.MaxPrewarm(); parsed > max {
+			httputil.RespondWithError(w, httputil.New400Error(fmt.Sprintf("Count must be at most %d", max)))
+			return
+		}
+		count = parsed
+	}
+
+	var payload []byte
+	if r.Body != nil {
+		body, readErr := io.ReadAll(r.Body)
+		if readErr != nil {
+			httputil.RespondWithError(w, httputil.New400Error("Could not read request body"))
+			return
+		}
+		if len(body) > 0 {
+			payload = body
+		}
+	}
+
+	results := h.scheduler.Prewarm(l, count, payload)
+	httputil.RespondWithJSON(w, results)
+}
+
+func (h *handlers) memoryUsageHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := h.scheduler.MemoryUsage()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	httputil.RespondWithJSON(w, usage)
+}
+
+// Profile expects POST requests like this:
+//
+// curl -X POST <host>:<port>/admin/profiles/<lambda-name> -d '{"memory_mb": 256}'
+func (h *handlers) profileHandler(w http.ResponseWriter, r *http.Request) {
+	lambdaName := httputil.GetPathSegmentAfter(r, "admin", "profiles")
+	if lambdaName == "" {
+		httputil.RespondWithError(w, httputil.New400Error("Could not find lambda name in path "+r.URL.Path))
+		return
+	}
+
+	var profile struct {
+		MemoryMB uint64 `json:"memory_mb"`
+	}
+	if decodingErr := json.NewDecoder(r.Body).Decode(&profile); decodingErr != nil || profile.MemoryMB == 0 {
+		httputil.RespondWithError(w, httputil.New400Error("Profile must contain a positive memory_mb"))
+		return
+	}
+
+	if err := h.scheduler.SetFunctionMemory(lambda.ParseID(lambdaName), profile.MemoryMB); err != nil {
+		httputil.RespondWithError(w, err)
+	}
+}
+
+// WorkerPackages expects POST requests from workers like this:
+//
+// curl -X POST <host>:<port>/admin/workers/packages?worker=<worker-url> -d '["numpy", "pyaes"]'
+//
+// GET requests return the packages known to be installed on each worker.
+func (h *handlers) workerPackagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		packages, err := h.scheduler.WorkerPackages()
+		if err != nil {
+			httputil.RespondWithError(w, err)
+			return
+		}
+		httputil.RespondWithJSON(w, packages)
+		return
+	}
+
+	workerUrls, err := parseWorkerURLs(r.URL.Query()["worker"])
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+
+	var packages []string
+	if decodingErr := json.NewDecoder(r.Body).Decode(&packages); decodingErr != nil {
+		httputil.RespondWithError(w, httputil.New400Error("Packages must be a JSON array of strings"))
+		return
+	}
+
+	for _, workerURL := range workerUrls {
+		if err := h.scheduler.SetWorkerPackages(workerURL, packages); err != nil {
+			httputil.RespondWithError(w, err)
+			return
+		}
+	}
+}
+
+// WorkerLabels expects POST requests from admins like this:
+//
+// curl -X POST <host>:<port>/admin/workers/labels?worker=<worker-url> -d '{"zone": "a", "pool": "batch"}'
+//
+// GET requests, which workers may send as well, return the labels of each
+// worker. Workers can't change labels, since labels decide which functions
+// and tenants they get.
+func (h *handlers) workerLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	placement, err := h.scheduler.Placement()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	if r.Method == http.MethodGet {
+		httputil.RespondWithJSON(w, placement.WorkerLabels())
+		return
+	}
+
+	workerUrls, err := parseWorkerURLs(r.URL.Query()["worker"])
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+
+	var labels map[string]string
+	if decodingErr := json.NewDecoder(r.Body).Decode(&labels); decodingErr != nil {
+		httputil.RespondWithError(w, httputil.New400Error("Labels must be a JSON object of strings"))
+		return
+	}
+
+	for _, workerURL := range workerUrls {
+		placement.SetWorkerLabels(workerURL, labels)
+	}
+}
+
+// Placement expects POST requests like this:
+//
+// curl -X POST <host>:<port>/admin/placement/<lambda-name> -d '{"constraints": ["pool=batch"], "preferences": ["zone=a"]}'
+//
+// GET requests to /admin/placement return the placement of each function.
+func (h *handlers) placementHandler(w http.ResponseWriter, r *http.Request) {
+	placement, err := h.scheduler.Placement()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	if r.Method == http.MethodGet {
+		httputil.RespondWithJSON(w, placement.FunctionPlacements())
+		return
+	}
+
+	lambdaName := httputil.GetPathSegmentAfter(r, "admin", "placement")
+	if lambdaName == "" {
+		httputil.RespondWithError(w, httputil.New400Error("Could not find lambda name in path "+r.URL.Path))
+		return
+	}
+
+	var functionPlacement balancer.FunctionPlacement
+	if decodingErr := json.NewDecoder(r.Body).Decode(&functionPlacement); decodingErr != nil {
+		httputil.RespondWithError(w, httputil.New400Error("Malformed placement: "+decodingErr.Error()))
+		return
+	}
+	placement.SetFunctionPlacement(lambdaName, functionPlacement)
+}
+
+// Zones returns the requests routed to the scheduler's zone and to others:
+//
+// curl <host>:<port>/admin/zones
+func (h *handlers) zonesHandler(w http.ResponseWriter, r *http.Request) {
+	placement, err := h.scheduler.Placement()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	httputil.RespondWithJSON(w, placement.ZoneStats())
+}
+
+// Cluster returns the scheduler replicas and whether they are reachable:
+//
+// curl <host>:<port>/admin/cluster
+func (h *handlers) clusterHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := h.scheduler.ClusterStatus()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	httputil.RespondWithJSON(w, status)
+}
+
+// Discovery returns the workers each discovery provider found last:
+//
+// curl <host>:<port>/admin/discovery
+func (h *handlers) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := h.scheduler.DiscoveryStatus()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	httputil.RespondWithJSON(w, status)
+}
+
+// Autoscaling returns the recommended number of workers and the load it
+// is computed from:
+//
+// curl <host>:<port>/admin/autoscaling
+func (h *handlers) autoscalingHandler(w http.ResponseWriter, r *http.Request) {
+	recommendation, err := h.scheduler.Autoscaling()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+	httputil.RespondWithJSON(w, recommendation)
+}
+
+// Faults expects requests like this:
+//
+// curl -X POST <host>:<port>/admin/faults -d '{"worker": "<worker-host>", "blackout": true, "duration": "30s"}'
+// curl -X DELETE <host>:<port>/admin/faults?id=<fault-id>
+//
+// GET requests return the active faults. DELETE without an ID removes all.
+func (h *handlers) faultsHandler(w http.ResponseWriter, r *http.Request) {
+	injector, err := h.scheduler.FaultInjector()
+	if err != nil {
+		httputil.RespondWithError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		faults := make([]config.FaultConfig, 0)
+		for _, fault := range injector.Faults() {
+			faults = append(faults, config.NewFaultConfig(fault))
+		}
+		httputil.RespondWithJSON(w, faults)
+	case http.MethodPost:
+		var fault config.FaultConfig
+		if decodingErr := json.NewDecoder(r.Body).Decode(&fault); decodingErr != nil {
+			httputil.RespondWithError(w, httputil.New400Error("Malformed fault: "+decodingErr.Error()))
+			return
+		}
+		if fault.Percentage < 0 || fault.Percentage > 100 {
+			httputil.RespondWithError(w, httputil.New400Error("Percentage must be between 0 and 100"))
+			return
+		}
+		if fault.AbortStatus != 0 && (fault.AbortStatus < 100 || fault.AbortStatus > 599) {
+			httputil.RespondWithError(w, httputil.New400Error("Abort status must be a valid HTTP status code"))
+			return
+		}
+		httputil.RespondWithJSON(w, config.NewFaultConfig(injector.AddFault(fault.ToFault())))
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			injector.ClearFaults()
+			return
+		}
+		if !injector.RemoveFault(id) {
+			httputil.RespondWithError(w, &httputil.HttpError{Code: http.StatusNotFound, Msg: "No fault with ID " + id})
+		}
+	default:
+		httputil.RespondWithError(w, &httputil.HttpError{Code: http.StatusMethodNotAllowed, Msg: "Method not allowed"})
+	}
+}
+
+// Concurrency expects POST requests like this:
+//
+// curl -X POST <host>:<port>/admin/concurrency/<lambda-name> -d '{"max": 10, "reserved": 5}'
+//
+// Zero values remove the cap or reservation. GET requests to
+// /admin/concurrency return the limits and invocations in flight.
+func (h *handlers) concurrencyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		httputil.RespondWithJSON(w, h.scheduler.ConcurrencyStats())
+		return
+	}
+
+	lambdaName := httputil.GetPathSegmentAfter(r, "admin", "concurrency")
+	if lambdaName == "" {
+		httputil.RespondWithError(w, httputil.New400Error("Could not find lambda name in path "+r.URL.Path))
+		return
+	}
+
+	var limit concurrency.FunctionLimit
+	if decodingErr := json.NewDecoder(r.Body).Decode(&limit); decodingErr != nil {
+		httputil.RespondWithError(w, httputil.New400Error("Malformed concurrency: "+decodingErr.Error()))
+		return
+	}
+	if err := h.scheduler.SetConcurrency(lambda.ParseID(lambdaName), limit); err != nil {
+		httputil.RespondWithError(w, err)
+	}
+}
+
+// RateLimits expects requests like this:
+//
+// curl -X POST <host>:<port>/admin/rate-limits -d '{"function": "<lambda-name>", "rate": 10, "burst": 20}'
+// curl -X POST <host>:<port>/admin/rate-limits -d '{"tenant": "<tenant>", "rate": 100, "burst": 100}'
+// curl -X DELETE <host>:<port>/admin/rate-limits?function=<lambda-name>
+//
+// GET requests return the current limits. A rate of zero exempts the
+// function or tenant from the default limit, DELETE makes it apply again.
+func (h *handlers) rateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	limiter := h.scheduler.RateLimiter()
+
+	switch r.Method {
+	case http.MethodGet:
+		httputil.RespondWithJSON(w, limiter.Options())
+	case http.MethodPost:
+		var update struct {
+			Function string `json:"function"`
+			Tenant   string `json:"tenant"`
+			ratelimit.Limit
+		}
+		if decodingErr := json.NewDecoder(r.Body).Decode(&update); decodingErr != nil {
+			httputil.RespondWithError(w, httputil.New400Error("Malformed rate limit: "+decodingErr.Error()))
+			return
+		}
+		if (update.Function == "") == (update.Tenant == "") {
+			httputil.RespondWithError(w, httputil.New400Error("Rate limit must be set for either a function or a tenant"))
+			return
+		}
+		if update.Rate < 0 || update.Burst < 0 {
+			httputil.RespondWithError(w, httputil.New400Error("Rate and burst must not be negative"))
+			return
+		}
+		if update.Function != "" {
+			limiter.SetFunctionLimit(update.Function, update.Limit)
+		} else {
+			limiter.SetTenantLimit(update.Tenant, update.Limit)
+		}
+	case http.MethodDelete:
+		query := r.URL.Query()
+		var removed bool
+		switch {
+		case query.Get("function") != "":
+			removed = limiter.RemoveFunctionLimit(query.Get("function"))
+		case query.Get("tenant") != "":
+			removed = limiter.RemoveTenantLimit(query.Get("tenant"))
+		default:
+			httputil.RespondWithError(w, httputil.New400Error("Function or tenant must be given"))
+			return
+		}
+		if !removed {
+			httputil.RespondWithError(w, &httputil.HttpError{Code: http.StatusNotFound, Msg: "No such rate limit"})
+		}
+	default:
+		httputil.RespondWithError(w, &httputil.HttpError{Code: http.StatusMethodNotAllowed, Msg: "Method not allowed"})
+	}
+}
+
+func (h *handlers) addWorkerHandler(w http.ResponseWriter, r *http.Request) {
 	workers := r.URL.Query()["workers"]
 
 	workerUrls, err := parseWorkerURLs(workers)
@@ -60,10 +521,10 @@ func addWorkerHandler(w http.ResponseWriter, r *http.Request) {
 		httputil.RespondWithError(w, err)
 		return
 	}
-	myScheduler.AddWorkers(workerUrls)
+	h.scheduler.AddWorkers(workerUrls)
 }
 
-func removeWorkerHandler(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) removeWorkerHandler(w http.ResponseWriter, r *http.Request) {
 	workers := r.URL.Query()["workers"]
 
 	workerUrls, err := parseWorkerURLs(workers)
@@ -71,26 +532,108 @@ func removeWorkerHandler(w http.ResponseWriter, r *http.Request) {
 		httputil.RespondWithError(w, err)
 		return
 	}
-	myScheduler.RemoveWorkers(workerUrls)
+	h.scheduler.RemoveWorkers(workerUrls)
 }
 
 // Run expects POST requests like this:
 //
 // curl -X POST <host>:<port>/destroySandbox/<lambda-name> -d '{"host": "URL"}'
-func destroySandboxHandler(w http.ResponseWriter, r *http.Request) {
-	myScheduler.DestroySandbox(r)
+func (h *handlers) destroySandboxHandler(w http.ResponseWriter, r *http.Request) {
+	h.scheduler.DestroySandbox(r)
+}
+
+func newHandlers(c config.Config) *handlers {
+	authenticator, authErr := auth.NewAuthenticator(c.Auth)
+	if authErr != nil {
+		log.Fatalf("Invalid auth configuration (%s)", authErr)
+	}
+	return &handlers{scheduler: scheduler.NewScheduler(c), authenticator: authenticator}
+}
+
+// NewHandler creates the scheduler and returns a handler serving its
+// endpoints, e.g. to mount it on a test server.
+func NewHandler(c config.Config) http.Handler {
+	return newHandlers(c).mux()
+}
+
+func (h *handlers) mux() http.Handler {
+	invoke := route{role: auth.Invoker}
+	read := route{role: auth.Admin, methods: []string{http.MethodGet}, audited: true}
+	write := route{role: auth.Admin, methods: []string{http.MethodPost}, audited: true}
+	manage := route{role: auth.Admin, methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, audited: true}
+	callback := route{role: auth.Worker, methods: []string{http.MethodPost}, audited: true}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/run/", h.protect(invoke, h.runHandler))
+	mux.HandleFunc("/async/", h.protect(route{role: auth.Invoker, methods: []string{http.MethodPost}}, h.asyncHandler))
+	mux.HandleFunc("/invocations/", h.protect(route{role: auth.Invoker, methods: []string{http.MethodGet}}, h.invocationHandler))
+	mux.HandleFunc("/status", h.statusHandler)
+	mux.HandleFunc("/admin/idle-queues", h.protect(read, h.idleQueueStatsHandler))
+	mux.HandleFunc("/admin/prewarm/", h.protect(write, h.prewarmHandler))
+	mux.HandleFunc("/admin/memory", h.protect(read, h.memoryUsageHandler))
+	mux.HandleFunc("/admin/profiles/", h.protect(write, h.profileHandler))
+	mux.HandleFunc("/admin/workers/add", h.protect(write, h.addWorkerHandler))
+	mux.HandleFunc("/admin/workers/remove", h.protect(write, h.removeWorkerHandler))
+	mux.HandleFunc("/admin/workers/packages", h.protect(route{role: auth.Worker,
+		methods: []string{http.MethodGet, http.MethodPost}, audited: true}, h.workerPackagesHandler))
+	mux.HandleFunc("/admin/workers/labels", h.protect(route{role: auth.Worker, writeRole: auth.Admin,
+		methods: []string{http.MethodGet, http.MethodPost}, audited: true}, h.workerLabelsHandler))
+	mux.HandleFunc("/admin/placement", h.protect(read, h.placementHandler))
+	mux.HandleFunc("/admin/placement/", h.protect(write, h.placementHandler))
+	mux.HandleFunc("/admin/zones", h.protect(read, h.zonesHandler))
+	mux.HandleFunc("/admin/cluster", h.protect(read, h.clusterHandler))
+	mux.HandleFunc("/admin/discovery", h.protect(read, h.discoveryHandler))
+	mux.HandleFunc("/admin/autoscaling", h.protect(read, h.autoscalingHandler))
+	mux.HandleFunc("/admin/faults", h.protect(manage, h.faultsHandler))
+	mux.HandleFunc("/admin/queues", h.protect(read, h.queueStatsHandler))
+	mux.HandleFunc("/admin/rate-limits", h.protect(manage, h.rateLimitsHandler))
+	mux.HandleFunc("/admin/tenants", h.protect(read, h.tenantsHandler))
+	mux.HandleFunc("/admin/concurrency", h.protect(read, h.concurrencyHandler))
+	mux.HandleFunc("/admin/concurrency/", h.protect(write, h.concurrencyHandler))
+	mux.HandleFunc("/admin/durable", h.protect(read, h.durableStatsHandler))
+	mux.HandleFunc("/admin/durable/dead-letters", h.protect(read, h.deadLettersHandler))
+	mux.HandleFunc("/destroySandbox/", h.protect(callback, h.destroySandboxHandler))
+	return mux
 }
 
 func Start(c config.Config) error {
-	myConfig = c
-	myScheduler = scheduler.NewScheduler(c)
+	h := newHandlers(c)
 
-	http.HandleFunc("/run/", runHandler)
-	http.HandleFunc("/status", statusHandler)
-	http.HandleFunc("/admin/workers/add", addWorkerHandler)
-	http.HandleFunc("/admin/workers/remove", removeWorkerHandler)
-	http.HandleFunc("/destroySandbox/", destroySandboxHandler)
+	schedulerUrl := fmt.Sprintf("%s:%d", c.Host, c.Port)
+	server := &http.Server{Addr: schedulerUrl, Handler: h.mux()}
+	if c.TLS != nil {
+		tlsConfig, err := tlsutil.NewServerConfig(*c.TLS)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	// Stop accepting requests on SIGINT or SIGTERM and let the scheduler
+	// persist its state once the requests in flight are done
+	stopped := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Requests still in flight after %s (%s)", shutdownTimeout, err)
+		}
+		stopped <- errors.Join(h.scheduler.Close(), h.authenticator.Close())
+	}()
 
-	schedulerUrl := fmt.Sprintf("%s:%d", myConfig.Host, myConfig.Port)
-	return http.ListenAndServe(schedulerUrl, nil)
+	var err error
+	if server.TLSConfig == nil {
+		err = server.ListenAndServe()
+	} else {
+		err = server.ListenAndServeTLS("", "")
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-stopped
 }
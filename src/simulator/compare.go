@@ -0,0 +1,39 @@
+package simulator
+
+import (
+	"fmt"
+
+	"hiku/config"
+	"hiku/trace"
+)
+
+// Compare runs the same invocations against each of the named balancers,
+// configured as in the given config apart from the workers.
+func Compare(c config.JSONConfig, balancerNames []string, invocations []trace.Invocation, options Options) ([]Report, error) {
+	if options.Workers < 1 {
+		return nil, fmt.Errorf("at least one simulated worker is needed")
+	}
+
+	workers := make([]string, options.Workers)
+	for i, workerURL := range WorkerUrls(options.Workers) {
+		workers[i] = workerURL.String()
+	}
+
+	reports := make([]Report, 0, len(balancerNames))
+	for _, name := range balancerNames {
+		balancerConfig := c
+		balancerConfig.Balancer = name
+		balancerConfig.Workers = workers
+		balancerConfig.Prewarm = nil
+
+		b, err := config.CreateBalancer(balancerConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		report := NewSimulator(b, options).Run(invocations)
+		report.Balancer = name
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
@@ -0,0 +1,71 @@
+package simulator
+
+import (
+	"fmt"
+	"io"
+
+	"hiku/stats"
+)
+
+// Report summarizes a simulation run.
+type Report struct {
+	Balancer    string               `json:"balancer"`
+	Invocations int                  `json:"invocations"`
+	Failed      int                  `json:"failed"`
+	WarmStarts  int                  `json:"warm_starts"`
+	ColdStarts  int                  `json:"cold_starts"`
+	WarmRatio   float64              `json:"warm_ratio"`
+	LatencyMs   stats.LatencySummary `json:"latency_ms"`
+	Workers     []WorkerSummary      `json:"workers"`
+	// Imbalance is the ratio of the busiest worker's invocations to the mean.
+	Imbalance float64 `json:"imbalance"`
+	// LoadCV is the coefficient of variation of invocations per worker.
+	LoadCV float64 `json:"load_cv"`
+}
+
+type WorkerSummary struct {
+	URL         string `json:"url"`
+	Invocations int    `json:"invocations"`
+	ColdStarts  int    `json:"cold_starts"`
+}
+
+func (s *Simulator) report(invocations int) Report {
+	report := Report{
+		Invocations: invocations,
+		Failed:      s.failed,
+		LatencyMs:   stats.SummarizeLatencies(s.latencies),
+	}
+
+	counts := make([]float64, 0, len(s.workerUrls))
+	for _, workerURL := range s.workerUrls {
+		w := s.workers[workerURL]
+		report.ColdStarts += w.coldStarts
+		report.Workers = append(report.Workers, WorkerSummary{
+			URL:         workerURL.String(),
+			Invocations: w.invocations,
+			ColdStarts:  w.coldStarts,
+		})
+		counts = append(counts, float64(w.invocations))
+	}
+
+	served := invocations - s.failed
+	report.WarmStarts = served - report.ColdStarts
+	if served > 0 {
+		report.WarmRatio = float64(report.WarmStarts) / float64(served)
+	}
+	report.Imbalance, report.LoadCV = stats.Imbalance(counts)
+	return report
+}
+
+// WriteText prints the report in a human-readable form.
+func (r Report) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Balancer:     %s\n", r.Balancer)
+	fmt.Fprintf(w, "Invocations:  %d (%d failed)\n", r.Invocations, r.Failed)
+	fmt.Fprintf(w, "Warm starts:  %d of %d (%.2f%%)\n", r.WarmStarts, r.WarmStarts+r.ColdStarts, r.WarmRatio*100)
+	fmt.Fprintf(w, "Latency (ms): mean %.1f, p50 %.1f, p90 %.1f, p99 %.1f, p99.9 %.1f, max %.1f\n",
+		r.LatencyMs.Mean, r.LatencyMs.P50, r.LatencyMs.P90, r.LatencyMs.P99, r.LatencyMs.P999, r.LatencyMs.Max)
+	fmt.Fprintf(w, "Imbalance:    max/mean %.2f, cv %.2f\n", r.Imbalance, r.LoadCV)
+	for _, worker := range r.Workers {
+		fmt.Fprintf(w, "  %-24s %8d invocations %8d cold starts\n", worker.URL, worker.Invocations, worker.ColdStarts)
+	}
+}
@@ -0,0 +1,271 @@
+package simulator
+
+import (
+	"container/heap"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"hiku/balancer"
+	"hiku/lambda"
+	"hiku/trace"
+)
+
+// Options describes the simulated workers.
+type Options struct {
+	Workers int
+	// ColdStart is added to the execution time when no idle sandbox of the
+	// function exists on the worker.
+	ColdStart time.Duration
+	// Exec is the execution time of invocations whose trace record has none.
+	Exec time.Duration
+	// KeepAlive is how long a worker keeps an idle sandbox before evicting
+	// it. Zero keeps sandboxes forever.
+	KeepAlive time.Duration
+	// Concurrency is the number of invocations a worker runs at once. Further
+	// invocations wait in a queue on the worker. Zero means no limit.
+	Concurrency int
+}
+
+type sandbox struct {
+	function string
+	busy     bool
+	evicted  bool
+	lastUsed time.Duration
+}
+
+type pending struct {
+	invocation trace.Invocation
+	lambda     *lambda.Lambda
+	arrival    time.Duration
+	cold       bool
+	sandbox    *sandbox
+}
+
+type worker struct {
+	url         url.URL
+	sandboxes   []*sandbox
+	running     int
+	queue       []*pending
+	invocations int
+	coldStarts  int
+}
+
+type eventKind int
+
+const (
+	arrivalEvent eventKind = iota
+	completionEvent
+	expiryEvent
+)
+
+type event struct {
+	at       time.Duration
+	seq      uint64
+	kind     eventKind
+	worker   *worker
+	pending  *pending
+	sandbox  *sandbox
+	lastUsed time.Duration
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at == q[j].at {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at < q[j].at
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return e
+}
+
+// Simulator replays a trace against a balancer with simulated workers in a
+// discrete-event simulation. No HTTP requests are sent, and time is virtual,
+// so a day of traffic is simulated in seconds.
+type Simulator struct {
+	options    Options
+	balancer   balancer.Balancer
+	workers    map[url.URL]*worker
+	workerUrls []url.URL
+	events     eventQueue
+	seq        uint64
+	start      time.Time
+	now        time.Duration
+	latencies  []time.Duration
+	failed     int
+}
+
+func (s *Simulator) schedule(e *event) {
+	s.seq++
+	e.seq = s.seq
+	heap.Push(&s.events, e)
+}
+
+// Run replays the invocations and reports the results.
+func (s *Simulator) Run(invocations []trace.Invocation) Report {
+	for i := range invocations {
+		s.schedule(&event{
+			at:      invocations[i].Offset,
+			kind:    arrivalEvent,
+			pending: &pending{invocation: invocations[i], arrival: invocations[i].Offset},
+		})
+	}
+
+	for s.events.Len() > 0 {
+		e := heap.Pop(&s.events).(*event)
+		s.now = e.at
+
+		switch e.kind {
+		case arrivalEvent:
+			s.arrive(e.pending)
+		case completionEvent:
+			s.complete(e.worker, e.pending)
+		case expiryEvent:
+			s.expire(e.worker, e.sandbox, e.lastUsed)
+		}
+	}
+
+	return s.report(len(invocations))
+}
+
+func (s *Simulator) arrive(p *pending) {
+	p.lambda = &lambda.Lambda{Name: p.invocation.Function}
+	r, _ := http.NewRequest("POST", "/run/"+p.lambda.Name, nil)
+
+	workerURL, err := s.balancer.SelectWorker(r, p.lambda)
+	if err != nil {
+		s.failed++
+		return
+	}
+
+	w, ok := s.workers[workerURL]
+	if !ok {
+		s.failed++
+		return
+	}
+
+	w.invocations++
+	if s.options.Concurrency > 0 && w.running >= s.options.Concurrency {
+		w.queue = append(w.queue, p)
+		return
+	}
+	s.execute(w, p)
+}
+
+func (s *Simulator) execute(w *worker, p *pending) {
+	w.running++
+
+	// Reuse the most recently used idle sandbox, as OpenLambda does
+	var selected *sandbox
+	for _, sb := range w.sandboxes {
+		if sb.function == p.lambda.Name && !sb.busy && (selected == nil || sb.lastUsed > selected.lastUsed) {
+			selected = sb
+		}
+	}
+
+	duration := p.invocation.Exec
+	if duration <= 0 {
+		duration = s.options.Exec
+	}
+	if selected == nil {
+		selected = &sandbox{function: p.lambda.Name}
+		w.sandboxes = append(w.sandboxes, selected)
+		w.coldStarts++
+		p.cold = true
+		duration += s.options.ColdStart
+	}
+	selected.busy = true
+	p.sandbox = selected
+
+	s.schedule(&event{at: s.now + duration, kind: completionEvent, worker: w, pending: p})
+}
+
+func (s *Simulator) complete(w *worker, p *pending) {
+	w.running--
+	p.sandbox.busy = false
+	p.sandbox.lastUsed = s.now
+
+	latency := s.now - p.arrival
+	s.latencies = append(s.latencies, latency)
+	s.balancer.ReleaseWorker(w.url, p.lambda, balancer.Outcome{Latency: latency, Status: http.StatusOK})
+
+	if s.options.KeepAlive > 0 {
+		s.schedule(&event{at: s.now + s.options.KeepAlive, kind: expiryEvent, worker: w, sandbox: p.sandbox, lastUsed: s.now})
+	}
+
+	if len(w.queue) > 0 {
+		next := w.queue[0]
+		w.queue = w.queue[1:]
+		s.execute(w, next)
+	}
+}
+
+// expire evicts a sandbox that stayed idle for the keep-alive and notifies
+// the balancer like the modified OpenLambda workers do.
+func (s *Simulator) expire(w *worker, sb *sandbox, lastUsed time.Duration) {
+	if sb.busy || sb.evicted || sb.lastUsed != lastUsed {
+		return
+	}
+	sb.evicted = true
+
+	for i, candidate := range w.sandboxes {
+		if candidate == sb {
+			w.sandboxes = append(w.sandboxes[:i], w.sandboxes[i+1:]...)
+			break
+		}
+	}
+	s.balancer.DestroySandbox(w.url, &lambda.Lambda{Name: sb.function})
+}
+
+// WorkerUrls returns the URLs of the simulated workers, which the balancer
+// has to be created with.
+func WorkerUrls(total int) []url.URL {
+	workerUrls := make([]url.URL, total)
+	for i := range workerUrls {
+		workerUrls[i] = url.URL{Scheme: "http", Host: fmt.Sprintf("sim-worker-%d", i)}
+	}
+	return workerUrls
+}
+
+// NewSimulator creates a simulator for a balancer that was created with
+// WorkerUrls(options.Workers).
+func NewSimulator(b balancer.Balancer, options Options) *Simulator {
+	s := &Simulator{
+		options:    options,
+		balancer:   b,
+		workers:    make(map[url.URL]*worker),
+		workerUrls: WorkerUrls(options.Workers),
+		start:      time.Unix(0, 0),
+	}
+
+	for _, workerURL := range s.workerUrls {
+		s.workers[workerURL] = &worker{url: workerURL}
+	}
+
+	// Run the balancer on virtual time and let expiry happen lazily
+	if clocked, ok := b.(balancer.Clocked); ok {
+		clocked.SetClock(func() time.Time {
+			return s.start.Add(s.now)
+		})
+	}
+	if closer, ok := b.(interface{ Close() }); ok {
+		closer.Close()
+	}
+
+	return s
+}
@@ -0,0 +1,85 @@
+// Package snapshot persists the learned state of a balancer to a local file,
+// so that a restarted scheduler keeps its idle queues and, if asked to, its
+// workers.
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"hiku/balancer"
+)
+
+// Options configures where and how often snapshots are written.
+type Options struct {
+	// File is the path of the snapshot file.
+	File string
+	// Interval is how often a snapshot is written in the background. Zero
+	// writes one on shutdown only.
+	Interval time.Duration
+	// MaxAge is how old a snapshot may be for its idle queues to be
+	// restored. Older idle queues are dropped since their sandboxes have most
+	// likely been evicted. Zero restores them regardless of age.
+	MaxAge time.Duration
+	// RestoreWorkers adds the workers of the snapshot that are neither
+	// configured nor discovered, e.g. ones added through the admin API.
+	// Otherwise only the state of the current workers is restored.
+	RestoreWorkers bool
+}
+
+// Write writes the snapshot to the file atomically, so a crash while
+// writing keeps the previous snapshot.
+func Write(path string, snapshot balancer.Snapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Read reads the snapshot from the file. Fields unknown to this version are
+// ignored, so snapshots written by newer schedulers can be read as well.
+func Read(path string) (balancer.Snapshot, error) {
+	var snapshot balancer.Snapshot
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("malformed snapshot: %w", err)
+	}
+	if snapshot.Version < 1 {
+		return snapshot, fmt.Errorf("snapshot has no valid version")
+	}
+	return snapshot, nil
+}
+
+// Trim drops the idle queues of a snapshot older than maxAge at now. The
+// statistics of functions are kept.
+func Trim(snapshot *balancer.Snapshot, maxAge time.Duration, now time.Time) {
+	if maxAge <= 0 || now.Sub(snapshot.Time) <= maxAge {
+		return
+	}
+	for functionType, function := range snapshot.Functions {
+		function.Idle = nil
+		snapshot.Functions[functionType] = function
+	}
+}
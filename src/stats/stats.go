@@ -0,0 +1,79 @@
+package stats
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// LatencySummary holds the mean and percentiles of latencies in milliseconds.
+type LatencySummary struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func SummarizeLatencies(latencies []time.Duration) LatencySummary {
+	if len(latencies) == 0 {
+		return LatencySummary{}
+	}
+
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, latency := range sorted {
+		total += latency
+	}
+
+	percentile := func(p float64) float64 {
+		index := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		if index < 0 {
+			index = 0
+		}
+		return toMs(sorted[index])
+	}
+
+	return LatencySummary{
+		Mean: toMs(total / time.Duration(len(sorted))),
+		P50:  percentile(50),
+		P90:  percentile(90),
+		P99:  percentile(99),
+		P999: percentile(99.9),
+		Max:  toMs(sorted[len(sorted)-1]),
+	}
+}
+
+// Imbalance returns the ratio of the maximum to the mean and the coefficient
+// of variation of the given per-worker counts.
+func Imbalance(counts []float64) (float64, float64) {
+	if len(counts) == 0 {
+		return 0, 0
+	}
+
+	var total, max float64
+	for _, count := range counts {
+		total += count
+		max = math.Max(max, count)
+	}
+	mean := total / float64(len(counts))
+	if mean == 0 {
+		return 0, 0
+	}
+
+	var variance float64
+	for _, count := range counts {
+		variance += (count - mean) * (count - mean)
+	}
+	variance /= float64(len(counts))
+
+	return max / mean, math.Sqrt(variance) / mean
+}
@@ -0,0 +1,195 @@
+// Package tenancy maps API keys to tenants, each with a namespace of its own
+// functions, and accounts their usage against quotas.
+package tenancy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"hiku/lambda"
+)
+
+const defaultAPIKeyHeader = "X-Api-Key"
+
+var (
+	// ErrMissingKey is returned for requests without API key if one is
+	// required.
+	ErrMissingKey = errors.New("missing API key")
+	// ErrUnknownKey is returned for API keys of no tenant.
+	ErrUnknownKey = errors.New("unknown API key")
+	// ErrQuotaExceeded is returned when a tenant has as many invocations in
+	// flight as its quota allows.
+	ErrQuotaExceeded = errors.New("tenant quota exceeded")
+)
+
+// Tenant is a team sharing the cluster.
+type Tenant struct {
+	Name string
+	// Namespace of the tenant's functions. Defaults to the name.
+	Namespace string
+	APIKeys   []string
+	// MaxInFlight caps the invocations of the tenant running at once. Zero
+	// means no limit.
+	MaxInFlight int
+}
+
+// Options configures the tenants.
+type Options struct {
+	// APIKeyHeader holds the API key of a request. Defaults to X-Api-Key.
+	APIKeyHeader string
+	// RequireAPIKey rejects requests without API key. Otherwise they run
+	// functions without namespace.
+	RequireAPIKey bool
+	Tenants       []Tenant
+}
+
+// Usage counts the invocations of a tenant.
+type Usage struct {
+	Namespace   string `json:"namespace"`
+	MaxInFlight int    `json:"max_in_flight,omitempty"`
+	InFlight    int    `json:"in_flight"`
+	Invocations uint64 `json:"invocations"`
+	Failed      uint64 `json:"failed"`
+	Throttled   uint64 `json:"throttled"`
+}
+
+type tenantState struct {
+	tenant Tenant
+	usage  Usage
+}
+
+// Registry resolves API keys to tenants and keeps their usage.
+type Registry struct {
+	options     Options
+	byKey       map[string]*tenantState
+	byNamespace map[string]*tenantState
+	mutex       sync.Mutex
+}
+
+// Enabled reports whether any tenants are configured.
+func (r *Registry) Enabled() bool {
+	return len(r.byKey) > 0 || r.options.RequireAPIKey
+}
+
+func (r *Registry) APIKeyHeader() string {
+	return r.options.APIKeyHeader
+}
+
+// Resolve returns the tenant of an API key, or nil for an empty key if
+// keys are optional.
+func (r *Registry) Resolve(apiKey string) (*Tenant, error) {
+	if apiKey == "" {
+		if r.options.RequireAPIKey {
+			return nil, ErrMissingKey
+		}
+		return nil, nil
+	}
+
+	state, ok := r.byKey[apiKey]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	tenant := state.tenant
+	return &tenant, nil
+}
+
+// TenantOf returns the name of the tenant that owns the namespace, or an
+// empty string.
+func (r *Registry) TenantOf(namespace string) string {
+	if state, ok := r.byNamespace[namespace]; ok {
+		return state.tenant.Name
+	}
+	return ""
+}
+
+// Acquire counts an invocation of a function against the quota of its
+// tenant and returns the function that records its status once it
+// completed. Functions without namespace are not accounted.
+func (r *Registry) Acquire(l *lambda.Lambda) (func(status int), error) {
+	state, ok := r.byNamespace[l.Namespace]
+	if !ok {
+		return func(int) {}, nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if state.tenant.MaxInFlight > 0 && state.usage.InFlight >= state.tenant.MaxInFlight {
+		state.usage.Throttled++
+		return nil, ErrQuotaExceeded
+	}
+	state.usage.InFlight++
+	state.usage.Invocations++
+
+	return func(status int) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		state.usage.InFlight--
+		if status == 0 || status >= 500 {
+			state.usage.Failed++
+		}
+	}, nil
+}
+
+// Throttled counts a request of the tenant that was rejected before it was
+// accounted, e.g. by a rate limit.
+func (r *Registry) Throttled(l *lambda.Lambda) {
+	if state, ok := r.byNamespace[l.Namespace]; ok {
+		r.mutex.Lock()
+		state.usage.Throttled++
+		r.mutex.Unlock()
+	}
+}
+
+// Usage returns the usage per tenant name.
+func (r *Registry) Usage() map[string]Usage {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usage := make(map[string]Usage, len(r.byNamespace))
+	for _, state := range r.byNamespace {
+		usage[state.tenant.Name] = state.usage
+	}
+	return usage
+}
+
+// NewRegistry fails if API keys or namespaces are used by several tenants
+// or a namespace contains the namespace separator.
+func NewRegistry(options Options) (*Registry, error) {
+	if options.APIKeyHeader == "" {
+		options.APIKeyHeader = defaultAPIKeyHeader
+	}
+
+	r := &Registry{
+		options:     options,
+		byKey:       make(map[string]*tenantState),
+		byNamespace: make(map[string]*tenantState),
+	}
+	for _, tenant := range options.Tenants {
+		if tenant.Namespace == "" {
+			tenant.Namespace = tenant.Name
+		}
+		if tenant.Namespace == "" || strings.Contains(tenant.Namespace, lambda.NamespaceSeparator) {
+			return nil, fmt.Errorf("invalid namespace %q of tenant %s", tenant.Namespace, tenant.Name)
+		}
+		if _, ok := r.byNamespace[tenant.Namespace]; ok {
+			return nil, fmt.Errorf("namespace %s is used by several tenants", tenant.Namespace)
+		}
+
+		state := &tenantState{
+			tenant: tenant,
+			usage:  Usage{Namespace: tenant.Namespace, MaxInFlight: tenant.MaxInFlight},
+		}
+		r.byNamespace[tenant.Namespace] = state
+		for _, key := range tenant.APIKeys {
+			if _, ok := r.byKey[key]; ok || key == "" {
+				return nil, fmt.Errorf("API key of tenant %s is empty or used by several tenants", tenant.Name)
+			}
+			r.byKey[key] = state
+		}
+	}
+	return r, nil
+}
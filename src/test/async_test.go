@@ -0,0 +1,213 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"hiku/async"
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/proxy"
+	"hiku/scheduler"
+	"hiku/testing/fakeworker"
+	"hiku/trace"
+)
+
+func submitAsync(t *testing.T, schedulerURL string, function string, callbackURL string) async.Invocation {
+	req, _ := http.NewRequest(http.MethodPost, schedulerURL+"/async/"+function, strings.NewReader("{}"))
+	if callbackURL != "" {
+		req.Header.Set("X-Hiku-Callback", callbackURL)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to submit %s: %v", function, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", resp.StatusCode)
+	}
+	var invocation async.Invocation
+	json.NewDecoder(resp.Body).Decode(&invocation)
+	if invocation.ID == "" || resp.Header.Get("Location") != "/invocations/"+invocation.ID {
+		t.Fatalf("expected an invocation ID and its location, got %+v", invocation)
+	}
+	return invocation
+}
+
+func TestAsyncInvocation(t *testing.T) {
+	// The webhook is on a loopback address, which is only called back if
+	// configured
+	b := balancer.NewPullBased([]url.URL{})
+	schedulerURL := startScheduler(t, config.Config{
+		Balancer:     b,
+		ReverseProxy: proxy.NewHTTPReverseProxy(),
+		Async:        async.Options{CallbackHosts: []string{"127.0.0.1"}},
+	})
+	worker := fakeworker.NewWorker(fakeworker.Options{
+		Default:      fakeworker.FunctionConfig{Warm: 50 * time.Millisecond},
+		SchedulerURL: schedulerURL,
+	})
+	workerURL, err := worker.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake worker: %v", err)
+	}
+	t.Cleanup(worker.Close)
+	b.AddWorker(workerURL)
+
+	callbacks := make(chan async.Invocation, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var invocation async.Invocation
+		json.NewDecoder(r.Body).Decode(&invocation)
+		callbacks <- invocation
+	}))
+	defer webhook.Close()
+
+	submitted := submitAsync(t, schedulerURL, "f", webhook.URL)
+
+	var invocation async.Invocation
+	select {
+	case invocation = <-callbacks:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("callback was not called")
+	}
+	if invocation.ID != submitted.ID || invocation.State != async.Succeeded {
+		t.Errorf("expected invocation %s to succeed, got %+v", submitted.ID, invocation)
+	}
+
+	resp, err := http.Get(schedulerURL + "/invocations/" + submitted.ID)
+	if err != nil {
+		t.Fatalf("failed to get invocation: %v", err)
+	}
+	json.NewDecoder(resp.Body).Decode(&invocation)
+	resp.Body.Close()
+	if invocation.Response == nil || invocation.Response.Status != http.StatusOK ||
+		!strings.Contains(invocation.Response.Body, `"function":"f"`) {
+		t.Errorf("expected the response of the worker, got %+v", invocation.Response)
+	}
+
+	resp, _ = http.Get(schedulerURL + "/invocations/unknown")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown invocation, got %d", resp.StatusCode)
+	}
+}
+
+func TestAsyncRefusesInternalCallbacks(t *testing.T) {
+	schedulerURL, _ := startCluster(t, balancer.NewPullBased([]url.URL{}), 1, fakeworker.Options{})
+
+	for _, callbackURL := range []string{"http://127.0.0.1:9020/admin/workers/add", "http://[::1]/",
+		"http://169.254.169.254/latest/meta-data", "http://10.0.0.1/", "file:///etc/passwd"} {
+		req, _ := http.NewRequest(http.MethodPost, schedulerURL+"/async/f", strings.NewReader("{}"))
+		req.Header.Set("X-Hiku-Callback", callbackURL)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to submit: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400 for callback %s, got %d", callbackURL, resp.StatusCode)
+		}
+	}
+
+	// Host names are refused once they resolve to an internal address
+	var calls atomic.Int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer webhook.Close()
+	webhookURL, _ := url.Parse(webhook.URL)
+
+	store := async.NewMemoryStore()
+	dispatcher, err := async.NewDispatcher(store, async.Options{Workers: 1}, func(string, []byte, string) async.Response {
+		return async.Response{Status: http.StatusOK}
+	})
+	if err != nil {
+		t.Fatalf("failed to start dispatcher: %v", err)
+	}
+	invocation, err := dispatcher.Submit("f", nil, "", "http://localhost:"+webhookURL.Port()+"/")
+	if err != nil {
+		t.Fatalf("failed to submit: %v", err)
+	}
+	waitForState(t, store, invocation.ID, async.Succeeded)
+	dispatcher.Close()
+	if calls.Load() != 0 {
+		t.Errorf("expected no callback to localhost, got %d", calls.Load())
+	}
+}
+
+func TestSchedulerCloseRunsQueuedInvocations(t *testing.T) {
+	worker := fakeworker.NewWorker(fakeworker.Options{Default: fakeworker.FunctionConfig{Warm: 50 * time.Millisecond}})
+	workerURL, err := worker.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake worker: %v", err)
+	}
+	t.Cleanup(worker.Close)
+
+	tracePath := filepath.Join(t.TempDir(), "capture.jsonl")
+	s := scheduler.NewScheduler(config.Config{
+		Balancer:     balancer.NewPullBased([]url.URL{workerURL}),
+		ReverseProxy: proxy.NewHTTPReverseProxy(),
+		Async:        async.Options{Workers: 1},
+		Capture:      &trace.CaptureOptions{File: tracePath},
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/async/", s.RunAsync)
+	schedulerServer := httptest.NewServer(mux)
+	defer schedulerServer.Close()
+
+	var submitted []async.Invocation
+	for i := 0; i < 3; i++ {
+		submitted = append(submitted, submitAsync(t, schedulerServer.URL, "f", ""))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close scheduler: %v", err)
+	}
+
+	// The invocations queued in memory ran before the scheduler closed
+	for _, invocation := range submitted {
+		if invocation, _ := s.GetInvocation(invocation.ID); invocation.State != async.Succeeded {
+			t.Errorf("expected invocation %s to run on close, got %+v", invocation.ID, invocation)
+		}
+	}
+	captured, err := trace.ReadFile(tracePath, 0)
+	if err != nil || len(captured) != len(submitted) {
+		t.Errorf("expected the captured traffic to be flushed on close, got %d records (%v)", len(captured), err)
+	}
+}
+
+func TestAsyncFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	store, err := async.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	store.Save(async.Invocation{ID: "old", State: async.Succeeded, CompletedAt: &old})
+	store.Save(async.Invocation{ID: "queued", State: async.Queued})
+	store.Close()
+
+	store, err = async.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	if invocation, ok, _ := store.Get("queued"); !ok || invocation.State != async.Failed {
+		t.Errorf("expected the unfinished invocation to fail after a restart, got %+v", invocation)
+	}
+	if pruned, _ := store.Prune(time.Now().Add(-time.Hour), 0); pruned != 1 {
+		t.Errorf("expected 1 pruned result, got %d", pruned)
+	}
+	if _, ok, _ := store.Get("old"); ok {
+		t.Errorf("expected the old result to be pruned")
+	}
+}
@@ -0,0 +1,208 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"hiku/auth"
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/proxy"
+	"hiku/testing/fakeworker"
+)
+
+func request(t *testing.T, method string, target string, token string) int {
+	req, _ := http.NewRequest(method, target, strings.NewReader("{}"))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to send %s %s: %v", method, target, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func readAuditLog(t *testing.T, path string) []auth.AuditEntry {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	var entries []auth.AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auth.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("malformed audit entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuthRolesAndAuditLog(t *testing.T) {
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	schedulerURL := startScheduler(t, config.Config{
+		Balancer:     balancer.NewPullBased([]url.URL{}),
+		ReverseProxy: proxy.NewHTTPReverseProxy(),
+		Auth: auth.Options{
+			Tokens: []auth.Token{
+				{Name: "ops", Token: "admin-token", Role: auth.Admin},
+				{Name: "client", Token: "invoker-token", Role: auth.Invoker},
+			},
+			WorkerSecret: "worker-secret",
+			AuditLog:     auditLog,
+		},
+	})
+
+	worker := fakeworker.NewWorker(fakeworker.Options{
+		KeepAlive:       20 * time.Millisecond,
+		SchedulerURL:    schedulerURL,
+		SchedulerSecret: "worker-secret",
+	})
+	workerURL, err := worker.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake worker: %v", err)
+	}
+	t.Cleanup(worker.Close)
+	addWorker := schedulerURL + "/admin/workers/add?workers=" + workerURL.String()
+
+	if status := request(t, http.MethodGet, addWorker, "admin-token"); status != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to add workers to be refused with 405, got %d", status)
+	}
+	if status := request(t, http.MethodPost, addWorker, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", status)
+	}
+	if status := request(t, http.MethodPost, addWorker, "invoker-token"); status != http.StatusForbidden {
+		t.Errorf("expected 403 for invokers, got %d", status)
+	}
+	if status := request(t, http.MethodPost, addWorker, "admin-token"); status != http.StatusOK {
+		t.Fatalf("expected admins to add workers, got %d", status)
+	}
+
+	if status := request(t, http.MethodPost, schedulerURL+"/run/f", ""); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 for invocations without token, got %d", status)
+	}
+	if status := request(t, http.MethodPost, schedulerURL+"/run/f", "invoker-token"); status != http.StatusOK {
+		t.Errorf("expected invokers to run functions, got %d", status)
+	}
+
+	// Unsigned callbacks are refused, the signed one of the worker accepted
+	body := `{"host": "` + workerURL.Host + `"}`
+	resp, err := http.Post(schedulerURL+"/destroySandbox/f", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to call back: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for unsigned callbacks, got %d", resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		accepted := false
+		for _, entry := range readAuditLog(t, auditLog) {
+			if entry.Path == "/destroySandbox/f" && entry.Status == http.StatusOK && entry.AuthMethod == "signature" {
+				accepted = true
+			}
+		}
+		if accepted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the signed eviction callback in the audit log")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	entries := readAuditLog(t, auditLog)
+	if entries[0].Status != http.StatusMethodNotAllowed || entries[2].Status != http.StatusForbidden ||
+		entries[3].Principal != "ops" || entries[3].Status != http.StatusOK {
+		t.Errorf("expected the admin actions in the audit log, got %+v", entries)
+	}
+}
+
+func TestSignedRequestsCannotBeReplayedOrRetargeted(t *testing.T) {
+	authenticator, err := auth.NewAuthenticator(auth.Options{WorkerSecret: "worker-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := func(target string) *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, target, strings.NewReader(`["numpy"]`))
+		auth.Sign(req, "worker-secret", []byte(`["numpy"]`), time.Now())
+		return req
+	}
+	copyOf := func(req *http.Request, target string) *http.Request {
+		replayed, _ := http.NewRequest(req.Method, target, strings.NewReader(`["numpy"]`))
+		replayed.Header = req.Header.Clone()
+		return replayed
+	}
+
+	target := "http://scheduler/admin/workers/packages?worker=http://w1:5000"
+	req := signed(target)
+	if _, err := authenticator.Authenticate(copyOf(req, target)); err != nil {
+		t.Fatalf("expected the signed request to be accepted, got %v", err)
+	}
+	if _, err := authenticator.Authenticate(copyOf(req, target)); err == nil {
+		t.Errorf("expected the replayed request to be refused")
+	}
+	replayed := copyOf(req, target)
+	replayed.Header.Set(auth.SignatureHeader, strings.ToUpper(req.Header.Get(auth.SignatureHeader)))
+	if _, err := authenticator.Authenticate(replayed); err == nil {
+		t.Errorf("expected the replayed request with an upper-case signature to be refused")
+	}
+
+	req = signed(target)
+	if _, err := authenticator.Authenticate(copyOf(req, "http://scheduler/admin/workers/packages?worker=http://w2:5000")); err == nil {
+		t.Errorf("expected a request with a changed query to be refused")
+	}
+
+	// Identical requests signed in the same second differ by their nonce
+	if _, err := authenticator.Authenticate(copyOf(signed(target), target)); err != nil {
+		t.Errorf("expected a second identical request to be accepted, got %v", err)
+	}
+}
+
+func TestWorkersCanReadButNotChangeLabels(t *testing.T) {
+	schedulerURL := startScheduler(t, config.Config{
+		Balancer:     balancer.NewPullBased([]url.URL{}),
+		ReverseProxy: proxy.NewHTTPReverseProxy(),
+		Placement:    balancer.NewPlacement(balancer.PlacementOptions{}),
+		Auth: auth.Options{
+			Tokens:       []auth.Token{{Name: "ops", Token: "admin-token", Role: auth.Admin}},
+			WorkerSecret: "worker-secret",
+		},
+	})
+	labels := schedulerURL + "/admin/workers/labels?worker=http://w1:5000"
+	signed := func(method string) int {
+		body := []byte(`{"pool": "dedicated"}`)
+		req, _ := http.NewRequest(method, labels, strings.NewReader(string(body)))
+		auth.Sign(req, "worker-secret", body, time.Now())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to send %s %s: %v", method, labels, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := signed(http.MethodGet); status != http.StatusOK {
+		t.Errorf("expected workers to read labels, got %d", status)
+	}
+	if status := signed(http.MethodPost); status != http.StatusForbidden {
+		t.Errorf("expected 403 for workers changing labels, got %d", status)
+	}
+	if status := request(t, http.MethodPost, labels, "admin-token"); status != http.StatusOK {
+		t.Errorf("expected admins to change labels, got %d", status)
+	}
+}
@@ -0,0 +1,142 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hiku/autoscale"
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/proxy"
+	"hiku/scheduler"
+)
+
+type fakeScalingSource struct {
+	workers []url.URL
+}
+
+func (s *fakeScalingSource) Workers() []url.URL           { return s.workers }
+func (s *fakeScalingSource) Queued() int                  { return 0 }
+func (s *fakeScalingSource) ColdStarts() (uint64, uint64) { return 0, 0 }
+func (s *fakeScalingSource) Drain(workerURL url.URL) {
+	s.workers = append(s.workers[:0:0], s.workers...)
+	if i := balancer.FindUrlInSlice(s.workers, workerURL); i != -1 {
+		s.workers = append(s.workers[:i], s.workers[i+1:]...)
+	}
+}
+
+func TestAutoscalingHooksAndDrain(t *testing.T) {
+	var mutex sync.Mutex
+	var events []autoscale.Event
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event autoscale.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		mutex.Lock()
+		events = append(events, event)
+		mutex.Unlock()
+	}))
+	defer webhook.Close()
+	targetFile := filepath.Join(t.TempDir(), "target")
+
+	workers := createTestUrls([]string{"w1:8080", "w2:8080"})
+	w1, w2 := workers[0], workers[1]
+	source := &fakeScalingSource{workers: workers}
+	scaler := autoscale.NewAutoscaler(autoscale.Options{
+		TargetInFlight: 2,
+		ScaleDownDelay: time.Minute,
+		Hooks: []autoscale.Hook{
+			{URL: webhook.URL},
+			{Command: []string{"sh", "-c", `echo "$HIKU_SCALE_DIRECTION $HIKU_SCALE_TARGET_WORKERS" > ` + targetFile}},
+		},
+	}, source)
+	now := time.Now()
+	scaler.SetClock(func() time.Time { return now })
+
+	// 7 invocations in flight need 4 workers, which is only requested once
+	for i := 0; i < 4; i++ {
+		scaler.Started(w1)
+	}
+	for i := 0; i < 3; i++ {
+		scaler.Started(w2)
+	}
+	if recommendation := scaler.Evaluate(); recommendation.DesiredWorkers != 4 || recommendation.Signals.PeakInFlight != 7 {
+		t.Fatalf("expected 4 workers for 7 invocations, got %+v", recommendation)
+	}
+	scaler.Evaluate()
+	if output, _ := os.ReadFile(targetFile); strings.TrimSpace(string(output)) != "up 4" {
+		t.Errorf("expected the command to scale up to 4, got %q", output)
+	}
+
+	// Once the load drops, a worker is drained after the delay and only
+	// reported once its invocation is done
+	for i := 0; i < 3; i++ {
+		scaler.Finished(w1)
+	}
+	for i := 0; i < 2; i++ {
+		scaler.Finished(w2)
+	}
+	scaler.Evaluate()
+	if recommendation := scaler.Evaluate(); recommendation.DesiredWorkers != 1 {
+		t.Fatalf("expected 1 worker for 2 invocations, got %+v", recommendation)
+	}
+	now = now.Add(time.Minute)
+	if recommendation := scaler.Evaluate(); len(recommendation.Draining) != 1 || recommendation.Draining[0] != w1.String() {
+		t.Fatalf("expected w1 to be draining, got %+v", recommendation)
+	}
+	if len(source.workers) != 1 || source.workers[0] != w2 || !scaler.Draining(w1) {
+		t.Fatalf("expected w1 to leave the balancer, got %v", source.workers)
+	}
+	mutex.Lock()
+	if len(events) != 1 {
+		t.Errorf("expected no scale-down while w1 drains, got %+v", events)
+	}
+	mutex.Unlock()
+
+	scaler.Finished(w1)
+	scaler.Evaluate()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(events) != 2 || events[0].Direction != autoscale.ScaleUp || events[0].TargetWorkers != 4 {
+		t.Fatalf("expected a scale-up and a scale-down, got %+v", events)
+	}
+	if down := events[1]; down.Direction != autoscale.ScaleDown || down.TargetWorkers != 1 || len(down.Workers) != 1 || down.Workers[0] != w1.String() {
+		t.Errorf("expected to scale down to 1 by removing w1, got %+v", down)
+	}
+}
+
+func TestAutoscalingWithoutHooksOnlyRecommends(t *testing.T) {
+	source := &fakeScalingSource{workers: createTestUrls([]string{"w1:8080", "w2:8080", "w3:8080"})}
+	scaler := autoscale.NewAutoscaler(autoscale.Options{ScaleDownDelay: time.Minute}, source)
+	now := time.Now()
+	scaler.SetClock(func() time.Time { return now })
+
+	scaler.Evaluate()
+	now = now.Add(time.Hour)
+	recommendation := scaler.Evaluate()
+	if recommendation.DesiredWorkers != 1 || len(recommendation.Draining) != 0 || len(source.workers) != 3 {
+		t.Errorf("expected a recommendation of 1 worker without draining any, got %+v with workers %v", recommendation, source.workers)
+	}
+}
+
+func TestAutoscalingStartsWithTheScheduler(t *testing.T) {
+	s := scheduler.NewScheduler(config.Config{
+		Balancer:     balancer.NewPullBased(createTestUrls([]string{"w1:8080"})),
+		ReverseProxy: proxy.NewHTTPReverseProxy(),
+		Autoscale:    &autoscale.Options{Interval: time.Millisecond},
+	})
+	defer s.Close()
+
+	// The first evaluations run while nothing is queued
+	time.Sleep(10 * time.Millisecond)
+	if recommendation, err := s.Autoscaling(); err != nil || recommendation.DesiredWorkers != 1 {
+		t.Errorf("expected a recommendation of 1 worker, got %+v (%v)", recommendation, err)
+	}
+}
@@ -1,14 +1,18 @@
 package test
 
 import (
+	"fmt"
 	"hiku/balancer"
 	"net/http"
 	"net/url"
 	"testing"
+	"time"
 
 	"hiku/lambda"
 )
 
+var testOutcome = balancer.Outcome{Latency: time.Millisecond, Status: http.StatusOK}
+
 func createTestUrls(hosts []string) []url.URL {
 	urls := make([]url.URL, len(hosts))
 	for i, host := range hosts {
@@ -102,7 +106,7 @@ func TestLeastConnectionsBalancer(t *testing.T) {
 		t.Error("expected different workers to be selected")
 	}
 
-	balancer.ReleaseWorker(worker1, testLambda)
+	balancer.ReleaseWorker(worker1, testLambda, testOutcome)
 
 	worker3, err := balancer.SelectWorker(createTestRequest("/run/test"), testLambda)
 	if err != nil {
@@ -140,8 +144,8 @@ func TestConsistentHashingBalancer(t *testing.T) {
 		t.Fatalf("failed to select worker for different request: %v", err)
 	}
 
-	balancer.ReleaseWorker(worker1, testLambda)
-	balancer.ReleaseWorker(worker3, testLambda)
+	balancer.ReleaseWorker(worker1, testLambda, testOutcome)
+	balancer.ReleaseWorker(worker3, testLambda, testOutcome)
 }
 
 func TestPullBasedBalancer(t *testing.T) {
@@ -156,7 +160,7 @@ func TestPullBasedBalancer(t *testing.T) {
 		t.Fatalf("failed to select worker for function1: %v", err)
 	}
 
-	balancer.ReleaseWorker(worker1, lambda1)
+	balancer.ReleaseWorker(worker1, lambda1, testOutcome)
 
 	worker2, err := balancer.SelectWorker(createTestRequest("/run/function1"), lambda1)
 	if err != nil {
@@ -171,7 +175,7 @@ func TestPullBasedBalancer(t *testing.T) {
 		t.Fatalf("failed to select worker for function2: %v", err)
 	}
 
-	balancer.ReleaseWorker(worker3, lambda2)
+	balancer.ReleaseWorker(worker3, lambda2, testOutcome)
 
 	worker4, err := balancer.SelectWorker(createTestRequest("/run/function2"), lambda2)
 	if err != nil {
@@ -181,3 +185,364 @@ func TestPullBasedBalancer(t *testing.T) {
 		t.Error("expected same worker for repeated function2 request")
 	}
 }
+
+func TestPullBasedIdleTTL(t *testing.T) {
+	testUrls := createTestUrls([]string{"worker1:8080", "worker2:8080"})
+	b := balancer.NewPullBasedWithOptions(testUrls, balancer.PullBasedOptions{
+		IdleTTL:          time.Hour,
+		FunctionIdleTTLs: map[string]time.Duration{"short": 10 * time.Millisecond},
+	})
+	defer b.(*balancer.PullBased).Close()
+	now := time.Now()
+	b.(balancer.Clocked).SetClock(func() time.Time { return now })
+
+	longLambda := &lambda.Lambda{Name: "long"}
+	shortLambda := &lambda.Lambda{Name: "short"}
+
+	for _, l := range []*lambda.Lambda{longLambda, shortLambda} {
+		worker, err := b.SelectWorker(createTestRequest("/run/"+l.Name), l)
+		if err != nil {
+			t.Fatalf("failed to select worker for %s: %v", l.Name, err)
+		}
+		b.ReleaseWorker(worker, l, testOutcome)
+	}
+
+	now = now.Add(20 * time.Millisecond)
+
+	for _, l := range []*lambda.Lambda{longLambda, shortLambda} {
+		worker, err := b.SelectWorker(createTestRequest("/run/"+l.Name), l)
+		if err != nil {
+			t.Fatalf("failed to select worker for %s: %v", l.Name, err)
+		}
+		b.ReleaseWorker(worker, l, testOutcome)
+	}
+
+	stats := b.(balancer.IdleQueueStatsProvider).IdleQueueStats()
+	if stats["long"].Hits != 1 || stats["long"].Expired != 0 {
+		t.Errorf("expected one hit for long TTL, got %+v", stats["long"])
+	}
+	if stats["short"].Hits != 0 || stats["short"].Expired != 1 {
+		t.Errorf("expected one expired entry for short TTL, got %+v", stats["short"])
+	}
+
+	now = now.Add(20 * time.Millisecond)
+	if expired := b.(*balancer.PullBased).ExpireIdleEntries(); expired != 1 {
+		t.Errorf("expected sweep to expire 1 entry, got %d", expired)
+	}
+}
+
+func TestMemoryAwareBalancer(t *testing.T) {
+	testUrls := createTestUrls([]string{"worker1:8080", "worker2:8080"})
+	b := balancer.NewMemoryAware(testUrls, balancer.PullBasedOptions{}, balancer.MemoryOptions{
+		WorkerBudgetMB: 1024,
+		FunctionMB:     map[string]uint64{"big": 768},
+	})
+
+	bigLambda := &lambda.Lambda{Name: "big"}
+	smallLambda := &lambda.Lambda{Name: "small"}
+
+	bigWorker, err := b.SelectWorker(createTestRequest("/run/big"), bigLambda)
+	if err != nil {
+		t.Fatalf("failed to select worker for big: %v", err)
+	}
+	b.ReleaseWorker(bigWorker, bigLambda, testOutcome)
+
+	// Both workers are idle, but only the other one has memory left
+	smallWorker, err := b.SelectWorker(createTestRequest("/run/small"), smallLambda)
+	if err != nil {
+		t.Fatalf("failed to select worker for small: %v", err)
+	}
+	if smallWorker.Host == bigWorker.Host {
+		t.Error("expected small function to be placed on the worker with memory left")
+	}
+
+	usage := b.(balancer.MemoryAware).MemoryUsage()
+	if usage[bigWorker.String()].CommittedMB != 768 {
+		t.Errorf("expected 768 MB committed on %s, got %d", bigWorker.Host, usage[bigWorker.String()].CommittedMB)
+	}
+
+	// An evicted sandbox frees its memory
+	b.DestroySandbox(bigWorker, bigLambda)
+	usage = b.(balancer.MemoryAware).MemoryUsage()
+	if usage[bigWorker.String()].CommittedMB != 0 {
+		t.Errorf("expected no memory committed after eviction, got %d", usage[bigWorker.String()].CommittedMB)
+	}
+}
+
+func TestMemoryOfDroppedIdleEntriesIsReleased(t *testing.T) {
+	testUrls := createTestUrls([]string{"worker1:8080", "worker2:8080"})
+	b := balancer.NewMemoryAware(testUrls, balancer.PullBasedOptions{}, balancer.MemoryOptions{WorkerBudgetMB: 1024})
+	placement := balancer.NewPlacement(balancer.PlacementOptions{})
+	b.(balancer.Constrained).SetPlacement(placement)
+	l := &lambda.Lambda{Name: "f"}
+
+	idleWorker, _ := b.SelectWorker(createTestRequest("/run/f"), l)
+	b.ReleaseWorker(idleWorker, l, testOutcome)
+
+	// The function may no longer run on the worker of its idle sandbox
+	otherWorker := testUrls[0]
+	if otherWorker == idleWorker {
+		otherWorker = testUrls[1]
+	}
+	placement.SetWorkerLabels(otherWorker, map[string]string{"pool": "other"})
+	placement.SetFunctionPlacement("f", balancer.FunctionPlacement{
+		Constraints: []balancer.Constraint{{Key: "pool", Value: "other"}},
+	})
+	if selected, _ := b.SelectWorker(createTestRequest("/run/f"), l); selected != otherWorker {
+		t.Fatalf("expected %s, got %s", otherWorker.Host, selected.Host)
+	}
+	if usage := b.(balancer.MemoryAware).MemoryUsage(); usage[idleWorker.String()].CommittedMB != 0 {
+		t.Errorf("expected the memory of the dropped sandbox to be released, got %d", usage[idleWorker.String()].CommittedMB)
+	}
+}
+
+func TestPackageAffinityBalancer(t *testing.T) {
+	testUrls := createTestUrls([]string{"worker1:8080", "worker2:8080", "worker3:8080"})
+	b := balancer.NewPackageAffinity(testUrls, balancer.PullBasedOptions{}, balancer.PackageOptions{
+		FunctionPackages: map[string][]string{
+			"matmul":  {"numpy"},
+			"linpack": {"numpy"},
+		},
+	})
+
+	matmulLambda := &lambda.Lambda{Name: "matmul"}
+	linpackLambda := &lambda.Lambda{Name: "linpack"}
+
+	matmulWorker, err := b.SelectWorker(createTestRequest("/run/matmul"), matmulLambda)
+	if err != nil {
+		t.Fatalf("failed to select worker for matmul: %v", err)
+	}
+	b.ReleaseWorker(matmulWorker, matmulLambda, testOutcome)
+
+	// No idle sandbox for linpack, but numpy is already installed
+	linpackWorker, err := b.SelectWorker(createTestRequest("/run/linpack"), linpackLambda)
+	if err != nil {
+		t.Fatalf("failed to select worker for linpack: %v", err)
+	}
+	if linpackWorker.Host != matmulWorker.Host {
+		t.Errorf("expected linpack on %s which has numpy installed, got %s", matmulWorker.Host, linpackWorker.Host)
+	}
+}
+
+func TestLatencyAwareBalancer(t *testing.T) {
+	testUrls := createTestUrls([]string{"worker1:8080", "worker2:8080"})
+	b := balancer.NewLatencyAware(testUrls, balancer.LatencyOptions{})
+	testLambda := &lambda.Lambda{Name: "test"}
+
+	// Workers without samples are tried first
+	first, err := b.SelectWorker(createTestRequest("/run/test"), testLambda)
+	if err != nil {
+		t.Fatalf("failed to select first worker: %v", err)
+	}
+	second, err := b.SelectWorker(createTestRequest("/run/test"), testLambda)
+	if err != nil {
+		t.Fatalf("failed to select second worker: %v", err)
+	}
+	if first.Host == second.Host {
+		t.Fatal("expected both workers to be tried")
+	}
+
+	b.ReleaseWorker(first, testLambda, balancer.Outcome{Latency: 100 * time.Millisecond, Status: http.StatusOK})
+	b.ReleaseWorker(second, testLambda, balancer.Outcome{Latency: 10 * time.Millisecond, Status: http.StatusOK})
+
+	// The fast worker is preferred even with a request in flight
+	for i := 0; i < 2; i++ {
+		worker, err := b.SelectWorker(createTestRequest("/run/test"), testLambda)
+		if err != nil {
+			t.Fatalf("failed to select worker: %v", err)
+		}
+		if worker.Host != second.Host {
+			t.Errorf("expected fast worker %s, got %s", second.Host, worker.Host)
+		}
+	}
+
+	// Server errors count as slow responses
+	b.ReleaseWorker(second, testLambda, balancer.Outcome{Latency: time.Millisecond, Status: http.StatusBadGateway})
+	b.ReleaseWorker(second, testLambda, testOutcome)
+	worker, err := b.SelectWorker(createTestRequest("/run/test"), testLambda)
+	if err != nil {
+		t.Fatalf("failed to select worker: %v", err)
+	}
+	if worker.Host != first.Host {
+		t.Errorf("expected failing worker to be avoided, got %s", worker.Host)
+	}
+}
+
+func TestPlacementConstraints(t *testing.T) {
+	testUrls := createTestUrls([]string{"latency1:8080", "batch1:8080", "batch2:8080"})
+	placement := balancer.NewPlacement(balancer.PlacementOptions{
+		WorkerLabels: map[string]map[string]string{
+			"http://latency1:8080": {"pool": "latency", "zone": "a"},
+			"http://batch1:8080":   {"pool": "batch", "zone": "a"},
+			"http://batch2:8080":   {"pool": "batch", "zone": "b"},
+		},
+	})
+	notLatency, _ := balancer.ParseConstraint("pool!=latency")
+	preference, _ := balancer.ParseConstraint("zone=b")
+	placement.SetFunctionPlacement("batch", balancer.FunctionPlacement{
+		Constraints: []balancer.Constraint{notLatency},
+		Preferences: []balancer.Constraint{preference},
+	})
+	gpu, _ := balancer.ParseConstraint("gpu=true")
+	placement.SetFunctionPlacement("training", balancer.FunctionPlacement{Constraints: []balancer.Constraint{gpu}})
+
+	balancers := map[string]func([]url.URL) balancer.Balancer{
+		"Random":            balancer.NewRandom,
+		"LeastConnections":  balancer.NewLeastConnections,
+		"ConsistentHashing": balancer.NewConsistentHashingBounded,
+		"PullBased":         balancer.NewPullBased,
+		"LatencyAware": func(urls []url.URL) balancer.Balancer {
+			return balancer.NewLatencyAware(urls, balancer.LatencyOptions{})
+		},
+	}
+
+	for name, constructor := range balancers {
+		t.Run(name, func(t *testing.T) {
+			b := constructor(testUrls)
+			b.(balancer.Constrained).SetPlacement(placement)
+
+			// Only the allowed worker in the preferred zone is selected
+			l := &lambda.Lambda{Name: "batch"}
+			var selected []url.URL
+			for i := 0; i < 10; i++ {
+				workerURL, err := b.SelectWorker(createTestRequest("/run/batch"), l)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if workerURL.Host != "batch2:8080" {
+					t.Fatalf("expected the batch worker in zone b, got %s", workerURL.Host)
+				}
+				selected = append(selected, workerURL)
+			}
+			for _, workerURL := range selected {
+				b.ReleaseWorker(workerURL, l, testOutcome)
+			}
+
+			if _, err := b.SelectWorker(createTestRequest("/run/training"), &lambda.Lambda{Name: "training"}); err == nil ||
+				err.Code != http.StatusServiceUnavailable {
+				t.Errorf("expected 503 without a worker satisfying the constraints, got %v", err)
+			}
+		})
+	}
+}
+
+func TestZoneAwarePullBased(t *testing.T) {
+	testUrls := createTestUrls([]string{"a1:8080", "b1:8080"})
+	placement := balancer.NewPlacement(balancer.PlacementOptions{
+		WorkerLabels: map[string]map[string]string{
+			"http://a1:8080": {"zone": "a"},
+			"http://b1:8080": {"zone": "b"},
+		},
+		Locality: balancer.LocalityOptions{Zone: "a", SpilloverLoad: 2},
+	})
+	b := balancer.NewPullBased(testUrls)
+	b.(balancer.Constrained).SetPlacement(placement)
+	l := &lambda.Lambda{Name: "f"}
+
+	// Cold starts stay in the zone until the local worker is busy
+	var selected []url.URL
+	for _, expected := range []string{"a1:8080", "a1:8080", "b1:8080"} {
+		workerURL, _ := b.SelectWorker(createTestRequest("/run/f"), l)
+		if workerURL.Host != expected {
+			t.Fatalf("expected %s, got %s", expected, workerURL.Host)
+		}
+		selected = append(selected, workerURL)
+	}
+	for _, workerURL := range selected {
+		b.ReleaseWorker(workerURL, l, testOutcome)
+		placement.RecordRoute(workerURL)
+	}
+
+	// Same-zone warm sandboxes first, the other zone's once they are busy
+	for _, expected := range []string{"a1:8080", "a1:8080", "b1:8080"} {
+		workerURL, _ := b.SelectWorker(createTestRequest("/run/f"), l)
+		if workerURL.Host != expected {
+			t.Errorf("expected warm sandbox on %s, got %s", expected, workerURL.Host)
+		}
+	}
+	if stats := b.(balancer.IdleQueueStatsProvider).IdleQueueStats()["f"]; stats.Hits != 3 {
+		t.Errorf("expected 3 idle-queue hits, got %+v", stats)
+	}
+
+	stats := placement.ZoneStats()
+	if stats.SameZone != 2 || stats.CrossZone != 1 || stats.ByZone["b"] != 1 {
+		t.Errorf("expected 2 same-zone and 1 cross-zone routes, got %+v", stats)
+	}
+}
+
+func TestPullBasedColdStartHashing(t *testing.T) {
+	hosts := []string{"w1:8080", "w2:8080", "w3:8080", "w4:8080"}
+	options := balancer.PullBasedOptions{ColdStartHashing: true}
+
+	// Cold starts of a function go to the same worker regardless of the
+	// order the workers were added in
+	b := balancer.NewPullBasedWithOptions(createTestUrls(hosts), options)
+	reversed := balancer.NewPullBasedWithOptions(createTestUrls([]string{hosts[3], hosts[2], hosts[1], hosts[0]}), options)
+	owners := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		l := &lambda.Lambda{Name: fmt.Sprintf("f%d", i)}
+		workerURL, _ := b.SelectWorker(createTestRequest("/run/"+l.Name), l)
+		other, _ := reversed.SelectWorker(createTestRequest("/run/"+l.Name), l)
+		if workerURL != other {
+			t.Errorf("expected cold starts of %s on the same worker, got %s and %s", l.Name, workerURL.Host, other.Host)
+		}
+		b.ReleaseWorker(workerURL, l, testOutcome)
+		reversed.ReleaseWorker(other, l, testOutcome)
+		owners[workerURL.Host] = true
+	}
+	if len(owners) < 3 {
+		t.Errorf("expected functions to spread over the workers, got %v", owners)
+	}
+
+	// A burst of a new function spreads over the bounded neighbours
+	b = balancer.NewPullBasedWithOptions(createTestUrls(hosts), options)
+	l := &lambda.Lambda{Name: "burst"}
+	loads := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		workerURL, _ := b.SelectWorker(createTestRequest("/run/burst"), l)
+		loads[workerURL.Host]++
+	}
+	for host, load := range loads {
+		if load > 3 {
+			t.Errorf("expected at most 3 cold starts per worker, got %d on %s", load, host)
+		}
+	}
+}
+
+func TestPlacementKeysOnNamespacedFunctions(t *testing.T) {
+	placement := balancer.NewPlacement(balancer.PlacementOptions{
+		WorkerLabels: map[string]map[string]string{"http://gpu:8080": {"gpu": "true"}},
+		Functions: map[string]balancer.FunctionPlacement{
+			"ml__resize": {Constraints: []balancer.Constraint{{Key: "gpu", Value: "true"}}},
+		},
+	})
+	candidates := createTestUrls([]string{"gpu:8080", "cpu:8080"})
+
+	ml, _ := placement.Filter(candidates, &lambda.Lambda{Name: "resize", Namespace: "ml"})
+	if len(ml) != 1 || ml[0].Host != "gpu:8080" {
+		t.Errorf("expected ml's resize on the GPU worker only, got %v", ml)
+	}
+	web, _ := placement.Filter(candidates, &lambda.Lambda{Name: "resize", Namespace: "web"})
+	if len(web) != 2 {
+		t.Errorf("expected web's resize to be unconstrained, got %v", web)
+	}
+}
+
+func TestLatencyAwareNewWorkerDoesNotDrawAllRequests(t *testing.T) {
+	b := balancer.NewLatencyAware(createTestUrls([]string{"w1:8080"}), balancer.LatencyOptions{})
+	l := &lambda.Lambda{Name: "f"}
+	workerURL, _ := b.SelectWorker(createTestRequest("/run/f"), l)
+	b.ReleaseWorker(workerURL, l, balancer.Outcome{Latency: 10 * time.Millisecond, Status: http.StatusOK})
+
+	// The new worker is assumed to be as fast as w1, so requests in flight
+	// spread over both until it responds
+	b.AddWorker(createTestUrls([]string{"w2:8080"})[0])
+	selected := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		workerURL, _ := b.SelectWorker(createTestRequest("/run/f"), l)
+		selected[workerURL.Host]++
+	}
+	if selected["w1:8080"] != 3 || selected["w2:8080"] != 3 {
+		t.Errorf("expected the requests to spread over both workers, got %v", selected)
+	}
+}
@@ -0,0 +1,301 @@
+package test
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"hiku/async"
+	"hiku/balancer"
+	"hiku/cluster"
+	"hiku/config"
+	"hiku/proxy"
+	hikuserver "hiku/server"
+	"hiku/testing/fakeworker"
+	"hiku/tlsutil"
+)
+
+// startReplicas serves schedulers that partition functions among them, each
+// with a balancer of its own.
+func startReplicas(t *testing.T, replicas int) []*httptest.Server {
+	servers := make([]*httptest.Server, replicas)
+	replicaURLs := make([]string, replicas)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		replicaURLs[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+
+	for i, server := range servers {
+		server.Config.Handler = hikuserver.NewHandler(config.Config{
+			Balancer:     balancer.NewPullBased([]url.URL{}),
+			ReverseProxy: proxy.NewHTTPReverseProxy(),
+			Cluster: &cluster.Options{Self: replicaURLs[i], Replicas: replicaURLs, RetryInterval: time.Minute,
+				Secret: "replica-secret"},
+		})
+		server.Start()
+		t.Cleanup(server.Close)
+	}
+	return servers
+}
+
+// getJSON decodes the response to a GET request to a scheduler endpoint.
+func getJSON(t *testing.T, target string, v any) {
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatalf("failed to get %s: %v", target, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("failed to decode %s: %v", target, err)
+	}
+}
+
+func idleQueues(t *testing.T, schedulerURL string) map[string]balancer.IdleQueueStats {
+	var stats map[string]balancer.IdleQueueStats
+	getJSON(t, schedulerURL+"/admin/idle-queues", &stats)
+	return stats
+}
+
+func addWorkers(t *testing.T, schedulerURL string, workerURL url.URL) {
+	resp, err := http.Post(schedulerURL+"/admin/workers/add?workers="+workerURL.String(), "", nil)
+	if err != nil {
+		t.Fatalf("failed to add worker: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestReplicasPartitionFunctions(t *testing.T) {
+	servers := startReplicas(t, 3)
+
+	// Workers report evictions to the first replica only
+	workers := make([]*fakeworker.Worker, 2)
+	for i := range workers {
+		workers[i] = fakeworker.NewWorker(fakeworker.Options{KeepAlive: 300 * time.Millisecond, SchedulerURL: servers[0].URL})
+		workerURL, err := workers[i].Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to start fake worker: %v", err)
+		}
+		t.Cleanup(workers[i].Close)
+		for _, server := range servers {
+			addWorkers(t, server.URL, workerURL)
+		}
+	}
+
+	// Every function is invoked through every replica
+	functions := 6
+	for round := 0; round < 2; round++ {
+		for _, server := range servers {
+			for f := 0; f < functions; f++ {
+				if status := invoke(t, server.URL, fmt.Sprintf("f%d", f)); status != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", status)
+				}
+			}
+		}
+	}
+
+	// Only the owner keeps idle queues, so each function starts cold once
+	if stats := totalStats(workers); stats.ColdStarts != functions || stats.Invocations != 6*functions {
+		t.Errorf("expected %d cold starts as with a single scheduler, got %+v", functions, stats)
+	}
+	owned := make([]int, len(servers))
+	total := 0
+	for i, server := range servers {
+		owned[i] = len(idleQueues(t, server.URL))
+		total += owned[i]
+	}
+	if total != functions {
+		t.Errorf("expected each function to be owned by one replica, got %d idle queues", total)
+	}
+
+	// Evictions reach the idle queues of the owners
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		evicted := uint64(0)
+		for _, server := range servers {
+			for _, queue := range idleQueues(t, server.URL) {
+				evicted += queue.Evicted
+			}
+		}
+		if evicted == uint64(functions) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d evictions at the owners, got %d", functions, evicted)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Functions of an unreachable replica are served by the others
+	servers[2].Close()
+	for f := 0; f < functions; f++ {
+		if status := invoke(t, servers[0].URL, fmt.Sprintf("f%d", f)); status != http.StatusOK {
+			t.Errorf("expected status 200 with a replica down, got %d", status)
+		}
+	}
+	var status []cluster.ReplicaStatus
+	getJSON(t, servers[0].URL+"/admin/cluster", &status)
+	for _, replica := range status {
+		if replica.URL == servers[2].URL && replica.Up && owned[2] > 0 {
+			t.Errorf("expected the closed replica to be reported down, got %+v", status)
+		}
+	}
+}
+
+func TestReplicasForwardAsyncInvocationsAndPrewarms(t *testing.T) {
+	servers := startReplicas(t, 3)
+	worker := fakeworker.NewWorker(fakeworker.Options{KeepAlive: time.Minute})
+	workerURL, err := worker.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake worker: %v", err)
+	}
+	t.Cleanup(worker.Close)
+	for _, server := range servers {
+		addWorkers(t, server.URL, workerURL)
+	}
+
+	// Every function is submitted through every replica, so through
+	// non-owners as well
+	functions := 6
+	var submitted []async.Invocation
+	for _, server := range servers {
+		for f := 0; f < functions; f++ {
+			submitted = append(submitted, submitAsync(t, server.URL, fmt.Sprintf("f%d", f), ""))
+		}
+	}
+
+	// Any replica finds the invocations queued by the owners
+	for _, invocation := range submitted {
+		deadline := time.Now().Add(2 * time.Second)
+		for invocation.State != async.Succeeded {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected invocation %s to succeed, got %+v", invocation.ID, invocation)
+			}
+			time.Sleep(10 * time.Millisecond)
+			getJSON(t, servers[0].URL+"/invocations/"+invocation.ID, &invocation)
+		}
+	}
+
+	// Pre-warming through any replica warms the idle queue of the owner
+	for _, server := range servers {
+		resp, err := http.Post(server.URL+"/admin/prewarm/g", "application/json", nil)
+		if err != nil {
+			t.Fatalf("failed to pre-warm: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	total := 0
+	for _, server := range servers {
+		total += len(idleQueues(t, server.URL))
+	}
+	if total != functions+1 {
+		t.Errorf("expected one idle queue per function across the replicas, got %d", total)
+	}
+	if stats := worker.Stats(); stats.ColdStarts != functions+1 {
+		t.Errorf("expected %d cold starts as with a single scheduler, got %+v", functions+1, stats)
+	}
+}
+
+func TestReplicasIgnoreForwardedHeaderFromClients(t *testing.T) {
+	servers := startReplicas(t, 3)
+	worker := fakeworker.NewWorker(fakeworker.Options{KeepAlive: time.Minute})
+	workerURL, err := worker.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake worker: %v", err)
+	}
+	t.Cleanup(worker.Close)
+	for _, server := range servers {
+		addWorkers(t, server.URL, workerURL)
+	}
+
+	// Clients claiming to be a replica are forwarded to the owner anyway
+	functions := 6
+	for _, server := range servers {
+		for f := 0; f < functions; f++ {
+			req, _ := http.NewRequest(http.MethodPost, server.URL+fmt.Sprintf("/run/f%d", f), strings.NewReader("{}"))
+			req.Header.Set(cluster.ForwardedHeader, servers[(f+1)%len(servers)].URL)
+			req.Header.Set(cluster.ForwardedSignatureHeader, "forged")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to invoke: %v", err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	total := 0
+	for _, server := range servers {
+		total += len(idleQueues(t, server.URL))
+	}
+	if total != functions {
+		t.Errorf("expected each function to be served by its owner only, got %d idle queues", total)
+	}
+}
+
+func TestReplicasForwardOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCertificate(t, dir, "ca", 1, nil)
+	replicaCert := newCertificate(t, dir, "replica", 2, &ca)
+	keyPair, _ := tls.LoadX509KeyPair(replicaCert.certFile, replicaCert.keyFile)
+	replicaTLS, err := tlsutil.NewClientConfig(tlsutil.ClientOptions{CAFile: ca.certFile})
+	if err != nil {
+		t.Fatalf("failed to create replica TLS config: %v", err)
+	}
+
+	servers := make([]*httptest.Server, 2)
+	replicaURLs := make([]string, len(servers))
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		servers[i].TLS = &tls.Config{Certificates: []tls.Certificate{keyPair}}
+		replicaURLs[i] = "https://" + servers[i].Listener.Addr().String()
+	}
+	worker := fakeworker.NewWorker(fakeworker.Options{KeepAlive: time.Minute})
+	workerURL, err := worker.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake worker: %v", err)
+	}
+	t.Cleanup(worker.Close)
+	for i, server := range servers {
+		b := balancer.NewPullBased([]url.URL{})
+		b.AddWorker(workerURL)
+		server.Config.Handler = hikuserver.NewHandler(config.Config{
+			Balancer:     b,
+			ReverseProxy: proxy.NewHTTPReverseProxy(),
+			Cluster: &cluster.Options{Self: replicaURLs[i], Replicas: replicaURLs, RetryInterval: time.Minute,
+				Timeout: 10 * time.Second, TLS: replicaTLS},
+		})
+		server.StartTLS()
+		t.Cleanup(server.Close)
+	}
+
+	client := servers[0].Client()
+	for f := 0; f < 6; f++ {
+		resp, err := client.Post(servers[0].URL+fmt.Sprintf("/run/f%d", f), "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("failed to invoke: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+	}
+
+	resp, err := client.Get(servers[0].URL + "/admin/cluster")
+	if err != nil {
+		t.Fatalf("failed to get cluster status: %v", err)
+	}
+	var status []cluster.ReplicaStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	for _, replica := range status {
+		if !replica.Up {
+			t.Errorf("expected the replicas to reach each other over TLS, got %+v", status)
+		}
+	}
+}
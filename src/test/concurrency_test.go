@@ -0,0 +1,88 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hiku/balancer"
+	"hiku/concurrency"
+	"hiku/testing/fakeworker"
+)
+
+func TestConcurrencyReservations(t *testing.T) {
+	limiter, err := concurrency.NewLimiter(concurrency.Options{
+		Limit: 3,
+		Mode:  concurrency.Throttle,
+		Functions: map[string]concurrency.FunctionLimit{
+			"reserved": {Reserved: 2, Max: 3},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create limiter: %v", err)
+	}
+	ctx := context.Background()
+
+	// Other functions share the single unreserved slot
+	releaseOther, err := limiter.Acquire(ctx, "other")
+	if err != nil {
+		t.Fatalf("expected the unreserved slot to be free: %v", err)
+	}
+	if _, err := limiter.Acquire(ctx, "another"); err != concurrency.ErrThrottled {
+		t.Errorf("expected other functions to be throttled, got %v", err)
+	}
+
+	// The reservation is still free for its function
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.Acquire(ctx, "reserved"); err != nil {
+			t.Fatalf("expected reserved slot %d to be free: %v", i, err)
+		}
+	}
+	if _, err := limiter.Acquire(ctx, "reserved"); err != concurrency.ErrThrottled {
+		t.Errorf("expected the function to be throttled beyond its reservation, got %v", err)
+	}
+
+	releaseOther()
+	if _, err := limiter.Acquire(ctx, "reserved"); err != nil {
+		t.Errorf("expected the function to burst into the unreserved slot: %v", err)
+	}
+	if _, err := limiter.Acquire(ctx, "reserved"); err != concurrency.ErrThrottled {
+		t.Errorf("expected the function to be capped at its maximum, got %v", err)
+	}
+
+	if err := limiter.SetFunctionLimit("another", concurrency.FunctionLimit{Reserved: 2}); err == nil {
+		t.Errorf("expected reservations beyond the limit to be refused")
+	}
+}
+
+func TestConcurrencyLimitQueuesRequests(t *testing.T) {
+	schedulerURL, workers := startCluster(t, balancer.NewPullBased([]url.URL{}), 1,
+		fakeworker.Options{Default: fakeworker.FunctionConfig{Warm: 50 * time.Millisecond}})
+
+	resp, err := http.Post(schedulerURL+"/admin/concurrency/f", "application/json", strings.NewReader(`{"max": 1}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to set concurrency: %v", err)
+	}
+	resp.Body.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status := invoke(t, schedulerURL, "f"); status != http.StatusOK {
+				t.Errorf("expected status 200, got %d", status)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// One at a time, every invocation finds the sandbox of the previous one
+	if stats := totalStats(workers); stats.ColdStarts != 1 || stats.WarmStarts != 2 {
+		t.Errorf("expected 1 cold and 2 warm starts, got %+v", stats)
+	}
+}
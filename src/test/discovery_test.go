@@ -0,0 +1,180 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"hiku/balancer"
+	"hiku/discovery"
+)
+
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+)
+
+type srvRecord struct {
+	target string
+	port   uint16
+}
+
+// startDNSStub answers A queries with the addresses and SRV queries with
+// the records, and returns a resolver that sends all queries to it.
+func startDNSStub(t *testing.T, addresses []net.IP, records []srvRecord) *net.Resolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := dnsResponse(buf[:n], addresses, records); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func dnsResponse(query []byte, addresses []net.IP, records []srvRecord) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// The question is the name up to its root label, then type and class
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	question := query[12:end]
+	queryType := binary.BigEndian.Uint16(question[len(question)-4:])
+
+	var answers [][]byte
+	switch queryType {
+	case dnsTypeA:
+		for _, address := range addresses {
+			answers = append(answers, dnsAnswer(dnsTypeA, address.To4()))
+		}
+	case dnsTypeSRV:
+		for _, record := range records {
+			data := []byte{0, 10, 0, 10, byte(record.port >> 8), byte(record.port)}
+			for _, label := range strings.Split(strings.TrimSuffix(record.target, "."), ".") {
+				data = append(data, byte(len(label)))
+				data = append(data, label...)
+			}
+			answers = append(answers, dnsAnswer(dnsTypeSRV, append(data, 0)))
+		}
+	}
+
+	response := make([]byte, 12, 512)
+	copy(response, query[:2])
+	binary.BigEndian.PutUint16(response[2:], 0x8180)
+	binary.BigEndian.PutUint16(response[4:], 1)
+	binary.BigEndian.PutUint16(response[6:], uint16(len(answers)))
+	response = append(response, question...)
+	for _, answer := range answers {
+		response = append(response, answer...)
+	}
+	return response
+}
+
+func dnsAnswer(recordType uint16, data []byte) []byte {
+	// The name points to the question, class IN and a TTL of a minute
+	answer := []byte{0xc0, 12, byte(recordType >> 8), byte(recordType), 0, 1, 0, 0, 0, 60}
+	answer = binary.BigEndian.AppendUint16(answer, uint16(len(data)))
+	return append(answer, data...)
+}
+
+func hostsOf(b balancer.Balancer) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, workerURL := range b.GetAllWorkers() {
+		hosts[workerURL.Host] = true
+	}
+	return hosts
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	resolver := startDNSStub(t,
+		[]net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+		[]srvRecord{{"w1.hiku.test.", 5001}, {"w2.hiku.test.", 5002}})
+
+	a, err := discovery.NewDNS(discovery.DNSOptions{Name: "workers.hiku.test.", Port: 5000}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := discovery.NewDNS(discovery.DNSOptions{Name: "_worker._tcp.hiku.test.", Record: "srv"}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := balancer.NewPullBased(createTestUrls([]string{"static:5000"}))
+	discovery.NewWatcher(b, 0, a, srv).Reconcile(context.Background())
+
+	hosts := hostsOf(b)
+	for _, expected := range []string{"static:5000", "10.0.0.1:5000", "10.0.0.2:5000", "w1.hiku.test:5001", "w2.hiku.test:5002"} {
+		if !hosts[expected] {
+			t.Errorf("expected worker %s, got %v", expected, hosts)
+		}
+	}
+}
+
+func TestFileAndCommandDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "workers.json")
+	yamlFile := filepath.Join(dir, "workers.yaml")
+	writeFile := func(path string, data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The output of `terraform output -json`
+	writeFile(jsonFile, `{"workers": {"sensitive": false, "type": ["list", "string"], "value": ["10.0.0.1:5000", "http://10.0.0.2:5000"]}}`)
+	writeFile(yamlFile, "# inventory\nworkers:\n  - http://10.0.1.1:5000\n  - \"10.0.1.2:5000\"\nregion: eu\n")
+
+	jsonProvider, _ := discovery.NewFile(discovery.FileOptions{Path: jsonFile})
+	yamlProvider, _ := discovery.NewFile(discovery.FileOptions{Path: yamlFile})
+	commandProvider, _ := discovery.NewCommand(discovery.CommandOptions{Command: []string{"echo", "10.0.2.1:5000"}})
+
+	b := balancer.NewPullBased(createTestUrls([]string{"static:5000"}))
+	watcher := discovery.NewWatcher(b, 0, jsonProvider, yamlProvider, commandProvider)
+	watcher.Reconcile(context.Background())
+	if hosts := hostsOf(b); len(hosts) != 6 || !hosts["10.0.1.2:5000"] || !hosts["10.0.2.1:5000"] {
+		t.Fatalf("expected the static and 5 discovered workers, got %v", hosts)
+	}
+
+	// Scaling in removes discovered workers but keeps configured ones, and a
+	// broken file keeps the workers it listed last
+	writeFile(jsonFile, `["10.0.0.1:5000", "static:5000"]`)
+	writeFile(yamlFile, "workers: [")
+	os.Chtimes(yamlFile, time.Time{}, time.Now().Add(time.Minute))
+	watcher.Reconcile(context.Background())
+	hosts := hostsOf(b)
+	if len(hosts) != 5 || hosts["10.0.0.2:5000"] || !hosts["static:5000"] || !hosts["10.0.1.1:5000"] {
+		t.Errorf("expected 10.0.0.2 to be removed only, got %v", hosts)
+	}
+	if status := watcher.Status(); status[1].Error == "" || status[0].Error != "" {
+		t.Errorf("expected an error of the YAML file only, got %+v", status)
+	}
+}
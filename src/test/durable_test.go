@@ -0,0 +1,156 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"hiku/async"
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/proxy"
+	"hiku/scheduler"
+	"hiku/testing/fakeworker"
+)
+
+func waitForState(t *testing.T, store async.Store, id string, state async.State) async.Invocation {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if invocation, ok, _ := store.Get(id); ok && invocation.State == state {
+			return invocation
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	invocation, _, _ := store.Get(id)
+	t.Fatalf("expected invocation %s to be %s, got %+v", id, state, invocation)
+	return invocation
+}
+
+func TestDurableQueueSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	options := async.Options{
+		Workers: 1,
+		Durable: async.DurableOptions{File: filepath.Join(dir, "queue.wal"), RetryBackoff: 200 * time.Millisecond},
+	}
+	attempted := make(chan struct{}, 1)
+	failing := func(string, []byte, string) async.Response {
+		attempted <- struct{}{}
+		return async.Response{Status: http.StatusBadGateway}
+	}
+
+	store, _ := async.NewFileStore(filepath.Join(dir, "results.jsonl"))
+	dispatcher, err := async.NewDispatcher(store, options, failing)
+	if err != nil {
+		t.Fatalf("failed to create dispatcher: %v", err)
+	}
+	submitted, err := dispatcher.SubmitDurable("f", []byte("{}"), "application/json", "")
+	if err != nil {
+		t.Fatalf("failed to submit: %v", err)
+	}
+	select {
+	case <-attempted:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected a first attempt")
+	}
+	waitForState(t, store, submitted.ID, async.Queued)
+	dispatcher.Close()
+
+	var body atomic.Value
+	succeeding := func(function string, b []byte, contentType string) async.Response {
+		body.Store(string(b))
+		return async.Response{Status: http.StatusOK}
+	}
+	store, _ = async.NewFileStore(filepath.Join(dir, "results.jsonl"))
+	dispatcher, err = async.NewDispatcher(store, options, succeeding)
+	if err != nil {
+		t.Fatalf("failed to reopen dispatcher: %v", err)
+	}
+	defer dispatcher.Close()
+
+	invocation := waitForState(t, store, submitted.ID, async.Succeeded)
+	if invocation.Attempts != 2 || body.Load() != "{}" {
+		t.Errorf("expected the second attempt to succeed with the original body, got %+v", invocation)
+	}
+	if stats, _ := dispatcher.DurableStats(); stats.Pending != 0 || stats.InFlight != 0 {
+		t.Errorf("expected an empty queue, got %+v", stats)
+	}
+}
+
+func TestDurableVisibilityTimeout(t *testing.T) {
+	var calls int32
+	run := func(string, []byte, string) async.Response {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// Hang past the visibility timeout
+			time.Sleep(300 * time.Millisecond)
+		}
+		return async.Response{Status: http.StatusOK}
+	}
+
+	store := async.NewMemoryStore()
+	dispatcher, err := async.NewDispatcher(store, async.Options{
+		Workers: 2,
+		Durable: async.DurableOptions{
+			File:              filepath.Join(t.TempDir(), "queue.wal"),
+			VisibilityTimeout: 50 * time.Millisecond,
+		},
+	}, run)
+	if err != nil {
+		t.Fatalf("failed to create dispatcher: %v", err)
+	}
+	defer dispatcher.Close()
+
+	submitted, _ := dispatcher.SubmitDurable("f", nil, "", "")
+	waitForState(t, store, submitted.ID, async.Succeeded)
+	if atomic.LoadInt32(&calls) < 2 {
+		t.Errorf("expected the invocation to be handed out again after the visibility timeout")
+	}
+}
+
+func TestDurableDeadLetters(t *testing.T) {
+	b := balancer.NewPullBased([]url.URL{})
+	_, workers := startCluster(t, b, 1, fakeworker.Options{})
+	workers[0].SetFunction("broken", fakeworker.FunctionConfig{FailureRate: 1, FailureStatus: http.StatusServiceUnavailable})
+
+	// A second scheduler on the same balancer, with a durable queue
+	c := config.Config{Balancer: b, ReverseProxy: proxy.NewHTTPReverseProxy()}
+	c.Async.Durable = async.DurableOptions{
+		File:         filepath.Join(t.TempDir(), "queue.wal"),
+		MaxAttempts:  2,
+		RetryBackoff: 10 * time.Millisecond,
+	}
+	schedulerURL := startScheduler(t, c)
+
+	req, _ := http.NewRequest(http.MethodPost, schedulerURL+"/run/broken", strings.NewReader("{}"))
+	req.Header.Set(scheduler.DurableHeader, "true")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected durable invocation to be accepted, got %v %v", resp, err)
+	}
+	var submitted async.Invocation
+	json.NewDecoder(resp.Body).Decode(&submitted)
+	resp.Body.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	var deadLetters []async.Invocation
+	for time.Now().Before(deadline) && len(deadLetters) == 0 {
+		time.Sleep(20 * time.Millisecond)
+		resp, err = http.Get(schedulerURL + "/admin/durable/dead-letters")
+		if err != nil {
+			t.Fatalf("failed to get dead letters: %v", err)
+		}
+		json.NewDecoder(resp.Body).Decode(&deadLetters)
+		resp.Body.Close()
+	}
+
+	if len(deadLetters) != 1 || deadLetters[0].ID != submitted.ID || deadLetters[0].Attempts != 2 {
+		t.Fatalf("expected the invocation to be dead-lettered after 2 attempts, got %+v", deadLetters)
+	}
+	if stats := workers[0].Stats(); stats.Invocations != 2 {
+		t.Errorf("expected 2 attempts on the worker, got %+v", stats)
+	}
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"hiku/fairqueue"
+)
+
+type queuedRequest struct {
+	class  string
+	flow   string
+	weight float64
+}
+
+// admissionOrder queues the requests behind one that holds the only slot
+// and returns the flows in the order they are admitted.
+func admissionOrder(t *testing.T, queue *fairqueue.Queue, requests []queuedRequest) []string {
+	hold, err := queue.Acquire(context.Background(), "", "hold", 1)
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+
+	var order []string
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		wg.Add(1)
+		go func(request queuedRequest) {
+			defer wg.Done()
+			release, err := queue.Acquire(context.Background(), request.class, request.flow, request.weight)
+			if err != nil {
+				t.Errorf("failed to acquire: %v", err)
+				return
+			}
+			mutex.Lock()
+			order = append(order, request.flow)
+			mutex.Unlock()
+			release()
+		}(request)
+
+		// Queue the requests in order
+		for queue.Stats().Queued != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	hold()
+	wg.Wait()
+	return order
+}
+
+func TestFairQueueIsolatesFlows(t *testing.T) {
+	queue := fairqueue.NewQueue(fairqueue.Options{
+		MaxInFlight: 1,
+		Classes:     map[string]int{"critical": 10, "normal": 0},
+	})
+
+	order := admissionOrder(t, queue, []queuedRequest{
+		{"normal", "noisy", 1}, {"normal", "noisy", 1}, {"normal", "noisy", 1}, {"normal", "noisy", 1},
+		{"normal", "quiet", 1}, {"normal", "quiet", 1},
+		{"critical", "urgent", 1},
+	})
+
+	expected := []string{"urgent", "noisy", "quiet", "noisy", "quiet", "noisy", "noisy"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected admission order %v, got %v", expected, order)
+	}
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	queue := fairqueue.NewQueue(fairqueue.Options{MaxInFlight: 1})
+
+	order := admissionOrder(t, queue, []queuedRequest{
+		{"", "heavy", 3}, {"", "heavy", 3}, {"", "heavy", 3}, {"", "heavy", 3},
+		{"", "light", 1}, {"", "light", 1},
+	})
+
+	expected := []string{"heavy", "heavy", "heavy", "light", "heavy", "light"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected admission order %v, got %v", expected, order)
+	}
+}
+
+func TestFairQueueTimeout(t *testing.T) {
+	queue := fairqueue.NewQueue(fairqueue.Options{MaxInFlight: 1, MaxQueued: 1})
+	hold, _ := queue.Acquire(context.Background(), "", "hold", 1)
+	defer hold()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := queue.Acquire(ctx, "", "f", 1); err != context.DeadlineExceeded {
+		t.Errorf("expected the request to time out, got %v", err)
+	}
+	if stats := queue.Stats(); stats.Queued != 0 {
+		t.Errorf("expected the timed out request to leave the queue, got %+v", stats)
+	}
+}
+
+func TestFairQueueClientsCannotRaiseTheirClass(t *testing.T) {
+	options := fairqueue.Options{
+		Classes:         map[string]int{"critical": 10, "normal": 5, "batch": 0},
+		DefaultClass:    "normal",
+		FunctionClasses: map[string]string{"report": "batch"},
+	}
+
+	for _, c := range []struct {
+		function  string
+		requested string
+		expected  string
+	}{
+		{"f", "", "normal"},
+		{"f", "batch", "batch"},
+		{"f", "critical", "normal"},
+		{"f", "unknown", "normal"},
+		{"report", "normal", "batch"},
+	} {
+		if class, _, _ := options.Classify(c.function, "", c.requested); class != c.expected {
+			t.Errorf("expected class %s for %s requesting %q, got %s", c.expected, c.function, c.requested, class)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/proxy"
+	"hiku/server"
+	"hiku/testing/fakeworker"
+)
+
+// startCluster serves a scheduler with the balancer on a test server and
+// adds fake workers that report evictions to it.
+func startCluster(t *testing.T, b balancer.Balancer, workers int, options fakeworker.Options) (string, []*fakeworker.Worker) {
+	return startClusterWithProxy(t, b, proxy.NewHTTPReverseProxy(), workers, options)
+}
+
+func startClusterWithProxy(t *testing.T, b balancer.Balancer, reverseProxy proxy.ReverseProxy, workers int,
+	options fakeworker.Options) (string, []*fakeworker.Worker) {
+	schedulerURL := startScheduler(t, config.Config{Balancer: b, ReverseProxy: reverseProxy})
+
+	options.SchedulerURL = schedulerURL
+	fakeWorkers := make([]*fakeworker.Worker, workers)
+	for i := range fakeWorkers {
+		fakeWorkers[i] = fakeworker.NewWorker(options)
+		workerURL, err := fakeWorkers[i].Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to start fake worker: %v", err)
+		}
+		t.Cleanup(fakeWorkers[i].Close)
+		b.AddWorker(workerURL)
+	}
+	return schedulerURL, fakeWorkers
+}
+
+func startScheduler(t *testing.T, c config.Config) string {
+	scheduler := httptest.NewServer(server.NewHandler(c))
+	t.Cleanup(scheduler.Close)
+	// The scheduler isn't closed, but the sweep of its balancer is stopped
+	if closer, ok := c.Balancer.(interface{ Close() }); ok {
+		t.Cleanup(closer.Close)
+	}
+	return scheduler.URL
+}
+
+func invoke(t *testing.T, schedulerURL string, function string) int {
+	resp, err := http.Post(schedulerURL+"/run/"+function, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("failed to invoke %s: %v", function, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func waitForEvictions(t *testing.T, schedulerURL string, function string, evicted uint64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(schedulerURL + "/admin/idle-queues")
+		if err != nil {
+			t.Fatalf("failed to get idle-queue stats: %v", err)
+		}
+		var stats map[string]balancer.IdleQueueStats
+		json.NewDecoder(resp.Body).Decode(&stats)
+		resp.Body.Close()
+
+		if stats[function].Evicted >= evicted {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("scheduler was not notified of %d evictions of %s", evicted, function)
+}
+
+func totalStats(workers []*fakeworker.Worker) fakeworker.Stats {
+	var total fakeworker.Stats
+	for _, w := range workers {
+		stats := w.Stats()
+		total.Invocations += stats.Invocations
+		total.ColdStarts += stats.ColdStarts
+		total.WarmStarts += stats.WarmStarts
+		total.Evictions += stats.Evictions
+	}
+	return total
+}
+
+func TestSchedulerReusesWarmSandboxes(t *testing.T) {
+	schedulerURL, workers := startCluster(t, balancer.NewPullBased([]url.URL{}), 2, fakeworker.Options{
+		Default: fakeworker.FunctionConfig{ColdStart: 20 * time.Millisecond, Warm: time.Millisecond},
+	})
+
+	for i := 0; i < 3; i++ {
+		if status := invoke(t, schedulerURL, "f"); status != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", status)
+		}
+	}
+
+	stats := totalStats(workers)
+	if stats.Invocations != 3 || stats.ColdStarts != 1 || stats.WarmStarts != 2 {
+		t.Errorf("expected 1 cold and 2 warm starts, got %+v", stats)
+	}
+
+	resp, err := http.Get(schedulerURL + "/status")
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Count(string(body), "ready") != 2 {
+		t.Errorf("expected both workers to be ready, got %q", body)
+	}
+}
+
+func TestFakeWorkerKeepAliveNotifiesScheduler(t *testing.T) {
+	schedulerURL, workers := startCluster(t, balancer.NewPullBased([]url.URL{}), 1, fakeworker.Options{
+		KeepAlive: 20 * time.Millisecond,
+	})
+
+	invoke(t, schedulerURL, "f")
+	waitForEvictions(t, schedulerURL, "f", 1)
+
+	// The sandbox is gone, so the next invocation is cold again
+	invoke(t, schedulerURL, "f")
+	if stats := workers[0].Stats(); stats.ColdStarts != 2 {
+		t.Errorf("expected 2 cold starts, got %+v", stats)
+	}
+}
+
+func TestFakeWorkerStopsKeepAliveOnClose(t *testing.T) {
+	var callbacks atomic.Int32
+	scheduler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callbacks.Add(1)
+	}))
+	defer scheduler.Close()
+
+	worker := fakeworker.NewWorker(fakeworker.Options{KeepAlive: 20 * time.Millisecond, SchedulerURL: scheduler.URL})
+	workerURL, err := worker.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake worker: %v", err)
+	}
+	invoke(t, workerURL.String(), "f")
+	worker.Close()
+
+	time.Sleep(60 * time.Millisecond)
+	if n := callbacks.Load(); n != 0 {
+		t.Errorf("expected no eviction callbacks after close, got %d", n)
+	}
+}
+
+func TestFakeWorkerEvictsWhenOutOfMemory(t *testing.T) {
+	schedulerURL, workers := startCluster(t, balancer.NewPullBased([]url.URL{}), 1, fakeworker.Options{
+		Default:  fakeworker.FunctionConfig{MemoryMB: 128},
+		MemoryMB: 256,
+	})
+
+	for _, function := range []string{"f", "g", "h"} {
+		invoke(t, schedulerURL, function)
+	}
+	waitForEvictions(t, schedulerURL, "f", 1)
+
+	sandboxes := workers[0].Sandboxes()
+	if sandboxes["f"] != 0 || sandboxes["g"] != 1 || sandboxes["h"] != 1 {
+		t.Errorf("expected the least recently used sandbox to be evicted, got %v", sandboxes)
+	}
+}
+
+func TestFakeWorkerFailureInjection(t *testing.T) {
+	schedulerURL, workers := startCluster(t, balancer.NewLeastConnections([]url.URL{}), 1, fakeworker.Options{})
+	workers[0].SetFunction("broken", fakeworker.FunctionConfig{FailureRate: 1, FailureStatus: http.StatusBadGateway})
+
+	if status := invoke(t, schedulerURL, "broken"); status != http.StatusBadGateway {
+		t.Errorf("expected injected status 502, got %d", status)
+	}
+	if status := invoke(t, schedulerURL, "f"); status != http.StatusOK {
+		t.Errorf("expected status 200, got %d", status)
+	}
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/proxy"
+	"hiku/testing/fakeworker"
+)
+
+func TestFaultInjection(t *testing.T) {
+	injector := proxy.NewFaultInjector(proxy.NewHTTPReverseProxy(), nil)
+	schedulerURL, workers := startClusterWithProxy(t, balancer.NewLeastConnections([]url.URL{}), injector, 1,
+		fakeworker.Options{})
+
+	abort := injector.AddFault(proxy.Fault{Function: "f", AbortStatus: http.StatusServiceUnavailable})
+	if status := invoke(t, schedulerURL, "f"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected injected status 503, got %d", status)
+	}
+	if status := invoke(t, schedulerURL, "g"); status != http.StatusOK {
+		t.Errorf("expected other functions to be unaffected, got %d", status)
+	}
+	injector.RemoveFault(abort.ID)
+
+	injector.AddFault(proxy.Fault{Function: "f", Delay: 50 * time.Millisecond, Duration: 200 * time.Millisecond})
+	start := time.Now()
+	invoke(t, schedulerURL, "f")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected a delay of at least 50ms, took %s", elapsed)
+	}
+
+	injector.AddFault(proxy.Fault{Worker: workers[0].URL().Host, Blackout: true, Duration: 50 * time.Millisecond})
+	if status := invoke(t, schedulerURL, "g"); status != http.StatusBadGateway {
+		t.Errorf("expected status 502 during the blackout, got %d", status)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if status := invoke(t, schedulerURL, "g"); status != http.StatusOK {
+		t.Errorf("expected status 200 after the blackout, got %d", status)
+	}
+	if faults := injector.Faults(); len(faults) != 0 {
+		t.Errorf("expected expired faults to be removed, got %v", faults)
+	}
+
+	injector.AddFault(proxy.Fault{Drop: true})
+	if _, err := http.Post(schedulerURL+"/run/f", "application/json", strings.NewReader("{}")); err == nil {
+		t.Errorf("expected the connection to be dropped")
+	}
+}
+
+func TestFaultAdminEndpoint(t *testing.T) {
+	injector := proxy.NewFaultInjector(proxy.NewHTTPReverseProxy(), nil)
+	schedulerURL, _ := startClusterWithProxy(t, balancer.NewLeastConnections([]url.URL{}), injector, 1,
+		fakeworker.Options{})
+
+	resp, err := http.Post(schedulerURL+"/admin/faults", "application/json",
+		strings.NewReader(`{"function": "f", "percentage": 100, "abort_status": 429}`))
+	if err != nil {
+		t.Fatalf("failed to add fault: %v", err)
+	}
+	var added config.FaultConfig
+	json.NewDecoder(resp.Body).Decode(&added)
+	resp.Body.Close()
+	if added.ID == "" {
+		t.Fatalf("expected the fault to get an ID")
+	}
+
+	if status := invoke(t, schedulerURL, "f"); status != http.StatusTooManyRequests {
+		t.Errorf("expected injected status 429, got %d", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, schedulerURL+"/admin/faults?id="+added.ID, nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to remove fault: %v", err)
+	}
+	resp.Body.Close()
+
+	if status := invoke(t, schedulerURL, "f"); status != http.StatusOK {
+		t.Errorf("expected status 200 after removing the fault, got %d", status)
+	}
+}
+
+func TestFaultIDsDoNotCollide(t *testing.T) {
+	injector := proxy.NewFaultInjector(proxy.NewHTTPReverseProxy(), nil)
+
+	injector.AddFault(proxy.Fault{ID: "2", Function: "f", Delay: time.Millisecond})
+	first := injector.AddFault(proxy.Fault{Function: "g", Delay: time.Millisecond})
+	second := injector.AddFault(proxy.Fault{Function: "h", Delay: time.Millisecond})
+	if first.ID == "2" || second.ID == "2" || first.ID == second.ID {
+		t.Errorf("expected automatic IDs to skip the given one, got %q and %q", first.ID, second.ID)
+	}
+	if faults := injector.Faults(); len(faults) != 3 {
+		t.Errorf("expected all three faults to be active, got %v", faults)
+	}
+}
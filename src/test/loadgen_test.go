@@ -0,0 +1,93 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"hiku/loadgen"
+	"hiku/replay"
+)
+
+const probabilitiesFile = "../../evaluation/azure_function_probabilities.json"
+
+func TestLoadgenIsReproducible(t *testing.T) {
+	stages, err := loadgen.ParseStages("20:10s,50:10s")
+	if err != nil {
+		t.Fatalf("failed to parse stages: %v", err)
+	}
+
+	var runs [2][]string
+	for i := range runs {
+		workload, err := loadgen.NewWorkload(probabilitiesFile, 2, 42)
+		if err != nil {
+			t.Fatalf("failed to create workload: %v", err)
+		}
+		if len(workload.Functions) != 2*len(loadgen.Benchmarks) {
+			t.Fatalf("expected %d functions, got %d", 2*len(loadgen.Benchmarks), len(workload.Functions))
+		}
+		for _, invocation := range workload.Poisson(stages) {
+			runs[i] = append(runs[i], invocation.Function)
+		}
+	}
+
+	if !reflect.DeepEqual(runs[0], runs[1]) {
+		t.Errorf("expected the same invocations for the same seed")
+	}
+	// 20/s for 10s and 50/s for 10s
+	if len(runs[0]) < 600 || len(runs[0]) > 800 {
+		t.Errorf("expected about 700 invocations, got %d", len(runs[0]))
+	}
+}
+
+func TestLoadgenWritesK6Results(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	workload, err := loadgen.NewWorkload(probabilitiesFile, 1, 1)
+	if err != nil {
+		t.Fatalf("failed to create workload: %v", err)
+	}
+	invocations := workload.Poisson([]loadgen.Stage{{Rate: 100, Duration: 100 * time.Millisecond}})
+	results := replay.Run(invocations, replay.Options{Target: server.URL})
+
+	var out bytes.Buffer
+	if err := loadgen.WriteK6Results(&out, server.URL, results); err != nil {
+		t.Fatalf("failed to write results: %v", err)
+	}
+
+	// Read the results the way evaluation/plot.py does
+	points := 0
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var line struct {
+			Type   string `json:"type"`
+			Metric string `json:"metric"`
+			Data   struct {
+				Time  string            `json:"time"`
+				Value float64           `json:"value"`
+				Tags  map[string]string `json:"tags"`
+			} `json:"data"`
+		}
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatalf("failed to decode results: %v", err)
+		}
+		if line.Type != "Point" || line.Metric != "http_req_duration" {
+			continue
+		}
+		points++
+		if line.Data.Tags["status"] != "200" {
+			t.Errorf("expected status 200, got %s", line.Data.Tags["status"])
+		}
+		if _, err := time.Parse("2006-01-02T15:04:05", line.Data.Time[:19]); err != nil {
+			t.Errorf("unexpected time format: %s", line.Data.Time)
+		}
+	}
+	if points != len(invocations) {
+		t.Errorf("expected %d points, got %d", len(invocations), points)
+	}
+}
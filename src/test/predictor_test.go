@@ -0,0 +1,151 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/lambda"
+	"hiku/predictor"
+	"hiku/proxy"
+	"hiku/scheduler"
+	"hiku/testing/fakeworker"
+)
+
+func TestPredictorPrewarmsBeforeNextArrival(t *testing.T) {
+	prewarmed := make(chan string, 1)
+	p := predictor.NewPredictor(predictor.Options{
+		BinWidth:   10 * time.Millisecond,
+		Bins:       100,
+		Lead:       20 * time.Millisecond,
+		MinSamples: 5,
+	}, func(functionType string) {
+		prewarmed <- functionType
+	})
+	defer p.Stop()
+
+	arrival := time.Now()
+	for i := 0; i < 6; i++ {
+		p.Observe("matmul", arrival)
+		arrival = arrival.Add(100 * time.Millisecond)
+	}
+
+	predicted, ok := p.Predict("matmul")
+	if !ok {
+		t.Fatal("expected a prediction after enough samples")
+	}
+	if predicted != 100*time.Millisecond {
+		t.Errorf("expected predicted inter-arrival time of 100ms, got %s", predicted)
+	}
+
+	select {
+	case functionType := <-prewarmed:
+		if functionType != "matmul" {
+			t.Errorf("expected matmul to be pre-warmed, got %s", functionType)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected function to be pre-warmed")
+	}
+}
+
+func TestPredictorNeedsEnoughSamples(t *testing.T) {
+	p := predictor.NewPredictor(predictor.Options{MinSamples: 5}, func(string) {})
+	defer p.Stop()
+
+	arrival := time.Now()
+	for i := 0; i < 3; i++ {
+		p.Observe("matmul", arrival)
+		arrival = arrival.Add(time.Minute)
+	}
+
+	if _, ok := p.Predict("matmul"); ok {
+		t.Error("expected no prediction with too few samples")
+	}
+}
+
+func TestPredictorSchedulesNothingOnceStopped(t *testing.T) {
+	prewarmed := make(chan string, 1)
+	p := predictor.NewPredictor(predictor.Options{
+		BinWidth:   10 * time.Millisecond,
+		Bins:       100,
+		Lead:       20 * time.Millisecond,
+		MinSamples: 5,
+	}, func(functionType string) {
+		prewarmed <- functionType
+	})
+
+	arrival := time.Now()
+	for i := 0; i < 5; i++ {
+		p.Observe("matmul", arrival)
+		arrival = arrival.Add(100 * time.Millisecond)
+	}
+	p.Stop()
+	p.Observe("matmul", arrival)
+
+	select {
+	case <-prewarmed:
+		t.Error("expected no pre-warm after the predictor stopped")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPrewarmPayloadsOfNamespacedFunctions(t *testing.T) {
+	payloads := make(chan string, 2)
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		payloads <- string(body)
+	}))
+	defer worker.Close()
+	workerURL, _ := url.Parse(worker.URL)
+
+	s := scheduler.NewScheduler(config.Config{
+		Balancer:     balancer.NewPullBased([]url.URL{*workerURL}),
+		ReverseProxy: proxy.NewHTTPReverseProxy(),
+		PrewarmPayloads: map[string][]byte{
+			"f":         []byte(`{"shared": true}`),
+			"team-a__f": []byte(`{"team": "a"}`),
+		},
+	})
+	defer s.Close()
+
+	s.Prewarm(&lambda.Lambda{Name: "f", Namespace: "team-a"}, 1, nil)
+	s.Prewarm(&lambda.Lambda{Name: "f", Namespace: "team-b"}, 1, nil)
+	if first, second := <-payloads, <-payloads; first != `{"team": "a"}` || second != `{"shared": true}` {
+		t.Errorf("expected the payload of team-a and the shared one, got %s and %s", first, second)
+	}
+}
+
+func TestPrewarmIsCappedAndTakesNoLatencySample(t *testing.T) {
+	b := balancer.NewLatencyAware([]url.URL{}, balancer.LatencyOptions{})
+	schedulerURL, _ := startCluster(t, b, 2, fakeworker.Options{
+		Default: fakeworker.FunctionConfig{ColdStart: 50 * time.Millisecond},
+	})
+
+	prewarm := func(count int) int {
+		resp, err := http.Post(fmt.Sprintf("%s/admin/prewarm/f?count=%d", schedulerURL, count), "application/json", nil)
+		if err != nil {
+			t.Fatalf("failed to pre-warm: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Four warm-up invocations per worker by default
+	if status := prewarm(9); status != http.StatusBadRequest {
+		t.Errorf("expected status 400 beyond the cap, got %d", status)
+	}
+	if status := prewarm(8); status != http.StatusOK {
+		t.Errorf("expected status 200 within the cap, got %d", status)
+	}
+
+	// Cold starts of warm-up invocations don't count as worker latency
+	if latencies := b.(balancer.Snapshotter).Snapshot().WorkerLatencies; len(latencies) != 0 {
+		t.Errorf("expected no latency samples from pre-warming, got %v", latencies)
+	}
+}
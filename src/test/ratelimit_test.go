@@ -0,0 +1,149 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/proxy"
+	"hiku/ratelimit"
+	"hiku/testing/fakeworker"
+)
+
+func TestRateLimiterBuckets(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.Options{
+		Functions:     map[string]ratelimit.Limit{"f": {Rate: 1, Burst: 2}},
+		DefaultTenant: ratelimit.Limit{Rate: 10, Burst: 1},
+	})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if decision := limiter.AllowAt("f", "", now); !decision.Allowed {
+			t.Fatalf("expected request %d within the burst to be allowed", i)
+		}
+	}
+	decision := limiter.AllowAt("f", "", now)
+	if decision.Allowed || decision.RetryAfter != time.Second || decision.Remaining != 0 {
+		t.Errorf("expected rejection with retry after 1s, got %+v", decision)
+	}
+	if !limiter.AllowAt("f", "", now.Add(time.Second)).Allowed {
+		t.Errorf("expected a token after one second")
+	}
+
+	// The tenant bucket rejects, so the function bucket keeps its tokens
+	later := now.Add(3 * time.Second)
+	if !limiter.AllowAt("g", "a", later).Allowed || limiter.AllowAt("f", "a", later).Allowed {
+		t.Errorf("expected the second request of tenant a to be rejected")
+	}
+	for i := 0; i < 2; i++ {
+		if !limiter.AllowAt("f", "", later).Allowed {
+			t.Errorf("expected request %d to get a token of f", i)
+		}
+	}
+	if decision := limiter.AllowAt("unlimited", "", now); !decision.Allowed || decision.Limited {
+		t.Errorf("expected functions without limit to be unlimited, got %+v", decision)
+	}
+}
+
+func TestRateLimitedRequestsDoNotReachWorkers(t *testing.T) {
+	schedulerURL, workers := startCluster(t, balancer.NewPullBased([]url.URL{}), 1, fakeworker.Options{})
+
+	resp, err := http.Post(schedulerURL+"/admin/rate-limits", "application/json",
+		strings.NewReader(`{"function": "f", "rate": 0.001, "burst": 2}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to set rate limit: %v", err)
+	}
+	resp.Body.Close()
+
+	for i := 0; i < 2; i++ {
+		if status := invoke(t, schedulerURL, "f"); status != http.StatusOK {
+			t.Fatalf("expected status 200 within the burst, got %d", status)
+		}
+	}
+
+	resp, err = http.Post(schedulerURL+"/run/f", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("failed to invoke: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" || resp.Header.Get("X-RateLimit-Limit") != "2" ||
+		resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("expected rate limit headers, got %v", resp.Header)
+	}
+	if invocations := totalStats(workers).Invocations; invocations != 2 {
+		t.Errorf("expected 2 invocations to reach the worker, got %d", invocations)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, schedulerURL+"/admin/rate-limits?function=f", nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to remove rate limit: %v", err)
+	}
+	resp.Body.Close()
+
+	if status := invoke(t, schedulerURL, "f"); status != http.StatusOK {
+		t.Errorf("expected status 200 after removing the limit, got %d", status)
+	}
+}
+
+func TestRateLimiterEvictsFullBuckets(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.Options{
+		DefaultFunction: ratelimit.Limit{Rate: 10, Burst: 5},
+		DefaultTenant:   ratelimit.Limit{Rate: 10, Burst: 5},
+	})
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		limiter.AllowAt(fmt.Sprintf("f%d", i), fmt.Sprintf("t%d", i), now)
+	}
+	if buckets := limiter.Buckets(); buckets != 200 {
+		t.Fatalf("expected a bucket per function and tenant, got %d", buckets)
+	}
+
+	// All buckets refilled, only the one of the new request is kept
+	if !limiter.AllowAt("f0", "", now.Add(2*time.Minute)).Allowed {
+		t.Errorf("expected a full bucket after two minutes")
+	}
+	if buckets := limiter.Buckets(); buckets != 1 {
+		t.Errorf("expected full buckets to be evicted, got %d", buckets)
+	}
+}
+
+func TestRateLimitsOnlyKnownTenants(t *testing.T) {
+	schedulerURL := startScheduler(t, config.Config{
+		Balancer:     balancer.NewPullBased([]url.URL{}),
+		ReverseProxy: proxy.NewHTTPReverseProxy(),
+		RateLimit: ratelimit.Options{
+			Tenants:       map[string]ratelimit.Limit{"known": {Rate: 0.001, Burst: 1}},
+			DefaultTenant: ratelimit.Limit{Rate: 0.001, Burst: 1},
+		},
+	})
+
+	// Without tenancy, the header only picks tenants with a limit of their
+	// own, so clients can't create buckets by sending new values
+	statuses := make(map[string][]int)
+	for _, tenant := range []string{"known", "known", "unknown", "unknown"} {
+		req, _ := http.NewRequest(http.MethodPost, schedulerURL+"/run/f", strings.NewReader("{}"))
+		req.Header.Set("X-Hiku-Tenant", tenant)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to invoke: %v", err)
+		}
+		resp.Body.Close()
+		statuses[tenant] = append(statuses[tenant], resp.StatusCode)
+	}
+	if statuses["known"][1] != http.StatusTooManyRequests {
+		t.Errorf("expected the limit of the configured tenant to apply, got %v", statuses["known"])
+	}
+	for _, status := range statuses["unknown"] {
+		if status == http.StatusTooManyRequests {
+			t.Errorf("expected no limit for an unknown tenant header, got %v", statuses["unknown"])
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"hiku/balancer"
+	"hiku/simulator"
+	"hiku/trace"
+)
+
+func TestSimulatorKeepAlive(t *testing.T) {
+	invocations := []trace.Invocation{
+		{Offset: 0, Function: "f"},
+		{Offset: time.Second, Function: "f"},
+		{Offset: 3 * time.Second, Function: "f"},
+	}
+	options := simulator.Options{
+		Workers:   2,
+		ColdStart: 500 * time.Millisecond,
+		Exec:      100 * time.Millisecond,
+		KeepAlive: 1500 * time.Millisecond,
+	}
+
+	b := balancer.NewPullBased(simulator.WorkerUrls(options.Workers))
+	report := simulator.NewSimulator(b, options).Run(invocations)
+
+	// The third invocation arrives after the sandbox has been evicted
+	if report.ColdStarts != 2 || report.WarmStarts != 1 {
+		t.Errorf("expected 2 cold and 1 warm start, got %d cold and %d warm", report.ColdStarts, report.WarmStarts)
+	}
+	if report.LatencyMs.Max != 600 {
+		t.Errorf("expected max latency of 600ms, got %.1f", report.LatencyMs.Max)
+	}
+}
+
+func TestSimulatorConcurrencyLimit(t *testing.T) {
+	invocations := []trace.Invocation{
+		{Offset: 0, Function: "f"},
+		{Offset: 0, Function: "g"},
+	}
+	options := simulator.Options{
+		Workers:     1,
+		Exec:        100 * time.Millisecond,
+		Concurrency: 1,
+	}
+
+	b := balancer.NewLeastConnections(simulator.WorkerUrls(options.Workers))
+	report := simulator.NewSimulator(b, options).Run(invocations)
+
+	// The second invocation waits for the first one on the worker
+	if report.LatencyMs.Max != 200 {
+		t.Errorf("expected queued invocation to take 200ms, got %.1f", report.LatencyMs.Max)
+	}
+}
+
+func TestReadAzureCSV(t *testing.T) {
+	csv := "HashOwner,HashApp,HashFunction,Trigger,1,2\n" +
+		"o,a,f1,http,2,0\n" +
+		"o,a,f2,timer,0,1\n"
+
+	invocations, err := trace.ReadAzureCSV(strings.NewReader(csv), 1)
+	if err != nil {
+		t.Fatalf("failed to read trace: %v", err)
+	}
+	if len(invocations) != 3 {
+		t.Fatalf("expected 3 invocations, got %d", len(invocations))
+	}
+
+	last := invocations[2]
+	if last.Function != "f2" || last.Offset < time.Minute || last.Offset >= 2*time.Minute {
+		t.Errorf("expected f2 in the second minute, got %s at %s", last.Function, last.Offset)
+	}
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/lambda"
+	"hiku/proxy"
+	"hiku/scheduler"
+	"hiku/snapshot"
+)
+
+func TestSnapshotRestoresIdleQueues(t *testing.T) {
+	b := balancer.NewPullBased(createTestUrls([]string{"w1:8080", "w2:8080"}))
+	l := &lambda.Lambda{Name: "f"}
+
+	workerURL, _ := b.SelectWorker(createTestRequest("/run/f"), l)
+	b.ReleaseWorker(workerURL, l, testOutcome)
+
+	file := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := snapshot.Write(file, b.(balancer.Snapshotter).Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := snapshot.Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted scheduler starts with the warm sandbox, but the worker
+	// removed before the restart doesn't come back
+	restarted := balancer.NewPullBased([]url.URL{workerURL})
+	restarted.(balancer.Snapshotter).Restore(restored)
+	if workers := restarted.GetAllWorkers(); len(workers) != 1 {
+		t.Fatalf("expected only the configured worker, got %v", workers)
+	}
+	selected, _ := restarted.SelectWorker(createTestRequest("/run/f"), l)
+	if selected != workerURL {
+		t.Errorf("expected warm sandbox on %s, got %s", workerURL.Host, selected.Host)
+	}
+	if stats := restarted.(balancer.IdleQueueStatsProvider).IdleQueueStats()["f"]; stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("expected the restored miss and a hit, got %+v", stats)
+	}
+}
+
+func TestSnapshotReadsNewerVersions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "snapshot.json")
+	data := `{"version": 2, "workers": ["http://w1:8080"], "unknown": {"x": 1},
+		"functions": {"f": {"hits": 3, "idle": [{"worker": "http://w1:8080", "idle_since": "2024-01-01T00:00:00Z", "extra": true}]}}}`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := snapshot.Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Workers) != 1 || len(restored.Functions["f"].Idle) != 1 || restored.Functions["f"].Hits != 3 {
+		t.Errorf("expected the known fields to be read, got %+v", restored)
+	}
+}
+
+func TestSnapshotRestoresWorkersOnlyIfAsked(t *testing.T) {
+	data := `{"version": 1, "workers": ["http://w1:8080", "http://injected:8080"]}`
+	for _, restoreWorkers := range []bool{false, true} {
+		file := filepath.Join(t.TempDir(), "snapshot.json")
+		if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		b := balancer.NewPullBased(createTestUrls([]string{"w1:8080"}))
+		s := scheduler.NewScheduler(config.Config{
+			Balancer:     b,
+			ReverseProxy: proxy.NewHTTPReverseProxy(),
+			Snapshot:     &snapshot.Options{File: file, RestoreWorkers: restoreWorkers},
+		})
+		expected := 1
+		if restoreWorkers {
+			expected = 2
+		}
+		if workers := b.GetAllWorkers(); len(workers) != expected {
+			t.Errorf("expected %d workers with restore_workers %v, got %v", expected, restoreWorkers, workers)
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,156 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/lambda"
+	"hiku/proxy"
+	"hiku/tenancy"
+	"hiku/testing/fakeworker"
+)
+
+func invokeAs(t *testing.T, schedulerURL string, function string, apiKey string) int {
+	req, _ := http.NewRequest(http.MethodPost, schedulerURL+"/run/"+function, strings.NewReader("{}"))
+	req.Header.Set("X-Api-Key", apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to invoke %s: %v", function, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestTenantsRunNamespacedFunctions(t *testing.T) {
+	options := fakeworker.Options{Default: fakeworker.FunctionConfig{Warm: 50 * time.Millisecond}}
+	shared := fakeworker.NewWorker(options)
+	sharedURL, err := shared.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake worker: %v", err)
+	}
+	t.Cleanup(shared.Close)
+	dedicated := fakeworker.NewWorker(options)
+	dedicatedURL, err := dedicated.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake worker: %v", err)
+	}
+	t.Cleanup(dedicated.Close)
+
+	schedulerURL := startScheduler(t, config.Config{
+		Balancer: balancer.NewPools(balancer.NewPullBased([]url.URL{sharedURL}), map[string]balancer.Balancer{
+			"beta": balancer.NewPullBased([]url.URL{dedicatedURL}),
+		}),
+		ReverseProxy: proxy.NewHTTPReverseProxy(),
+		Tenancy: tenancy.Options{
+			RequireAPIKey: true,
+			Tenants: []tenancy.Tenant{
+				{Name: "alpha", APIKeys: []string{"alpha-key"}, MaxInFlight: 1},
+				{Name: "beta", APIKeys: []string{"beta-key"}},
+			},
+		},
+	})
+
+	for _, key := range []string{"alpha-key", "alpha-key", "beta-key", "beta-key"} {
+		if status := invokeAs(t, schedulerURL, "f", key); status != http.StatusOK {
+			t.Fatalf("expected status 200 for %s, got %d", key, status)
+		}
+	}
+
+	// The same function name is a function of its own per tenant, and beta
+	// runs on its dedicated worker only
+	if sandboxes := shared.Sandboxes(); sandboxes["alpha__f"] != 1 || len(sandboxes) != 1 {
+		t.Errorf("expected only alpha's sandbox on the shared worker, got %v", sandboxes)
+	}
+	if sandboxes := dedicated.Sandboxes(); sandboxes["beta__f"] != 1 || len(sandboxes) != 1 {
+		t.Errorf("expected only beta's sandbox on the dedicated worker, got %v", sandboxes)
+	}
+	for _, stats := range []fakeworker.Stats{shared.Stats(), dedicated.Stats()} {
+		if stats.ColdStarts != 1 || stats.WarmStarts != 1 {
+			t.Errorf("expected 1 cold and 1 warm start per tenant, got %+v", stats)
+		}
+	}
+
+	if status := invokeAs(t, schedulerURL, "f", ""); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 without API key, got %d", status)
+	}
+	if status := invokeAs(t, schedulerURL, "f", "unknown"); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 for unknown API keys, got %d", status)
+	}
+	if status := invokeAs(t, schedulerURL, "beta__f", "alpha-key"); status != http.StatusBadRequest {
+		t.Errorf("expected 400 for names of other namespaces, got %d", status)
+	}
+
+	// Alpha may only run one invocation at a time
+	statuses := make(chan int, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- invokeAs(t, schedulerURL, "f", "alpha-key")
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	throttled := 0
+	for status := range statuses {
+		if status == http.StatusTooManyRequests {
+			throttled++
+		}
+	}
+	if throttled != 1 {
+		t.Errorf("expected one invocation over the quota to be throttled, got %d", throttled)
+	}
+
+	resp, err := http.Get(schedulerURL + "/admin/tenants")
+	if err != nil {
+		t.Fatalf("failed to get tenant usage: %v", err)
+	}
+	defer resp.Body.Close()
+	var usage map[string]tenancy.Usage
+	json.NewDecoder(resp.Body).Decode(&usage)
+	if usage["alpha"].Invocations != 3 || usage["alpha"].Throttled != 1 || usage["beta"].Invocations != 2 {
+		t.Errorf("expected the usage per tenant, got %+v", usage)
+	}
+}
+
+func TestPoolsKeepMemoryPackagesAndSnapshots(t *testing.T) {
+	newPools := func() balancer.Balancer {
+		memory := balancer.MemoryOptions{WorkerBudgetMB: 1024, FunctionMB: map[string]uint64{"beta__f": 256}}
+		return balancer.NewPools(
+			balancer.NewMemoryAware(createTestUrls([]string{"shared:8080"}), balancer.PullBasedOptions{}, memory),
+			map[string]balancer.Balancer{
+				"beta": balancer.NewMemoryAware(createTestUrls([]string{"dedicated:8080"}), balancer.PullBasedOptions{}, memory),
+			})
+	}
+	b := newPools()
+	alpha := &lambda.Lambda{Name: "f", Namespace: "alpha"}
+	beta := &lambda.Lambda{Name: "f", Namespace: "beta"}
+	for _, l := range []*lambda.Lambda{alpha, beta} {
+		workerURL, _ := b.SelectWorker(createTestRequest("/run/"+l.ID()), l)
+		b.ReleaseWorker(workerURL, l, testOutcome)
+	}
+
+	usage := b.(balancer.MemoryAware).MemoryUsage()
+	if usage["http://shared:8080"].CommittedMB != 512 || usage["http://dedicated:8080"].CommittedMB != 256 {
+		t.Errorf("expected the memory of both balancers, got %+v", usage)
+	}
+
+	// The restarted balancers find their own warm sandboxes
+	restarted := newPools()
+	restarted.(balancer.Snapshotter).Restore(b.(balancer.Snapshotter).Snapshot())
+	for _, l := range []*lambda.Lambda{alpha, beta} {
+		restarted.SelectWorker(createTestRequest("/run/"+l.ID()), l)
+	}
+	stats := restarted.(balancer.IdleQueueStatsProvider).IdleQueueStats()
+	if stats["alpha__f"].Hits != 1 || stats["beta__f"].Hits != 1 {
+		t.Errorf("expected a warm start per tenant after the restore, got %+v", stats)
+	}
+}
@@ -0,0 +1,182 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"hiku/auth"
+	"hiku/balancer"
+	"hiku/config"
+	"hiku/proxy"
+	"hiku/server"
+	"hiku/testing/fakeworker"
+	"hiku/tlsutil"
+)
+
+type testCertificate struct {
+	certFile string
+	keyFile  string
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+}
+
+// newCertificate writes a certificate for 127.0.0.1 signed by the CA, or a
+// self-signed CA certificate if ca is nil.
+func newCertificate(t *testing.T, dir string, name string, serial int64, ca *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	c := testCertificate{
+		certFile: filepath.Join(dir, name+".pem"),
+		keyFile:  filepath.Join(dir, name+"-key.pem"),
+		cert:     cert,
+		key:      key,
+	}
+	os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return c
+}
+
+func TestMutualTLSEndToEnd(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCertificate(t, dir, "ca", 1, nil)
+	schedulerCert := newCertificate(t, dir, "scheduler", 2, &ca)
+	workerCert := newCertificate(t, dir, "worker", 3, &ca)
+	clientCert := newCertificate(t, dir, "client", 4, &ca)
+
+	// The worker only accepts the scheduler's client certificate
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.cert)
+	worker := httptest.NewUnstartedServer(fakeworker.NewWorker(fakeworker.Options{}))
+	workerKeyPair, _ := tls.LoadX509KeyPair(workerCert.certFile, workerCert.keyFile)
+	worker.TLS = &tls.Config{
+		Certificates: []tls.Certificate{workerKeyPair},
+		ClientCAs:    caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	worker.StartTLS()
+	t.Cleanup(worker.Close)
+	workerURL, _ := url.Parse(worker.URL)
+
+	workerTLS, err := tlsutil.NewClientConfig(tlsutil.ClientOptions{
+		CAFile:   ca.certFile,
+		CertFile: schedulerCert.certFile,
+		KeyFile:  schedulerCert.keyFile,
+	})
+	if err != nil {
+		t.Fatalf("failed to create worker TLS config: %v", err)
+	}
+	b := balancer.NewPullBased([]url.URL{})
+	b.AddWorker(*workerURL)
+	handler := server.NewHandler(config.Config{
+		Balancer:     b,
+		ReverseProxy: proxy.NewHTTPSReverseProxy(proxy.TLSOptions{Default: workerTLS, RequireTLS: true}),
+		Auth:         auth.Options{ClientCertificates: map[string]auth.Role{"client": auth.Invoker}},
+	})
+
+	// httptest would replace the reloading certificate with its own
+	serverTLS, err := tlsutil.NewServerConfig(tlsutil.ServerOptions{
+		CertFile:     schedulerCert.certFile,
+		KeyFile:      schedulerCert.keyFile,
+		ClientCAFile: ca.certFile,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server TLS config: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	scheduler := &http.Server{Handler: handler}
+	go scheduler.Serve(listener)
+	t.Cleanup(func() { scheduler.Close() })
+	schedulerURL := "https://" + listener.Addr().String()
+
+	clientKeyPair, _ := tls.LoadX509KeyPair(clientCert.certFile, clientCert.keyFile)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      caPool,
+		Certificates: []tls.Certificate{clientKeyPair},
+	}}}
+	resp, err := client.Post(schedulerURL+"/run/f", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("failed to invoke over TLS: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200 with client certificate, got %d", resp.StatusCode)
+	}
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}}}
+	resp, err = anonymous.Post(schedulerURL+"/run/f", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("failed to invoke over TLS: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without client certificate, got %d", resp.StatusCode)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCertificate(t, dir, "ca", 1, nil)
+	first := newCertificate(t, dir, "server", 2, &ca)
+
+	reloader, err := tlsutil.NewCertificateReloader(first.certFile, first.keyFile, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %v", err)
+	}
+	if serial := reloader.Certificate().Leaf.SerialNumber.Int64(); serial != 2 {
+		t.Fatalf("expected serial 2, got %d", serial)
+	}
+
+	// Rotate the certificate in place
+	newCertificate(t, dir, "server", 3, &ca)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(first.certFile, later, later)
+	time.Sleep(5 * time.Millisecond)
+
+	if serial := reloader.Certificate().Leaf.SerialNumber.Int64(); serial != 3 {
+		t.Errorf("expected the rotated certificate with serial 3, got %d", serial)
+	}
+}
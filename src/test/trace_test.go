@@ -0,0 +1,112 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"hiku/replay"
+	"hiku/trace"
+)
+
+func TestRecorderRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	recorder, err := trace.NewRecorder(trace.CaptureOptions{File: path, Body: trace.BodyFull, MaxBodyBytes: 4})
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+
+	start := time.Now()
+	for i, function := range []string{"f", "g"} {
+		record := trace.Record{Time: start.Add(time.Duration(i) * time.Second), Function: function, Status: http.StatusOK}
+		recorder.SetBody(&record, []byte(`{"n": 1}`))
+		if err := recorder.Record(record); err != nil {
+			t.Fatalf("failed to record: %v", err)
+		}
+	}
+	recorder.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open trace: %v", err)
+	}
+	defer file.Close()
+
+	invocations, err := trace.ReadJSONL(file)
+	if err != nil {
+		t.Fatalf("failed to read trace: %v", err)
+	}
+	if len(invocations) != 2 {
+		t.Fatalf("expected 2 invocations, got %d", len(invocations))
+	}
+	if invocations[1].Function != "g" || invocations[1].Offset != time.Second {
+		t.Errorf("expected g after 1s, got %s after %s", invocations[1].Function, invocations[1].Offset)
+	}
+	if string(invocations[0].Body) != `{"n"` || !invocations[0].Truncated {
+		t.Errorf("expected body marked as truncated to 4 bytes, got %q", invocations[0].Body)
+	}
+}
+
+func TestReplaySendsPayloadForTruncatedBodies(t *testing.T) {
+	bodies := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	results := replay.Run([]trace.Invocation{
+		{Function: "f", Body: []byte(`{"n"`), Truncated: true},
+	}, replay.Options{Target: server.URL, Payload: []byte(`{}`)})
+
+	if body := <-bodies; body != `{}` {
+		t.Errorf("expected the payload instead of the truncated body, got %q", body)
+	}
+	if !results[0].BodyTruncated {
+		t.Errorf("expected the result to report the truncated body")
+	}
+	var summary strings.Builder
+	replay.WriteSummary(&summary, results)
+	if !strings.Contains(summary.String(), "Truncated:    1 captured bodies") {
+		t.Errorf("expected the summary to warn about the truncated body, got %s", summary.String())
+	}
+}
+
+func TestReplayScalesArrivals(t *testing.T) {
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	invocations := []trace.Invocation{
+		{Offset: 0, Function: "f"},
+		{Offset: 2 * time.Second, Function: "f"},
+	}
+
+	start := time.Now()
+	results := replay.Run(invocations, replay.Options{Target: server.URL, Speed: 4})
+	elapsed := time.Since(start)
+
+	if atomic.LoadInt32(&received) != 2 {
+		t.Errorf("expected 2 requests, got %d", received)
+	}
+	if results[1].ScheduledMs != 500 {
+		t.Errorf("expected the second request to be scheduled after 500ms, got %.1fms", results[1].ScheduledMs)
+	}
+	// Far from the 2s of the original rate, so slow machines don't fail
+	if elapsed < 500*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("expected replay at 4x speed to take about 500ms, took %s", elapsed)
+	}
+	for _, result := range results {
+		if result.Status != http.StatusOK {
+			t.Errorf("expected status 200, got %d (%s)", result.Status, result.Error)
+		}
+	}
+}
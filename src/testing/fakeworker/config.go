@@ -0,0 +1,59 @@
+package fakeworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+type jsonFunctionConfig struct {
+	ColdStart     string  `json:"cold_start"`
+	Warm          string  `json:"warm"`
+	MemoryMB      uint64  `json:"memory_mb"`
+	FailureRate   float64 `json:"failure_rate"`
+	FailureStatus int     `json:"failure_status"`
+}
+
+// LoadFunctions reads per-function settings from a JSON file like this:
+//
+//	{"matmul": {"cold_start": "800ms", "warm": "50ms", "memory_mb": 256, "failure_rate": 0.01}}
+//
+// Unset fields are taken from the defaults.
+func LoadFunctions(path string, defaults FunctionConfig) (map[string]FunctionConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var jsonFunctions map[string]jsonFunctionConfig
+	if err := json.Unmarshal(content, &jsonFunctions); err != nil {
+		return nil, err
+	}
+
+	functions := make(map[string]FunctionConfig)
+	for name, jsonConfig := range jsonFunctions {
+		config := defaults
+		if jsonConfig.ColdStart != "" {
+			if config.ColdStart, err = time.ParseDuration(jsonConfig.ColdStart); err != nil {
+				return nil, fmt.Errorf("invalid cold_start of %s: %v", name, err)
+			}
+		}
+		if jsonConfig.Warm != "" {
+			if config.Warm, err = time.ParseDuration(jsonConfig.Warm); err != nil {
+				return nil, fmt.Errorf("invalid warm of %s: %v", name, err)
+			}
+		}
+		if jsonConfig.MemoryMB > 0 {
+			config.MemoryMB = jsonConfig.MemoryMB
+		}
+		if jsonConfig.FailureRate > 0 {
+			config.FailureRate = jsonConfig.FailureRate
+		}
+		if jsonConfig.FailureStatus > 0 {
+			config.FailureStatus = jsonConfig.FailureStatus
+		}
+		functions[name] = config
+	}
+	return functions, nil
+}
@@ -0,0 +1,382 @@
+// Package fakeworker provides an in-process HTTP server that mimics an
+// OpenLambda worker, so the scheduler can be tested end to end without
+// Docker. Sandboxes are simulated: invocations sleep for a configurable
+// cold-start and warm latency instead of running code.
+package fakeworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"hiku/auth"
+)
+
+// FunctionConfig describes how the fake worker runs a function.
+type FunctionConfig struct {
+	// ColdStart is added to the warm latency when no idle sandbox of the
+	// function exists.
+	ColdStart time.Duration
+	// Warm is the execution time in a warm sandbox.
+	Warm time.Duration
+	// MemoryMB is the memory a sandbox of the function occupies.
+	MemoryMB uint64
+	// FailureRate is the fraction of invocations answered with FailureStatus.
+	FailureRate float64
+	// FailureStatus defaults to 500.
+	FailureStatus int
+}
+
+// Options configures a fake worker.
+type Options struct {
+	// Default applies to functions without an entry in Functions.
+	Default   FunctionConfig
+	Functions map[string]FunctionConfig
+	// KeepAlive is how long an idle sandbox is kept before it is evicted.
+	// Zero keeps sandboxes until memory runs out.
+	KeepAlive time.Duration
+	// MemoryMB is the memory available for sandboxes. Idle sandboxes are
+	// evicted, least recently used first, to make room for new ones. Zero
+	// means unlimited.
+	MemoryMB uint64
+	// SchedulerURL is notified of evicted sandboxes via /destroySandbox/,
+	// like the modified OpenLambda workers do. Empty disables callbacks.
+	SchedulerURL string
+	// SchedulerSecret signs the callbacks with HMAC if the scheduler
+	// requires authentication.
+	SchedulerSecret string
+	// Seed of the failure injection.
+	Seed int64
+}
+
+// Stats counts what happened on a fake worker.
+type Stats struct {
+	Invocations int `json:"invocations"`
+	ColdStarts  int `json:"cold_starts"`
+	WarmStarts  int `json:"warm_starts"`
+	Failures    int `json:"failures"`
+	Evictions   int `json:"evictions"`
+	// Rejected invocations found no memory for a new sandbox.
+	Rejected int `json:"rejected"`
+}
+
+type sandbox struct {
+	function string
+	memoryMB uint64
+	busy     bool
+	lastUsed time.Time
+	// expiry evicts the sandbox once it was idle for KeepAlive
+	expiry *time.Timer
+}
+
+// Worker is a fake OpenLambda worker. It serves /run/<name>, /status and
+// /pid like OpenLambda.
+type Worker struct {
+	options   Options
+	host      string
+	sandboxes []*sandbox
+	usedMB    uint64
+	stats     Stats
+	rng       *rand.Rand
+	client    *http.Client
+	server    *http.Server
+	callbacks sync.WaitGroup
+	closed    bool
+	mutex     sync.Mutex
+}
+
+// Listen binds the worker to addr, e.g. "127.0.0.1:0", and serves requests
+// in the background until Close is called.
+func (w *Worker) Listen(addr string) (url.URL, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return url.URL{}, err
+	}
+
+	w.mutex.Lock()
+	w.host = listener.Addr().String()
+	w.server = &http.Server{Handler: w}
+	w.mutex.Unlock()
+
+	go w.server.Serve(listener)
+	return w.URL(), nil
+}
+
+// ListenAndServe binds the worker to addr and serves requests until the
+// server fails.
+func (w *Worker) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	w.host = listener.Addr().String()
+	w.server = &http.Server{Handler: w}
+	w.mutex.Unlock()
+
+	log.Printf("Fake worker listening on %s", w.host)
+	return w.server.Serve(listener)
+}
+
+// URL returns the URL the worker is reachable at once it listens.
+func (w *Worker) URL() url.URL {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return url.URL{Scheme: "http", Host: w.host}
+}
+
+// Close stops the server and the keep-alive timers, and waits for pending
+// callbacks to the scheduler.
+func (w *Worker) Close() {
+	w.mutex.Lock()
+	server := w.server
+	w.closed = true
+	for _, sb := range w.sandboxes {
+		if sb.expiry != nil {
+			sb.expiry.Stop()
+		}
+	}
+	w.mutex.Unlock()
+
+	if server != nil {
+		server.Close()
+	}
+	w.callbacks.Wait()
+}
+
+// Stats returns the counters of the worker.
+func (w *Worker) Stats() Stats {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.stats
+}
+
+// Sandboxes returns the number of sandboxes of each function, busy or idle.
+func (w *Worker) Sandboxes() map[string]int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	sandboxes := make(map[string]int)
+	for _, sb := range w.sandboxes {
+		sandboxes[sb.function]++
+	}
+	return sandboxes
+}
+
+// SetFunction changes how a function is run, e.g. to inject failures while a
+// test is running.
+func (w *Worker) SetFunction(name string, config FunctionConfig) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.options.Functions == nil {
+		w.options.Functions = make(map[string]FunctionConfig)
+	}
+	w.options.Functions[name] = config
+}
+
+// Evict destroys all idle sandboxes of a function and notifies the scheduler.
+func (w *Worker) Evict(name string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, sb := range append([]*sandbox(nil), w.sandboxes...) {
+		if sb.function == name && !sb.busy {
+			w.evict(sb)
+		}
+	}
+}
+
+func (w *Worker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/run/"):
+		w.run(rw, r, strings.TrimPrefix(r.URL.Path, "/run/"))
+	case r.URL.Path == "/status":
+		fmt.Fprintln(rw, "ready")
+	case r.URL.Path == "/pid":
+		fmt.Fprintf(rw, "%d", os.Getpid())
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+func (w *Worker) functionConfig(name string) FunctionConfig {
+	config, ok := w.options.Functions[name]
+	if !ok {
+		config = w.options.Default
+	}
+	if config.FailureStatus == 0 {
+		config.FailureStatus = http.StatusInternalServerError
+	}
+	return config
+}
+
+func (w *Worker) run(rw http.ResponseWriter, r *http.Request, name string) {
+	io.Copy(io.Discard, r.Body)
+	if name == "" {
+		http.Error(rw, "missing lambda name", http.StatusBadRequest)
+		return
+	}
+
+	w.mutex.Lock()
+	config := w.functionConfig(name)
+	w.stats.Invocations++
+
+	// Reuse the most recently used idle sandbox, as OpenLambda does
+	var selected *sandbox
+	for _, sb := range w.sandboxes {
+		if sb.function == name && !sb.busy && (selected == nil || sb.lastUsed.After(selected.lastUsed)) {
+			selected = sb
+		}
+	}
+
+	cold := selected == nil
+	if cold {
+		if !w.reserveMemory(config.MemoryMB) {
+			w.stats.Rejected++
+			w.mutex.Unlock()
+			http.Error(rw, "not enough memory for a new sandbox", http.StatusServiceUnavailable)
+			return
+		}
+		selected = &sandbox{function: name, memoryMB: config.MemoryMB}
+		w.sandboxes = append(w.sandboxes, selected)
+		w.stats.ColdStarts++
+	} else {
+		w.stats.WarmStarts++
+	}
+	selected.busy = true
+	failed := config.FailureRate > 0 && w.rng.Float64() < config.FailureRate
+	if failed {
+		w.stats.Failures++
+	}
+	w.mutex.Unlock()
+
+	latency := config.Warm
+	if cold {
+		latency += config.ColdStart
+	}
+	time.Sleep(latency)
+
+	w.mutex.Lock()
+	selected.busy = false
+	selected.lastUsed = time.Now()
+	if w.options.KeepAlive > 0 && !w.closed {
+		if selected.expiry != nil {
+			selected.expiry.Stop()
+		}
+		lastUsed := selected.lastUsed
+		selected.expiry = time.AfterFunc(w.options.KeepAlive, func() {
+			w.expire(selected, lastUsed)
+		})
+	}
+	w.mutex.Unlock()
+
+	if failed {
+		http.Error(rw, "injected failure", config.FailureStatus)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"function": name,
+		"cold":     cold,
+	})
+}
+
+// reserveMemory evicts idle sandboxes, least recently used first, until the
+// new sandbox fits.
+func (w *Worker) reserveMemory(memoryMB uint64) bool {
+	for w.options.MemoryMB > 0 && w.usedMB+memoryMB > w.options.MemoryMB {
+		var lru *sandbox
+		for _, sb := range w.sandboxes {
+			if !sb.busy && (lru == nil || sb.lastUsed.Before(lru.lastUsed)) {
+				lru = sb
+			}
+		}
+		if lru == nil {
+			return false
+		}
+		w.evict(lru)
+	}
+	w.usedMB += memoryMB
+	return true
+}
+
+func (w *Worker) expire(sb *sandbox, lastUsed time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// A timer may have fired just before the worker was closed
+	if w.closed || sb.busy || !sb.lastUsed.Equal(lastUsed) {
+		return
+	}
+	w.evict(sb)
+}
+
+func (w *Worker) evict(sb *sandbox) {
+	index := -1
+	for i, candidate := range w.sandboxes {
+		if candidate == sb {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return
+	}
+
+	w.sandboxes = append(w.sandboxes[:index], w.sandboxes[index+1:]...)
+	w.usedMB -= sb.memoryMB
+	w.stats.Evictions++
+
+	if w.options.SchedulerURL != "" {
+		w.callbacks.Add(1)
+		go w.notifyScheduler(sb.function, w.host)
+	}
+}
+
+func (w *Worker) notifyScheduler(function string, host string) {
+	defer w.callbacks.Done()
+
+	destroySandboxURL := strings.TrimSuffix(w.options.SchedulerURL, "/") + "/destroySandbox/" + function
+	body := []byte(fmt.Sprintf(`{"host": "%s"}`, host))
+	r, err := http.NewRequest(http.MethodPost, destroySandboxURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error creating request: %v", err)
+		return
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if w.options.SchedulerSecret != "" {
+		auth.Sign(r, w.options.SchedulerSecret, body, time.Now())
+	}
+	resp, err := w.client.Do(r)
+	if err != nil {
+		log.Printf("Error destroying sandbox: %v", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// NewWorker creates a fake worker. Call Listen or ListenAndServe to serve
+// requests, or use it as http.Handler.
+func NewWorker(options Options) *Worker {
+	return &Worker{
+		options: options,
+		rng:     rand.New(rand.NewSource(options.Seed)),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
@@ -0,0 +1,195 @@
+// Package tlsutil builds the TLS configurations of the scheduler's listener
+// and of its connections to workers, with certificates that are reloaded
+// when their files change.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultReloadInterval = 10 * time.Second
+
+// ServerOptions configures the TLS listener.
+type ServerOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables client certificates, verified against these CAs.
+	ClientCAFile string
+	// RequireClientCert refuses connections without a valid client
+	// certificate. Otherwise a client certificate is only verified if one
+	// is presented.
+	RequireClientCert bool
+	// ReloadInterval is how often the certificate files are checked for
+	// changes. Defaults to ten seconds.
+	ReloadInterval time.Duration
+}
+
+// ClientOptions configures connections to workers.
+type ClientOptions struct {
+	// CAFile verifies the certificates of workers against these CAs instead
+	// of the system roots.
+	CAFile string
+	// CertFile and KeyFile are the client certificate presented to workers.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the host name the worker certificate is verified
+	// against.
+	ServerName         string
+	InsecureSkipVerify bool
+	ReloadInterval     time.Duration
+}
+
+// CertificateReloader keeps a certificate and loads it again once its files
+// were modified, so certificates can be rotated without a restart.
+type CertificateReloader struct {
+	certFile    string
+	keyFile     string
+	interval    time.Duration
+	certificate *tls.Certificate
+	modified    time.Time
+	checked     time.Time
+	mutex       sync.Mutex
+}
+
+func modTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *CertificateReloader) load() error {
+	modified, err := modTime(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.certificate = &certificate
+	cr.modified = modified
+	return nil
+}
+
+// Certificate returns the current certificate. At most once per interval,
+// it checks whether the files changed and reloads them. A certificate that
+// fails to load is logged and the previous one kept.
+func (cr *CertificateReloader) Certificate() *tls.Certificate {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(cr.checked) < cr.interval {
+		return cr.certificate
+	}
+	cr.checked = now
+
+	modified, err := modTime(cr.certFile, cr.keyFile)
+	if err != nil || !modified.After(cr.modified) {
+		return cr.certificate
+	}
+	if err := cr.load(); err != nil {
+		log.Printf("Error reloading certificate %s: %v", cr.certFile, err)
+	} else {
+		log.Printf("Reloaded certificate %s", cr.certFile)
+	}
+	return cr.certificate
+}
+
+func (cr *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.Certificate(), nil
+}
+
+func (cr *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return cr.Certificate(), nil
+}
+
+// NewCertificateReloader fails if the certificate can't be loaded.
+func NewCertificateReloader(certFile string, keyFile string, interval time.Duration) (*CertificateReloader, error) {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	cr := &CertificateReloader{certFile: certFile, keyFile: keyFile, interval: interval, checked: time.Now()}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// NewServerConfig returns the TLS configuration of the listener.
+func NewServerConfig(options ServerOptions) (*tls.Config, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, fmt.Errorf("a certificate and key file are required")
+	}
+	reloader, err := NewCertificateReloader(options.CertFile, options.KeyFile, options.ReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if options.ClientCAFile != "" {
+		pool, err := loadCertPool(options.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if options.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// NewClientConfig returns the TLS configuration of connections to workers.
+func NewClientConfig(options ClientOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+	if options.CAFile != "" {
+		pool, err := loadCertPool(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if options.CertFile != "" || options.KeyFile != "" {
+		reloader, err := NewCertificateReloader(options.CertFile, options.KeyFile, options.ReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return config, nil
+}
@@ -0,0 +1,69 @@
+package trace
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ReadAzureCSV reads a trace in the format of the Azure Functions dataset
+// (invocations_per_function_md.anon.d*.csv). Every row holds the number of
+// invocations of a function per minute in the columns "1" to "1440". The
+// invocations are spread randomly within their minute, seeded for
+// reproducibility.
+func ReadAzureCSV(r io.Reader, seed int64) ([]Invocation, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	functionColumn := -1
+	var minuteColumns []int
+	for i, name := range header {
+		if name == "HashFunction" {
+			functionColumn = i
+		} else if _, convErr := strconv.Atoi(name); convErr == nil {
+			minuteColumns = append(minuteColumns, i)
+		}
+	}
+	if functionColumn == -1 || len(minuteColumns) == 0 {
+		return nil, fmt.Errorf("not an Azure Functions trace, expecting HashFunction and minute columns")
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	var invocations []Invocation
+	for {
+		row, readErr := reader.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		for _, column := range minuteColumns {
+			minute, _ := strconv.Atoi(header[column])
+			count, convErr := strconv.Atoi(row[column])
+			if convErr != nil {
+				return nil, fmt.Errorf("invalid count %q for minute %d", row[column], minute)
+			}
+			minuteStart := time.Duration(minute-1) * time.Minute
+			for i := 0; i < count; i++ {
+				invocations = append(invocations, Invocation{
+					Offset:   minuteStart + time.Duration(rng.Int63n(int64(time.Minute))),
+					Function: row[functionColumn],
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(invocations, func(i, j int) bool {
+		return invocations[i].Offset < invocations[j].Offset
+	})
+	return invocations, nil
+}
@@ -0,0 +1,105 @@
+package trace
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// BodyMode selects how much of the request bodies is captured.
+type BodyMode string
+
+const (
+	BodyNone BodyMode = "none"
+	BodyHash BodyMode = "hash"
+	BodyFull BodyMode = "full"
+)
+
+// CaptureOptions configures the capture of live traffic.
+type CaptureOptions struct {
+	File string
+	Body BodyMode
+	// MaxBodyBytes truncates captured bodies in BodyFull mode, which marks
+	// their records. Zero keeps them whole.
+	MaxBodyBytes int
+}
+
+// Recorder appends records to a JSON lines trace file.
+type Recorder struct {
+	options CaptureOptions
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+// CapturesBody reports whether request bodies have to be read for records.
+func (r *Recorder) CapturesBody() bool {
+	return r.options.Body == BodyHash || r.options.Body == BodyFull
+}
+
+// SetBody fills in the body fields of a record according to the body mode.
+func (r *Recorder) SetBody(record *Record, body []byte) {
+	if !r.CapturesBody() {
+		return
+	}
+
+	record.BodySize = len(body)
+	sum := sha256.Sum256(body)
+	record.BodyHash = hex.EncodeToString(sum[:])
+
+	if r.options.Body == BodyFull {
+		if r.options.MaxBodyBytes > 0 && len(body) > r.options.MaxBodyBytes {
+			body = body[:r.options.MaxBodyBytes]
+			record.BodyTruncated = true
+		}
+		record.Body = body
+	}
+}
+
+func (r *Recorder) Record(record Record) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.encoder.Encode(record); err != nil {
+		return err
+	}
+	return r.writer.Flush()
+}
+
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writer.Flush(); err != nil {
+		return err
+	}
+	return r.file.Close()
+}
+
+func NewRecorder(options CaptureOptions) (*Recorder, error) {
+	switch options.Body {
+	case "":
+		options.Body = BodyNone
+	case BodyNone, BodyHash, BodyFull:
+	default:
+		return nil, fmt.Errorf("unknown body mode: %s", options.Body)
+	}
+
+	file, err := os.OpenFile(options.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriter(file)
+	return &Recorder{
+		options: options,
+		file:    file,
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+	}, nil
+}
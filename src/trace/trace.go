@@ -0,0 +1,111 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Record is a single invocation of a trace. Traces are stored as JSON lines,
+// one record per invocation in order of arrival.
+type Record struct {
+	Time     time.Time `json:"time"`
+	Function string    `json:"function"`
+	// Tenant that invoked the function, if tenants are configured
+	Tenant string `json:"tenant,omitempty"`
+	// ExecMs is the execution time of the invocation on a warm sandbox, if
+	// known. Consumers fall back to their own defaults otherwise.
+	ExecMs float64 `json:"exec_ms,omitempty"`
+
+	// The remaining fields are filled in when live traffic is captured
+	Worker    string  `json:"worker,omitempty"`
+	Status    int     `json:"status,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	BodySize  int     `json:"body_size,omitempty"`
+	BodyHash  string  `json:"body_sha256,omitempty"`
+	Body      []byte  `json:"body,omitempty"`
+	// BodyTruncated is set if Body holds only the first bytes of the body
+	BodyTruncated bool `json:"body_truncated,omitempty"`
+}
+
+// Invocation is a record relative to the start of its trace.
+type Invocation struct {
+	Offset   time.Duration
+	Function string
+	Exec     time.Duration
+	Body     []byte
+	// Truncated is set if Body was cut off when it was captured
+	Truncated bool
+}
+
+func ReadJSONL(r io.Reader) ([]Invocation, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return FromRecords(records), nil
+}
+
+// FromRecords converts records into invocations sorted by arrival, relative
+// to the first record.
+func FromRecords(records []Record) []Invocation {
+	if len(records) == 0 {
+		return nil
+	}
+
+	sorted := make([]Record, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+
+	start := sorted[0].Time
+	invocations := make([]Invocation, len(sorted))
+	for i, record := range sorted {
+		invocations[i] = Invocation{
+			Offset:   record.Time.Sub(start),
+			Function: record.Function,
+			Exec:     time.Duration(record.ExecMs * float64(time.Millisecond)),
+			Body:     record.Body,
+			// Traces of older schedulers only tell by the size
+			Truncated: record.BodyTruncated || record.Body != nil && len(record.Body) < record.BodySize,
+		}
+	}
+	return invocations
+}
+
+// ReadFile reads a trace in the format given by its extension: Azure
+// Functions CSV for .csv files, JSON lines otherwise.
+func ReadFile(path string, seed int64) ([]Invocation, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if strings.HasSuffix(path, ".csv") {
+		return ReadAzureCSV(file, seed)
+	}
+	return ReadJSONL(file)
+}